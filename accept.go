@@ -0,0 +1,87 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"mime"
+	"path"
+	"strconv"
+	"strings"
+)
+
+// accepts reports whether the media ranges in the Accept header
+// value accept contain contentType. As in RFC 9110, the q-value comes
+// from the most specific range that contains it, so "text/html;q=0"
+// refuses text/html even if "*/*" is listed too. An empty Accept
+// header accepts everything, as does an empty or malformed content
+// type, since there is nothing to negotiate against.
+func accepts(accept, contentType string) bool {
+	if strings.TrimSpace(accept) == "" {
+		return true
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return true
+	}
+	typ, subtype, _ := strings.Cut(mediaType, "/")
+
+	// the q-value of the most specific matching range so far, and
+	// how specific it is: 0 for */*, 1 for type/* and 2 for an
+	// exact type
+	weight, specificity := 0.0, -1
+	for _, mediaRange := range strings.Split(accept, ",") {
+		rangeType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		rangeTyp, rangeSubtype, _ := strings.Cut(rangeType, "/")
+		if (rangeTyp != "*" && rangeTyp != typ) || (rangeSubtype != "*" && rangeSubtype != subtype) {
+			continue
+		}
+		s := 0
+		if rangeTyp != "*" {
+			s++
+		}
+		if rangeSubtype != "*" {
+			s++
+		}
+		if s > specificity {
+			weight, specificity = q, s
+		}
+	}
+	return weight > 0
+}
+
+// matchesContentType reports whether the media type of contentType
+// matches one of the glob patterns. An empty or malformed content type
+// matches nothing.
+func matchesContentType(patterns []string, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(strings.ToLower(pattern), mediaType); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestAccepts(t *testing.T) {
+	for _, tt := range []struct {
+		accept      string
+		contentType string
+		want        bool
+	}{
+		{"", "text/html", true},
+		{"text/html", "text/html; charset=utf-8", true},
+		{"application/json", "text/html", false},
+		{"text/*", "text/html", true},
+		{"*/*", "text/html", true},
+		{"application/json, */*;q=0.1", "text/html", true},
+		{"text/html;q=0", "text/html", false},
+		{"text/html;q=0, */*", "text/html", false},
+		{"*/*, text/html;q=0", "text/html", false},
+		{"text/*;q=0, */*", "text/html", false},
+		{"text/*;q=0, text/html", "text/html", true},
+		{"text/html;q=0, */*", "text/plain", true},
+		{"*/*;q=0", "text/html", false},
+		{"text/html;q=bogus", "text/html", false},
+		{"text/html", "", true},
+	} {
+		if got := accepts(tt.accept, tt.contentType); got != tt.want {
+			t.Errorf("accepts(%q, %q) = %v, want %v", tt.accept, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestMatchAccept(t *testing.T) {
+	for _, tt := range []struct {
+		accept string
+		want   string
+	}{
+		{accept: "text/html", want: "bar"},
+		{accept: "application/json", want: "foo"},
+		{accept: "text/html;q=0, */*", want: "foo"},
+	} {
+		h := provision(t, &Handler{MatchAccept: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+		r := newRequest("GET", "/", nil)
+		r.Header.Set("Accept", tt.accept)
+		if got := serve(t, h, r, upstream("text/html", "foo")).Body.String(); got != tt.want {
+			t.Errorf("Accept %q: got %q, want %q", tt.accept, got, tt.want)
+		}
+	}
+}
+
+func TestMatchesContentType(t *testing.T) {
+	for _, tt := range []struct {
+		patterns    []string
+		contentType string
+		want        bool
+	}{
+		{[]string{"application/javascript"}, "application/javascript; charset=utf-8", true},
+		{[]string{"application/javascript"}, "Application/JavaScript", true},
+		{[]string{"APPLICATION/javascript"}, "application/javascript", true},
+		{[]string{"image/*"}, "image/png", true},
+		{[]string{"image/*"}, "text/html", false},
+		{[]string{"text/html", "*/json"}, "application/json", true},
+		{[]string{"text/*"}, "", false},
+		{[]string{"text/*"}, "not a type;;", false},
+		{nil, "text/html", false},
+	} {
+		if got := matchesContentType(tt.patterns, tt.contentType); got != tt.want {
+			t.Errorf("matchesContentType(%q, %q) = %v, want %v", tt.patterns, tt.contentType, got, tt.want)
+		}
+	}
+}
+
+func TestExcludeContentTypes(t *testing.T) {
+	allow := &caddyhttp.ResponseMatcher{Headers: http.Header{"Content-Type": []string{"text/*"}}}
+	for _, tt := range []struct {
+		name        string
+		matcher     *caddyhttp.ResponseMatcher
+		exclude     []string
+		contentType string
+		want        string
+	}{
+		{name: "in neither", exclude: []string{"application/javascript"}, contentType: "text/css", want: "bar"},
+		{name: "in neither with allowlist", matcher: allow, exclude: []string{"text/javascript"}, contentType: "application/json", want: "foo"},
+		{name: "in allow only", matcher: allow, exclude: []string{"text/javascript"}, contentType: "text/html", want: "bar"},
+		{name: "in exclude only", exclude: []string{"application/javascript"}, contentType: "application/javascript", want: "foo"},
+		{name: "in both", matcher: allow, exclude: []string{"text/javascript"}, contentType: "text/javascript", want: "foo"},
+		{name: "glob", exclude: []string{"text/*"}, contentType: "text/plain; charset=utf-8", want: "foo"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, stream := range []bool{false, true} {
+				h := provision(t, &Handler{Stream: stream, Matcher: tt.matcher, ExcludeContentTypes: tt.exclude, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+				if got := serve(t, h, newRequest("GET", "/", nil), upstream(tt.contentType, "foo")).Body.String(); got != tt.want {
+					t.Errorf("stream %v: got %q, want %q", stream, got, tt.want)
+				}
+			}
+		})
+	}
+}
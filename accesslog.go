@@ -0,0 +1,75 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// outcome is what the handler did to a response, as recorded in the
+// access log with AccessLogFields. It is copied out of the replacer,
+// since the access log is written after the replacer is released.
+type outcome struct {
+	mode         string
+	replacements int
+	rules        []string
+}
+
+func (o outcome) MarshalLogObject(enc zapcore.ObjectEncoder) error {
+	enc.AddString("mode", o.mode)
+	enc.AddInt("replacements", o.replacements)
+	return enc.AddArray("rules", zapcore.ArrayMarshalerFunc(func(arr zapcore.ArrayEncoder) error {
+		for _, rule := range o.rules {
+			arr.AppendString(rule)
+		}
+		return nil
+	}))
+}
+
+// logOutcome adds the outcome of replacing the response to r to the
+// access log, if AccessLogFields is set. rt is nil if the response
+// wasn't considered for replacements at all.
+func (h *Handler) logOutcome(r *http.Request, rt *replacer) {
+	if !h.AccessLogFields {
+		return
+	}
+	extra, ok := r.Context().Value(caddyhttp.ExtraLogFieldsCtxKey).(*caddyhttp.ExtraLogFields)
+	if !ok {
+		return
+	}
+	o := outcome{mode: "none"}
+	if rt != nil {
+		if rt.mode != "" {
+			o.mode = rt.mode
+		}
+		for i, n := range rt.counts {
+			if n == 0 {
+				continue
+			}
+			o.replacements += n
+			if name := h.rules[i].Name; name != "" {
+				o.rules = append(o.rules, name)
+			} else {
+				o.rules = append(o.rules, strconv.Itoa(h.rules[i].index))
+			}
+		}
+	}
+	extra.Add(zap.Object("replace_response", o))
+}
@@ -0,0 +1,131 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+	"unsafe"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap/zapcore"
+)
+
+// loggedOutcome serves r and returns the replace_response field that h
+// added to the access log, or nil if there is none.
+func loggedOutcome(t *testing.T, h *Handler, r *http.Request, next caddyhttp.Handler) map[string]interface{} {
+	t.Helper()
+	extra := new(caddyhttp.ExtraLogFields)
+	serve(t, h, r.WithContext(context.WithValue(r.Context(), caddyhttp.ExtraLogFieldsCtxKey, extra)), next)
+	// ExtraLogFields only holds the fields, which it doesn't export
+	fields := *(*[]zapcore.Field)(unsafe.Pointer(extra))
+	enc := zapcore.NewMapObjectEncoder()
+	for _, f := range fields {
+		f.AddTo(enc)
+	}
+	if len(fields) > 1 {
+		t.Errorf("got %d fields, want 1", len(fields))
+	}
+	o, _ := enc.Fields["replace_response"].(map[string]interface{})
+	return o
+}
+
+func TestAccessLogFields(t *testing.T) {
+	rules := func() []*Replacement {
+		return []*Replacement{
+			{Name: "greeting", Search: "hello", Replaces: []string{"hi"}},
+			{Search: "world", Replaces: []string{"earth"}},
+			{Search: "unused", Replaces: []string{"x"}},
+		}
+	}
+	for _, tt := range []struct {
+		name   string
+		h      *Handler
+		ct     string
+		chunks []string
+		want   map[string]interface{}
+	}{
+		{
+			name:   "buffer",
+			h:      &Handler{Replacements: rules()},
+			ct:     "text/plain",
+			chunks: []string{"hello world, hello"},
+			want:   map[string]interface{}{"mode": "buffer", "replacements": 3, "rules": []interface{}{"greeting", "1"}},
+		},
+		{
+			name:   "stream",
+			h:      &Handler{Stream: true, Replacements: rules()},
+			ct:     "text/plain",
+			chunks: []string{"hello wo", "rld"},
+			want:   map[string]interface{}{"mode": "stream", "replacements": 2, "rules": []interface{}{"greeting", "1"}},
+		},
+		{
+			name:   "no matches",
+			h:      &Handler{Replacements: rules()},
+			ct:     "text/plain",
+			chunks: []string{"nothing"},
+			want:   map[string]interface{}{"mode": "buffer", "replacements": 0, "rules": []interface{}{}},
+		},
+		{
+			name:   "content type not matched",
+			h:      &Handler{Replacements: rules()},
+			ct:     "image/png",
+			chunks: []string{"hello"},
+			want:   map[string]interface{}{"mode": "none", "replacements": 0, "rules": []interface{}{}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.h.AccessLogFields = true
+			tt.h.ExcludeContentTypes = []string{"image/png"}
+			h := provision(t, tt.h)
+			got := loggedOutcome(t, h, newRequest("GET", "/", nil), upstream(tt.ct, tt.chunks...))
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessLogFieldsDisabled(t *testing.T) {
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}}})
+	if got := loggedOutcome(t, h, newRequest("GET", "/", nil), upstream("text/plain", "a")); got != nil {
+		t.Errorf("got %v, want no field", got)
+	}
+	// without the access log's fields in the context, nothing breaks
+	h = provision(t, &Handler{AccessLogFields: true, Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}}})
+	if got := serve(t, h, newRequest("GET", "/", nil), upstream("text/plain", "a")).Body.String(); got != "b" {
+		t.Errorf("got %q, want %q", got, "b")
+	}
+}
+
+func TestCaddyfileAccessLogFields(t *testing.T) {
+	h, err := parse("replace {\n\taccess_log_fields\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.AccessLogFields {
+		t.Error("access_log_fields not set")
+	}
+	for _, input := range []string{
+		"replace {\n\taccess_log_fields yes\n}",
+		"replace {\n\taccess_log_fields\n\taccess_log_fields\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// base64EncodingOf returns the encoding that encoded appears to use:
+// URL-safe if it contains - or _, and unpadded if its length is not a
+// multiple of 4.
+func base64EncodingOf(encoded []byte) *base64.Encoding {
+	url := bytes.ContainsAny(encoded, "-_")
+	raw := len(encoded)%4 != 0
+	switch {
+	case url && raw:
+		return base64.RawURLEncoding
+	case url:
+		return base64.URLEncoding
+	case raw:
+		return base64.RawStdEncoding
+	}
+	return base64.StdEncoding
+}
+
+// checkBase64 returns an error if the decode_match_base64 settings of
+// repl are invalid. It must be called after the search_regexp is
+// compiled.
+func (repl *Replacement) checkBase64(maxRegexpSize, maxSearchLength int, requireEnv bool) error {
+	if !repl.DecodeMatchBase64 {
+		if len(repl.Base64Replacements) > 0 {
+			return fmt.Errorf("base64_replacements requires decode_match_base64")
+		}
+		return nil
+	}
+	if repl.re == nil {
+		return fmt.Errorf("decode_match_base64 requires search_regexp")
+	}
+	if len(repl.Replaces) > 0 || repl.Mask != "" || repl.Template != "" || repl.ReplaceFile != "" {
+		return fmt.Errorf("decode_match_base64 is mutually exclusive with replace, mask, template and replace_file")
+	}
+	if len(repl.Base64Replacements) == 0 {
+		return fmt.Errorf("decode_match_base64 requires base64_replacements")
+	}
+	for i, inner := range repl.Base64Replacements {
+		if inner.JSONPointer != "" || inner.Mask != "" || inner.HashMatch != "" || inner.wraps() || inner.FuncTransform != "" || inner.Invert || inner.Template != "" || inner.ReplaceFile != "" ||
+			inner.When != "" || inner.hasRegion() || inner.SampleRate != 0 || inner.Once || inner.OncePerValue || inner.EveryNth != 0 || inner.ActivateAfter != 0 || inner.FlagKey != "" ||
+			inner.Required || inner.Name != "" || inner.EscapeJSON || inner.PreserveCase || len(inner.Weights) > 0 || inner.SelectByHeader != "" ||
+			inner.DecodeMatchBase64 || inner.Overlap {
+			return fmt.Errorf("base64 replacement %d: can only use search, search_regexp and replace", i)
+		}
+		if err := inner.provision(maxRegexpSize, maxSearchLength, requireEnv); err != nil {
+			return fmt.Errorf("base64 replacement %d: %v", i, err)
+		}
+	}
+	return nil
+}
+
+// patchBase64 returns the match described by index with its capture
+// group Group, or the whole match if the group is 0, base64-decoded,
+// replaced by the Base64Replacements and encoded again. It reports
+// false if the group didn't participate in the match or is not valid
+// base64.
+func (repl *Replacement) patchBase64(placeholders *caddy.Replacer, point float64, src []byte, index []int) ([]byte, bool) {
+	start, end := index[2*repl.Group], index[2*repl.Group+1]
+	if start < 0 {
+		return nil, false
+	}
+	encoded := src[start:end]
+	enc := base64EncodingOf(encoded)
+	decoded := make([]byte, enc.DecodedLen(len(encoded)))
+	n, err := enc.Decode(decoded, encoded)
+	if err != nil {
+		return nil, false
+	}
+	decoded = decoded[:n]
+	for _, inner := range repl.Base64Replacements {
+		decoded = inner.replaceAllIn(placeholders, point, decoded)
+	}
+	out := make([]byte, 0, index[1]-index[0]-len(encoded)+enc.EncodedLen(len(decoded)))
+	out = append(out, src[index[0]:start]...)
+	out = enc.AppendEncode(out, decoded)
+	return append(out, src[end:index[1]]...), true
+}
+
+// replaceAllIn returns b with all matches of repl replaced by its
+// replace value.
+func (repl *Replacement) replaceAllIn(placeholders *caddy.Replacer, point float64, b []byte) []byte {
+	value := repl.chooseReplace(placeholders, point)
+	if repl.re != nil {
+		return repl.re.ReplaceAll(b, []byte(value))
+	}
+	return bytes.ReplaceAll(b, []byte(placeholders.ReplaceKnown(repl.Search, "")), []byte(value))
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+func TestDecodeMatchBase64(t *testing.T) {
+	std := base64.StdEncoding.EncodeToString
+	dataURI := `data:text/plain;base64,([\w+/=-]+)`
+	for _, tt := range []struct {
+		name string
+		repl *Replacement
+		body string
+		want string
+	}{
+		{
+			name: "data URI",
+			repl: &Replacement{SearchRegexp: dataURI, Group: 1},
+			body: `<img src="data:text/plain;base64,` + std([]byte("hello user")) + `">`,
+			want: `<img src="data:text/plain;base64,` + std([]byte("hello anon")) + `">`,
+		},
+		{
+			name: "several matches",
+			repl: &Replacement{SearchRegexp: dataURI, Group: 1},
+			body: "data:text/plain;base64," + std([]byte("user")) + " data:text/plain;base64," + std([]byte("a user b")),
+			want: "data:text/plain;base64," + std([]byte("anon")) + " data:text/plain;base64," + std([]byte("a anon b")),
+		},
+		{
+			name: "whole match",
+			repl: &Replacement{SearchRegexp: `[\w+/]+=*`},
+			body: std([]byte("user!")),
+			want: std([]byte("anon!")),
+		},
+		{
+			name: "URL-safe and unpadded",
+			repl: &Replacement{SearchRegexp: dataURI, Group: 1},
+			body: "data:text/plain;base64," + base64.RawURLEncoding.EncodeToString([]byte("user??>")),
+			want: "data:text/plain;base64," + base64.RawURLEncoding.EncodeToString([]byte("anon??>")),
+		},
+		{
+			name: "invalid base64 is left alone",
+			repl: &Replacement{SearchRegexp: dataURI, Group: 1},
+			body: "data:text/plain;base64,a data:text/plain;base64," + std([]byte("user")),
+			want: "data:text/plain;base64,a data:text/plain;base64," + std([]byte("anon")),
+		},
+		{
+			name: "group that didn't participate",
+			repl: &Replacement{SearchRegexp: `id=(?:x|([\w+/=]+))`, Group: 1},
+			body: "id=x",
+			want: "id=x",
+		},
+		{
+			name: "nested regexp",
+			repl: &Replacement{SearchRegexp: dataURI, Group: 1, Base64Replacements: []*Replacement{{SearchRegexp: `u(s)er`, Replaces: []string{"$1"}}}},
+			body: "data:text/plain;base64," + std([]byte("user")),
+			want: "data:text/plain;base64," + std([]byte("s")),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.repl.DecodeMatchBase64 = true
+			if tt.repl.Base64Replacements == nil {
+				tt.repl.Base64Replacements = []*Replacement{{Search: "user", Replaces: []string{"anon"}}}
+			}
+			for _, mode := range []struct {
+				name     string
+				stream   bool
+				conflict string
+				chunk    int
+			}{
+				{"buffer", false, "", len(tt.body)},
+				{"stream", true, "", len(tt.body)},
+				{"stream bytewise", true, "", 1},
+				{"longest match", false, conflictLongestMatchWins, len(tt.body)},
+			} {
+				h := provision(t, &Handler{Stream: mode.stream, ConflictResolution: mode.conflict, Replacements: []*Replacement{tt.repl}})
+				if got := replaced(t, h, splitEvery(tt.body, mode.chunk)...); got != tt.want {
+					t.Errorf("%s: got %q, want %q", mode.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeMatchBase64Invalid(t *testing.T) {
+	inner := []*Replacement{{Search: "user", Replaces: []string{"anon"}}}
+	for _, tt := range []struct {
+		name string
+		repl *Replacement
+	}{
+		{"without regexp", &Replacement{Search: "x", DecodeMatchBase64: true, Base64Replacements: inner}},
+		{"with replace", &Replacement{SearchRegexp: "x", Replaces: []string{"y"}, DecodeMatchBase64: true, Base64Replacements: inner}},
+		{"with mask", &Replacement{SearchRegexp: "x", Mask: "*", DecodeMatchBase64: true, Base64Replacements: inner}},
+		{"no base64 replacements", &Replacement{SearchRegexp: "x", DecodeMatchBase64: true}},
+		{"base64 replacements alone", &Replacement{SearchRegexp: "x", Replaces: []string{"y"}, Base64Replacements: inner}},
+		{"inner option", &Replacement{SearchRegexp: "x", DecodeMatchBase64: true, Base64Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}, Once: true}}}},
+		{"inner without replace", &Replacement{SearchRegexp: "x", DecodeMatchBase64: true, Base64Replacements: []*Replacement{{Search: "a"}}}},
+		{"invalid group", &Replacement{SearchRegexp: "(x)", Group: 2, DecodeMatchBase64: true, Base64Replacements: inner}},
+	} {
+		if err := provisionErr(&Handler{Replacements: []*Replacement{tt.repl}}); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
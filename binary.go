@@ -0,0 +1,72 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// binaryMediaTypes are media types, in addition to the binaryTypePrefixes,
+// which are known not to be text.
+var binaryMediaTypes = map[string]bool{
+	"application/octet-stream":      true,
+	"application/pdf":               true,
+	"application/wasm":              true,
+	"application/zip":               true,
+	"application/gzip":              true,
+	"application/x-gzip":            true,
+	"application/x-bzip2":           true,
+	"application/x-tar":             true,
+	"application/x-7z-compressed":   true,
+	"application/x-rar-compressed":  true,
+	"application/vnd.rar":           true,
+	"application/zstd":              true,
+	"application/vnd.ms-fontobject": true,
+	"application/font-woff":         true,
+}
+
+// binaryTypePrefixes are prefixes of media types that are known not
+// to be text.
+var binaryTypePrefixes = []string{"image/", "audio/", "video/", "font/"}
+
+// isBinaryType reports whether contentType is a known binary media
+// type. Unknown and malformed types are assumed to be text.
+func isBinaryType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	// SVG is an image, but it's XML
+	if mediaType == "image/svg+xml" {
+		return false
+	}
+	if binaryMediaTypes[mediaType] {
+		return true
+	}
+	for _, prefix := range binaryTypePrefixes {
+		if strings.HasPrefix(mediaType, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// isBinaryContent reports whether body, a response body without a
+// Content-Type, looks like a known binary type.
+func isBinaryContent(body []byte) bool {
+	return isBinaryType(http.DetectContentType(body))
+}
@@ -0,0 +1,69 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import "testing"
+
+func TestIsBinaryType(t *testing.T) {
+	for _, tt := range []struct {
+		contentType string
+		binary      bool
+	}{
+		{"text/html; charset=utf-8", false},
+		{"application/json", false},
+		{"image/svg+xml", false},
+		{"", false},
+		{"not a type;;", false},
+		{"image/png", true},
+		{"IMAGE/PNG", true},
+		{"video/mp4", true},
+		{"font/woff2", true},
+		{"application/zip", true},
+		{"application/octet-stream", true},
+	} {
+		if got := isBinaryType(tt.contentType); got != tt.binary {
+			t.Errorf("%q: got %v, want %v", tt.contentType, got, tt.binary)
+		}
+	}
+}
+
+func TestBinarySkipped(t *testing.T) {
+	png := "\x89PNG\r\n\x1a\naaaa"
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		body        string
+		force       bool
+		stream      bool
+		want        string
+	}{
+		{name: "text", contentType: "text/plain", body: "aaaa", want: "bbbb"},
+		{name: "image type", contentType: "image/png", body: "aaaa", want: "aaaa"},
+		{name: "image type streamed", contentType: "image/png", body: "aaaa", stream: true, want: "aaaa"},
+		{name: "image type forced", contentType: "image/png", body: "aaaa", force: true, want: "bbbb"},
+		{name: "image type streamed and forced", contentType: "image/png", body: "aaaa", stream: true, force: true, want: "bbbb"},
+		{name: "sniffed", body: png, want: png},
+		{name: "sniffed and forced", body: png, force: true, want: "\x89PNG\r\n\x1a\nbbbb"},
+		{name: "sniffed text", body: "aaaa", want: "bbbb"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{Stream: tt.stream, ForceBinary: tt.force, Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}}})
+			w := serve(t, h, newRequest("GET", "/", nil), upstream(tt.contentType, tt.body))
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// BodyFunc transforms a whole response body. It is given the body
+// after the other replacements and the request's replacer, and
+// returns the new body. It may modify body in place.
+type BodyFunc func(body []byte, repl *caddy.Replacer) []byte
+
+var (
+	bodyFuncs   = make(map[string]BodyFunc)
+	bodyFuncsMu sync.RWMutex
+)
+
+// RegisterBodyFunc registers fn under name, so that handlers can
+// refer to it with func_transform. It is meant to be called from the
+// init function of a package that is compiled into Caddy along with
+// this one; it panics if name is empty or already registered, or if
+// fn is nil.
+func RegisterBodyFunc(name string, fn BodyFunc) {
+	if name == "" {
+		panic("body func name is missing")
+	}
+	if fn == nil {
+		panic("body func is nil")
+	}
+	bodyFuncsMu.Lock()
+	defer bodyFuncsMu.Unlock()
+	if _, ok := bodyFuncs[name]; ok {
+		panic(fmt.Sprintf("body func already registered: %s", name))
+	}
+	bodyFuncs[name] = fn
+}
+
+// lookupBodyFunc returns the body func registered under name.
+func lookupBodyFunc(name string) (BodyFunc, error) {
+	bodyFuncsMu.RLock()
+	defer bodyFuncsMu.RUnlock()
+	fn, ok := bodyFuncs[name]
+	if !ok {
+		return nil, fmt.Errorf("func_transform: no body func registered as %q", name)
+	}
+	return fn, nil
+}
+
+// checkFuncTransform returns an error if the func_transform of repl
+// is combined with options that produce the replacement some other
+// way, and looks up its body func otherwise.
+func (repl *Replacement) checkFuncTransform() error {
+	if repl.FuncTransform == "" {
+		return nil
+	}
+	if len(repl.Replaces) > 0 || repl.Mask != "" || repl.HashMatch != "" || repl.wraps() || repl.Template != "" || repl.ReplaceFile != "" || repl.DecodeMatchBase64 {
+		return fmt.Errorf("func_transform is mutually exclusive with replace, mask, hash_match, prefix, suffix, template, replace_file and decode_match_base64")
+	}
+	fn, err := lookupBodyFunc(repl.FuncTransform)
+	if err != nil {
+		return err
+	}
+	repl.bodyFunc = fn
+	return nil
+}
+
+// transformMatch returns the result of the body func of repl for
+// match, which is copied first since the func may modify it.
+func (repl *Replacement) transformMatch(placeholders *caddy.Replacer, match []byte) []byte {
+	return repl.bodyFunc(bytes.Clone(match), placeholders)
+}
@@ -0,0 +1,160 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func init() {
+	// registered once, however often the tests run
+	RegisterBodyFunc("test.upper", func(body []byte, repl *caddy.Replacer) []byte {
+		// modifies body in place
+		for i, b := range body {
+			if b >= 'a' && b <= 'z' {
+				body[i] = b - 'a' + 'A'
+			}
+		}
+		return body
+	})
+	RegisterBodyFunc("test.footer", func(body []byte, repl *caddy.Replacer) []byte {
+		return append(body, repl.ReplaceKnown("<!-- {test.id} -->", "")...)
+	})
+	RegisterBodyFunc("test.brackets", func(body []byte, repl *caddy.Replacer) []byte {
+		return []byte("[" + string(body) + "]")
+	})
+}
+
+func TestFuncTransform(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		h    *Handler
+		body string
+		want string
+	}{
+		{
+			name: "whole body after the replacements",
+			h:    &Handler{FuncTransform: "test.upper", Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}},
+			body: "a foo",
+			want: "A BAR",
+		},
+		{
+			name: "whole body without replacements",
+			h:    &Handler{FuncTransform: "test.upper"},
+			body: "a foo",
+			want: "A FOO",
+		},
+		{
+			name: "request replacer",
+			h:    &Handler{FuncTransform: "test.footer"},
+			body: "<p>a</p>",
+			want: "<p>a</p><!-- 42 -->",
+		},
+		{
+			name: "each match",
+			h:    &Handler{Replacements: []*Replacement{{SearchRegexp: `<h1>\w+`, FuncTransform: "test.upper"}}},
+			body: "<h1>title</h1> and <h1>more</h1>",
+			want: "<H1>TITLE</h1> and <H1>MORE</h1>",
+		},
+		{
+			name: "each substring match",
+			h:    &Handler{Replacements: []*Replacement{{Search: "foo", FuncTransform: "test.upper"}}},
+			body: "foo bar foo",
+			want: "FOO bar FOO",
+		},
+		{
+			name: "each match streamed",
+			h:    &Handler{Stream: true, Replacements: []*Replacement{{SearchRegexp: `<h1>\w+`, FuncTransform: "test.upper"}}},
+			body: "<h1>title</h1> and <h1>more</h1>",
+			want: "<H1>TITLE</h1> and <H1>MORE</h1>",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, tt.h)
+			r := newRequest("GET", "/", nil)
+			r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer).Set("test.id", "42")
+			if got := serve(t, h, r, upstream("text/html", tt.body)).Body.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFuncTransformInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		h    *Handler
+		err  string
+	}{
+		{name: "not registered", h: &Handler{FuncTransform: "test.missing"}, err: `no body func registered as "test.missing"`},
+		{name: "streamed", h: &Handler{FuncTransform: "test.upper", Stream: true}, err: "requires buffer mode"},
+		{name: "spilled", h: &Handler{FuncTransform: "test.upper", SpillToDisk: true}, err: "can't be used with spill_to_disk"},
+		{name: "rule not registered", h: &Handler{Replacements: []*Replacement{{Search: "a", FuncTransform: "test.missing"}}}, err: `no body func registered as "test.missing"`},
+		{name: "rule with replace", h: &Handler{Replacements: []*Replacement{{Search: "a", FuncTransform: "test.upper", Replaces: []string{"b"}}}}, err: "mutually exclusive"},
+		{name: "rule with mask", h: &Handler{Replacements: []*Replacement{{Search: "a", FuncTransform: "test.upper", Mask: "*"}}}, err: "mutually exclusive"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := provisionErr(tt.h)
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRegisterBodyFunc(t *testing.T) {
+	fn := func(body []byte, repl *caddy.Replacer) []byte { return bytes.ToLower(body) }
+	for _, tt := range []struct {
+		name string
+		key  string
+		fn   BodyFunc
+	}{
+		{name: "empty name", key: "", fn: fn},
+		{name: "nil func", key: "test.nil", fn: nil},
+		{name: "already registered", key: "test.upper", fn: fn},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			defer func() {
+				if recover() == nil {
+					t.Error("no panic")
+				}
+			}()
+			RegisterBodyFunc(tt.key, tt.fn)
+		})
+	}
+}
+
+func TestCaddyfileFuncTransform(t *testing.T) {
+	h, err := parse("replace {\n\tfunc_transform test.upper\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.FuncTransform != "test.upper" {
+		t.Errorf("func_transform %q, want %q", h.FuncTransform, "test.upper")
+	}
+	for _, input := range []string{
+		"replace {\n\tfunc_transform\n}",
+		"replace {\n\tfunc_transform a b\n}",
+		"replace {\n\tfunc_transform a\n\tfunc_transform b\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+
+	"golang.org/x/text/transform"
+)
+
+// utf8BOM is the byte order mark at the start of some UTF-8 text.
+var utf8BOM = []byte{0xef, 0xbb, 0xbf}
+
+// bomStripper is a transformer that removes a UTF-8 byte order mark
+// from the start of its input. The same bytes later in the input are
+// copied unchanged.
+type bomStripper struct {
+	// whether the start of the input has been seen
+	started bool
+}
+
+func (s *bomStripper) Reset() {
+	s.started = false
+}
+
+func (s *bomStripper) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if !s.started {
+		if len(src) < len(utf8BOM) && !atEOF && bytes.HasPrefix(utf8BOM, src) {
+			if len(src) == 0 {
+				return 0, 0, nil
+			}
+			return 0, 0, transform.ErrShortSrc
+		}
+		s.started = true
+		if bytes.HasPrefix(src, utf8BOM) {
+			nSrc = len(utf8BOM)
+		}
+	}
+	n := copy(dst, src[nSrc:])
+	nDst, nSrc = n, nSrc+n
+	if nSrc < len(src) {
+		return nDst, nSrc, transform.ErrShortDst
+	}
+	return nDst, nSrc, nil
+}
@@ -0,0 +1,77 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import "testing"
+
+func TestStripBOM(t *testing.T) {
+	const bom = "\xef\xbb\xbf"
+	for _, tt := range []struct {
+		name  string
+		rules []*Replacement
+		body  string
+		want  string
+	}{
+		{name: "leading BOM", body: bom + "<p>foo</p>", want: "<p>bar</p>"},
+		{name: "no BOM", body: "<p>foo</p>", want: "<p>bar</p>"},
+		{name: "BOM mid-body", body: "a" + bom + "foo", want: "a" + bom + "bar"},
+		{name: "only the first BOM", body: bom + bom + "foo", want: bom + "bar"},
+		{name: "only a BOM", body: bom, want: ""},
+		{name: "partial BOM", body: "\xef\xbbfoo", want: "\xef\xbbbar"},
+		{name: "short body", body: "\xef", want: "\xef"},
+		{
+			name:  "inserted by a replacement",
+			rules: []*Replacement{{Search: "<!-- start -->", Replaces: []string{bom}}},
+			body:  "<!-- start -->foo",
+			want:  "bar",
+		},
+		{
+			name:  "revealed by a replacement",
+			rules: []*Replacement{{Search: "x", Replaces: []string{""}}},
+			body:  "x" + bom + "foo",
+			want:  "bar",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []struct {
+				name   string
+				stream bool
+				chunk  int
+			}{{"buffer", false, len(tt.body)}, {"stream", true, len(tt.body)}, {"stream bytewise", true, 1}} {
+				rules := append([]*Replacement{{Search: "foo", Replaces: []string{"bar"}}}, tt.rules...)
+				h := provision(t, &Handler{Stream: mode.stream, StripBOM: true, Replacements: rules})
+				if got := replaced(t, h, splitEvery(tt.body, mode.chunk)...); got != tt.want {
+					t.Errorf("%s: got %q, want %q", mode.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestStripBOMOnly(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		h := provision(t, &Handler{Stream: stream, StripBOM: true})
+		if got := replaced(t, h, "\xef\xbb", "\xbffoo"); got != "foo" {
+			t.Errorf("stream %v: got %q, want %q", stream, got, "foo")
+		}
+	}
+}
+
+func TestStripBOMOff(t *testing.T) {
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+	if got := replaced(t, h, "\xef\xbb\xbffoo"); got != "\xef\xbb\xbfbar" {
+		t.Errorf("got %q, want the BOM kept", got)
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// flushGuard is the writer the upstream writes a buffered response
+// to. Flushes are dropped while rec buffers the response, since
+// flushing the client's writer would send the status and headers
+// before the body has been replaced. reverse_proxy flushes after
+// copying every response with trailers, to force chunked encoding;
+// the trailers are still sent, since they are set in the header map
+// that is shared with the client's writer. Responses that are passed
+// through unbuffered are flushed as usual.
+type flushGuard struct {
+	http.ResponseWriter
+	rec caddyhttp.ResponseRecorder
+}
+
+// Flush implements http.Flusher.
+func (fg flushGuard) Flush() {
+	_ = fg.FlushError()
+}
+
+// FlushError flushes the response unless it is buffered.
+func (fg flushGuard) FlushError() error {
+	if fg.rec.Buffered() {
+		return nil
+	}
+	return http.NewResponseController(fg.ResponseWriter).Flush()
+}
+
+// Unwrap returns the underlying writer.
+func (fg flushGuard) Unwrap() http.ResponseWriter {
+	return fg.ResponseWriter
+}
@@ -0,0 +1,98 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultCacheHeaders are the headers that indicate a response was
+// served from a cache, if none are configured.
+var defaultCacheHeaders = []string{"Age", "X-Cache: HIT"}
+
+// cacheIndicator is a parsed entry of Handler.CacheHeaders.
+type cacheIndicator struct {
+	name  string
+	value string
+}
+
+// parseCacheIndicator parses an entry of the form "Name" or
+// "Name: value".
+func parseCacheIndicator(s string) cacheIndicator {
+	name, value, _ := strings.Cut(s, ":")
+	return cacheIndicator{
+		name:  strings.TrimSpace(name),
+		value: strings.ToLower(strings.TrimSpace(value)),
+	}
+}
+
+// matches reports whether header has the indicator's field and, if it
+// has a value, whether one of the field's values contains it, ignoring
+// case.
+func (c cacheIndicator) matches(header http.Header) bool {
+	values := header.Values(c.name)
+	if len(values) == 0 {
+		return false
+	}
+	if c.value == "" {
+		return true
+	}
+	for _, v := range values {
+		if strings.Contains(strings.ToLower(v), c.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// maxAgeSeconds is the age that an Age header with a larger value is
+// taken to mean, as RFC 9111 requires of caches.
+const maxAgeSeconds = 1 << 31
+
+// responseAge returns how long the response with the given header has
+// been in a cache, according to its Age header. Like RFC 9111, only the
+// first value is used if there are several. It reports false if there
+// is no Age header or its value isn't a whole number of seconds.
+func responseAge(header http.Header) (time.Duration, bool) {
+	value, _, _ := strings.Cut(header.Get("Age"), ",")
+	value = strings.TrimSpace(value)
+	if value == "" || strings.Trim(value, "0123456789") != "" {
+		return 0, false
+	}
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || seconds > maxAgeSeconds {
+		// only digits, so it's out of range
+		seconds = maxAgeSeconds
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// cachedBy returns the first of the cache indicators that header
+// matches, or the empty string if there is none.
+func (h *Handler) cachedBy(header http.Header) string {
+	indicators := h.CacheHeaders
+	if len(indicators) == 0 {
+		indicators = defaultCacheHeaders
+	}
+	for _, s := range indicators {
+		if parseCacheIndicator(s).matches(header) {
+			return s
+		}
+	}
+	return ""
+}
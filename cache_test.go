@@ -0,0 +1,167 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestSkipIfCached(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		cacheHeaders []string
+		header       http.Header
+		want         string
+	}{
+		{name: "not cached", header: http.Header{}, want: "bar"},
+		{name: "age", header: http.Header{"Age": {"10"}}, want: "foo"},
+		{name: "zero age", header: http.Header{"Age": {"0"}}, want: "foo"},
+		{name: "x-cache hit", header: http.Header{"X-Cache": {"HIT"}}, want: "foo"},
+		{name: "x-cache hit among others", header: http.Header{"X-Cache": {"MISS from edge, hit from origin"}}, want: "foo"},
+		{name: "x-cache miss", header: http.Header{"X-Cache": {"MISS"}}, want: "bar"},
+		{name: "configured header", cacheHeaders: []string{"Cf-Cache-Status: hit"}, header: http.Header{"Cf-Cache-Status": {"HIT"}}, want: "foo"},
+		{name: "configured header without value", cacheHeaders: []string{"X-From-Cache"}, header: http.Header{"X-From-Cache": {"1"}}, want: "foo"},
+		{name: "configured replace defaults", cacheHeaders: []string{"X-From-Cache"}, header: http.Header{"Age": {"10"}}, want: "bar"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				for name, values := range tt.header {
+					w.Header()[name] = values
+				}
+				w.Header().Set("Content-Type", "text/plain")
+				_, err := io.WriteString(w, "foo")
+				return err
+			})
+			for _, stream := range []bool{false, true} {
+				h := provision(t, &Handler{Stream: stream, SkipIfCached: true, CacheHeaders: tt.cacheHeaders, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+				if got := serve(t, h, newRequest("GET", "/", nil), next).Body.String(); got != tt.want {
+					t.Errorf("stream %v: got %q, want %q", stream, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSkipIfCachedOff(t *testing.T) {
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Cache", "HIT")
+		_, err := io.WriteString(w, "foo")
+		return err
+	})
+	if got := serve(t, h, newRequest("GET", "/", nil), next).Body.String(); got != "bar" {
+		t.Errorf("got %q, want %q", got, "bar")
+	}
+}
+
+func TestCacheHeadersInvalid(t *testing.T) {
+	err := provisionErr(&Handler{SkipIfCached: true, CacheHeaders: []string{": hit"}, Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}}})
+	if err == nil || !strings.Contains(err.Error(), "cache_headers[0]: missing header name") {
+		t.Errorf("got error %v", err)
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		age  []string
+		want string
+	}{
+		{name: "no age", want: "bar"},
+		{name: "younger", age: []string{"59"}, want: "bar"},
+		{name: "exactly max_age", age: []string{"60"}, want: "bar"},
+		{name: "older", age: []string{"61"}, want: "foo"},
+		{name: "much older", age: []string{"99999999999999999999"}, want: "foo"},
+		{name: "first value", age: []string{"61, 10"}, want: "foo"},
+		{name: "first header", age: []string{"10", "61"}, want: "bar"},
+		{name: "spaces", age: []string{" 61 "}, want: "foo"},
+		{name: "not a number", age: []string{"a lot"}, want: "bar"},
+		{name: "negative", age: []string{"-61"}, want: "bar"},
+		{name: "fraction", age: []string{"61.5"}, want: "bar"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header()["Age"] = tt.age
+				w.Header().Set("Content-Type", "text/plain")
+				_, err := io.WriteString(w, "foo")
+				return err
+			})
+			for _, stream := range []bool{false, true} {
+				h := provision(t, &Handler{Stream: stream, MaxAge: caddy.Duration(time.Minute), Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+				if got := serve(t, h, newRequest("GET", "/", nil), next).Body.String(); got != tt.want {
+					t.Errorf("stream %v: got %q, want %q", stream, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestResponseAge(t *testing.T) {
+	for _, tt := range []struct {
+		age  string
+		want time.Duration
+		ok   bool
+	}{
+		{"0", 0, true},
+		{"120", 2 * time.Minute, true},
+		{"3, 4", 3 * time.Second, true},
+		{"99999999999999999999", maxAgeSeconds * time.Second, true},
+		{"", 0, false},
+		{"1e3", 0, false},
+		{"-1", 0, false},
+	} {
+		header := http.Header{}
+		if tt.age != "" {
+			header.Set("Age", tt.age)
+		}
+		if got, ok := responseAge(header); got != tt.want || ok != tt.ok {
+			t.Errorf("%q: got %v, %v, want %v, %v", tt.age, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMaxAgeInvalid(t *testing.T) {
+	if err := provisionErr(&Handler{MaxAge: caddy.Duration(-time.Second), Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}}}); err == nil {
+		t.Error("negative max_age: no error")
+	}
+}
+
+func TestCaddyfileMaxAge(t *testing.T) {
+	h, err := parse("replace {\n\tmax_age 1h\n\tfoo bar\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.MaxAge != caddy.Duration(time.Hour) {
+		t.Errorf("max_age %v, want 1h", time.Duration(h.MaxAge))
+	}
+	for _, input := range []string{
+		"replace {\n\tmax_age\n}",
+		"replace {\n\tmax_age 1h 2h\n}",
+		"replace {\n\tmax_age soon\n}",
+		"replace {\n\tmax_age 1h\n\tmax_age 2h\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
@@ -15,9 +15,14 @@
 package replaceresponse
 
 import (
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/dustin/go-humanize"
 )
 
 func init() {
@@ -34,21 +39,220 @@ func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error)
 // UnmarshalCaddyfile implements caddyfile.Unmarshaler. Syntax:
 //
 //	replace [stream | [re] <search> <replace>] {
-//	    stream
+//	    stream [{
+//	        window <size>
+//	    }]
 //		match {
 //			header Content-Type application/json*
 //		}
+//		multipart_parts <index...>
+//		match_accept
+//		flush_interval <duration>
+//		max_stream_bytes <size>
+//		require_env
+//		paths <prefix|glob...>
+//		path_regexp <regexp>
+//		force_binary
+//		sse_boundary_aware
+//		direction response|request|both
+//		request_content_types <pattern...>
+//		max_request_body <size>|off
+//		conflict_resolution first_wins|longest_match_wins
+//		optimize
+//		replacements_csv <file>
+//		csv_delimiter <char>
+//		csv_header
+//		decompress
+//		reencode_for_client
+//		collapse_whitespace
+//		sticky_key <key>
+//		correlated_random
+//		buffer_size <size>
+//		required_status <code>
+//		trailers
+//		spill_to_disk
+//		spill_threshold <size>
+//		temp_dir <dir>
+//		prewarm_pool
+//		exclude_content_types <pattern...>
+//		scope all|comments|non-comments
+//		allow_empty
+//		decode_entities
+//		cookie_domain <from> <to>
+//		cookie_path <from> <to>
+//		dedupe
+//		skip_if_cached [<header[:value]>...]
+//		max_age <duration>
+//		skip_if_header <header> [<regexp>]
+//		link_headers
+//		expose_original
+//		upgrade_insecure_urls [<host>...]
+//		max_regexp_size <instructions>
+//		preview_bytes <n>
+//		length_headers
+//		strip_bom
+//		func_transform <name>
+//		debug_config [<placeholder>...]
+//		content_length_mismatch fix|error|trust-upstream
+//		max_search_length <bytes>
+//		stream_status <code...>
+//		max_concurrent <n> [wait|bypass]
+//		max_expansion_ratio <ratio> [error|passthrough]
+//		stream_window <size>
+//		buffer_until_first_match
+//		require_utf8 [error|skip]
+//		flags_file <file>
+//		drop_headers <header...>
+//		decode_quoted_printable
+//		access_log_fields
+//		csp_nonce <value>
+//		csp_script_hashes
 //	    [re] <search> <replace>
+//	    re <search> <replace> {
+//	        dot_all
+//	        multiline
+//	        overlap
+//	    }
 //	}
 //
+// A quoted search, such as "trailers", is always a search string, even if
+// it is spelled like one of the keywords above.
 // If 're' is specified, the search string will be treated as a regular expression.
+// In a block after it, 'dot_all' makes . match newlines, and 'multiline' makes
+// ^ and $ match at line boundaries, and 'overlap' lets matches overlap.
 // If 'stream' is specified, the replacement will happen without buffering the
 // whole response body; this might remove the Content-Length header.
+// If 'multipart_parts' is specified, only the bodies of those parts of a
+// multipart response are replaced, counting from 0.
+// If 'match_accept' is specified, only responses whose Content-Type is
+// accepted by the request's Accept header are replaced.
+// If 'flush_interval' is specified, streamed responses are flushed to
+// the client at least that often, and with 'max_stream_bytes' they are
+// truncated after that many bytes from upstream.
+// If 'require_env' is specified, provisioning fails if an {env.*}
+// placeholder in a search or replace value refers to an unset variable.
+// If 'paths' or 'path_regexp' is specified, only requests whose path has
+// one of the prefixes, matches one of the globs or matches the regular
+// expression are replaced.
+// If 'force_binary' is specified, responses known to be binary, such as
+// images and archives, are replaced too; by default they are skipped.
+// If 'sse_boundary_aware' is specified, streamed server-sent events are
+// replaced one event at a time.
+// If 'direction' is specified, replacements are performed on request
+// bodies, response bodies (the default) or both.
+// If 'request_content_types' is specified, only request bodies whose media
+// type matches one of the patterns are replaced.
+// If 'max_request_body' is specified, request bodies longer than that are
+// rejected in buffer mode instead of being read into memory.
+// If 'conflict_resolution' is longest_match_wins, all replacements are
+// applied in a single pass and the longest match at each position wins.
+// If 'optimize' is specified, adjacent substring replacements that can't
+// affect each other are performed in a single pass.
+// If 'replacements_csv' is specified, substring replacements are also
+// loaded from the rows of that CSV file.
+// If 'decompress' is specified, compressed responses are decoded before
+// replacing and encoded again afterwards; with 'reencode_for_client',
+// they are encoded with the coding the client prefers instead.
+// If 'collapse_whitespace' is specified, runs of whitespace are collapsed
+// into a single space, except inside preformatted HTML elements.
+// If 'sticky_key' is specified, it seeds which matches are replaced for
+// replacements with a sample rate.
+// If 'correlated_random' is specified, replacements with several replace
+// values choose one for each response, all from the same random draw.
+// If 'buffer_size' is specified, response buffers start out with that
+// capacity.
+// If 'required_status' is specified, it is the status of the error when
+// a required replacement made no replacements.
+// If 'trailers' is specified, replacements are also performed on the
+// values of response trailers in buffer mode.
+// If 'spill_to_disk' is specified, buffered response bodies larger than
+// 'spill_threshold' are moved to a temporary file in 'temp_dir'.
+// If 'prewarm_pool' is specified, a transformer is built while the config
+// is loaded rather than on the first request.
+// If 'exclude_content_types' is specified, responses whose media type
+// matches one of the patterns are not replaced, even if they are matched.
+// If 'scope' is specified, replacements are performed only inside or only
+// outside of HTML, JavaScript and CSS comments.
+// If 'allow_empty' is specified, a directive without replacements passes
+// everything through instead of being an error.
+// If 'decode_entities' is specified, entities in the text of HTML responses
+// are decoded before matching in buffer mode.
+// If 'cookie_domain' or 'cookie_path' is specified, the Domain or Path
+// attribute of Set-Cookie headers is rewritten from one value to another.
+// If 'skip_if_cached' is specified, responses with one of the given cache
+// headers, by default Age or an X-Cache containing HIT, are not replaced.
+// If 'max_age' is specified, responses whose Age header is larger than that
+// duration are not replaced.
+// If 'skip_if_header' is specified, responses with that header, and a value
+// matching the regular expression if given, are not replaced.
+// If 'link_headers' is specified, the target URLs of Link headers are
+// replaced as well.
+// If 'expose_original' is specified, the original response body is kept in
+// the replace_response.original_body request variable in buffer mode.
+// If 'upgrade_insecure_urls' is specified, http:// URLs for the given hosts,
+// or all hosts, are rewritten to https://.
+// If 'max_regexp_size' is specified, regular expressions that compile to more
+// program instructions are rejected; a negative value disables the limit.
+// If 'preview_bytes' is specified, the start of the replaced body is sent
+// base64-encoded in the X-Replace-Preview header, for debugging.
+// If 'length_headers' is specified, the length of the body before and after
+// replacing is sent in the X-Original-Length and X-Modified-Length headers.
+// If 'strip_bom' is specified, a UTF-8 byte order mark at the start of the
+// body is removed.
+// If 'func_transform' is specified, the body func registered under that name
+// with RegisterBodyFunc is applied to the whole body in buffer mode.
+// If 'debug_config' is specified, the search and replace values are logged
+// for every request with placeholders expanded, redacting the given
+// placeholders or, by default, secrets such as environment variables.
+// If 'content_length_mismatch' is specified, it decides what happens to a
+// buffered response whose body doesn't match its Content-Length.
+// If 'max_search_length' is specified, substring searches that are longer are
+// rejected; a negative value disables the limit.
+// If 'stream_status' is specified, responses with one of those statuses,
+// such as 200 or 2xx, are streamed while the others are buffered.
+// If 'max_concurrent' is specified, at most that many responses are replaced
+// at the same time; the others wait for a turn or, with 'bypass', are passed
+// through unreplaced.
+// If 'max_expansion_ratio' is specified, a buffered response whose body grows
+// by more than that factor fails or, with 'passthrough', is sent unreplaced.
+// If 'stream_window', or 'window' in a 'stream' block, is specified, matches of
+// up to that many bytes are found in streamed bodies, however many writes they
+// are split across.
+// If 'buffer_until_first_match' is specified, streamed responses are held back
+// until a match is replaced, and sent as a whole if there is none.
+// If 'require_utf8' is specified, a buffered response that is not valid UTF-8
+// fails or, with 'skip', is passed through unreplaced.
+// If 'flags_file' is specified, replacements with a flag_key are only performed
+// while their flag in that JSON file is true.
+// If 'drop_headers' is specified, those response headers are removed when
+// the body is modified.
+// If 'decode_quoted_printable' is specified, buffered bodies are decoded from
+// quoted-printable before replacing and encoded again afterwards.
+// If 'access_log_fields' is specified, the mode, number of replacements and
+// rules that fired are recorded in the access log of each request.
+// If 'csp_nonce' is specified, the {csp_nonce} token in replace values expands
+// to that value instead of the nonce in the Content-Security-Policy header.
+// If 'csp_script_hashes' is specified, the hashes of the inline scripts that
+// the replacements insert are added to the script-src of the response's
+// Content-Security-Policy.
 func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	line := func(isBlock bool) error {
+		// a quoted search is never taken for a keyword, so that
+		// the words of options can be searched for too
+		keyword := d.Val()
+		if d.Token().Quoted() {
+			keyword = ""
+		}
+		if isBlock && keyword != "" {
+			ok, err := h.unmarshalBlockOption(d)
+			if ok || err != nil {
+				return err
+			}
+		}
+
 		var repl Replacement
 
-		switch d.Val() {
+		switch keyword {
 		case "stream":
 			if h.Stream {
 				return d.Err("streaming already enabled")
@@ -57,6 +261,19 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 			if d.NextArg() {
 				return d.ArgErr()
 			}
+			if !isBlock {
+				return nil
+			}
+			for nesting := d.Nesting(); d.NextBlock(nesting); {
+				switch d.Val() {
+				case "window":
+					if err := h.unmarshalStreamWindow(d, "window"); err != nil {
+						return err
+					}
+				default:
+					return d.Errf("unrecognized stream option '%s'", d.Val())
+				}
+			}
 			return nil
 
 		case "re":
@@ -73,21 +290,24 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 				return d.ArgErr()
 			}
 			repl.Replaces = replaces
-		default:
-			if isBlock && d.Val() == "match" {
-				if h.Matcher != nil {
-					return d.Err("match block already specified")
-				}
-				responseMatchers := make(map[string]caddyhttp.ResponseMatcher)
-				err := caddyhttp.ParseNamedResponseMatcher(d.NewFromNextSegment(), responseMatchers)
-				if err != nil {
-					return err
+			if isBlock {
+				for nesting := d.Nesting(); d.NextBlock(nesting); {
+					switch d.Val() {
+					case "dot_all":
+						repl.DotAll = true
+					case "multiline":
+						repl.Multiline = true
+					case "overlap":
+						repl.Overlap = true
+					default:
+						return d.Errf("unrecognized regexp option '%s'", d.Val())
+					}
+					if d.NextArg() {
+						return d.ArgErr()
+					}
 				}
-				matcher := responseMatchers["match"]
-				h.Matcher = &matcher
-				return nil
 			}
-
+		default:
 			repl.Search = d.Val()
 			n := d.CountRemainingArgs()
 			if n < 1 {
@@ -114,3 +334,753 @@ func (h *Handler) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
 	}
 	return nil
 }
+
+// unmarshalBlockOption parses the handler option at the current token,
+// which is only valid inside a block. It reports false if the token is
+// not an option, in which case it is parsed as a replacement instead.
+func (h *Handler) unmarshalBlockOption(d *caddyfile.Dispenser) (bool, error) {
+	switch d.Val() {
+	case "match":
+		if h.Matcher != nil {
+			return true, d.Err("match block already specified")
+		}
+		responseMatchers := make(map[string]caddyhttp.ResponseMatcher)
+		err := caddyhttp.ParseNamedResponseMatcher(d.NewFromNextSegment(), responseMatchers)
+		if err != nil {
+			return true, err
+		}
+		matcher := responseMatchers["match"]
+		h.Matcher = &matcher
+
+	case "multipart_parts":
+		if len(h.MultipartParts) > 0 {
+			return true, d.Err("multipart parts already specified")
+		}
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return true, d.ArgErr()
+		}
+		for _, arg := range args {
+			part, err := strconv.Atoi(arg)
+			if err != nil || part < 0 {
+				return true, d.Errf("invalid multipart part index: %s", arg)
+			}
+			h.MultipartParts = append(h.MultipartParts, part)
+		}
+
+	case "flush_interval":
+		if h.FlushInterval != 0 {
+			return true, d.Err("flush_interval already specified")
+		}
+		var val string
+		if !d.Args(&val) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(val)
+		if err != nil {
+			return true, d.Errf("invalid flush_interval: %v", err)
+		}
+		h.FlushInterval = caddy.Duration(dur)
+
+	case "require_env":
+		if h.RequireEnv {
+			return true, d.Err("require_env already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.RequireEnv = true
+
+	case "paths":
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return true, d.ArgErr()
+		}
+		h.Paths = append(h.Paths, args...)
+
+	case "path_regexp":
+		if h.PathRegexp != "" {
+			return true, d.Err("path_regexp already specified")
+		}
+		if !d.Args(&h.PathRegexp) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+
+	case "force_binary":
+		if h.ForceBinary {
+			return true, d.Err("force_binary already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.ForceBinary = true
+
+	case "sse_boundary_aware":
+		if h.SSEBoundaryAware {
+			return true, d.Err("sse_boundary_aware already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.SSEBoundaryAware = true
+
+	case "direction":
+		if h.Direction != "" {
+			return true, d.Err("direction already specified")
+		}
+		if !d.Args(&h.Direction) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+
+	case "conflict_resolution":
+		if h.ConflictResolution != "" {
+			return true, d.Err("conflict_resolution already specified")
+		}
+		if !d.Args(&h.ConflictResolution) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+
+	case "optimize":
+		if h.Optimize {
+			return true, d.Err("optimize already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.Optimize = true
+
+	case "replacements_csv":
+		if h.ReplacementsCSV != "" {
+			return true, d.Err("replacements_csv already specified")
+		}
+		if !d.Args(&h.ReplacementsCSV) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+
+	case "csv_delimiter":
+		if h.CSVDelimiter != "" {
+			return true, d.Err("csv_delimiter already specified")
+		}
+		if !d.Args(&h.CSVDelimiter) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+
+	case "csv_header":
+		if h.CSVHeader {
+			return true, d.Err("csv_header already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.CSVHeader = true
+
+	case "decompress":
+		if h.Decompress {
+			return true, d.Err("decompress already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.Decompress = true
+
+	case "collapse_whitespace":
+		if h.CollapseWhitespace {
+			return true, d.Err("collapse_whitespace already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.CollapseWhitespace = true
+
+	case "sticky_key":
+		if h.StickyKey != "" {
+			return true, d.Err("sticky_key already specified")
+		}
+		if !d.Args(&h.StickyKey) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+
+	case "correlated_random":
+		if h.CorrelatedRandom {
+			return true, d.Err("correlated_random already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.CorrelatedRandom = true
+
+	case "reencode_for_client":
+		if h.ReencodeForClient {
+			return true, d.Err("reencode_for_client already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.ReencodeForClient = true
+
+	case "max_stream_bytes":
+		if h.MaxStreamBytes != 0 {
+			return true, d.Err("max_stream_bytes already specified")
+		}
+		var val string
+		if !d.Args(&val) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		size, err := humanize.ParseBytes(val)
+		if err != nil {
+			return true, d.Errf("invalid max_stream_bytes: %v", err)
+		}
+		h.MaxStreamBytes = int64(size)
+
+	case "buffer_size":
+		if h.BufferSize != 0 {
+			return true, d.Err("buffer_size already specified")
+		}
+		var val string
+		if !d.Args(&val) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		size, err := humanize.ParseBytes(val)
+		if err != nil {
+			return true, d.Errf("invalid buffer_size: %v", err)
+		}
+		h.BufferSize = int(size)
+
+	case "required_status":
+		if h.RequiredStatus != 0 {
+			return true, d.Err("required_status already specified")
+		}
+		var val string
+		if !d.Args(&val) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		status, err := strconv.Atoi(val)
+		if err != nil {
+			return true, d.Errf("invalid required_status: %v", err)
+		}
+		h.RequiredStatus = status
+
+	case "trailers":
+		if h.Trailers {
+			return true, d.Err("trailers already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.Trailers = true
+
+	case "spill_to_disk":
+		if h.SpillToDisk {
+			return true, d.Err("spill_to_disk already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.SpillToDisk = true
+
+	case "spill_threshold":
+		if h.SpillThreshold != 0 {
+			return true, d.Err("spill_threshold already specified")
+		}
+		var val string
+		if !d.Args(&val) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		size, err := humanize.ParseBytes(val)
+		if err != nil {
+			return true, d.Errf("invalid spill_threshold: %v", err)
+		}
+		h.SpillThreshold = int64(size)
+
+	case "temp_dir":
+		if h.TempDir != "" {
+			return true, d.Err("temp_dir already specified")
+		}
+		if !d.Args(&h.TempDir) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+
+	case "prewarm_pool":
+		if h.PrewarmPool {
+			return true, d.Err("prewarm_pool already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.PrewarmPool = true
+
+	case "request_content_types":
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return true, d.ArgErr()
+		}
+		h.RequestContentTypes = append(h.RequestContentTypes, args...)
+
+	case "max_request_body":
+		if h.MaxRequestBody != 0 {
+			return true, d.Err("max_request_body already specified")
+		}
+		var val string
+		if !d.Args(&val) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		if val == "off" {
+			h.MaxRequestBody = -1
+			break
+		}
+		size, err := humanize.ParseBytes(val)
+		if err != nil || size == 0 {
+			return true, d.Errf("invalid max_request_body: %s", val)
+		}
+		h.MaxRequestBody = int64(size)
+
+	case "exclude_content_types":
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return true, d.ArgErr()
+		}
+		h.ExcludeContentTypes = append(h.ExcludeContentTypes, args...)
+
+	case "scope":
+		if h.Scope != "" {
+			return true, d.Err("scope already specified")
+		}
+		if !d.Args(&h.Scope) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+
+	case "allow_empty":
+		if h.AllowEmpty {
+			return true, d.Err("allow_empty already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.AllowEmpty = true
+
+	case "decode_entities":
+		if h.DecodeEntities {
+			return true, d.Err("decode_entities already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.DecodeEntities = true
+
+	case "cookie_domain":
+		var from, to string
+		if !d.Args(&from, &to) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		if h.CookieDomains == nil {
+			h.CookieDomains = make(map[string]string)
+		}
+		h.CookieDomains[from] = to
+
+	case "cookie_path":
+		var from, to string
+		if !d.Args(&from, &to) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		if h.CookiePaths == nil {
+			h.CookiePaths = make(map[string]string)
+		}
+		h.CookiePaths[from] = to
+
+	case "dedupe":
+		if h.Dedupe {
+			return true, d.Err("dedupe already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.Dedupe = true
+
+	case "skip_if_cached":
+		if h.SkipIfCached {
+			return true, d.Err("skip_if_cached already specified")
+		}
+		h.SkipIfCached = true
+		h.CacheHeaders = append(h.CacheHeaders, d.RemainingArgs()...)
+
+	case "max_age":
+		if h.MaxAge != 0 {
+			return true, d.Err("max_age already specified")
+		}
+		var val string
+		if !d.Args(&val) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		dur, err := caddy.ParseDuration(val)
+		if err != nil {
+			return true, d.Errf("invalid max_age: %v", err)
+		}
+		h.MaxAge = caddy.Duration(dur)
+
+	case "skip_if_header":
+		var name, value string
+		if !d.Args(&name) {
+			return true, d.ArgErr()
+		}
+		d.Args(&value)
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		if h.SkipIfHeader == nil {
+			h.SkipIfHeader = make(map[string]string)
+		}
+		h.SkipIfHeader[name] = value
+
+	case "link_headers":
+		if h.LinkHeaders {
+			return true, d.Err("link_headers already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.LinkHeaders = true
+
+	case "expose_original":
+		if h.ExposeOriginal {
+			return true, d.Err("expose_original already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.ExposeOriginal = true
+
+	case "upgrade_insecure_urls":
+		if h.UpgradeInsecureURLs {
+			return true, d.Err("upgrade_insecure_urls already specified")
+		}
+		h.UpgradeInsecureURLs = true
+		h.UpgradeHosts = append(h.UpgradeHosts, d.RemainingArgs()...)
+
+	case "max_regexp_size":
+		if h.MaxRegexpSize != 0 {
+			return true, d.Err("max_regexp_size already specified")
+		}
+		var val string
+		if !d.Args(&val) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		size, err := strconv.Atoi(val)
+		if err != nil {
+			return true, d.Errf("invalid max_regexp_size: %v", err)
+		}
+		h.MaxRegexpSize = size
+
+	case "max_search_length":
+		if h.MaxSearchLength != 0 {
+			return true, d.Err("max_search_length already specified")
+		}
+		var val string
+		if !d.Args(&val) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		length, err := strconv.Atoi(val)
+		if err != nil {
+			return true, d.Errf("invalid max_search_length: %v", err)
+		}
+		h.MaxSearchLength = length
+
+	case "preview_bytes":
+		if h.PreviewBytes != 0 {
+			return true, d.Err("preview_bytes already specified")
+		}
+		var val string
+		if !d.Args(&val) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return true, d.Errf("invalid preview_bytes: %v", err)
+		}
+		h.PreviewBytes = n
+
+	case "length_headers":
+		if h.LengthHeaders {
+			return true, d.Err("length_headers already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.LengthHeaders = true
+
+	case "csp_nonce":
+		if h.CSPNonce != "" {
+			return true, d.Err("csp_nonce already specified")
+		}
+		if !d.Args(&h.CSPNonce) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+
+	case "csp_script_hashes":
+		if h.CSPScriptHashes {
+			return true, d.Err("csp_script_hashes already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.CSPScriptHashes = true
+
+	case "strip_bom":
+		if h.StripBOM {
+			return true, d.Err("strip_bom already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.StripBOM = true
+
+	case "debug_config":
+		if h.DebugConfig {
+			return true, d.Err("debug_config already specified")
+		}
+		h.DebugConfig = true
+		h.DebugRedact = append(h.DebugRedact, d.RemainingArgs()...)
+
+	case "content_length_mismatch":
+		if h.ContentLengthMismatch != "" {
+			return true, d.Err("content_length_mismatch already specified")
+		}
+		if !d.Args(&h.ContentLengthMismatch) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+
+	case "func_transform":
+		if h.FuncTransform != "" {
+			return true, d.Err("func_transform already specified")
+		}
+		if !d.Args(&h.FuncTransform) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+
+	case "stream_status":
+		if len(h.StreamStatusCodes) > 0 {
+			return true, d.Err("stream_status already specified")
+		}
+		args := d.RemainingArgs()
+		if len(args) == 0 {
+			return true, d.ArgErr()
+		}
+		for _, arg := range args {
+			if len(arg) == 3 && strings.HasSuffix(arg, "xx") {
+				arg = arg[:1]
+			}
+			code, err := strconv.Atoi(arg)
+			if err != nil {
+				return true, d.Errf("invalid stream_status: %v", err)
+			}
+			h.StreamStatusCodes = append(h.StreamStatusCodes, code)
+		}
+
+	case "max_concurrent":
+		if h.MaxConcurrent != 0 {
+			return true, d.Err("max_concurrent already specified")
+		}
+		var val string
+		if !d.Args(&val) {
+			return true, d.ArgErr()
+		}
+		n, err := strconv.Atoi(val)
+		if err != nil {
+			return true, d.Errf("invalid max_concurrent: %v", err)
+		}
+		h.MaxConcurrent = n
+		if d.NextArg() {
+			h.ConcurrencyPolicy = d.Val()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+
+	case "max_expansion_ratio":
+		if h.MaxExpansionRatio != 0 {
+			return true, d.Err("max_expansion_ratio already specified")
+		}
+		var val string
+		if !d.Args(&val) {
+			return true, d.ArgErr()
+		}
+		ratio, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return true, d.Errf("invalid max_expansion_ratio: %v", err)
+		}
+		h.MaxExpansionRatio = ratio
+		if d.NextArg() {
+			h.ExpansionPolicy = d.Val()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+
+	case "stream_window":
+		if err := h.unmarshalStreamWindow(d, "stream_window"); err != nil {
+			return true, err
+		}
+
+	case "buffer_until_first_match":
+		if h.BufferUntilFirstMatch {
+			return true, d.Err("buffer_until_first_match already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.BufferUntilFirstMatch = true
+
+	case "require_utf8":
+		if h.RequireUTF8 {
+			return true, d.Err("require_utf8 already specified")
+		}
+		h.RequireUTF8 = true
+		if d.NextArg() {
+			h.InvalidUTF8 = d.Val()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+
+	case "flags_file":
+		if h.FlagsFile != "" {
+			return true, d.Err("flags_file already specified")
+		}
+		if !d.Args(&h.FlagsFile) {
+			return true, d.ArgErr()
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+
+	case "drop_headers":
+		names := d.RemainingArgs()
+		if len(names) == 0 {
+			return true, d.ArgErr()
+		}
+		h.DropHeaders = append(h.DropHeaders, names...)
+
+	case "decode_quoted_printable":
+		if h.DecodeQuotedPrintable {
+			return true, d.Err("decode_quoted_printable already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.DecodeQuotedPrintable = true
+
+	case "access_log_fields":
+		if h.AccessLogFields {
+			return true, d.Err("access_log_fields already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.AccessLogFields = true
+
+	case "match_accept":
+		if h.MatchAccept {
+			return true, d.Err("match_accept already specified")
+		}
+		if d.NextArg() {
+			return true, d.ArgErr()
+		}
+		h.MatchAccept = true
+
+	default:
+		return false, nil
+	}
+	return true, nil
+}
+
+// unmarshalStreamWindow parses the size argument of the option name,
+// either stream_window or window in a stream block, into StreamWindow.
+func (h *Handler) unmarshalStreamWindow(d *caddyfile.Dispenser, name string) error {
+	if h.StreamWindow != 0 {
+		return d.Err("stream window already specified")
+	}
+	var val string
+	if !d.Args(&val) {
+		return d.ArgErr()
+	}
+	size, err := humanize.ParseBytes(val)
+	if err != nil {
+		return d.Errf("invalid %s: %v", name, err)
+	}
+	if size == 0 || size > maxStreamWindow {
+		return d.Errf("invalid %s: must be between 1 and %d bytes, got %s", name, maxStreamWindow, val)
+	}
+	h.StreamWindow = int(size)
+	if d.NextArg() {
+		return d.ArgErr()
+	}
+	return nil
+}
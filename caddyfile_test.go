@@ -0,0 +1,217 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+// parse unmarshals input into a new Handler.
+func parse(input string) (*Handler, error) {
+	h := new(Handler)
+	err := h.UnmarshalCaddyfile(caddyfile.NewTestDispenser(input))
+	return h, err
+}
+
+func TestCaddyfileQuotedSearch(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		input    string
+		search   []string
+		trailers bool
+	}{
+		{name: "keyword", input: "replace {\n\ttrailers\n}", trailers: true},
+		{name: "quoted keyword", input: "replace {\n\t\"trailers\" foo\n}", search: []string{"trailers"}},
+		{name: "quoted keyword with option", input: "replace {\n\ttrailers\n\t\"trailers\" foo\n}", search: []string{"trailers"}, trailers: true},
+		{name: "quoted re", input: "replace {\n\t\"re\" foo\n}", search: []string{"re"}},
+		{name: "quoted stream", input: "replace \"stream\" foo", search: []string{"stream"}},
+		{name: "plain search", input: "replace {\n\tfoo bar\n\t\"scope\" x\n}", search: []string{"foo", "scope"}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := parse(tt.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var search []string
+			for _, repl := range h.Replacements {
+				search = append(search, repl.Search)
+			}
+			if !reflect.DeepEqual(search, tt.search) {
+				t.Errorf("searches %q, want %q", search, tt.search)
+			}
+			if h.Trailers != tt.trailers {
+				t.Errorf("trailers %v, want %v", h.Trailers, tt.trailers)
+			}
+			if h.Stream {
+				t.Error("stream enabled")
+			}
+		})
+	}
+}
+
+func TestCaddyfileKeywordArgs(t *testing.T) {
+	// an unquoted keyword is an option, so a replacement spelled
+	// like it is rejected rather than silently taken for a search
+	if _, err := parse("replace {\n\ttrailers foo\n}"); err == nil {
+		t.Error("trailers foo: no error")
+	}
+}
+
+func TestCaddyfileDuplicates(t *testing.T) {
+	for _, option := range []string{
+		"csv_delimiter ;",
+		"csv_header",
+		"flush_interval 1s",
+		"max_stream_bytes 1MB",
+		"buffer_size 4KB",
+		"required_status 502",
+		"max_regexp_size 100",
+		"preview_bytes 10",
+		"max_search_length 100",
+		"spill_threshold 1MB",
+	} {
+		if _, err := parse("replace {\n\t" + option + "\n\t" + option + "\n}"); err == nil {
+			t.Errorf("%s twice: no error", option)
+		}
+	}
+}
+
+func TestCaddyfileExtraArgs(t *testing.T) {
+	for _, option := range []string{
+		"flush_interval 1s foo bar",
+		"max_stream_bytes 1MB foo bar",
+		"buffer_size 4KB foo bar",
+		"required_status 502 foo bar",
+		"max_regexp_size 100 foo bar",
+		"preview_bytes 10 foo bar",
+		"max_search_length 100 foo bar",
+		"spill_threshold 1MB foo bar",
+	} {
+		if _, err := parse("replace {\n\t" + option + "\n}"); err == nil {
+			t.Errorf("%s: no error", option)
+		}
+	}
+}
+
+func TestCaddyfilePaths(t *testing.T) {
+	h, err := parse("replace {\n\tpaths /docs/ /blog/*\n\tpaths /more\n\tpath_regexp \\.html$\n\tfoo bar\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"/docs/", "/blog/*", "/more"}; !reflect.DeepEqual(h.Paths, want) {
+		t.Errorf("paths %q, want %q", h.Paths, want)
+	}
+	if h.PathRegexp != `\.html$` {
+		t.Errorf("path_regexp %q, want %q", h.PathRegexp, `\.html$`)
+	}
+	for _, input := range []string{
+		"replace {\n\tpaths\n}",
+		"replace {\n\tpath_regexp a\n\tpath_regexp b\n}",
+		"replace {\n\tpath_regexp a b\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+func TestCaddyfileMaxRegexpSize(t *testing.T) {
+	h, err := parse("replace {\n\tmax_regexp_size -1\n\tfoo bar\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.MaxRegexpSize != -1 {
+		t.Errorf("max_regexp_size %d, want -1", h.MaxRegexpSize)
+	}
+	for _, input := range []string{
+		"replace {\n\tmax_regexp_size\n}",
+		"replace {\n\tmax_regexp_size big\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+func TestCaddyfileMaxSearchLength(t *testing.T) {
+	h, err := parse("replace {\n\tmax_search_length 4096\n\tfoo bar\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.MaxSearchLength != 4096 {
+		t.Errorf("max_search_length %d, want 4096", h.MaxSearchLength)
+	}
+	for _, input := range []string{
+		"replace {\n\tmax_search_length\n}",
+		"replace {\n\tmax_search_length 4KB\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+func TestCaddyfilePreviewBytes(t *testing.T) {
+	h, err := parse("replace {\n\tpreview_bytes 64\n\tfoo bar\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.PreviewBytes != 64 {
+		t.Errorf("preview_bytes %d, want 64", h.PreviewBytes)
+	}
+	for _, input := range []string{
+		"replace {\n\tpreview_bytes\n}",
+		"replace {\n\tpreview_bytes 1KB\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+func TestCaddyfileLengthHeaders(t *testing.T) {
+	h, err := parse("replace {\n\tlength_headers\n\tfoo bar\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.LengthHeaders {
+		t.Error("length_headers not set")
+	}
+	for _, input := range []string{
+		"replace {\n\tlength_headers yes\n}",
+		"replace {\n\tlength_headers\n\tlength_headers\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+func TestCaddyfileReplaceValues(t *testing.T) {
+	h, err := parse("replace {\n\ta b\n\tc d e\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got [][]string
+	for _, repl := range h.Replacements {
+		got = append(got, repl.Replaces)
+	}
+	if want := [][]string{{"b"}, {"d", "e"}}; !reflect.DeepEqual(got, want) {
+		t.Errorf("replace values %q, want %q", got, want)
+	}
+}
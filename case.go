@@ -0,0 +1,131 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"unicode"
+	"unicode/utf8"
+)
+
+// letterCase is the casing of a match, as far as PreserveCase is
+// concerned.
+type letterCase int
+
+const (
+	// anything not covered below, such as "iPhone", or no cased
+	// letters at all
+	caseMixed letterCase = iota
+
+	// all cased letters are lowercase, as in "color"
+	caseLower
+
+	// all cased letters are uppercase, and there are at least two,
+	// as in "COLOR"
+	caseUpper
+
+	// the first cased letter is uppercase and the others are
+	// lowercase, as in "Color" or "A"
+	caseTitle
+)
+
+// caseOf returns the casing of b. Letters without case, such as those
+// of Chinese, are ignored.
+func caseOf(b []byte) letterCase {
+	var letters, upper int
+	firstUpper := false
+	for _, r := range string(b) {
+		switch {
+		case unicode.IsUpper(r):
+			if letters == 0 {
+				firstUpper = true
+			}
+			upper++
+		case unicode.IsLower(r):
+		default:
+			continue
+		}
+		letters++
+	}
+	switch {
+	case letters == 0:
+		return caseMixed
+	case upper == 0:
+		return caseLower
+	case upper == 1 && firstUpper:
+		return caseTitle
+	case upper == letters:
+		return caseUpper
+	}
+	return caseMixed
+}
+
+// withCase returns b converted to c. A mixed case leaves b as it is.
+func withCase(b []byte, c letterCase) []byte {
+	switch c {
+	case caseLower:
+		return bytes.ToLower(b)
+	case caseUpper:
+		return bytes.ToUpper(b)
+	case caseTitle:
+		lower := bytes.ToLower(b)
+		i := bytes.IndexFunc(lower, unicode.IsLower)
+		if i < 0 {
+			return lower
+		}
+		r, n := utf8.DecodeRune(lower[i:])
+		out := make([]byte, 0, len(lower)+utf8.UTFMax)
+		out = append(out, lower[:i]...)
+		out = utf8.AppendRune(out, unicode.ToUpper(r))
+		return append(out, lower[i+n:]...)
+	}
+	return b
+}
+
+// matchCase returns out, the replacement for match, in the casing of
+// match if PreserveCase is set.
+func (repl *Replacement) matchCase(match, out []byte) []byte {
+	if !repl.PreserveCase {
+		return out
+	}
+	return withCase(out, caseOf(match))
+}
+
+// caseSearch returns the regular expression for the literal search
+// finalSearch, which matches it ignoring case if PreserveCase is set.
+func (repl *Replacement) caseSearch(finalSearch string) string {
+	quoted := regexp.QuoteMeta(finalSearch)
+	if repl.PreserveCase {
+		return "(?i:" + quoted + ")"
+	}
+	return quoted
+}
+
+// checkPreserveCase returns an error if PreserveCase is combined with
+// options it doesn't work with.
+func (repl *Replacement) checkPreserveCase() error {
+	if !repl.PreserveCase {
+		return nil
+	}
+	if len(repl.Replaces) == 0 {
+		return fmt.Errorf("preserve_case requires replace values")
+	}
+	if repl.EscapeJSON {
+		return fmt.Errorf("cannot specify both preserve_case and escape_json in same replacement")
+	}
+	return nil
+}
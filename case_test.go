@@ -0,0 +1,168 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import "testing"
+
+func TestCaseOf(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want letterCase
+	}{
+		{"color", caseLower},
+		{"COLOR", caseUpper},
+		{"Color", caseTitle},
+		{"A", caseTitle},
+		{"a", caseLower},
+		{"iPhone", caseMixed},
+		{"CoLoR", caseMixed},
+		{"cOLOR", caseMixed},
+		{"123", caseMixed},
+		{"", caseMixed},
+		{"x-ray 2", caseLower},
+		{"X-RAY", caseUpper},
+		{"X-ray", caseTitle},
+		{"'Hello'", caseTitle},
+		{"ÉCOLE", caseUpper},
+		{"École", caseTitle},
+		{"中文Abc", caseTitle},
+	} {
+		if got := caseOf([]byte(tt.in)); got != tt.want {
+			t.Errorf("caseOf(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestWithCase(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		c    letterCase
+		want string
+	}{
+		{"Colour", caseLower, "colour"},
+		{"colour", caseUpper, "COLOUR"},
+		{"colOUR", caseTitle, "Colour"},
+		{"new york", caseTitle, "New york"},
+		{"'quoted'", caseTitle, "'Quoted'"},
+		{"école", caseTitle, "École"},
+		{"iPad", caseMixed, "iPad"},
+		{"123", caseTitle, "123"},
+	} {
+		if got := string(withCase([]byte(tt.in), tt.c)); got != tt.want {
+			t.Errorf("withCase(%q, %d) = %q, want %q", tt.in, tt.c, got, tt.want)
+		}
+	}
+}
+
+func TestPreserveCase(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		repl *Replacement
+		body string
+		want string
+	}{
+		{
+			name: "lower",
+			repl: &Replacement{Search: "color", Replaces: []string{"colour"}},
+			body: "the color",
+			want: "the colour",
+		},
+		{
+			name: "title",
+			repl: &Replacement{Search: "color", Replaces: []string{"colour"}},
+			body: "Color me",
+			want: "Colour me",
+		},
+		{
+			name: "upper",
+			repl: &Replacement{Search: "color", Replaces: []string{"colour"}},
+			body: "COLOR!",
+			want: "COLOUR!",
+		},
+		{
+			name: "mixed falls back to the replace value",
+			repl: &Replacement{Search: "color", Replaces: []string{"colour"}},
+			body: "cOLoR",
+			want: "colour",
+		},
+		{
+			name: "all forms in one body",
+			repl: &Replacement{Search: "color", Replaces: []string{"colour"}},
+			body: "color Color COLOR",
+			want: "colour Colour COLOUR",
+		},
+		{
+			name: "search in another case",
+			repl: &Replacement{Search: "Color", Replaces: []string{"Colour"}},
+			body: "color",
+			want: "colour",
+		},
+		{
+			name: "regexp",
+			repl: &Replacement{SearchRegexp: `(?i)colou?r`, Replaces: []string{"hue"}},
+			body: "Color COLOUR",
+			want: "Hue HUE",
+		},
+		{
+			name: "regexp with submatches",
+			repl: &Replacement{SearchRegexp: `(?i)(\w+)@example`, Replaces: []string{"${1}@test"}},
+			body: "ME@EXAMPLE",
+			want: "ME@TEST",
+		},
+		{
+			name: "non-ASCII",
+			repl: &Replacement{Search: "ecole", Replaces: []string{"école"}},
+			body: "Ecole ECOLE",
+			want: "École ÉCOLE",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.repl.PreserveCase = true
+			for _, mode := range []struct {
+				name     string
+				stream   bool
+				conflict string
+				chunk    int
+			}{
+				{"buffer", false, "", len(tt.body)},
+				{"stream", true, "", len(tt.body)},
+				{"stream bytewise", true, "", 1},
+				{"longest match", false, conflictLongestMatchWins, len(tt.body)},
+			} {
+				h := provision(t, &Handler{Stream: mode.stream, ConflictResolution: mode.conflict, Replacements: []*Replacement{tt.repl}})
+				if got := replaced(t, h, splitEvery(tt.body, mode.chunk)...); got != tt.want {
+					t.Errorf("%s: got %q, want %q", mode.name, got, tt.want)
+				}
+			}
+		})
+	}
+
+	// without preserve_case, the search is case-sensitive
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "color", Replaces: []string{"colour"}}}})
+	if got := replaced(t, h, "Color color"); got != "Color colour" {
+		t.Errorf("got %q, want %q", got, "Color colour")
+	}
+}
+
+func TestPreserveCaseInvalid(t *testing.T) {
+	for _, repl := range []*Replacement{
+		{Search: "a", Mask: "*", PreserveCase: true},
+		{Search: "a", Replaces: []string{"b"}, EscapeJSON: true, PreserveCase: true},
+	} {
+		if err := provisionErr(&Handler{Replacements: []*Replacement{repl}}); err == nil {
+			t.Errorf("%+v: no error", repl)
+		}
+	}
+}
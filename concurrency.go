@@ -0,0 +1,61 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"net/http"
+
+	"go.uber.org/zap"
+)
+
+// The values of ConcurrencyPolicy.
+const (
+	concurrencyWait   = "wait"
+	concurrencyBypass = "bypass"
+)
+
+// acquireSlot takes one of the MaxConcurrent slots for replacing the
+// response to r, if there is a limit. If none is free, it waits for
+// one until r is canceled, or, with the bypass policy, reports false
+// right away so that the response is passed through unreplaced. A
+// slot that was taken must be given back with releaseSlot.
+func (h *Handler) acquireSlot(r *http.Request) (bool, error) {
+	if h.slots == nil {
+		return true, nil
+	}
+	select {
+	case h.slots <- struct{}{}:
+		return true, nil
+	default:
+	}
+	if h.ConcurrencyPolicy == concurrencyBypass {
+		h.logDecision(r, "passing response through since max_concurrent responses are being replaced",
+			zap.Int("max_concurrent", h.MaxConcurrent))
+		return false, nil
+	}
+	select {
+	case h.slots <- struct{}{}:
+		return true, nil
+	case <-r.Context().Done():
+		return false, r.Context().Err()
+	}
+}
+
+// releaseSlot gives back a slot taken by acquireSlot.
+func (h *Handler) releaseSlot() {
+	if h.slots != nil {
+		<-h.slots
+	}
+}
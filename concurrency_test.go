@@ -0,0 +1,173 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestMaxConcurrent(t *testing.T) {
+	const limit, requests = 2, 5
+	h := provision(t, &Handler{Stream: true, MaxConcurrent: limit, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+
+	var active, most atomic.Int32
+	started := make(chan struct{}, requests)
+	release := make(chan struct{})
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/plain")
+		// the slot is taken when the header is written
+		w.WriteHeader(http.StatusOK)
+		n := active.Add(1)
+		for {
+			m := most.Load()
+			if n <= m || most.CompareAndSwap(m, n) {
+				break
+			}
+		}
+		started <- struct{}{}
+		<-release
+		active.Add(-1)
+		_, err := io.WriteString(w, "a foo")
+		return err
+	})
+
+	var wg sync.WaitGroup
+	bodies := make([]string, requests)
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			if err := h.ServeHTTP(w, newRequest("GET", "/", nil), next); err != nil {
+				t.Error(err)
+			}
+			bodies[i] = w.Body.String()
+		}(i)
+	}
+	for i := 0; i < limit; i++ {
+		<-started
+	}
+	select {
+	case <-started:
+		t.Errorf("more than %d responses replaced at once", limit)
+	case <-time.After(50 * time.Millisecond):
+	}
+	close(release)
+	wg.Wait()
+
+	if n := most.Load(); n != limit {
+		t.Errorf("at most %d at once, want %d", n, limit)
+	}
+	for i, body := range bodies {
+		if body != "a bar" {
+			t.Errorf("response %d: body %q, want %q", i, body, "a bar")
+		}
+	}
+	if n := len(h.slots); n != 0 {
+		t.Errorf("%d slots not given back", n)
+	}
+}
+
+func TestMaxConcurrentPolicy(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		stream   bool
+		policy   string
+		canceled bool
+		want     string
+		err      error
+	}{
+		{name: "bypass buffered", policy: concurrencyBypass, want: "a foo"},
+		{name: "bypass streamed", stream: true, policy: concurrencyBypass, want: "a foo"},
+		{name: "wait until canceled buffered", canceled: true, err: context.Canceled},
+		{name: "wait until canceled streamed", stream: true, canceled: true, want: "a foo"},
+		{name: "wait policy until canceled", policy: concurrencyWait, canceled: true, err: context.Canceled},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{Stream: tt.stream, MaxConcurrent: 1, ConcurrencyPolicy: tt.policy, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+			// another response is being replaced
+			h.slots <- struct{}{}
+
+			r := newRequest("GET", "/", nil)
+			if tt.canceled {
+				ctx, cancel := context.WithCancel(r.Context())
+				cancel()
+				r = r.WithContext(ctx)
+			}
+			w := httptest.NewRecorder()
+			err := h.ServeHTTP(w, r, upstream("text/plain", "a foo"))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("error %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && w.Body.String() != tt.want {
+				t.Errorf("body %q, want %q", w.Body.String(), tt.want)
+			}
+			if n := len(h.slots); n != 1 {
+				t.Errorf("%d slots taken, want 1", n)
+			}
+		})
+	}
+}
+
+func TestMaxConcurrentInvalid(t *testing.T) {
+	for _, h := range []*Handler{
+		{MaxConcurrent: -1},
+		{MaxConcurrent: 1, ConcurrencyPolicy: "drop"},
+	} {
+		h.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}
+		if err := provisionErr(h); err == nil {
+			t.Errorf("max_concurrent %d, concurrency_policy %q: no error", h.MaxConcurrent, h.ConcurrencyPolicy)
+		}
+	}
+}
+
+func TestCaddyfileMaxConcurrent(t *testing.T) {
+	for _, tt := range []struct {
+		input  string
+		max    int
+		policy string
+	}{
+		{input: "replace {\n\tmax_concurrent 4\n}", max: 4},
+		{input: "replace {\n\tmax_concurrent 4 bypass\n}", max: 4, policy: concurrencyBypass},
+	} {
+		h, err := parse(tt.input)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.input, err)
+		}
+		if h.MaxConcurrent != tt.max || h.ConcurrencyPolicy != tt.policy {
+			t.Errorf("%q: max_concurrent %d %q, want %d %q", tt.input, h.MaxConcurrent, h.ConcurrencyPolicy, tt.max, tt.policy)
+		}
+	}
+	for _, input := range []string{
+		"replace {\n\tmax_concurrent\n}",
+		"replace {\n\tmax_concurrent x\n}",
+		"replace {\n\tmax_concurrent 4 wait extra\n}",
+		"replace {\n\tmax_concurrent 4\n\tmax_concurrent 2\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// condition is a parsed Replacement.When expression, which compares
+// a capture group of a regexp match, or a placeholder of the request,
+// against a literal string.
+type condition struct {
+	// group reference in regexp.Expand template syntax, e.g. ${1}
+	group string
+	// placeholder, e.g. {http.request.proto}, if it is compared
+	// instead of a group
+	placeholder string
+	negate      bool
+	value       string
+}
+
+var conditionRe = regexp.MustCompile(`^\s*(?:\$(\d+|\{\w+\})|(\{[^{}\s]+\}))\s*(==|!=)\s*("(?:[^"\\]|\\.)*")\s*$`)
+
+// parseCondition parses an expression of the form
+//
+//	$<group> == "<value>"
+//	$<group> != "<value>"
+//	{<placeholder>} == "<value>"
+//	{<placeholder>} != "<value>"
+//
+// where <group> is a capture group number or a braced group name,
+// as in $1 or ${name}, <placeholder> is the name of a placeholder,
+// as in {http.request.proto}, and <value> is a double-quoted Go
+// string. re is nil for substring searches, which have no groups.
+func parseCondition(expr string, re *regexp.Regexp) (*condition, error) {
+	m := conditionRe.FindStringSubmatch(expr)
+	if m == nil {
+		return nil, fmt.Errorf("invalid condition %q: expected $<group> or {<placeholder>}, then == or !=, then \"<value>\"", expr)
+	}
+
+	value, err := strconv.Unquote(m[4])
+	if err != nil {
+		return nil, fmt.Errorf("invalid condition %q: %v", expr, err)
+	}
+	if m[2] != "" {
+		return &condition{
+			placeholder: m[2],
+			negate:      m[3] == "!=",
+			value:       value,
+		}, nil
+	}
+
+	if re == nil {
+		return nil, fmt.Errorf("invalid condition %q: capture groups require search_regexp", expr)
+	}
+	group := m[1]
+	if n, err := strconv.Atoi(group); err == nil {
+		if n > re.NumSubexp() {
+			return nil, fmt.Errorf("invalid condition %q: regexp has no group %d", expr, n)
+		}
+		group = "{" + group + "}"
+	} else if re.SubexpIndex(group[1:len(group)-1]) < 0 {
+		return nil, fmt.Errorf("invalid condition %q: regexp has no group named %s", expr, group[1:len(group)-1])
+	}
+
+	return &condition{
+		group:  "$" + group,
+		negate: m[3] == "!=",
+		value:  value,
+	}, nil
+}
+
+// holds reports whether the condition is true for the match of re
+// in src described by index, in the response to the request of
+// placeholders. Unknown placeholders are compared as empty.
+func (c *condition) holds(placeholders *caddy.Replacer, re *regexp.Regexp, src []byte, index []int) bool {
+	var got string
+	if c.placeholder != "" {
+		got = placeholders.ReplaceAll(c.placeholder, "")
+	} else {
+		got = string(re.Expand(nil, []byte(c.group), src, index))
+	}
+	return (got == c.value) != c.negate
+}
+
+// allows reports whether c, if it is a condition on a placeholder,
+// holds for the request of placeholders. Conditions on capture
+// groups are decided for each match, so they allow every request, as
+// does a nil condition.
+func (c *condition) allows(placeholders *caddy.Replacer) bool {
+	return c == nil || c.placeholder == "" || c.holds(placeholders, nil, nil, nil)
+}
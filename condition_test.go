@@ -0,0 +1,198 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"context"
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestWhen(t *testing.T) {
+	const body = `<a class="active">x</a><a class="idle">x</a>`
+	for _, tt := range []struct {
+		name   string
+		repl   *Replacement
+		proto  string
+		want   string
+		errMsg string
+	}{
+		{
+			name: "group equals",
+			repl: &Replacement{SearchRegexp: `class="(\w+)">x`, Replaces: []string{`class="$1">y`}, When: `$1 == "active"`},
+			want: `<a class="active">y</a><a class="idle">x</a>`,
+		},
+		{
+			name: "group differs",
+			repl: &Replacement{SearchRegexp: `class="(\w+)">x`, Replaces: []string{`class="$1">y`}, When: `$1 != "active"`},
+			want: `<a class="active">x</a><a class="idle">y</a>`,
+		},
+		{
+			name: "named group",
+			repl: &Replacement{SearchRegexp: `class="(?P<c>\w+)">x`, Replaces: []string{`class="${c}">y`}, When: `${c} == "idle"`},
+			want: `<a class="active">x</a><a class="idle">y</a>`,
+		},
+		{
+			name: "escaped value",
+			repl: &Replacement{SearchRegexp: `class="(\w+)">x`, Replaces: []string{"y"}, When: `$1 == "\x61ctive"`},
+			want: `<a y</a><a class="idle">x</a>`,
+		},
+		{
+			name:  "placeholder holds",
+			repl:  &Replacement{Search: "x", Replaces: []string{"y"}, When: `{proto} == "HTTP/2.0"`},
+			proto: "HTTP/2.0",
+			want:  strings.ReplaceAll(body, "x", "y"),
+		},
+		{
+			name:  "placeholder doesn't hold",
+			repl:  &Replacement{Search: "x", Replaces: []string{"y"}, When: `{proto} == "HTTP/2.0"`},
+			proto: "HTTP/1.1",
+			want:  body,
+		},
+		{name: "missing group", repl: &Replacement{SearchRegexp: `(\w+)`, Replaces: []string{"y"}, When: `$2 == "a"`}, errMsg: "regexp has no group 2"},
+		{name: "missing name", repl: &Replacement{SearchRegexp: `(\w+)`, Replaces: []string{"y"}, When: `${n} == "a"`}, errMsg: "regexp has no group named n"},
+		{name: "group without regexp", repl: &Replacement{Search: "x", Replaces: []string{"y"}, When: `$1 == "a"`}, errMsg: "capture groups require search_regexp"},
+		{name: "unquoted value", repl: &Replacement{SearchRegexp: `(\w+)`, Replaces: []string{"y"}, When: `$1 == a`}, errMsg: "invalid condition"},
+		{name: "bad operator", repl: &Replacement{SearchRegexp: `(\w+)`, Replaces: []string{"y"}, When: `$1 = "a"`}, errMsg: "invalid condition"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{Replacements: []*Replacement{tt.repl}}
+			if tt.errMsg != "" {
+				if err := provisionErr(h); err == nil || !strings.Contains(err.Error(), tt.errMsg) {
+					t.Fatalf("got error %v, want %q", err, tt.errMsg)
+				}
+				return
+			}
+			for _, stream := range []bool{false, true} {
+				h.Stream = stream
+				provision(t, h)
+				r := newRequest("GET", "/", nil)
+				replacerOf(r).Set("proto", tt.proto)
+				if got := serve(t, h, r, upstream("text/html", body)).Body.String(); got != tt.want {
+					t.Errorf("stream %v: got %q, want %q", stream, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWhenRequestPlaceholders(t *testing.T) {
+	request := func(proto string, secure bool) *http.Request {
+		r := newRequest("GET", "/", nil)
+		r.Proto = proto
+		r.ProtoMajor, r.ProtoMinor, _ = http.ParseHTTPVersion(proto)
+		if secure {
+			r.TLS = &tls.ConnectionState{Version: tls.VersionTLS13, NegotiatedProtocol: "h2"}
+		}
+		return r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddyhttp.NewTestReplacer(r)))
+	}
+	for _, tt := range []struct {
+		name   string
+		when   string
+		regexp bool
+		proto  string
+		secure bool
+		want   string
+	}{
+		{name: "HTTP/2", when: `{http.request.proto} == "HTTP/2.0"`, proto: "HTTP/2.0", want: "/h2/app.js"},
+		{name: "not HTTP/2", when: `{http.request.proto} == "HTTP/2.0"`, proto: "HTTP/1.1", want: "/app.js"},
+		{name: "negated", when: `{http.request.proto} != "HTTP/2.0"`, proto: "HTTP/1.1", want: "/h2/app.js"},
+		{name: "regexp search", when: `{http.request.proto} == "HTTP/2.0"`, regexp: true, proto: "HTTP/2.0", want: "/h2/app.js"},
+		{name: "regexp search not matched", when: `{http.request.proto} == "HTTP/2.0"`, regexp: true, proto: "HTTP/1.1", want: "/app.js"},
+		{name: "TLS", when: `{http.request.tls.version} == "tls1.3"`, proto: "HTTP/1.1", secure: true, want: "/h2/app.js"},
+		{name: "plaintext", when: `{http.request.tls.version} == "tls1.3"`, proto: "HTTP/1.1", want: "/app.js"},
+		{name: "ALPN", when: `{http.request.tls.proto} == "h2"`, proto: "HTTP/2.0", secure: true, want: "/h2/app.js"},
+		{name: "unknown placeholder is empty", when: `{no.such.placeholder} == ""`, proto: "HTTP/1.1", want: "/h2/app.js"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			repl := &Replacement{Search: "/app.js", Replaces: []string{"/h2/app.js"}, When: tt.when}
+			if tt.regexp {
+				repl = &Replacement{SearchRegexp: `/(app)\.js`, Replaces: []string{"/h2/$1.js"}, When: tt.when}
+			}
+			for _, mode := range []struct {
+				name     string
+				stream   bool
+				conflict string
+			}{{"buffer", false, ""}, {"stream", true, ""}, {"longest match", false, conflictLongestMatchWins}} {
+				h := provision(t, &Handler{Stream: mode.stream, ConflictResolution: mode.conflict, Replacements: []*Replacement{repl}})
+				// evaluated for each request
+				for _, r := range []*http.Request{request(tt.proto, tt.secure), request(tt.proto, tt.secure)} {
+					if got := serve(t, h, r, upstream("text/html", "/app.js")).Body.String(); got != tt.want {
+						t.Errorf("%s: got %q, want %q", mode.name, got, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestWhenRequired(t *testing.T) {
+	// a required rule whose condition doesn't allow the request is
+	// not missed
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}, Required: true, When: `{proto} == "HTTP/2.0"`}}})
+	r := newRequest("GET", "/", nil)
+	replacerOf(r).Set("proto", "HTTP/1.1")
+	if got := serve(t, h, r, upstream("text/plain", "no match")).Body.String(); got != "no match" {
+		t.Errorf("got %q, want %q", got, "no match")
+	}
+	r = newRequest("GET", "/", nil)
+	replacerOf(r).Set("proto", "HTTP/2.0")
+	if err := h.ServeHTTP(httptest.NewRecorder(), r, upstream("text/plain", "no match")); err == nil {
+		t.Error("allowed required rule without match: no error")
+	}
+}
+
+func TestRequestConditionsParity(t *testing.T) {
+	rules := func() []*Replacement {
+		return []*Replacement{
+			{Search: "<b>foo</b>", Replaces: []string{"[A]"}, When: `{v} == "1"`},
+			{Search: "foo", Replaces: []string{"B"}},
+			{SearchRegexp: `(\w+)@x`, Replaces: []string{"<$1>"}, When: `$1 != "me"`},
+			{Search: "bar", Replaces: []string{"C"}, When: `{v} != "1"`, Priority: 1},
+		}
+	}
+	const body = "<b>foo</b> foo me@x you@x bar"
+	want := map[string]string{
+		"1": "[A] B me@x <you> bar",
+		// the text of the rule that is left out is matched by
+		// another one
+		"2": "<b>B</b> B me@x <you> C",
+	}
+	for _, conflict := range []string{"", conflictLongestMatchWins} {
+		for _, mode := range []struct {
+			name   string
+			stream bool
+			chunk  int
+		}{{"buffer", false, len(body)}, {"stream", true, len(body)}, {"stream bytewise", true, 1}} {
+			h := provision(t, &Handler{Stream: mode.stream, ConflictResolution: conflict, Replacements: rules()})
+			// requests alternate on the same handler, so that
+			// pooled transformers are reused
+			for _, v := range []string{"1", "2", "1", "2"} {
+				r := newRequest("GET", "/", nil)
+				replacerOf(r).Set("v", v)
+				got := serve(t, h, r, upstream("text/html", splitEvery(body, mode.chunk)...)).Body.String()
+				if got != want[v] {
+					t.Errorf("%q, %s, v=%s: got %q, want %q", conflict, mode.name, v, got, want[v])
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,456 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/text/transform"
+)
+
+// Ways of resolving conflicts between replacements that match
+// the same part of the body.
+const (
+	// Each replacement is applied in turn to the output of the
+	// ones before it, so the first one to match wins.
+	conflictFirstWins = "first_wins"
+
+	// All replacements are applied in a single pass, and at each
+	// position the longest match wins.
+	conflictLongestMatchWins = "longest_match_wins"
+)
+
+// combinedPattern returns a regular expression matching any of rules,
+// with each rule wrapped in a capture group, and the index of each
+// rule's group. search returns the literal search string of a
+// substring replacement.
+func combinedPattern(rules []*Replacement, search func(*Replacement) string) (string, []int) {
+	alternatives := make([]string, len(rules))
+	groups := make([]int, len(rules))
+	group := 1
+	for i, repl := range rules {
+		alternatives[i] = "(" + rulePattern(repl, search) + ")"
+		groups[i] = group
+		if repl.re != nil {
+			group += 1 + repl.re.NumSubexp()
+		} else {
+			group++
+		}
+	}
+	return strings.Join(alternatives, "|"), groups
+}
+
+// rulePattern returns the regular expression that repl searches for.
+func rulePattern(repl *Replacement, search func(*Replacement) string) string {
+	if repl.re != nil {
+		return repl.re.String()
+	}
+	return repl.caseSearch(search(repl))
+}
+
+// newLongestMatchTransformer returns a transformer that performs all
+// replacements in a single pass, choosing the longest match at each
+// position. Ties go to the replacement that is applied first. Rules
+// for which omit is true are left out, as if they weren't configured;
+// omit may be nil.
+func (h *Handler) newLongestMatchTransformer(placeholderRepl *caddy.Replacer, rt *replacer, omit []bool) transform.Transformer {
+	// the rules taking part, as indices into h.rules
+	var rules []int
+	for i := range h.rules {
+		if omit == nil || !omit[i] {
+			rules = append(rules, i)
+		}
+	}
+	if len(rules) == 0 {
+		return transform.Nop
+	}
+	parts := make([]*Replacement, len(rules))
+	for k, i := range rules {
+		parts[k] = h.rules[i]
+	}
+
+	// the replace values of each rule; rules with variants have
+	// one for each, the others a single one
+	replaces := make([][]string, len(h.rules))
+	for _, i := range rules {
+		repl := h.rules[i]
+		var values []string
+		if !repl.hasVariants() {
+			values = []string{repl.chooseReplace(placeholderRepl, 0)}
+		} else {
+			values = make([]string, len(repl.Replaces))
+			for v, r := range repl.Replaces {
+				values[v] = placeholderRepl.ReplaceKnown(r, "")
+			}
+		}
+		for v, finalReplace := range values {
+			if repl.re == nil {
+				// substring replacements are not templates
+				finalSearch := rt.repl.ReplaceKnown(placeholderRepl.ReplaceKnown(repl.Search, ""), "")
+				values[v] = repl.escape(rt.repl.ReplaceKnown(strings.ReplaceAll(finalReplace, matchPlaceholder, finalSearch), ""))
+			} else {
+				// the match is substituted by Expand, since its
+				// text may contain $ signs
+				values[v] = strings.ReplaceAll(finalReplace, matchPlaceholder, "${0}")
+			}
+		}
+		replaces[i] = values
+	}
+
+	search := func(repl *Replacement) string {
+		return rt.repl.ReplaceKnown(placeholderRepl.ReplaceKnown(repl.Search, ""), "")
+	}
+	expr, groups := combinedPattern(parts, search)
+	// the pattern was checked during provisioning, and placeholder
+	// values are quoted, so it and each of its rules always compile
+	lt := &longestTransformer{search: compileFrom("", expr)}
+	// the extra group of search takes the place of the whole match
+	lt.groups = 1 + lt.search.atStart.NumSubexp()
+	for k, repl := range parts {
+		lt.rules = append(lt.rules, longestRule{re: compileFrom(`\A`, rulePattern(repl, search)), group: groups[k]})
+	}
+
+	var pos *positionTracker
+	for _, repl := range parts {
+		if repl.hasRegion() {
+			pos = new(positionTracker)
+			break
+		}
+	}
+
+	lt.replace = h.marked(func(src []byte, index []int) []byte {
+		for k, i := range rules {
+			repl := h.rules[i]
+			group := groups[k]
+			if index[2*group] < 0 {
+				continue
+			}
+			// the rule's own submatches, as if it had matched alone
+			var sub []int
+			if repl.re != nil {
+				sub = index[2*group : 2*(group+1+repl.re.NumSubexp())]
+			}
+			if repl.cond != nil && !repl.cond.holds(rt.repl, repl.re, src, sub) {
+				return src[index[0]:index[1]]
+			}
+			var patched []byte
+			if repl.DecodeMatchBase64 {
+				var ok bool
+				if patched, ok = repl.patchBase64(rt.repl, rt.pointOf(repl), src, sub); !ok {
+					return src[index[0]:index[1]]
+				}
+			}
+			if repl.hasRegion() && !pos.inRegion(repl, src, index) {
+				return src[index[0]:index[1]]
+			}
+			if !rt.sampled(repl) || !h.fire(rt, i) || !rt.firstValue(i, repl, src[index[0]:index[1]]) {
+				return src[index[0]:index[1]]
+			}
+			rt.count(i, repl)
+			rt.setMatch(src[index[0]:index[1]])
+			if patched != nil {
+				return patched
+			}
+			if repl.Mask != "" {
+				if sub != nil {
+					return repl.maskMatch(src, sub)
+				}
+				return repl.mask(src[index[0]:index[1]])
+			}
+			if repl.HashMatch != "" {
+				if sub != nil {
+					return repl.hashMatch(src, sub)
+				}
+				return repl.hash(src[index[0]:index[1]])
+			}
+			if repl.wraps() {
+				return repl.wrap(rt.repl, src[index[0]:index[1]])
+			}
+			if repl.bodyFunc != nil {
+				return repl.transformMatch(rt.repl, src[index[0]:index[1]])
+			}
+			if repl.tmpl != nil {
+				if sub == nil {
+					sub = index[2*group : 2*group+2]
+				}
+				return h.executeTemplate(repl, repl.re, src, sub)
+			}
+			if repl.files != nil {
+				if contents, ok := h.fileReplacement(rt, i); ok {
+					return contents
+				}
+				return src[index[0]:index[1]]
+			}
+			finalReplace := replaces[i][0]
+			if repl.hasVariants() {
+				finalReplace = replaces[i][repl.chooseVariant(rt.repl, rt.pointOf(repl))]
+			}
+			if repl.re == nil {
+				return repl.matchCase(src[index[0]:index[1]], rt.expandTokens([]byte(finalReplace)))
+			}
+			template := rt.expandTokens([]byte(repl.escape(rt.repl.ReplaceKnown(finalReplace, ""))))
+			return repl.matchCase(src[index[0]:index[1]], repl.re.Expand(nil, template, src, sub))
+		}
+		return src[index[0]:index[1]]
+	})
+
+	// See: https://github.com/icholy/replace/issues/5#issuecomment-949757616
+	lt.MaxMatchSize = h.window
+	if pos != nil {
+		pos.Transformer = lt
+		return pos
+	}
+	return lt
+}
+
+// fromRegexp matches a regular expression from a position within a
+// src, taking the character before the position into account for ^,
+// \b and \B, as if the search had started at the beginning of src.
+type fromRegexp struct {
+	// the expression as group 1, for positions at the start of src
+	atStart *regexp.Regexp
+	// any character followed by the expression as group 1, for
+	// positions after the character
+	after *regexp.Regexp
+}
+
+// compileFrom compiles a fromRegexp for expr, with prefix in front of
+// it, such as \A to only match at the position.
+func compileFrom(prefix, expr string) fromRegexp {
+	return fromRegexp{
+		atStart: regexp.MustCompile(prefix + "(" + expr + ")"),
+		after:   regexp.MustCompile(prefix + "(?s:.)(" + expr + ")"),
+	}
+}
+
+// find returns the submatch indices into src of the first match of
+// the expression that starts at or after from, or nil.
+func (r fromRegexp) find(src []byte, from int) []int {
+	re, start := r.atStart, from
+	if from > 0 {
+		_, size := utf8.DecodeLastRune(src[:from])
+		re, start = r.after, from-size
+	}
+	index := re.FindSubmatchIndex(src[start:])
+	if index == nil {
+		return nil
+	}
+	index = index[2:]
+	for i := range index {
+		if index[i] >= 0 {
+			index[i] += start
+		}
+	}
+	return index
+}
+
+// longestRule is a rule taking part in a longestTransformer.
+type longestRule struct {
+	// matches the rule only at the position searched from
+	re fromRegexp
+	// the index of the rule's group in the combined pattern
+	group int
+}
+
+// longestTransformer is like the transformer of replace.RegexpIndexFunc
+// with the combined pattern of several rules, but at each position
+// where one of them matches, it replaces the longest of their matches.
+// Each rule matches with its own semantics, so a lazy quantifier
+// stays lazy. replace is called with the submatch indices of the
+// combined pattern, where only the groups of the rule that won are
+// set.
+type longestTransformer struct {
+	// the combined pattern, which finds where the next match starts
+	search fromRegexp
+	// the number of groups of the combined pattern, including the
+	// whole match
+	groups  int
+	rules   []longestRule
+	replace func(src []byte, index []int) []byte
+
+	// MaxMatchSize is as for replace.RegexpTransformer. Unless the
+	// end of the body has been reached, a match is only replaced
+	// once this many bytes from its start can be seen, since a
+	// rule that doesn't match yet may match longer with more.
+	MaxMatchSize int
+
+	// replacement that didn't fit into dst yet
+	overflow []byte
+}
+
+func (t *longestTransformer) Reset() {
+	t.overflow = nil
+}
+
+// longest returns the submatch indices of the longest match of the
+// rules at start, with ties going to the first rule, or nil.
+func (t *longestTransformer) longest(src []byte, start int) []int {
+	var best []int
+	bestRule := 0
+	for k, rule := range t.rules {
+		index := rule.re.find(src, start)
+		if index != nil && (best == nil || index[1] > best[1]) {
+			best, bestRule = index, k
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	index := make([]int, 2*t.groups)
+	for i := range index {
+		index[i] = -1
+	}
+	index[0], index[1] = best[0], best[1]
+	copy(index[2*t.rules[bestRule].group:], best)
+	return index
+}
+
+func (t *longestTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if len(t.overflow) > 0 {
+		n := copy(dst, t.overflow)
+		nDst += n
+		t.overflow = t.overflow[n:]
+		if len(t.overflow) > 0 {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		t.overflow = nil
+	}
+	// keep copies the text up to end unchanged
+	keep := func(end int) bool {
+		n := copy(dst[nDst:], src[nSrc:end])
+		nDst += n
+		nSrc += n
+		return nSrc == end
+	}
+	// where the last replaced match ended, since as with
+	// regexp.FindAll, an empty match right after it is ignored
+	prevEnd := -1
+	for from := nSrc; from <= len(src); {
+		loc := t.search.find(src, from)
+		if loc == nil {
+			break
+		}
+		start := loc[0]
+		if !atEOF && len(src)-start < t.MaxMatchSize {
+			break
+		}
+		index := t.longest(src, start)
+		if index == nil || (index[1] == start && start == prevEnd) {
+			if start == len(src) {
+				break
+			}
+			_, size := utf8.DecodeRune(src[start:])
+			from = start + size
+			continue
+		}
+		if !keep(start) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		rep := t.replace(src, index)
+		n := copy(dst[nDst:], rep)
+		nDst += n
+		nSrc, prevEnd, from = index[1], index[1], index[1]
+		if n < len(rep) {
+			t.overflow = rep[n:]
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		if index[1] == start {
+			// an empty match; the search goes on after the
+			// character at it, which is kept
+			if start == len(src) {
+				break
+			}
+			_, size := utf8.DecodeRune(src[start:])
+			from = start + size
+		}
+	}
+	if atEOF {
+		if !keep(len(src)) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		return nDst, nSrc, nil
+	}
+	// skip any bytes which exceed the max match size
+	if end := len(src) - t.MaxMatchSize; end > nSrc {
+		if !keep(end) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+	}
+	return nDst, nSrc, transform.ErrShortSrc
+}
+
+// conditionalTransformer performs the replacements in longest-match
+// mode without the rules that the current response omits, so that
+// other rules can match the text they would have matched. The transformer for each
+// combination of rules is built when a response first needs it and
+// kept along with the pooled replacer.
+type conditionalTransformer struct {
+	h               *Handler
+	rt              *replacer
+	placeholderRepl *caddy.Replacer
+
+	// the transformers built so far, by the rules they omit, with
+	// a byte for each rule
+	built map[string]transform.Transformer
+	// the transformer for the current response, or nil after Reset
+	cur transform.Transformer
+}
+
+// hasOptionalRules reports whether one of the rules may be omitted
+// from a response, because it has a condition on a request
+// placeholder or a flag_key.
+func (h *Handler) hasOptionalRules() bool {
+	for _, repl := range h.rules {
+		if (repl.cond != nil && repl.cond.placeholder != "") || repl.FlagKey != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// omits reports whether repl is left out of the body being replaced
+// by rt, because its condition on a request placeholder doesn't hold
+// or its flag is off.
+func (rt *replacer) omits(repl *Replacement) bool {
+	return !repl.cond.allows(rt.repl) || !rt.flagged(repl)
+}
+
+func (ct *conditionalTransformer) Reset() {
+	ct.cur = nil
+}
+
+func (ct *conditionalTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if ct.cur == nil {
+		omit := make([]bool, len(ct.h.rules))
+		key := make([]byte, len(ct.h.rules))
+		for i, repl := range ct.h.rules {
+			omit[i] = ct.rt.omits(repl)
+			if omit[i] {
+				key[i] = 1
+			}
+		}
+		tr, ok := ct.built[string(key)]
+		if !ok {
+			tr = ct.h.newLongestMatchTransformer(ct.placeholderRepl, ct.rt, omit)
+			ct.built[string(key)] = tr
+		}
+		tr.Reset()
+		ct.cur = tr
+	}
+	return ct.cur.Transform(dst, src, atEOF)
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import "testing"
+
+func TestLongestMatchWins(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		rules []*Replacement
+		body  string
+		want  string
+	}{
+		{
+			name:  "longer substring wins",
+			rules: []*Replacement{{Search: "Foo", Replaces: []string{"Bar"}}, {Search: "FooBaz", Replaces: []string{"Qux"}}},
+			body:  "FooBaz Foo",
+			want:  "Qux Bar",
+		},
+		{
+			name:  "tie goes to the first rule",
+			rules: []*Replacement{{Search: "ab", Replaces: []string{"1"}}, {SearchRegexp: "a.", Replaces: []string{"2"}}},
+			body:  "ab ac",
+			want:  "1 2",
+		},
+		{
+			name:  "tie goes to the higher priority",
+			rules: []*Replacement{{Search: "ab", Replaces: []string{"1"}}, {SearchRegexp: "a.", Replaces: []string{"2"}, Priority: 1}},
+			body:  "ab",
+			want:  "2",
+		},
+		{
+			name:  "lazy quantifier stays lazy",
+			rules: []*Replacement{{SearchRegexp: "<b>.*?</b>", Replaces: []string{"X"}}},
+			body:  "<b>1</b> and <b>2</b>",
+			want:  "X and X",
+		},
+		{
+			name:  "lazy quantifier against a longer rule",
+			rules: []*Replacement{{SearchRegexp: "<b>.*?</b>", Replaces: []string{"X"}}, {Search: "<b>1</b> and", Replaces: []string{"Y"}}},
+			body:  "<b>1</b> and <b>2</b>",
+			want:  "Y X",
+		},
+		{
+			name:  "lazy optional stays lazy",
+			rules: []*Replacement{{SearchRegexp: "ab??", Replaces: []string{"1"}}, {Search: "c", Replaces: []string{"2"}}},
+			body:  "abc",
+			want:  "1b2",
+		},
+		{
+			name:  "earliest match comes first",
+			rules: []*Replacement{{Search: "bcd", Replaces: []string{"1"}}, {Search: "ab", Replaces: []string{"2"}}},
+			body:  "abcd",
+			want:  "2cd",
+		},
+		{
+			name:  "submatches of the winning rule",
+			rules: []*Replacement{{SearchRegexp: `(\w+)@(\w+)`, Replaces: []string{"$2 at $1"}}, {SearchRegexp: `(\w+)@`, Replaces: []string{"$1"}}},
+			body:  "me@host",
+			want:  "host at me",
+		},
+		{
+			name:  "word boundaries see the text before",
+			rules: []*Replacement{{Search: "x", Replaces: []string{"y"}}, {SearchRegexp: `\bcat`, Replaces: []string{"dog"}}},
+			body:  "xcat cat",
+			want:  "ycat dog",
+		},
+		{
+			name:  "empty matches",
+			rules: []*Replacement{{SearchRegexp: "b*", Replaces: []string{"-"}}, {Search: "a", Replaces: []string{"A"}}},
+			body:  "abba",
+			want:  "A-A",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []struct {
+				name   string
+				stream bool
+				chunk  int
+			}{{"buffer", false, len(tt.body)}, {"stream", true, len(tt.body)}, {"stream bytewise", true, 1}} {
+				h := provision(t, &Handler{ConflictResolution: conflictLongestMatchWins, Stream: mode.stream, Replacements: tt.rules})
+				if got := replaced(t, h, splitEvery(tt.body, mode.chunk)...); got != tt.want {
+					t.Errorf("%s: got %q, want %q", mode.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestLongestMatchAcrossWindow(t *testing.T) {
+	// the longer rule only matches once the rest of the body arrives
+	h := provision(t, &Handler{ConflictResolution: conflictLongestMatchWins, Stream: true, Replacements: []*Replacement{
+		{Search: "ab", Replaces: []string{"1"}},
+		{SearchRegexp: "ab.*c", Replaces: []string{"2"}},
+	}})
+	if got := replaced(t, h, "xab", "zzz", "c"); got != "x2" {
+		t.Errorf("got %q, want %q", got, "x2")
+	}
+}
@@ -0,0 +1,66 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// Policies for a buffered response whose body doesn't have the length
+// that its Content-Length header declares.
+const (
+	// The body is replaced as usual, and Content-Length is set to
+	// the length of the result.
+	lengthMismatchFix = "fix"
+
+	// The handler fails with 502 Bad Gateway.
+	lengthMismatchError = "error"
+
+	// The response is passed through without replacements, with the
+	// upstream's Content-Length.
+	lengthMismatchTrustUpstream = "trust-upstream"
+)
+
+// lengthMismatch checks the body of size bytes that was buffered for
+// the response to r against the Content-Length in header. It returns
+// an error if the response must fail, and reports whether it should be
+// replaced.
+func (h *Handler) lengthMismatch(r *http.Request, status int, header http.Header, size int64) (bool, error) {
+	if h.ContentLengthMismatch == "" || h.ContentLengthMismatch == lengthMismatchFix {
+		return true, nil
+	}
+	declared := header.Get("Content-Length")
+	if declared == "" || r.Method == http.MethodHead || !bodyAllowed(status) {
+		return true, nil
+	}
+	length, err := strconv.ParseInt(declared, 10, 64)
+	if err == nil && length == size {
+		return true, nil
+	}
+
+	if h.ContentLengthMismatch == lengthMismatchError {
+		return false, caddyhttp.Error(http.StatusBadGateway,
+			fmt.Errorf("upstream declared Content-Length %s but sent %d bytes", declared, size))
+	}
+	h.logDecision(r, "skipping replacements on response with mismatched Content-Length",
+		zap.String("content_length", declared),
+		zap.Int64("size", size))
+	return false, nil
+}
@@ -0,0 +1,118 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// lengthUpstream responds with body and the given Content-Length.
+func lengthUpstream(status int, length, body string) caddyhttp.Handler {
+	return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", length)
+		w.WriteHeader(status)
+		_, err := io.WriteString(w, body)
+		return err
+	})
+}
+
+func TestContentLengthMismatch(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		policy     string
+		method     string
+		status     int
+		length     string
+		want       string
+		wantLength string
+		err        int
+	}{
+		{name: "default fixes", length: "100", want: "bar", wantLength: "3"},
+		{name: "fix", policy: lengthMismatchFix, length: "100", want: "bar", wantLength: "3"},
+		{name: "fix short", policy: lengthMismatchFix, length: "1", want: "bar", wantLength: "3"},
+		{name: "error", policy: lengthMismatchError, length: "100", err: http.StatusBadGateway},
+		{name: "error on invalid length", policy: lengthMismatchError, length: "three", err: http.StatusBadGateway},
+		{name: "error when matching", policy: lengthMismatchError, length: "3", want: "bar", wantLength: "3"},
+		{name: "trust-upstream", policy: lengthMismatchTrustUpstream, length: "100", want: "foo", wantLength: "100"},
+		{name: "trust-upstream when matching", policy: lengthMismatchTrustUpstream, length: "3", want: "bar", wantLength: "3"},
+		// responses without a body don't fail
+		{name: "HEAD", policy: lengthMismatchError, method: "HEAD", length: "100"},
+		{name: "no body allowed", policy: lengthMismatchError, status: http.StatusNotModified, length: "100"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			method, status := tt.method, tt.status
+			if method == "" {
+				method = "GET"
+			}
+			if status == 0 {
+				status = http.StatusOK
+			}
+			h := provision(t, &Handler{ContentLengthMismatch: tt.policy, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+			w := httptest.NewRecorder()
+			body := "foo"
+			if method == "HEAD" || status == http.StatusNotModified {
+				body = ""
+			}
+			err := h.ServeHTTP(w, newRequest(method, "/", nil), lengthUpstream(status, tt.length, body))
+			if tt.err != 0 {
+				var herr caddyhttp.HandlerError
+				if !errors.As(err, &herr) || herr.StatusCode != tt.err {
+					t.Fatalf("got error %v, want status %d", err, tt.err)
+				}
+				if w.Body.Len() != 0 {
+					t.Errorf("sent body %q", w.Body.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.Body.String() != tt.want || (tt.wantLength != "" && w.Header().Get("Content-Length") != tt.wantLength) {
+				t.Errorf("got %q with Content-Length %q, want %q with %q", w.Body.String(), w.Header().Get("Content-Length"), tt.want, tt.wantLength)
+			}
+		})
+	}
+}
+
+func TestContentLengthMismatchInvalid(t *testing.T) {
+	if err := provisionErr(&Handler{ContentLengthMismatch: "ignore", Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}}); err == nil {
+		t.Error("no error")
+	}
+}
+
+func TestCaddyfileContentLengthMismatch(t *testing.T) {
+	h, err := parse("replace {\n\tcontent_length_mismatch error\n\tfoo bar\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.ContentLengthMismatch != lengthMismatchError {
+		t.Errorf("content_length_mismatch %q, want %q", h.ContentLengthMismatch, lengthMismatchError)
+	}
+	for _, input := range []string{
+		"replace {\n\tcontent_length_mismatch\n}",
+		"replace {\n\tcontent_length_mismatch fix\n\tcontent_length_mismatch error\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
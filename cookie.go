@@ -0,0 +1,130 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// rewritesCookies reports whether Set-Cookie headers are rewritten.
+func (h *Handler) rewritesCookies() bool {
+	return len(h.CookieDomains) > 0 || len(h.CookiePaths) > 0
+}
+
+// rewriteCookies rewrites the Domain and Path attributes of every
+// Set-Cookie header in header, leaving everything else as it was.
+func (h *Handler) rewriteCookies(header http.Header) {
+	cookies := header.Values("Set-Cookie")
+	for i, cookie := range cookies {
+		cookies[i] = h.rewriteCookie(cookie)
+	}
+}
+
+// rewriteCookie returns the Set-Cookie header value cookie with its
+// Domain and Path attributes rewritten.
+func (h *Handler) rewriteCookie(cookie string) string {
+	attrs := strings.Split(cookie, ";")
+	// the first part is the name and value
+	for i := 1; i < len(attrs); i++ {
+		name, value, ok := strings.Cut(attrs[i], "=")
+		if !ok {
+			continue
+		}
+		var rewritten string
+		switch strings.ToLower(strings.TrimSpace(name)) {
+		case "domain":
+			rewritten, ok = h.rewriteCookieDomain(strings.TrimSpace(value))
+		case "path":
+			rewritten, ok = h.rewriteCookiePath(strings.TrimSpace(value))
+		default:
+			ok = false
+		}
+		if ok {
+			attrs[i] = name + "=" + rewritten
+		}
+	}
+	return strings.Join(attrs, ";")
+}
+
+// rewriteCookieDomain returns the target of the cookie domain, which
+// is matched ignoring case and a leading dot.
+func (h *Handler) rewriteCookieDomain(domain string) (string, bool) {
+	normalized := strings.ToLower(strings.TrimPrefix(domain, "."))
+	for from, to := range h.CookieDomains {
+		if strings.ToLower(strings.TrimPrefix(from, ".")) == normalized {
+			return to, true
+		}
+	}
+	return "", false
+}
+
+// rewriteCookiePath returns the cookie path with its longest prefix
+// in CookiePaths replaced by that prefix's target. A prefix matches
+// only the whole path or up to a slash, so /app matches /app/x but
+// not /application.
+func (h *Handler) rewriteCookiePath(path string) (string, bool) {
+	var best string
+	found := false
+	for from := range h.CookiePaths {
+		if !strings.HasPrefix(path, from) || (found && len(from) <= len(best)) {
+			continue
+		}
+		if len(path) == len(from) || strings.HasSuffix(from, "/") || path[len(from)] == '/' {
+			best, found = from, true
+		}
+	}
+	if !found {
+		return "", false
+	}
+	to, rest := h.CookiePaths[best], path[len(best):]
+	if strings.HasSuffix(to, "/") && strings.HasPrefix(rest, "/") {
+		rest = rest[1:]
+	}
+	return to + rest, true
+}
+
+// cookieWriter rewrites the Set-Cookie headers of a response just
+// before they are written.
+type cookieWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	handler     *Handler
+	wroteHeader bool
+}
+
+func (cw *cookieWriter) WriteHeader(status int) {
+	if cw.wroteHeader {
+		return
+	}
+	// informational responses precede the final one
+	if status < 100 || status > 199 {
+		cw.wroteHeader = true
+		cw.handler.rewriteCookies(cw.Header())
+	}
+	cw.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (cw *cookieWriter) Write(p []byte) (int, error) {
+	cw.WriteHeader(http.StatusOK)
+	return cw.ResponseWriterWrapper.Write(p)
+}
+
+func (cw *cookieWriter) ReadFrom(r io.Reader) (int64, error) {
+	cw.WriteHeader(http.StatusOK)
+	return cw.ResponseWriterWrapper.ReadFrom(r)
+}
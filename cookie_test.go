@@ -0,0 +1,99 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestRewriteCookie(t *testing.T) {
+	h := &Handler{
+		CookieDomains: map[string]string{"internal.local": "example.com", ".Other.Local": "other.example.com"},
+		CookiePaths:   map[string]string{"/app": "/", "/app/admin/": "/admin/", "/api": "/v2/api"},
+	}
+	for _, tt := range []struct {
+		cookie string
+		want   string
+	}{
+		{"a=1; Domain=internal.local", "a=1; Domain=example.com"},
+		{"a=1; domain=.INTERNAL.local; Secure", "a=1; domain=example.com; Secure"},
+		{"a=1; Domain=other.local", "a=1; Domain=other.example.com"},
+		{"a=1; Domain=unknown.local", "a=1; Domain=unknown.local"},
+		{"a=1; Path=/app", "a=1; Path=/"},
+		{"a=1; Path=/app/x", "a=1; Path=/x"},
+		{"a=1; Path=/application", "a=1; Path=/application"},
+		{"a=1; Path=/app/admin/users", "a=1; Path=/admin/users"},
+		{"a=1; Path=/api/x", "a=1; Path=/v2/api/x"},
+		{"a=1; Path=/other", "a=1; Path=/other"},
+		{"a=1; Path=/app; Domain=internal.local; HttpOnly; SameSite=Lax; Max-Age=60", "a=1; Path=/; Domain=example.com; HttpOnly; SameSite=Lax; Max-Age=60"},
+		// the value may look like an attribute
+		{"Domain=internal.local; Path=/app", "Domain=internal.local; Path=/"},
+		{"a=b=c;Path=/app;Expires=Wed, 21 Oct 2015 07:28:00 GMT", "a=b=c;Path=/;Expires=Wed, 21 Oct 2015 07:28:00 GMT"},
+		{"a=1", "a=1"},
+	} {
+		if got := h.rewriteCookie(tt.cookie); got != tt.want {
+			t.Errorf("rewriteCookie(%q) = %q, want %q", tt.cookie, got, tt.want)
+		}
+	}
+}
+
+func TestCookieRewriting(t *testing.T) {
+	next := func(contentType string) caddyhttp.Handler {
+		return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Add("Set-Cookie", "session=abc; Domain=internal.local; Path=/app; HttpOnly")
+			w.Header().Add("Set-Cookie", "theme=dark; Path=/app/settings; Max-Age=3600")
+			w.Header().Add("Set-Cookie", "other=1; Domain=elsewhere.local")
+			_, err := io.WriteString(w, "foo")
+			return err
+		})
+	}
+	want := []string{
+		"session=abc; Domain=example.com; Path=/; HttpOnly",
+		"theme=dark; Path=/settings; Max-Age=3600",
+		"other=1; Domain=elsewhere.local",
+	}
+	for _, tt := range []struct {
+		name        string
+		stream      bool
+		contentType string
+		body        string
+	}{
+		{name: "buffer", contentType: "text/html", body: "bar"},
+		{name: "stream", stream: true, contentType: "text/html", body: "bar"},
+		{name: "passed through", contentType: "image/png", body: "foo"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{
+				Stream:        tt.stream,
+				CookieDomains: map[string]string{"internal.local": "example.com"},
+				CookiePaths:   map[string]string{"/app": "/"},
+				Replacements:  []*Replacement{{Search: "foo", Replaces: []string{"bar"}}},
+			})
+			w := serve(t, h, newRequest("GET", "/", nil), next(tt.contentType))
+			if got := w.Header().Values("Set-Cookie"); !reflect.DeepEqual(got, want) {
+				t.Errorf("Set-Cookie %q, want %q", got, want)
+			}
+			if got := w.Body.String(); got != tt.body {
+				t.Errorf("body %q, want %q", got, tt.body)
+			}
+		})
+	}
+}
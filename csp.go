@@ -0,0 +1,292 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"regexp"
+	"strings"
+)
+
+// The headers that carry a Content-Security-Policy.
+var cspHeaders = []string{"Content-Security-Policy", "Content-Security-Policy-Report-Only"}
+
+// scriptDirectives are the CSP directives that govern script
+// elements, in the order browsers fall back through them.
+var scriptDirectives = []string{"script-src-elem", "script-src", "default-src"}
+
+// takeNonce sets the value of the {csp_nonce} token for the body
+// about to be replaced by rt: the CSPNonce value if it is set, and
+// otherwise the nonce in the Content-Security-Policy of header, which
+// is nil for request bodies.
+func (h *Handler) takeNonce(rt *replacer, header http.Header) {
+	rt.nonce = ""
+	if h.CSPNonce != "" {
+		rt.nonce = validNonce(rt.repl.ReplaceKnown(h.CSPNonce, ""))
+		return
+	}
+	if header != nil {
+		rt.nonce = policyNonce(header.Values(cspHeaders[0]))
+	}
+}
+
+// validNonce returns nonce if it only contains base64 characters, so
+// that it can't break out of the attribute it is inserted into, and
+// the empty string otherwise.
+func validNonce(nonce string) string {
+	for i := 0; i < len(nonce); i++ {
+		b := nonce[i]
+		if !isASCIILetter(b) && (b < '0' || b > '9') && !strings.ContainsRune("+/=-_", rune(b)) {
+			return ""
+		}
+	}
+	return nonce
+}
+
+// policyNonce returns the first nonce that one of the policies allows
+// script elements with.
+func policyNonce(policies []string) string {
+	for _, policy := range policies {
+		d := parsePolicy(policy).scriptDirective()
+		if d == nil {
+			continue
+		}
+		for _, source := range d.sources {
+			const prefix = "'nonce-"
+			if len(source) > len(prefix) && strings.EqualFold(source[:len(prefix)], prefix) && strings.HasSuffix(source, "'") {
+				if nonce := validNonce(source[len(prefix) : len(source)-1]); nonce != "" {
+					return nonce
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// directive is a directive of a Content-Security-Policy.
+type directive struct {
+	// the name, in lower case
+	name    string
+	sources []string
+	// the directive as it was written, or empty if it was changed
+	raw string
+}
+
+// policy is a parsed Content-Security-Policy.
+type policy []*directive
+
+func parsePolicy(s string) policy {
+	var p policy
+	for _, raw := range strings.Split(s, ";") {
+		fields := strings.Fields(raw)
+		if len(fields) == 0 {
+			continue
+		}
+		p = append(p, &directive{name: strings.ToLower(fields[0]), sources: fields[1:], raw: strings.TrimSpace(raw)})
+	}
+	return p
+}
+
+// lookup returns the directive with the given name, or nil. Like
+// browsers, it ignores repeated directives.
+func (p policy) lookup(name string) *directive {
+	for _, d := range p {
+		if d.name == name {
+			return d
+		}
+	}
+	return nil
+}
+
+// scriptDirective returns the directive that applies to script
+// elements, or nil if the policy doesn't restrict them.
+func (p policy) scriptDirective() *directive {
+	for _, name := range scriptDirectives {
+		if d := p.lookup(name); d != nil {
+			return d
+		}
+	}
+	return nil
+}
+
+func (p policy) String() string {
+	parts := make([]string, len(p))
+	for i, d := range p {
+		if d.raw != "" {
+			parts[i] = d.raw
+		} else {
+			parts[i] = strings.Join(append([]string{d.name}, d.sources...), " ")
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// allowHashes returns the policy s changed so that it allows scripts
+// with the given hash sources. Where only default-src restricts
+// scripts, a script-src with its sources is added.
+func allowHashes(s string, hashes []string) string {
+	p := parsePolicy(s)
+	elem, src := p.lookup("script-src-elem"), p.lookup("script-src")
+	if elem == nil && src == nil {
+		def := p.lookup("default-src")
+		if def == nil {
+			return s
+		}
+		src = &directive{name: "script-src", sources: append([]string(nil), def.sources...)}
+		p = append(p, src)
+	}
+	changed := false
+	for _, d := range []*directive{elem, src} {
+		if d != nil && d.allow(hashes) {
+			changed = true
+		}
+	}
+	if !changed {
+		return s
+	}
+	return p.String()
+}
+
+// allow adds the hashes that are missing from the sources of d, and
+// reports whether it changed d. A directive that allows all inline
+// scripts with 'unsafe-inline' is left alone, since adding a hash to
+// it would make browsers ignore 'unsafe-inline'.
+func (d *directive) allow(hashes []string) bool {
+	if len(d.sources) == 1 && strings.EqualFold(d.sources[0], "'none'") {
+		d.sources = nil
+	}
+	inline, hashed := false, false
+	for _, source := range d.sources {
+		lower := strings.ToLower(source)
+		switch {
+		case lower == "'unsafe-inline'":
+			inline = true
+		case strings.HasPrefix(lower, "'nonce-") || strings.HasPrefix(lower, "'sha"):
+			hashed = true
+		}
+	}
+	if inline && !hashed {
+		return false
+	}
+	before := len(d.sources)
+	for _, hash := range hashes {
+		if !containsString(d.sources, hash) {
+			d.sources = append(d.sources, hash)
+		}
+	}
+	if len(d.sources) == before && d.raw != "" {
+		return false
+	}
+	d.raw = ""
+	return true
+}
+
+// addScriptHashes adds the hashes of the inline scripts that the
+// replacements insert to the Content-Security-Policy headers of a
+// replaced response, if CSPScriptHashes is set.
+func (h *Handler) addScriptHashes(header http.Header, rt *replacer) {
+	if !h.CSPScriptHashes {
+		return
+	}
+	hashes := h.scriptHashes(rt)
+	if len(hashes) == 0 {
+		return
+	}
+	for _, name := range cspHeaders {
+		policies := header.Values(name)
+		if len(policies) == 0 {
+			continue
+		}
+		header.Del(name)
+		for _, policy := range policies {
+			header.Add(name, allowHashes(policy, hashes))
+		}
+	}
+}
+
+// scriptHashes returns the hash sources of the inline scripts in the
+// replace, prefix and suffix values of the replacements, with the
+// placeholders in them expanded for the current request.
+func (h *Handler) scriptHashes(rt *replacer) []string {
+	var hashes []string
+	for _, repl := range h.Replacements {
+		values := append([]string{repl.Prefix, repl.Suffix}, repl.Replaces...)
+		for _, value := range values {
+			if strings.Contains(value, matchPlaceholder) {
+				continue
+			}
+			value = strings.ReplaceAll(rt.repl.ReplaceKnown(value, ""), nonceToken, rt.nonce)
+			if hasMatchTokens(value) {
+				continue
+			}
+			for _, script := range inlineScripts(value) {
+				// submatches may be expanded into a regexp
+				// replacement
+				if repl.re != nil && strings.Contains(script, "$") {
+					continue
+				}
+				sum := sha256.Sum256([]byte(script))
+				hash := "'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'"
+				if !containsString(hashes, hash) {
+					hashes = append(hashes, hash)
+				}
+			}
+		}
+	}
+	return hashes
+}
+
+var (
+	scriptStartRe = regexp.MustCompile(`(?i)<script[\s/>]`)
+	scriptEndRe   = regexp.MustCompile(`(?i)</script[\s/>]`)
+	srcAttrRe     = regexp.MustCompile(`(?i)[\s/]src(?:[\s/=]|$)`)
+)
+
+// inlineScripts returns the text of the script elements in s that
+// have no src attribute and are closed within s.
+func inlineScripts(s string) []string {
+	var scripts []string
+	for {
+		loc := scriptStartRe.FindStringIndex(s)
+		if loc == nil {
+			return scripts
+		}
+		tagEnd := strings.IndexByte(s[loc[1]-1:], '>')
+		if tagEnd < 0 {
+			return scripts
+		}
+		attrs := s[loc[0]+len("<script") : loc[1]-1+tagEnd]
+		s = s[loc[1]+tagEnd:]
+		end := scriptEndRe.FindStringIndex(s)
+		if end == nil {
+			return scripts
+		}
+		if !srcAttrRe.MatchString(attrs) {
+			scripts = append(scripts, s[:end[0]])
+		}
+		s = s[end[1]-1:]
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
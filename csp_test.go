@@ -0,0 +1,239 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// cspUpstream responds with an HTML body and the given
+// Content-Security-Policy headers, by name.
+func cspUpstream(policies map[string][]string, body string) caddyhttp.Handler {
+	return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		for name, values := range policies {
+			for _, v := range values {
+				w.Header().Add(name, v)
+			}
+		}
+		_, err := io.WriteString(w, body)
+		return err
+	})
+}
+
+// scriptHash returns the CSP hash source of script.
+func scriptHash(script string) string {
+	sum := sha256.Sum256([]byte(script))
+	return "'sha256-" + base64.StdEncoding.EncodeToString(sum[:]) + "'"
+}
+
+func TestCSPNonce(t *testing.T) {
+	const inject = `<script nonce="{csp_nonce}">track()</script></body>`
+	for _, tt := range []struct {
+		name     string
+		cspNonce string
+		// the value of the {nonce} placeholder
+		placeholder string
+		policies    []string
+		want        string
+	}{
+		{name: "from the policy", policies: []string{"script-src 'self' 'nonce-abc123'"}, want: "abc123"},
+		{name: "from script-src-elem", policies: []string{"script-src 'nonce-a'; script-src-elem 'nonce-b'"}, want: "b"},
+		{name: "from default-src", policies: []string{"default-src 'nonce-d'; img-src *"}, want: "d"},
+		{name: "from a later policy", policies: []string{"img-src *", "script-src 'nonce-e'"}, want: "e"},
+		{name: "no nonce in the policy", policies: []string{"script-src 'self'"}, want: ""},
+		{name: "no policy", want: ""},
+		{name: "csp_nonce", cspNonce: "{nonce}", placeholder: "n0nce+/=", policies: []string{"script-src 'nonce-abc123'"}, want: "n0nce+/="},
+		{name: "invalid csp_nonce", cspNonce: "{nonce}", placeholder: `x"><script>`, policies: []string{"script-src 'nonce-abc123'"}, want: ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, stream := range []bool{false, true} {
+				h := provision(t, &Handler{Stream: stream, CSPNonce: tt.cspNonce, Replacements: []*Replacement{{Search: "</body>", Replaces: []string{inject}}}})
+				r := newRequest("GET", "/", nil)
+				replacerOf(r).Set("nonce", tt.placeholder)
+				got := serve(t, h, r, cspUpstream(map[string][]string{"Content-Security-Policy": tt.policies}, "<body></body>")).Body.String()
+				if want := `<body><script nonce="` + tt.want + `">track()</script></body>`; got != want {
+					t.Errorf("stream %v: got %q, want %q", stream, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPolicyNonce(t *testing.T) {
+	for _, tt := range []struct {
+		policies []string
+		want     string
+	}{
+		{[]string{"script-src 'nonce-abc'"}, "abc"},
+		{[]string{"SCRIPT-SRC 'NONCE-abc'"}, "abc"},
+		{[]string{"script-src 'self'; default-src 'nonce-abc'"}, ""},
+		{[]string{"script-src 'nonce-a\"b' 'nonce-ok'"}, "ok"},
+		{[]string{"script-src 'nonce-'"}, ""},
+		{[]string{"script-src 'nonce-abc"}, ""},
+		{[]string{"style-src 'nonce-abc'"}, ""},
+		{[]string{"script-src 'nonce-a'; script-src 'nonce-b'"}, "a"},
+		{nil, ""},
+	} {
+		if got := policyNonce(tt.policies); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.policies, got, tt.want)
+		}
+	}
+}
+
+func TestAllowHashes(t *testing.T) {
+	const h1, h2 = "'sha256-one'", "'sha256-two'"
+	for _, tt := range []struct {
+		name   string
+		policy string
+		want   string
+	}{
+		{name: "script-src", policy: "default-src 'self'; script-src 'self'", want: "default-src 'self'; script-src 'self' 'sha256-one' 'sha256-two'"},
+		{name: "script-src-elem too", policy: "script-src 'self'; script-src-elem 'self'", want: "script-src 'self' 'sha256-one' 'sha256-two'; script-src-elem 'self' 'sha256-one' 'sha256-two'"},
+		{name: "only default-src", policy: "default-src 'self' cdn.example.com", want: "default-src 'self' cdn.example.com; script-src 'self' cdn.example.com 'sha256-one' 'sha256-two'"},
+		{name: "none", policy: "script-src 'none'", want: "script-src 'sha256-one' 'sha256-two'"},
+		{name: "unsafe-inline", policy: "script-src 'self' 'unsafe-inline'", want: "script-src 'self' 'unsafe-inline'"},
+		{name: "unsafe-inline with a nonce", policy: "script-src 'unsafe-inline' 'nonce-x'", want: "script-src 'unsafe-inline' 'nonce-x' 'sha256-one' 'sha256-two'"},
+		{name: "already allowed", policy: "script-src  'sha256-one'   'sha256-two' ;img-src *", want: "script-src  'sha256-one'   'sha256-two' ;img-src *"},
+		{name: "one missing", policy: "script-src 'sha256-one'; img-src  *", want: "script-src 'sha256-one' 'sha256-two'; img-src  *"},
+		{name: "scripts not restricted", policy: "img-src *", want: "img-src *"},
+	} {
+		if got := allowHashes(tt.policy, []string{h1, h2}); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestInlineScripts(t *testing.T) {
+	for _, tt := range []struct {
+		s    string
+		want []string
+	}{
+		{"<script>a()</script>", []string{"a()"}},
+		{`<SCRIPT type="module">a()</Script >`, []string{"a()"}},
+		{`<script src="x.js"></script><script>b()</script>`, []string{"b()"}},
+		{`<script data-src="x">c()</script>`, []string{"c()"}},
+		{"<script>a()</script><p><script>\nb()\n</script>", []string{"a()", "\nb()\n"}},
+		{"<script>unclosed()", nil},
+		{"<scripts>no()</scripts>", nil},
+		{"<script>a()</scripts></script>", []string{"a()</scripts>"}},
+		{"no scripts", nil},
+	} {
+		if got := inlineScripts(tt.s); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.s, got, tt.want)
+		}
+	}
+}
+
+func TestCSPScriptHashes(t *testing.T) {
+	policies := map[string][]string{
+		"Content-Security-Policy":             {"script-src 'self'", "img-src *"},
+		"Content-Security-Policy-Report-Only": {"default-src 'self'"},
+	}
+	for _, tt := range []struct {
+		name  string
+		rules []*Replacement
+		// the scripts whose hashes are added
+		scripts []string
+	}{
+		{
+			name:    "replace",
+			rules:   []*Replacement{{Search: "</body>", Replaces: []string{"<script>track()</script></body>"}}},
+			scripts: []string{"track()"},
+		},
+		{
+			name:    "prefix and suffix",
+			rules:   []*Replacement{{Search: "<main>", Prefix: "<script>a()</script>", Suffix: "<script>b()</script>"}},
+			scripts: []string{"a()", "b()"},
+		},
+		{
+			name:    "placeholders and the nonce",
+			rules:   []*Replacement{{Search: "</body>", Replaces: []string{`<script nonce="{csp_nonce}">id("{user}")</script></body>`}}},
+			scripts: []string{`id("42")`},
+		},
+		{
+			name:  "depends on the match",
+			rules: []*Replacement{{Search: "</body>", Replaces: []string{"<script>{http.replace_response.match}</script>"}}, {SearchRegexp: "<p>(x)", Replaces: []string{"<script>$1</script>"}}},
+		},
+		{
+			name:  "external script",
+			rules: []*Replacement{{Search: "</body>", Replaces: []string{`<script src="/a.js"></script></body>`}}},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, stream := range []bool{false, true} {
+				h := provision(t, &Handler{Stream: stream, CSPScriptHashes: true, Replacements: tt.rules})
+				r := newRequest("GET", "/", nil)
+				replacerOf(r).Set("user", "42")
+				w := serve(t, h, r, cspUpstream(policies, "<body><main><p>x</main></body>"))
+				want := map[string][]string{
+					"Content-Security-Policy":             {"script-src 'self'", "img-src *"},
+					"Content-Security-Policy-Report-Only": {"default-src 'self'"},
+				}
+				if len(tt.scripts) > 0 {
+					var sources string
+					for _, script := range tt.scripts {
+						sources += " " + scriptHash(script)
+					}
+					want["Content-Security-Policy"][0] += sources
+					want["Content-Security-Policy-Report-Only"][0] += "; script-src 'self'" + sources
+				}
+				for name, values := range want {
+					if got := w.Header().Values(name); !reflect.DeepEqual(got, values) {
+						t.Errorf("stream %v: %s %q, want %q", stream, name, got, values)
+					}
+				}
+			}
+		})
+	}
+
+	// without csp_script_hashes, the policy is left alone
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "</body>", Replaces: []string{"<script>track()</script></body>"}}}})
+	w := serve(t, h, newRequest("GET", "/", nil), cspUpstream(policies, "<body></body>"))
+	if got := w.Header().Values("Content-Security-Policy"); !reflect.DeepEqual(got, policies["Content-Security-Policy"]) {
+		t.Errorf("not enabled: got %q", got)
+	}
+}
+
+func TestCaddyfileCSP(t *testing.T) {
+	h, err := parse("replace {\n\tcsp_nonce {http.request.header.X-Nonce}\n\tcsp_script_hashes\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.CSPNonce != "{http.request.header.X-Nonce}" {
+		t.Errorf("csp_nonce %q", h.CSPNonce)
+	}
+	if !h.CSPScriptHashes {
+		t.Error("csp_script_hashes not set")
+	}
+	for _, input := range []string{
+		"replace {\n\tcsp_nonce\n}",
+		"replace {\n\tcsp_nonce a b\n}",
+		"replace {\n\tcsp_nonce a\n\tcsp_nonce b\n}",
+		"replace {\n\tcsp_script_hashes yes\n}",
+		"replace {\n\tcsp_script_hashes\n\tcsp_script_hashes\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"unicode/utf8"
+)
+
+// loadCSVReplacements reads substring replacements from the CSV file
+// at filename. Each row holds a search string followed by one or
+// more replacement values.
+func loadCSVReplacements(filename, delimiter string, header bool) ([]*Replacement, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := csv.NewReader(f)
+	r.FieldsPerRecord = -1
+	if delimiter != "" {
+		comma, size := utf8.DecodeRuneInString(delimiter)
+		if size != len(delimiter) {
+			return nil, fmt.Errorf("delimiter must be a single character, got %q", delimiter)
+		}
+		r.Comma = comma
+	}
+
+	var repls []*Replacement
+	for first := true; ; first = false {
+		record, err := r.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if first && header {
+			continue
+		}
+		line, _ := r.FieldPos(0)
+		if len(record) < 2 {
+			return nil, fmt.Errorf("line %d: expected a search value and at least one replace value, got %d fields", line, len(record))
+		}
+		if record[0] == "" {
+			return nil, fmt.Errorf("line %d: empty search value", line)
+		}
+		repls = append(repls, &Replacement{
+			Search:   record[0],
+			Replaces: record[1:],
+		})
+	}
+	return repls, nil
+}
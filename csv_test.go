@@ -0,0 +1,144 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLoadCSVReplacements(t *testing.T) {
+	type row struct {
+		search   string
+		replaces []string
+	}
+	for _, tt := range []struct {
+		name      string
+		csv       string
+		delimiter string
+		header    bool
+		want      []row
+		err       string
+	}{
+		{
+			name: "rows",
+			csv:  "foo,bar\nhello,hi,hey\n",
+			want: []row{{"foo", []string{"bar"}}, {"hello", []string{"hi", "hey"}}},
+		},
+		{
+			name: "quoted commas",
+			csv:  "\"a, b\",\"c, d\"\n",
+			want: []row{{"a, b", []string{"c, d"}}},
+		},
+		{
+			name: "quoted quotes and newlines",
+			csv:  "\"say \"\"hi\"\"\",\"line\nbreak\"\n",
+			want: []row{{`say "hi"`, []string{"line\nbreak"}}},
+		},
+		{
+			name: "empty replace",
+			csv:  "remove,\n",
+			want: []row{{"remove", []string{""}}},
+		},
+		{
+			name: "no final newline",
+			csv:  "a,b",
+			want: []row{{"a", []string{"b"}}},
+		},
+		{
+			name:   "header",
+			csv:    "search,replace\na,b\n",
+			header: true,
+			want:   []row{{"a", []string{"b"}}},
+		},
+		{
+			name:      "delimiter",
+			csv:       "a,b;c\n",
+			delimiter: ";",
+			want:      []row{{"a,b", []string{"c"}}},
+		},
+		{
+			name:      "multibyte delimiter",
+			csv:       "a→b\n",
+			delimiter: "→",
+			want:      []row{{"a", []string{"b"}}},
+		},
+		{
+			name: "one field",
+			csv:  "a,b\nc\n",
+			err:  "line 2: expected a search value and at least one replace value, got 1 fields",
+		},
+		{
+			name: "empty search",
+			csv:  "a,b\n\n,c\n",
+			err:  "line 3: empty search value",
+		},
+		{
+			name: "bare quote",
+			csv:  "a,b\"c\n",
+			err:  "line 1",
+		},
+		{
+			name:      "long delimiter",
+			csv:       "a,b\n",
+			delimiter: ";;",
+			err:       "delimiter must be a single character",
+		},
+		{
+			name:      "invalid delimiter",
+			csv:       "a,b\n",
+			delimiter: "\"",
+			err:       "invalid field or comment delimiter",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "replacements.csv")
+			if err := os.WriteFile(filename, []byte(tt.csv), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			repls, err := loadCSVReplacements(filename, tt.delimiter, tt.header)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []row
+			for _, repl := range repls {
+				got = append(got, row{repl.Search, repl.Replaces})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplacementsCSV(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "replacements.csv")
+	if err := os.WriteFile(filename, []byte("\"a, b\",c\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	h := provision(t, &Handler{ReplacementsCSV: filename})
+	if got := replaced(t, h, "a, b and a"); got != "c and a" {
+		t.Errorf("got %q, want %q", got, "c and a")
+	}
+}
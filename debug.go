@@ -0,0 +1,112 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// defaultDebugRedact are the placeholders whose values are redacted
+// in the effective config log, if none are configured.
+var defaultDebugRedact = []string{
+	"env.*",
+	"file.*",
+	"http.request.cookie.*",
+	"http.request.header.Authorization",
+	"http.request.header.Cookie",
+	"http.request.header.Proxy-Authorization",
+}
+
+// redactedValue is logged in place of a redacted placeholder value.
+const redactedValue = "REDACTED"
+
+// checkDebugRedact returns an error if one of the patterns is invalid.
+func checkDebugRedact(patterns []string) error {
+	for _, p := range patterns {
+		name := strings.TrimSuffix(p, "*")
+		if name == "" || strings.ContainsAny(name, "{}*") {
+			return fmt.Errorf("debug_redact: invalid placeholder %q", p)
+		}
+	}
+	return nil
+}
+
+// redacted reports whether the value of the placeholder key is kept
+// out of the effective config log. Patterns ending in * match all
+// placeholders with that prefix. Placeholders are compared ignoring
+// case, since header and cookie names are.
+func (h *Handler) redacted(key string) bool {
+	patterns := h.DebugRedact
+	if len(patterns) == 0 {
+		patterns = defaultDebugRedact
+	}
+	key = strings.ToLower(key)
+	for _, p := range patterns {
+		p = strings.ToLower(p)
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		} else if key == p {
+			return true
+		}
+	}
+	return false
+}
+
+// logEffectiveConfig logs the search and replace values of every
+// replacement as they are expanded for r, with the values of
+// redacted placeholders left out. Regular expressions are logged as
+// they are, since placeholders in them are not expanded.
+func (h *Handler) logEffectiveConfig(r *http.Request, repl *caddy.Replacer) {
+	debugRepl := caddy.NewEmptyReplacer()
+	debugRepl.Map(func(key string) (any, bool) {
+		if key == matchKey {
+			// only known once there is a match
+			return nil, false
+		}
+		val, ok := repl.Get(key)
+		if ok && h.redacted(key) {
+			return redactedValue, true
+		}
+		return val, ok
+	})
+
+	rules := make([]any, 0, len(h.Replacements))
+	for _, rule := range h.Replacements {
+		search := rule.SearchRegexp
+		if rule.re == nil {
+			search = debugRepl.ReplaceKnown(rule.Search, "")
+		}
+		replaces := make([]string, len(rule.Replaces))
+		for i, r := range rule.Replaces {
+			replaces[i] = debugRepl.ReplaceKnown(r, "")
+		}
+		rules = append(rules, map[string]any{
+			"index":   rule.index,
+			"search":  search,
+			"regexp":  rule.re != nil,
+			"replace": replaces,
+		})
+	}
+	h.logger.Info("effective replacements",
+		zap.Any("replacements", rules),
+		zap.String("uri", r.RequestURI))
+}
@@ -0,0 +1,120 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestDebugConfig(t *testing.T) {
+	t.Setenv("REPLACE_TEST_SECRET", "hunter2")
+	rules := func() []*Replacement {
+		return []*Replacement{
+			{Search: "{http.request.header.X-Name}", Replaces: []string{"hello {http.request.cookie.session}"}},
+			{Search: "token", Replaces: []string{"{env.REPLACE_TEST_SECRET}", "{http.request.header.Authorization}"}},
+			{SearchRegexp: `{x}\d+`, Replaces: []string{"[{http.request.uri.path}]"}},
+			{Search: "m", Replaces: []string{"<{replace.match}>"}},
+		}
+	}
+	for _, tt := range []struct {
+		name   string
+		redact []string
+		want   []any
+	}{
+		{
+			name: "default redaction",
+			want: []any{
+				map[string]any{"index": 0, "search": "alice", "regexp": false, "replace": []string{"hello REDACTED"}},
+				map[string]any{"index": 1, "search": "token", "regexp": false, "replace": []string{"REDACTED", "REDACTED"}},
+				map[string]any{"index": 2, "search": `{x}\d+`, "regexp": true, "replace": []string{"[/page]"}},
+				map[string]any{"index": 3, "search": "m", "regexp": false, "replace": []string{"<{replace.match}>"}},
+			},
+		},
+		{
+			name:   "configured redaction",
+			redact: []string{"http.request.header.x-*"},
+			want: []any{
+				map[string]any{"index": 0, "search": "REDACTED", "regexp": false, "replace": []string{"hello s3cr3t"}},
+				map[string]any{"index": 1, "search": "token", "regexp": false, "replace": []string{"hunter2", "Bearer abc"}},
+				map[string]any{"index": 2, "search": `{x}\d+`, "regexp": true, "replace": []string{"[/page]"}},
+				map[string]any{"index": 3, "search": "m", "regexp": false, "replace": []string{"<{replace.match}>"}},
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{DebugConfig: true, DebugRedact: tt.redact, Replacements: rules()})
+			core, logs := observer.New(zapcore.InfoLevel)
+			h.logger = zap.New(core)
+			r := newRequest("GET", "/page", nil)
+			r.Header.Set("X-Name", "alice")
+			r.Header.Set("Authorization", "Bearer abc")
+			r.AddCookie(&http.Cookie{Name: "session", Value: "s3cr3t"})
+			// the placeholders of the request, as the server sets them
+			r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddyhttp.NewTestReplacer(r)))
+			serve(t, h, r, upstream("text/plain", "alice token"))
+			entries := logs.FilterMessage("effective replacements").All()
+			if len(entries) != 1 {
+				t.Fatalf("got %d entries in %v", len(entries), logs.All())
+			}
+			fields := entries[0].ContextMap()
+			if !reflect.DeepEqual(fields["replacements"], tt.want) {
+				t.Errorf("got replacements %v, want %v", fields["replacements"], tt.want)
+			}
+			if fields["uri"] != "/page" {
+				t.Errorf("uri %v, want /page", fields["uri"])
+			}
+		})
+	}
+}
+
+func TestDebugConfigOff(t *testing.T) {
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}}})
+	core, logs := observer.New(zapcore.InfoLevel)
+	h.logger = zap.New(core)
+	replaced(t, h, "a")
+	if n := logs.FilterMessage("effective replacements").Len(); n != 0 {
+		t.Errorf("logged the effective config %d times", n)
+	}
+}
+
+func TestDebugRedactInvalid(t *testing.T) {
+	for _, pattern := range []string{"", "*", "{env.X}", "env.*.x"} {
+		if err := provisionErr(&Handler{DebugConfig: true, DebugRedact: []string{pattern}, Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}}}); err == nil {
+			t.Errorf("%q: no error", pattern)
+		}
+	}
+}
+
+func TestCaddyfileDebugConfig(t *testing.T) {
+	h, err := parse("replace {\n\tdebug_config env.* http.request.header.X-Token\n\tfoo bar\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.DebugConfig || !reflect.DeepEqual(h.DebugRedact, []string{"env.*", "http.request.header.X-Token"}) {
+		t.Errorf("debug_config %v with redacted %q", h.DebugConfig, h.DebugRedact)
+	}
+	if _, err := parse("replace {\n\tdebug_config\n\tdebug_config\n}"); err == nil {
+		t.Error("repeated debug_config: no error")
+	}
+}
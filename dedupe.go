@@ -0,0 +1,161 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+
+	"golang.org/x/text/transform"
+)
+
+// The markers around inserted text when Dedupe is enabled. Neither
+// byte sequence can appear in UTF-8 text, and the deduper removes
+// them again before the body is written.
+var (
+	insertStart = []byte{0xfe, 0xfe}
+	insertEnd   = []byte{0xfe, 0xfd}
+)
+
+// marked wraps the replace function of a regexp transformer so that,
+// if Dedupe is enabled, the text it inserts is surrounded by markers.
+// Matches that are left unchanged are not marked.
+func (h *Handler) marked(fn func(src []byte, index []int) []byte) func(src []byte, index []int) []byte {
+	if !h.Dedupe {
+		return fn
+	}
+	return func(src []byte, index []int) []byte {
+		out := fn(src, index)
+		if bytes.Equal(out, src[index[0]:index[1]]) {
+			return out
+		}
+		marked := make([]byte, 0, len(insertStart)+len(out)+len(insertEnd))
+		marked = append(marked, insertStart...)
+		marked = append(marked, out...)
+		return append(marked, insertEnd...)
+	}
+}
+
+// deduper is a transformer that removes the markers around inserted
+// text, dropping each inserted segment that is identical to the
+// previous one when only ASCII whitespace separates the two. The
+// whitespace in between is kept. Markers nested inside a segment,
+// from a later replacement matching within inserted text, are
+// removed without being compared on their own.
+type deduper struct {
+	// output that didn't fit into dst yet
+	pending []byte
+	// nesting depth of the markers
+	depth int
+	// the inserted segment being read
+	seg []byte
+	// the previous inserted segment
+	last    []byte
+	hasLast bool
+	// whether only whitespace was seen since the previous segment
+	adjacent bool
+}
+
+func (d *deduper) Reset() {
+	d.pending = d.pending[:0]
+	d.depth = 0
+	d.seg = d.seg[:0]
+	d.last = d.last[:0]
+	d.hasLast = false
+	d.adjacent = false
+}
+
+func (d *deduper) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for {
+		if len(d.pending) > 0 {
+			n := copy(dst[nDst:], d.pending)
+			nDst += n
+			d.pending = d.pending[n:]
+			if len(d.pending) > 0 {
+				return nDst, nSrc, transform.ErrShortDst
+			}
+		}
+		if nSrc >= len(src) {
+			break
+		}
+
+		b := src[nSrc]
+		if b == insertStart[0] {
+			if nSrc+1 >= len(src) && !atEOF {
+				return nDst, nSrc, transform.ErrShortSrc
+			}
+			if nSrc+1 < len(src) {
+				switch src[nSrc+1] {
+				case insertStart[1]:
+					d.depth++
+					nSrc += 2
+					continue
+				case insertEnd[1]:
+					// an unbalanced end marker, left over from a
+					// replacement that matched the start marker,
+					// is dropped as well
+					nSrc += 2
+					if d.depth > 0 {
+						d.depth--
+						if d.depth == 0 {
+							d.endSegment()
+						}
+					}
+					continue
+				}
+			}
+		}
+
+		if d.depth > 0 {
+			d.seg = append(d.seg, b)
+			nSrc++
+			continue
+		}
+		if nDst >= len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		if !isASCIISpace(b) {
+			d.adjacent = false
+		}
+		dst[nDst] = b
+		nDst++
+		nSrc++
+	}
+
+	if atEOF && d.depth > 0 {
+		// markers are always balanced, but don't lose text if not
+		d.depth = 0
+		d.pending = append(d.pending, d.seg...)
+		d.seg = d.seg[:0]
+		n := copy(dst[nDst:], d.pending)
+		nDst += n
+		d.pending = d.pending[n:]
+		if len(d.pending) > 0 {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+	}
+	return nDst, nSrc, nil
+}
+
+// endSegment writes the segment that was just read, unless it repeats
+// the previous one.
+func (d *deduper) endSegment() {
+	if !d.hasLast || !d.adjacent || !bytes.Equal(d.seg, d.last) {
+		d.pending = append(d.pending, d.seg...)
+		d.last = append(d.last[:0], d.seg...)
+		d.hasLast = true
+	}
+	d.seg = d.seg[:0]
+	d.adjacent = true
+}
@@ -0,0 +1,56 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import "testing"
+
+func TestDedupe(t *testing.T) {
+	banner := &Replacement{Search: "<!-- banner -->", Replaces: []string{"<div>sale</div>"}}
+	for _, tt := range []struct {
+		name  string
+		rules []*Replacement
+		body  string
+		want  string
+	}{
+		{name: "adjacent", rules: []*Replacement{banner}, body: "<!-- banner --><!-- banner -->", want: "<div>sale</div>"},
+		{name: "whitespace between", rules: []*Replacement{banner}, body: "<!-- banner -->\n  <!-- banner -->x", want: "<div>sale</div>\n  x"},
+		{name: "three in a row", rules: []*Replacement{banner}, body: "<!-- banner --> <!-- banner --> <!-- banner -->", want: "<div>sale</div>  "},
+		{name: "text between", rules: []*Replacement{banner}, body: "<!-- banner -->x<!-- banner -->", want: "<div>sale</div>x<div>sale</div>"},
+		{name: "different insertions", rules: []*Replacement{{SearchRegexp: `<(\d)>`, Replaces: []string{"[$1]"}}}, body: "<1><2><2>", want: "[1][2]"},
+		{name: "unchanged matches aren't insertions", rules: []*Replacement{{SearchRegexp: `\|`, Replaces: []string{"$0"}}}, body: "a||b", want: "a||b"},
+		{name: "nested insertion", rules: []*Replacement{banner, {Search: "sale", Replaces: []string{"SALE"}}}, body: "<!-- banner --> <!-- banner -->", want: "<div>SALE</div> "},
+		{name: "no insertions", rules: []*Replacement{banner}, body: "plain text", want: "plain text"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []struct {
+				name   string
+				stream bool
+				chunk  int
+			}{{"buffer", false, len(tt.body)}, {"stream", true, len(tt.body)}, {"stream bytewise", true, 1}} {
+				h := provision(t, &Handler{Dedupe: true, Stream: mode.stream, Replacements: tt.rules})
+				if got := replaced(t, h, splitEvery(tt.body, mode.chunk)...); got != tt.want {
+					t.Errorf("%s: got %q, want %q", mode.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDedupeOff(t *testing.T) {
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "x", Replaces: []string{"y"}}}})
+	if got := replaced(t, h, "xx"); got != "yy" {
+		t.Errorf("got %q, want %q", got, "yy")
+	}
+}
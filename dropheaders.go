@@ -0,0 +1,39 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// checkDropHeaders returns an error if one of the names is invalid.
+func checkDropHeaders(names []string) error {
+	for i, name := range names {
+		if name == "" || strings.ContainsAny(name, " \t\r\n:") {
+			return fmt.Errorf("drop_headers[%d]: invalid header name %q", i, name)
+		}
+	}
+	return nil
+}
+
+// dropHeaders removes the DropHeaders from the header of a response
+// whose body was modified.
+func (h *Handler) dropHeaders(header http.Header) {
+	for _, name := range h.DropHeaders {
+		header.Del(name)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"io"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestDropHeaders(t *testing.T) {
+	digestUpstream := func(contentType, body string) caddyhttp.Handler {
+		return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Type", contentType)
+			w.Header().Set("X-Content-Digest", "sha-256=abc")
+			w.Header().Set("Integrity", "sha384-def")
+			w.Header().Set("X-Keep", "1")
+			_, err := io.WriteString(w, body)
+			return err
+		})
+	}
+	for _, tt := range []struct {
+		name        string
+		h           *Handler
+		contentType string
+		body        string
+		dropped     bool
+	}{
+		{name: "buffered and changed", h: &Handler{}, body: "a foo", dropped: true},
+		{name: "buffered and unchanged", h: &Handler{}, body: "no match"},
+		{name: "replaced by the same", h: &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"foo"}}}}, body: "a foo"},
+		{name: "streamed", h: &Handler{Stream: true}, body: "a foo", dropped: true},
+		{name: "streamed without a match", h: &Handler{Stream: true}, body: "no match", dropped: true},
+		{name: "spilled", h: &Handler{SpillToDisk: true, SpillThreshold: 10}, body: strings.Repeat("foo ", 10), dropped: true},
+		{name: "not replaced", h: &Handler{}, contentType: "image/png", body: "a foo"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.h.DropHeaders = []string{"x-content-digest", "Integrity"}
+			if tt.h.Replacements == nil {
+				tt.h.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}
+			}
+			if tt.h.SpillToDisk {
+				tt.h.TempDir = t.TempDir()
+			}
+			if tt.contentType == "" {
+				tt.contentType = "text/plain"
+			}
+			h := provision(t, tt.h)
+			w := serve(t, h, newRequest("GET", "/", nil), digestUpstream(tt.contentType, tt.body))
+			var got []string
+			for _, name := range []string{"X-Content-Digest", "Integrity", "X-Keep"} {
+				if w.Header().Get(name) != "" {
+					got = append(got, name)
+				}
+			}
+			want := []string{"X-Content-Digest", "Integrity", "X-Keep"}
+			if tt.dropped {
+				want = []string{"X-Keep"}
+			}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("headers %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestDropHeadersInvalid(t *testing.T) {
+	for _, name := range []string{"", "X Digest", "X-Digest:", "X-Digest\r\n"} {
+		if err := provisionErr(&Handler{DropHeaders: []string{name}, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}}); err == nil {
+			t.Errorf("%q: no error", name)
+		}
+	}
+}
+
+func TestCaddyfileDropHeaders(t *testing.T) {
+	h, err := parse("replace {\n\tdrop_headers X-Content-Digest Integrity\n\tdrop_headers Digest\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"X-Content-Digest", "Integrity", "Digest"}; !reflect.DeepEqual(h.DropHeaders, want) {
+		t.Errorf("drop_headers %q, want %q", h.DropHeaders, want)
+	}
+	if _, err := parse("replace {\n\tdrop_headers\n}"); err == nil {
+		t.Error("drop_headers without names: no error")
+	}
+}
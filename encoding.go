@@ -0,0 +1,184 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// contentEncodings returns the content codings applied to a response
+// with the given headers, in the order they were applied. It returns
+// false if the list is malformed or contains a coding that can't be
+// decoded, such as br, for which there is no decoder.
+func contentEncodings(header http.Header) ([]string, bool) {
+	var encodings []string
+	for _, value := range header.Values("Content-Encoding") {
+		for _, token := range strings.Split(value, ",") {
+			encoding := strings.ToLower(strings.TrimSpace(token))
+			switch encoding {
+			case "identity":
+			case "gzip", "x-gzip", "deflate", "zstd":
+				encodings = append(encodings, encoding)
+			default:
+				return nil, false
+			}
+		}
+	}
+	return encodings, true
+}
+
+// decodeBody removes the content codings in encodings from body,
+// undoing the last one applied first.
+func decodeBody(body []byte, encodings []string) ([]byte, error) {
+	for i := len(encodings) - 1; i >= 0; i-- {
+		r, err := newDecoder(bytes.NewReader(body), encodings[i])
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", encodings[i], err)
+		}
+		decoded, err := io.ReadAll(r)
+		r.Close()
+		if err != nil {
+			return nil, fmt.Errorf("decoding %s: %v", encodings[i], err)
+		}
+		body = decoded
+	}
+	return body, nil
+}
+
+// encodeBody applies the content codings in encodings to body, in order.
+func encodeBody(body []byte, encodings []string) ([]byte, error) {
+	for _, encoding := range encodings {
+		var buf bytes.Buffer
+		w, err := newEncoder(&buf, encoding)
+		if err != nil {
+			return nil, fmt.Errorf("encoding %s: %v", encoding, err)
+		}
+		if _, err := w.Write(body); err != nil {
+			return nil, fmt.Errorf("encoding %s: %v", encoding, err)
+		}
+		if err := w.Close(); err != nil {
+			return nil, fmt.Errorf("encoding %s: %v", encoding, err)
+		}
+		body = buf.Bytes()
+	}
+	return body, nil
+}
+
+// preferredEncodings are the content codings we can produce, most
+// preferred first. There is no brotli encoder in the standard library
+// or klauspost/compress, so br is not among them.
+var preferredEncodings = []string{"zstd", "gzip", "deflate"}
+
+// chooseEncoding returns the content coding to use for a client that
+// sent the given Accept-Encoding header: the supported coding with the
+// highest q-value, with ties broken by preferredEncodings. It returns
+// the empty string if the client accepts none of them, in which case
+// the response should not be encoded. It reports false if the client
+// refuses unencoded responses too, with "identity;q=0" or "*;q=0", in
+// which case the upstream's codings should be kept. br is never
+// chosen, since it can't be produced.
+func chooseEncoding(acceptEncoding string) (string, bool) {
+	weights := make(map[string]float64)
+	wildcard := -1.0
+	for _, token := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(token), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+		if name == "*" {
+			wildcard = q
+		} else {
+			weights[name] = q
+		}
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range preferredEncodings {
+		q, ok := weights[encoding]
+		if !ok {
+			q = wildcard
+		}
+		if q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	if best != "" {
+		return best, true
+	}
+	identity, ok := weights["identity"]
+	if !ok {
+		identity = wildcard
+	}
+	return "", identity != 0
+}
+
+// addVary adds field to the Vary header if it isn't listed already.
+func addVary(header http.Header, field string) {
+	for _, value := range header.Values("Vary") {
+		for _, token := range strings.Split(value, ",") {
+			token = strings.TrimSpace(token)
+			if token == "*" || strings.EqualFold(token, field) {
+				return
+			}
+		}
+	}
+	header.Add("Vary", field)
+}
+
+func newDecoder(r io.Reader, encoding string) (io.ReadCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		return zlib.NewReader(r)
+	case "zstd":
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	}
+	return nil, fmt.Errorf("unsupported encoding")
+}
+
+func newEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		return gzip.NewWriter(w), nil
+	case "deflate":
+		return zlib.NewWriter(w), nil
+	case "zstd":
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("unsupported encoding")
+}
@@ -0,0 +1,152 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestChooseEncoding(t *testing.T) {
+	for _, tt := range []struct {
+		accept string
+		want   string
+		ok     bool
+	}{
+		{accept: "", want: "", ok: true},
+		{accept: "gzip", want: "gzip", ok: true},
+		{accept: "gzip, zstd", want: "zstd", ok: true},
+		{accept: "gzip;q=1, zstd;q=0.5", want: "gzip", ok: true},
+		{accept: "*", want: "zstd", ok: true},
+		{accept: "*, zstd;q=0", want: "gzip", ok: true},
+		{accept: "br", want: "", ok: true},
+		{accept: "br, identity;q=0", want: "", ok: false},
+		{accept: "br, *;q=0", want: "", ok: false},
+		{accept: "br, identity, *;q=0", want: "", ok: true},
+		{accept: "br, identity;q=0, gzip;q=0.1", want: "gzip", ok: true},
+	} {
+		got, ok := chooseEncoding(tt.accept)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("%q: got %q, %v, want %q, %v", tt.accept, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// encodedUpstream responds with body encoded with encodings.
+func encodedUpstream(t *testing.T, body string, encodings ...string) caddyhttp.Handler {
+	encoded, err := encodeBody([]byte(body), encodings)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/plain")
+		for _, encoding := range encodings {
+			w.Header().Add("Content-Encoding", encoding)
+		}
+		_, err := w.Write(encoded)
+		return err
+	})
+}
+
+func TestReencodeForClient(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		accept string
+		stream bool
+		spill  bool
+		want   string
+	}{
+		{name: "preferred", accept: "zstd", want: "zstd"},
+		{name: "unencoded", accept: "br", want: ""},
+		{name: "identity refused", accept: "br, identity;q=0", want: "gzip"},
+		{name: "identity refused streamed", accept: "br, identity;q=0", stream: true, want: "gzip"},
+		{name: "preferred streamed", accept: "deflate", stream: true, want: "deflate"},
+		{name: "identity refused spilled", accept: "br, identity;q=0", spill: true, want: "gzip"},
+		{name: "unencoded spilled", accept: "br", spill: true, want: ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{Decompress: true, ReencodeForClient: true, Stream: tt.stream, SpillToDisk: tt.spill, SpillThreshold: 1, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+			r := newRequest("GET", "/", nil)
+			r.Header.Set("Accept-Encoding", tt.accept)
+			w := serve(t, h, r, encodedUpstream(t, "a foo", "gzip"))
+			if got := w.Header().Get("Content-Encoding"); got != tt.want {
+				t.Fatalf("Content-Encoding %q, want %q", got, tt.want)
+			}
+			var encodings []string
+			if tt.want != "" {
+				encodings = []string{tt.want}
+			}
+			body, err := decodeBody(w.Body.Bytes(), encodings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != "a bar" {
+				t.Errorf("body %q, want %q", body, "a bar")
+			}
+			if w.Header().Get("Vary") != "Accept-Encoding" {
+				t.Errorf("Vary %q", w.Header().Get("Vary"))
+			}
+		})
+	}
+}
+
+func TestDecompressStacked(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		encodings []string
+		want      string
+	}{
+		{name: "single", encodings: []string{"gzip"}, want: "a bar"},
+		{name: "two layers", encodings: []string{"gzip", "zstd"}, want: "a bar"},
+		{name: "three layers", encodings: []string{"deflate", "gzip", "zstd"}, want: "a bar"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{Decompress: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+			w := serve(t, h, newRequest("GET", "/", nil), encodedUpstream(t, "a foo", tt.encodings...))
+			got, ok := contentEncodings(w.Header())
+			if !ok || len(got) != len(tt.encodings) {
+				t.Fatalf("Content-Encoding %q", w.Header().Values("Content-Encoding"))
+			}
+			for i := range got {
+				if got[i] != tt.encodings[i] {
+					t.Fatalf("Content-Encoding %q, want %q", got, tt.encodings)
+				}
+			}
+			body, err := decodeBody(w.Body.Bytes(), tt.encodings)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(body) != tt.want {
+				t.Errorf("body %q, want %q", body, tt.want)
+			}
+		})
+	}
+}
+
+func TestDecompressUnsupported(t *testing.T) {
+	h := provision(t, &Handler{Decompress: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+	upstream := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", "gzip, br")
+		_, err := w.Write([]byte("foo"))
+		return err
+	})
+	w := serve(t, h, newRequest("GET", "/", nil), upstream)
+	if w.Body.String() != "foo" || w.Header().Get("Content-Encoding") != "gzip, br" {
+		t.Errorf("got %q with Content-Encoding %q, want it passed through", w.Body.String(), w.Header().Get("Content-Encoding"))
+	}
+}
@@ -0,0 +1,175 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"html"
+
+	"golang.org/x/text/transform"
+)
+
+// rawTextElements are the HTML elements whose contents are not parsed
+// for tags or entities.
+var rawTextElements = []string{"script", "style"}
+
+// replaceHTMLText performs the replacements of tr on an HTML body,
+// with the entities in its text nodes decoded, so that plain patterns
+// match text like "Tom &amp; Jerry". Markup (tags with their attribute
+// values, comments and the like) and the contents of raw text elements
+// are replaced as they are. Every text node and piece of markup is
+// replaced separately, so matches can't span them. A text node that
+// is changed is encoded again, escaping only &, < and >; others are
+// kept byte for byte.
+func replaceHTMLText(tr transform.Transformer, body []byte) ([]byte, error) {
+	out := make([]byte, 0, len(body))
+	var err error
+	for len(body) > 0 {
+		n, text := htmlSegment(body)
+		segment := body[:n]
+		body = body[n:]
+
+		if !text || bytes.IndexByte(segment, '&') < 0 {
+			out, err = transformAppend(tr, out, segment)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		decoded := []byte(html.UnescapeString(string(segment)))
+		var replaced []byte
+		replaced, err = transformAppend(tr, nil, decoded)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.Equal(replaced, decoded) {
+			out = append(out, segment...)
+		} else {
+			out = appendEscapedText(out, replaced)
+		}
+	}
+	return out, nil
+}
+
+// htmlSegment returns the length of the text node or piece of markup
+// at the start of body, and whether it is a text node.
+func htmlSegment(body []byte) (n int, text bool) {
+	if body[0] != '<' || len(body) < 2 || !isMarkupStart(body[1]) {
+		// text runs until the next tag
+		i := 1
+		for i < len(body) && !(body[i] == '<' && i+1 < len(body) && isMarkupStart(body[i+1])) {
+			i++
+		}
+		return i, true
+	}
+
+	if bytes.HasPrefix(body, []byte("<!--")) {
+		end := bytes.Index(body[4:], []byte("-->"))
+		if end < 0 {
+			return len(body), false
+		}
+		return 4 + end + 3, false
+	}
+
+	// a tag ends at the first > outside of a quoted attribute value
+	var quote byte
+	i := 1
+	for ; i < len(body); i++ {
+		c := body[i]
+		if quote != 0 {
+			if c == quote {
+				quote = 0
+			}
+		} else if c == '"' || c == '\'' {
+			quote = c
+		} else if c == '>' {
+			i++
+			break
+		}
+	}
+
+	// the contents of raw text elements belong to their tag
+	for _, name := range rawTextElements {
+		if len(body) > len(name)+1 && bytes.EqualFold(body[1:1+len(name)], []byte(name)) && isTagNameEnd(body[1+len(name)]) {
+			closing := []byte("</" + name)
+			end := indexFold(body[i:], closing)
+			if end < 0 {
+				return len(body), false
+			}
+			return i + end, false
+		}
+	}
+	return i, false
+}
+
+// isMarkupStart reports whether c, following a '<', starts markup
+// rather than being text.
+func isMarkupStart(c byte) bool {
+	return c == '/' || c == '!' || c == '?' || ('a' <= c && c <= 'z') || ('A' <= c && c <= 'Z')
+}
+
+// indexFold is like bytes.Index, but ignores ASCII case.
+func indexFold(s, sep []byte) int {
+	for i := 0; i+len(sep) <= len(s); i++ {
+		if bytes.EqualFold(s[i:i+len(sep)], sep) {
+			return i
+		}
+	}
+	return -1
+}
+
+// appendEscapedText appends text to out, escaping &, < and >.
+func appendEscapedText(out, text []byte) []byte {
+	for _, c := range text {
+		switch c {
+		case '&':
+			out = append(out, "&amp;"...)
+		case '<':
+			out = append(out, "&lt;"...)
+		case '>':
+			out = append(out, "&gt;"...)
+		default:
+			out = append(out, c)
+		}
+	}
+	return out
+}
+
+// transformAppend appends the result of transforming src as a whole
+// to out. Unlike transform.Append, it doesn't reset tr first, so the
+// state of a response, such as how many matches were replaced, is
+// kept across calls.
+func transformAppend(tr transform.Transformer, out, src []byte) ([]byte, error) {
+	if cap(out)-len(out) < len(src) {
+		out = grow(out, len(src))
+	}
+	for {
+		nDst, nSrc, err := tr.Transform(out[len(out):cap(out)], src, true)
+		out = out[:len(out)+nDst]
+		src = src[nSrc:]
+		if err != transform.ErrShortDst {
+			return out, err
+		}
+		out = grow(out, len(src))
+	}
+}
+
+// grow returns out with room for at least n more bytes, and then some.
+func grow(out []byte, n int) []byte {
+	grown := make([]byte, len(out), 2*cap(out)+n+64)
+	copy(grown, out)
+	return grown
+}
@@ -0,0 +1,50 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import "testing"
+
+func TestDecodeEntities(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		search      string
+		replace     string
+		body        string
+		want        string
+	}{
+		{name: "named entity", search: "Tom & Jerry", replace: "Tom and Jerry", body: "<p>Tom &amp; Jerry</p>", want: "<p>Tom and Jerry</p>"},
+		{name: "numeric entities", search: "it's", replace: "it is", body: "<p>it&#39;s &#x27;here&#x27;</p>", want: "<p>it is 'here'</p>"},
+		{name: "inserted text is encoded", search: "A", replace: "<b> & </b>", body: "<p>&quot;A&quot;</p>", want: "<p>\"&lt;b&gt; &amp; &lt;/b&gt;\"</p>"},
+		{name: "unchanged text kept byte for byte", search: "zzz", replace: "y", body: "<p>&quot;a&quot; &amp;</p>", want: "<p>&quot;a&quot; &amp;</p>"},
+		{name: "attribute values unchanged", search: "a & b", replace: "c", body: `<a title="a &amp; b">a &amp; b</a>`, want: `<a title="a &amp; b">c</a>`},
+		{name: "attribute values replaced as they are", search: "a &amp; b", replace: "c", body: `<a title="a &amp; b">a &amp; b</a>`, want: `<a title="c">a &amp; b</a>`},
+		{name: "script", search: "a & b", replace: "c", body: "<script>x = 'a &amp; b'</script>", want: "<script>x = 'a &amp; b'</script>"},
+		{name: "comment", search: "a & b", replace: "c", body: "<!-- a &amp; b -->a &amp; b", want: "<!-- a &amp; b -->c"},
+		{name: "matches don't span tags", search: "a & b", replace: "c", body: "a &amp;<i> b</i>", want: "a &amp;<i> b</i>"},
+		{name: "not HTML", contentType: "text/plain", search: "a & b", replace: "c", body: "a &amp; b", want: "a &amp; b"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = "text/html"
+			}
+			h := provision(t, &Handler{DecodeEntities: true, Replacements: []*Replacement{{Search: tt.search, Replaces: []string{tt.replace}}}})
+			if got := serve(t, h, newRequest("GET", "/", nil), upstream(contentType, tt.body)).Body.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
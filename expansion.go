@@ -0,0 +1,57 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// The values of ExpansionPolicy.
+const (
+	expansionError       = "error"
+	expansionPassthrough = "passthrough"
+)
+
+// checkExpansion compares the size of the replaced body for the
+// response to r with the size of the body before replacements. If
+// the body grew by more than MaxExpansionRatio, it returns an error,
+// or, with the passthrough policy, reports false so that the original
+// body is sent instead. An empty body counts as one byte.
+func (h *Handler) checkExpansion(r *http.Request, before, after int) (bool, error) {
+	if h.MaxExpansionRatio == 0 {
+		return true, nil
+	}
+	in := before
+	if in == 0 {
+		in = 1
+	}
+	ratio := float64(after) / float64(in)
+	if ratio <= h.MaxExpansionRatio {
+		return true, nil
+	}
+	if h.ExpansionPolicy == expansionPassthrough {
+		h.logDecision(r, "skipping replacements that expanded the body too much",
+			zap.Int("size", before),
+			zap.Int("replaced_size", after),
+			zap.Float64("ratio", ratio))
+		return false, nil
+	}
+	return false, caddyhttp.Error(http.StatusInternalServerError,
+		fmt.Errorf("replacements expanded the body from %d to %d bytes, more than max_expansion_ratio %g", before, after, h.MaxExpansionRatio))
+}
@@ -0,0 +1,117 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestMaxExpansionRatio(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		ratio   float64
+		policy  string
+		replace string
+		want    string
+		err     bool
+	}{
+		{name: "runaway", ratio: 10, replace: strings.Repeat("x", 1000), err: true},
+		{name: "runaway with error policy", ratio: 10, policy: expansionError, replace: strings.Repeat("x", 1000), err: true},
+		{name: "runaway passed through", ratio: 10, policy: expansionPassthrough, replace: strings.Repeat("x", 1000), want: "a foo b"},
+		{name: "within the ratio", ratio: 10, replace: "bar", want: "a bar b"},
+		{name: "exactly the ratio", ratio: 2, replace: "foo" + strings.Repeat("y", 7), want: "a foo" + strings.Repeat("y", 7) + " b"},
+		{name: "just over the ratio", ratio: 2, replace: "foo" + strings.Repeat("y", 8), err: true},
+		{name: "shrinking", ratio: 1, replace: "", want: "a  b"},
+		{name: "unlimited", replace: strings.Repeat("x", 1000), want: "a " + strings.Repeat("x", 1000) + " b"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{MaxExpansionRatio: tt.ratio, ExpansionPolicy: tt.policy, Replacements: []*Replacement{{Search: "foo", Replaces: []string{tt.replace}}}})
+			w := httptest.NewRecorder()
+			err := h.ServeHTTP(w, newRequest("GET", "/", nil), upstream("text/plain", "a foo b"))
+			if tt.err {
+				if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusInternalServerError {
+					t.Fatalf("error %v, want a 500 handler error", err)
+				}
+				if w.Body.Len() != 0 {
+					t.Errorf("body %q sent", w.Body.String())
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if w.Body.String() != tt.want {
+				t.Errorf("body %q, want %q", w.Body.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxExpansionRatioDecompressed(t *testing.T) {
+	// the decoded sizes are compared, not the encoded ones, which
+	// barely grow for a body this repetitive
+	h := provision(t, &Handler{Decompress: true, MaxExpansionRatio: 2, Replacements: []*Replacement{{Search: "foo", Replaces: []string{strings.Repeat("foo", 10)}}}})
+	err := h.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "/", nil), encodedUpstream(t, strings.Repeat("foo ", 1000), "gzip"))
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("error %v, want a 500 handler error", err)
+	}
+}
+
+func TestMaxExpansionRatioInvalid(t *testing.T) {
+	for _, h := range []*Handler{
+		{MaxExpansionRatio: -1},
+		{MaxExpansionRatio: 2, Stream: true},
+		{MaxExpansionRatio: 2, ExpansionPolicy: "truncate"},
+	} {
+		h.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}
+		if err := provisionErr(h); err == nil {
+			t.Errorf("max_expansion_ratio %g, stream %v, expansion_policy %q: no error", h.MaxExpansionRatio, h.Stream, h.ExpansionPolicy)
+		}
+	}
+}
+
+func TestCaddyfileMaxExpansionRatio(t *testing.T) {
+	for _, tt := range []struct {
+		input  string
+		ratio  float64
+		policy string
+	}{
+		{input: "replace {\n\tmax_expansion_ratio 2.5\n}", ratio: 2.5},
+		{input: "replace {\n\tmax_expansion_ratio 10 passthrough\n}", ratio: 10, policy: expansionPassthrough},
+	} {
+		h, err := parse(tt.input)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.input, err)
+		}
+		if h.MaxExpansionRatio != tt.ratio || h.ExpansionPolicy != tt.policy {
+			t.Errorf("%q: max_expansion_ratio %g %q, want %g %q", tt.input, h.MaxExpansionRatio, h.ExpansionPolicy, tt.ratio, tt.policy)
+		}
+	}
+	for _, input := range []string{
+		"replace {\n\tmax_expansion_ratio\n}",
+		"replace {\n\tmax_expansion_ratio x\n}",
+		"replace {\n\tmax_expansion_ratio 2 error extra\n}",
+		"replace {\n\tmax_expansion_ratio 2\n\tmax_expansion_ratio 3\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
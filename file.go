@@ -0,0 +1,104 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// fileCache holds the contents of replacement files, which are read
+// again only when their modification time or size changes.
+type fileCache struct {
+	mu      sync.Mutex
+	entries map[string]fileEntry
+}
+
+type fileEntry struct {
+	modTime  time.Time
+	size     int64
+	contents []byte
+}
+
+// read returns the current contents of the file at name.
+func (c *fileCache) read(name string) ([]byte, error) {
+	info, err := os.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return nil, fmt.Errorf("%s is a directory", name)
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if entry, ok := c.entries[name]; ok && entry.modTime.Equal(info.ModTime()) && entry.size == info.Size() {
+		return entry.contents, nil
+	}
+	contents, err := os.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]fileEntry)
+	}
+	c.entries[name] = fileEntry{modTime: info.ModTime(), size: info.Size(), contents: contents}
+	return contents, nil
+}
+
+// replaceFilePath returns the path of the replacement file of repl
+// for the request with the given replacer. Placeholder values can't
+// contain path separators or be dot segments, so they can't be used
+// to reach other directories.
+func (repl *Replacement) replaceFilePath(r *caddy.Replacer) (string, error) {
+	return r.ReplaceFunc(repl.ReplaceFile, func(key string, val any) (any, error) {
+		s := caddy.ToString(val)
+		if strings.ContainsAny(s, `/\`) || s == "." || s == ".." {
+			return nil, fmt.Errorf("placeholder %s has unsafe value %q for a file path", key, s)
+		}
+		return s, nil
+	})
+}
+
+// fileReplacement returns the contents of the replacement file of the
+// i-th rule, which are read at most once per response, or nil and
+// false if the file can't be read.
+func (h *Handler) fileReplacement(rt *replacer, i int) ([]byte, bool) {
+	if contents, ok := rt.files[i]; ok {
+		return contents, contents != nil
+	}
+	repl := h.rules[i]
+	name, err := repl.replaceFilePath(rt.repl)
+	if err == nil {
+		var contents []byte
+		contents, err = repl.files.read(name)
+		if err == nil {
+			rt.files[i] = contents
+			return contents, true
+		}
+	}
+	h.logger.Warn("reading replacement file failed, leaving matches unchanged",
+		zap.Int("replacement", repl.index),
+		zap.String("replace_file", repl.ReplaceFile),
+		zap.Error(err))
+	rt.files[i] = nil
+	return nil, false
+}
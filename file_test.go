@@ -0,0 +1,93 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestReplaceFile(t *testing.T) {
+	dir := t.TempDir()
+	banner := filepath.Join(dir, "banner.html")
+	write := func(contents string, modTime time.Time) {
+		t.Helper()
+		if err := os.WriteFile(banner, []byte(contents), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(banner, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+	}
+	now := time.Now()
+	write("<p>maintenance</p>", now)
+
+	for _, stream := range []bool{false, true} {
+		h := provision(t, &Handler{Stream: stream, Replacements: []*Replacement{{Search: "<!-- banner -->", ReplaceFile: banner}}})
+		if got := replaced(t, h, "a<!-- banner -->b<!-- banner -->"); got != "a<p>maintenance</p>b<p>maintenance</p>" {
+			t.Errorf("stream %v: got %q", stream, got)
+		}
+	}
+
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "<!-- banner -->", ReplaceFile: banner}}})
+	replaced(t, h, "<!-- banner -->")
+	// edits show up in the next response, even if the size stays
+	// the same
+	write("<p>back soon!</p>", now.Add(time.Second))
+	if got := replaced(t, h, "<!-- banner -->"); got != "<p>back soon!</p>" {
+		t.Errorf("after an edit: got %q", got)
+	}
+	write("<p>all good...</p>", now.Add(2*time.Second))
+	if got := replaced(t, h, "<!-- banner -->"); got != "<p>all good...</p>" {
+		t.Errorf("after an edit of the same size: got %q", got)
+	}
+}
+
+func TestReplaceFileUnreadable(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "en.html"), []byte("hello"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		lang string
+		want string
+	}{
+		{name: "placeholder", lang: "en", want: "hello"},
+		{name: "missing file", lang: "fr", want: "<!-- banner -->"},
+		{name: "path separator", lang: "../en", want: "<!-- banner -->"},
+		{name: "dot dot", lang: "..", want: "<!-- banner -->"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{Replacements: []*Replacement{{Search: "<!-- banner -->", ReplaceFile: filepath.Join(dir, "{lang}.html")}}})
+			core, logs := observer.New(zapcore.WarnLevel)
+			h.logger = zap.New(core)
+			r := newRequest("GET", "/", nil)
+			replacerOf(r).Set("lang", tt.lang)
+			if got := serve(t, h, r, upstream("text/plain", "<!-- banner -->")).Body.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if warned := logs.FilterMessage("reading replacement file failed, leaving matches unchanged").Len() == 1; warned != (tt.want != "hello") {
+				t.Errorf("warned %v", warned)
+			}
+		})
+	}
+}
@@ -0,0 +1,99 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+
+	"go.uber.org/zap"
+)
+
+// matched reports whether any rule has replaced a match in the body
+// being replaced by rt.
+func (rt *replacer) matched() bool {
+	for _, n := range rt.counts {
+		if n > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// headBuffer holds back the replaced output of a streamed response,
+// and its status and headers, until a rule has replaced a match, for
+// BufferUntilFirstMatch. The head of the body is then sent, and the
+// rest of it is streamed as it arrives. Since the same transformer
+// replaces the whole body, matches that span the point at which the
+// head is sent are found as usual. If the body ends without a match,
+// it is sent as a whole, with a correct Content-Length.
+type headBuffer struct {
+	fw     *replaceWriter
+	status int
+
+	// whether the upstream declared a Content-Length
+	hadLength bool
+
+	buf  bytes.Buffer
+	sent bool
+}
+
+func (hb *headBuffer) Write(p []byte) (int, error) {
+	if hb.sent {
+		return hb.fw.ResponseWriterWrapper.Write(p)
+	}
+	hb.buf.Write(p)
+	if !hb.fw.tr.matched() {
+		return len(p), nil
+	}
+	hb.fw.handler.logDecision(hb.fw.req, "streaming rest of response after first match",
+		zap.Int("buffered", hb.buf.Len()))
+	if err := hb.send(); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// holding reports whether the head is still being held back.
+func (hb *headBuffer) holding() bool {
+	return hb != nil && !hb.sent
+}
+
+// end sends the body if no match was found in it, now that it is
+// complete.
+func (hb *headBuffer) end() error {
+	if hb.sent {
+		return nil
+	}
+	if hb.hadLength && hb.fw.req.Method != http.MethodHead {
+		hb.fw.Header().Set("Content-Length", strconv.Itoa(hb.buf.Len()))
+	}
+	return hb.send()
+}
+
+// send writes the status, the headers and the head of the body. As
+// in buffer mode, the headers that describe a modified body are only
+// changed if a match was replaced.
+func (hb *headBuffer) send() error {
+	hb.sent = true
+	if hb.fw.tr.matched() {
+		hb.fw.handler.dropHeaders(hb.fw.Header())
+		hb.fw.handler.addScriptHashes(hb.fw.Header(), hb.fw.tr)
+	}
+	hb.fw.ResponseWriterWrapper.WriteHeader(hb.status)
+	_, err := hb.buf.WriteTo(hb.fw.ResponseWriterWrapper)
+	return err
+}
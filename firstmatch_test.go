@@ -0,0 +1,212 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestBufferUntilFirstMatch(t *testing.T) {
+	tail := strings.Repeat("lorem ipsum ", 100000)
+	for _, tt := range []struct {
+		name   string
+		chunks []string
+		length bool
+		want   string
+		// the number of writes until the first match is complete,
+		// or 0 if the client gets the body all at the end
+		sentAfter  int
+		wantLength bool
+	}{
+		{
+			name:      "match near the start",
+			chunks:    append([]string{"<html><head>"}, splitEvery(tail+"</html>", 4096)...),
+			want:      "<html><head><script>x</script>" + tail + "</html>",
+			sentAfter: 1,
+		},
+		{
+			name:      "match across the first writes",
+			chunks:    append([]string{"<html><he", "ad>"}, splitEvery(tail, 4096)...),
+			want:      "<html><head><script>x</script>" + tail,
+			sentAfter: 2,
+		},
+		{
+			name:      "match with a declared length",
+			chunks:    append([]string{"<head>"}, splitEvery(tail, 4096)...),
+			length:    true,
+			want:      "<head><script>x</script>" + tail,
+			sentAfter: 1,
+		},
+		{
+			name:   "match at the end",
+			chunks: append(splitEvery(tail, 4096), "<head>"),
+			want:   tail + "<head><script>x</script>",
+		},
+		{
+			name:   "no match",
+			chunks: splitEvery(tail, 4096),
+			want:   tail,
+		},
+		{
+			name:       "no match with a declared length",
+			chunks:     splitEvery(tail, 4096),
+			length:     true,
+			want:       tail,
+			wantLength: true,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{Stream: true, BufferUntilFirstMatch: true, Replacements: []*Replacement{{Search: "<head>", Replaces: []string{"<head><script>x</script>"}}}})
+			w := httptest.NewRecorder()
+			// what the client has before each write
+			var sizes []int
+			next := caddyhttp.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) error {
+				rw.Header().Set("Content-Type", "text/html")
+				if tt.length {
+					rw.Header().Set("Content-Length", strconv.Itoa(len(strings.Join(tt.chunks, ""))))
+				}
+				for _, chunk := range tt.chunks {
+					sizes = append(sizes, w.Body.Len())
+					if _, err := io.WriteString(rw, chunk); err != nil {
+						return err
+					}
+					rw.(http.Flusher).Flush()
+				}
+				return nil
+			})
+			if err := h.ServeHTTP(w, newRequest("GET", "/", nil), next); err != nil {
+				t.Fatal(err)
+			}
+			if w.Body.String() != tt.want {
+				t.Errorf("body of %d bytes, want %d", w.Body.Len(), len(tt.want))
+			}
+			for i, size := range sizes {
+				if (tt.sentAfter == 0 || i < tt.sentAfter) && size > 0 {
+					t.Fatalf("client had %d bytes before write %d", size, i)
+				}
+			}
+			if tt.sentAfter > 0 {
+				// the replacements hold back no more than their
+				// window once the match is found
+				if size := sizes[tt.sentAfter+1]; size == 0 {
+					t.Errorf("client had nothing before write %d", tt.sentAfter+1)
+				}
+				// the first match is near the start, so most of
+				// the body is streamed
+				if size := sizes[len(sizes)-1]; size < len(tt.want)/2 {
+					t.Errorf("only %d of %d bytes streamed", size, len(tt.want))
+				}
+			}
+			got := w.Header().Get("Content-Length")
+			if tt.wantLength && got != strconv.Itoa(len(tt.want)) {
+				t.Errorf("Content-Length %q, want %d", got, len(tt.want))
+			}
+			if !tt.wantLength && got != "" {
+				t.Errorf("Content-Length %q sent for a streamed body", got)
+			}
+		})
+	}
+}
+
+func TestBufferUntilFirstMatchFlush(t *testing.T) {
+	// flushes from the upstream are held back with the body
+	h := provision(t, &Handler{Stream: true, BufferUntilFirstMatch: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+	w := newFlushRecorder()
+	if err := h.ServeHTTP(w, newRequest("GET", "/", nil), upstream("text/plain", "a ", "b ", "foo ", "c")); err != nil {
+		t.Fatal(err)
+	}
+	if w.Body.String() != "a b bar c" {
+		t.Errorf("body %q, want %q", w.Body.String(), "a b bar c")
+	}
+	for _, flushed := range w.flushes() {
+		if !strings.HasPrefix(flushed, "a b bar") {
+			t.Errorf("flushed %q before the match", flushed)
+		}
+	}
+}
+
+func TestBufferUntilFirstMatchStreamStatus(t *testing.T) {
+	h := provision(t, &Handler{StreamStatusCodes: []int{200}, BufferUntilFirstMatch: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+	w := serve(t, h, newRequest("GET", "/", nil), statusUpstream(http.StatusOK, "no match"))
+	if got := w.Header().Get("Content-Length"); got != "8" {
+		t.Errorf("Content-Length %q, want 8", got)
+	}
+	if got := serve(t, h, newRequest("GET", "/", nil), statusUpstream(http.StatusOK, "a foo")).Body.String(); got != "a bar" {
+		t.Errorf("got %q, want %q", got, "a bar")
+	}
+}
+
+func TestBufferUntilFirstMatchHeaders(t *testing.T) {
+	// as in buffer mode, the headers of a body without a match are
+	// left alone
+	h := provision(t, &Handler{Stream: true, BufferUntilFirstMatch: true, DropHeaders: []string{"X-Content-Digest"}, CSPScriptHashes: true, Replacements: []*Replacement{{Search: "</body>", Replaces: []string{"<script>track()</script></body>"}}}})
+	for _, tt := range []struct {
+		body    string
+		matched bool
+	}{
+		{body: "<body><p>x</p>"},
+		{body: "<body><p>x</p></body>", matched: true},
+	} {
+		next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			w.Header().Set("Content-Type", "text/html")
+			w.Header().Set("Content-Security-Policy", "script-src 'self'")
+			w.Header().Set("X-Content-Digest", "sha-256=abc")
+			_, err := io.WriteString(w, tt.body)
+			return err
+		})
+		w := serve(t, h, newRequest("GET", "/", nil), next)
+		digest, policy := "sha-256=abc", "script-src 'self'"
+		if tt.matched {
+			digest, policy = "", policy+" "+scriptHash("track()")
+		}
+		if got := w.Header().Get("X-Content-Digest"); got != digest {
+			t.Errorf("matched %v: X-Content-Digest %q, want %q", tt.matched, got, digest)
+		}
+		if got := w.Header().Get("Content-Security-Policy"); got != policy {
+			t.Errorf("matched %v: Content-Security-Policy %q, want %q", tt.matched, got, policy)
+		}
+	}
+}
+
+func TestBufferUntilFirstMatchInvalid(t *testing.T) {
+	if err := provisionErr(&Handler{BufferUntilFirstMatch: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}}); err == nil {
+		t.Error("buffer mode: no error")
+	}
+}
+
+func TestCaddyfileBufferUntilFirstMatch(t *testing.T) {
+	h, err := parse("replace {\n\tstream\n\tbuffer_until_first_match\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.BufferUntilFirstMatch {
+		t.Error("buffer_until_first_match not set")
+	}
+	for _, input := range []string{
+		"replace {\n\tbuffer_until_first_match yes\n}",
+		"replace {\n\tbuffer_until_first_match\n\tbuffer_until_first_match\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// flagsCheckInterval is how often the flags file is checked for
+// changes, at most.
+const flagsCheckInterval = time.Second
+
+// flagSet holds the feature flags of a FlagsFile, which is read again
+// when its modification time or size changes.
+type flagSet struct {
+	path   string
+	logger *zap.Logger
+
+	mu      sync.Mutex
+	checked time.Time
+	modTime time.Time
+	size    int64
+	// replaced as a whole when the file changes, so it can be
+	// shared with responses without copying
+	values map[string]bool
+}
+
+// loadFlags reads the flags file at path.
+func loadFlags(path string, logger *zap.Logger) (*flagSet, error) {
+	f := &flagSet{path: path, logger: logger, checked: time.Now()}
+	if err := f.reload(); err != nil {
+		return nil, fmt.Errorf("flags_file: %v", err)
+	}
+	return f, nil
+}
+
+// reload reads the file again if it changed since it was last read.
+// A JSON object whose values are booleans is expected.
+func (f *flagSet) reload() error {
+	info, err := os.Stat(f.path)
+	if err != nil {
+		return err
+	}
+	if f.values != nil && info.ModTime().Equal(f.modTime) && info.Size() == f.size {
+		return nil
+	}
+	contents, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	var values map[string]bool
+	if err := json.Unmarshal(contents, &values); err != nil {
+		return fmt.Errorf("parsing %s: %v", f.path, err)
+	}
+	if values == nil {
+		values = make(map[string]bool)
+	}
+	f.values, f.modTime, f.size = values, info.ModTime(), info.Size()
+	return nil
+}
+
+// current returns the flags, checking the file for changes if it
+// wasn't checked within flagsCheckInterval. If the file can't be read
+// or parsed, the flags it last had are kept.
+func (f *flagSet) current() map[string]bool {
+	if f == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if now := time.Now(); now.Sub(f.checked) >= flagsCheckInterval {
+		f.checked = now
+		if err := f.reload(); err != nil {
+			f.logger.Warn("reading flags file failed, keeping the previous flags",
+				zap.String("file", f.path),
+				zap.Error(err))
+		}
+	}
+	return f.values
+}
+
+// flagged reports whether repl applies to the body being replaced by
+// rt, given its flag_key. The flags are taken once for each body, so a
+// flag that changes while a response streams doesn't change it
+// halfway.
+func (rt *replacer) flagged(repl *Replacement) bool {
+	return repl.FlagKey == "" || rt.flags[repl.FlagKey]
+}
@@ -0,0 +1,167 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// writeFlags writes contents to the flags file at path and makes sure
+// that h notices on its next response.
+func writeFlags(t *testing.T, h *Handler, path, contents string) {
+	t.Helper()
+	if err := os.WriteFile(path, []byte(contents), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	// a modification time the file can't have had before
+	modTime := time.Now().Add(time.Duration(len(contents)) * time.Hour)
+	if err := os.Chtimes(path, modTime, modTime); err != nil {
+		t.Fatal(err)
+	}
+	if h != nil {
+		h.flags.checked = time.Time{}
+	}
+}
+
+func TestFlagKey(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		stream   bool
+		conflict string
+	}{{"buffer", false, ""}, {"stream", true, ""}, {"longest match", false, conflictLongestMatchWins}} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "flags.json")
+			writeFlags(t, nil, path, `{"banner": false}`)
+			h := provision(t, &Handler{Stream: tt.stream, ConflictResolution: tt.conflict, FlagsFile: path, Replacements: []*Replacement{
+				{Search: "<!-- banner -->", Replaces: []string{"<div>new</div>"}, FlagKey: "banner"},
+				{Search: "foo", Replaces: []string{"bar"}},
+			}})
+			for _, step := range []struct {
+				flags string
+				want  string
+			}{
+				{"", "<!-- banner -->bar"},
+				{`{"banner": true}`, "<div>new</div>bar"},
+				{`{"banner": true, "other": false}`, "<div>new</div>bar"},
+				{`{"banner": false}`, "<!-- banner -->bar"},
+				{`{"other": true}`, "<!-- banner -->bar"},
+				{`{"banner": true}`, "<div>new</div>bar"},
+				{`{}`, "<!-- banner -->bar"},
+			} {
+				if step.flags != "" {
+					writeFlags(t, h, path, step.flags)
+				}
+				if got := replaced(t, h, "<!-- banner -->foo"); got != step.want {
+					t.Errorf("flags %s: got %q, want %q", step.flags, got, step.want)
+				}
+			}
+		})
+	}
+}
+
+func TestFlagsFileChecked(t *testing.T) {
+	// the file isn't checked again within flagsCheckInterval
+	path := filepath.Join(t.TempDir(), "flags.json")
+	writeFlags(t, nil, path, `{"banner": false}`)
+	h := provision(t, &Handler{FlagsFile: path, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}, FlagKey: "banner"}}})
+	h.flags.checked = time.Now()
+	if err := os.WriteFile(path, []byte(`{"banner": true}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if got := replaced(t, h, "foo"); got != "foo" {
+		t.Errorf("within the interval: got %q, want %q", got, "foo")
+	}
+	h.flags.checked = time.Now().Add(-flagsCheckInterval)
+	if got := replaced(t, h, "foo"); got != "bar" {
+		t.Errorf("after the interval: got %q, want %q", got, "bar")
+	}
+}
+
+func TestFlagsFileBroken(t *testing.T) {
+	// the previous flags are kept while the file can't be used
+	path := filepath.Join(t.TempDir(), "flags.json")
+	writeFlags(t, nil, path, `{"banner": true}`)
+	h := provision(t, &Handler{FlagsFile: path, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}, FlagKey: "banner"}}})
+	core, logs := observer.New(zapcore.DebugLevel)
+	h.flags.logger = zap.New(core)
+
+	writeFlags(t, h, path, `{"banner": tru`)
+	if got := replaced(t, h, "foo"); got != "bar" {
+		t.Errorf("invalid JSON: got %q, want %q", got, "bar")
+	}
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	h.flags.checked = time.Time{}
+	if got := replaced(t, h, "foo"); got != "bar" {
+		t.Errorf("missing file: got %q, want %q", got, "bar")
+	}
+	if n := logs.FilterMessage("reading flags file failed, keeping the previous flags").Len(); n != 2 {
+		t.Errorf("%d warnings, want 2", n)
+	}
+
+	writeFlags(t, h, path, `{"banner": false}`)
+	if got := replaced(t, h, "foo"); got != "foo" {
+		t.Errorf("fixed: got %q, want %q", got, "foo")
+	}
+}
+
+func TestFlagsFileInvalid(t *testing.T) {
+	dir := t.TempDir()
+	writeFlags(t, nil, filepath.Join(dir, "list.json"), `["banner"]`)
+	writeFlags(t, nil, filepath.Join(dir, "string.json"), `{"banner": "yes"}`)
+	for _, tt := range []struct {
+		name string
+		h    *Handler
+	}{
+		{"flag_key without flags_file", &Handler{Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}, FlagKey: "x"}}}},
+		{"missing file", &Handler{FlagsFile: filepath.Join(dir, "missing.json")}},
+		{"not an object", &Handler{FlagsFile: filepath.Join(dir, "list.json")}},
+		{"not a boolean", &Handler{FlagsFile: filepath.Join(dir, "string.json")}},
+	} {
+		if tt.h.Replacements == nil {
+			tt.h.Replacements = []*Replacement{{Search: "a", Replaces: []string{"b"}, FlagKey: "x"}}
+		}
+		if err := provisionErr(tt.h); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestCaddyfileFlagsFile(t *testing.T) {
+	h, err := parse("replace {\n\tflags_file /etc/caddy/flags.json\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.FlagsFile != "/etc/caddy/flags.json" {
+		t.Errorf("flags_file %q", h.FlagsFile)
+	}
+	for _, input := range []string{
+		"replace {\n\tflags_file\n}",
+		"replace {\n\tflags_file a b\n}",
+		"replace {\n\tflags_file a\n\tflags_file b\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
@@ -18,35 +18,72 @@ package replaceresponse
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand/v2"
 	"net/http"
+	"os"
+	"path"
 	"regexp"
+	"regexp/syntax"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"text/template"
 	"time"
 
 	"github.com/caddyserver/caddy/v2"
 	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
 	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/icholy/replace"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
 	"golang.org/x/text/transform"
 )
 
-var randReplace *rand.Rand
+var (
+	randReplace *rand.Rand
+	// guards randReplace, since the transformer pools of handlers
+	// build transformers concurrently
+	randMu sync.Mutex
+)
+
+// Generated from random.org, because why not
+const seed2 uint64 = 0x845a6f90b949a040
 
 func init() {
 	caddy.RegisterModule(Handler{})
-	// Generated from random.org, because why not
-	var seed2 uint64 = 0x845a6f90b949a040
-
 	// We probably lose a bit of entropy on the int64 -> uint64, but this shouldn't
 	// be used for cryptographically sensitive purposes anyway, for many reasons, so
 	// please don't.
 	randReplace = rand.New(rand.NewPCG(uint64(time.Now().UnixNano()), seed2))
 }
 
+// previewHeader is the response header that holds the start of the
+// replaced body if PreviewBytes is set.
+const previewHeader = "X-Replace-Preview"
+
+// maxPreviewBytes is the largest allowed PreviewBytes.
+const maxPreviewBytes = 1024
+
+// Response headers that hold the length of the body before and after
+// replacements if LengthHeaders is set.
+const (
+	originalLengthHeader = "X-Original-Length"
+	modifiedLengthHeader = "X-Modified-Length"
+)
+
+// originalBodyVar is the name of the request variable that holds the
+// original response body if ExposeOriginal is set.
+const originalBodyVar = "replace_response.original_body"
+
 // Handler manipulates response bodies by performing
 // substring or regex replacements.
 type Handler struct {
@@ -57,15 +94,557 @@ type Handler struct {
 	// This is more memory-efficient but can remove the
 	// Content-Length header since knowing the correct length
 	// is impossible without buffering, and getting it wrong
-	// can break HTTP/2 streams.
+	// can break HTTP/2 streams. When the upstream flushes, the
+	// replaced output is flushed to the client as well.
 	Stream bool `json:"stream,omitempty"`
 
+	// In buffer mode, responses with these statuses are streamed
+	// instead, as if Stream were set, while the others are still
+	// buffered. A code below 100 stands for a class of statuses,
+	// such as 2 for all 2xx responses. The choice is made when the
+	// status is written, so features that only work in buffer mode,
+	// such as required replacements and JSON pointers, do not apply
+	// to the streamed responses.
+	StreamStatusCodes []int `json:"stream_status_codes,omitempty"`
+
+	// In streaming mode, flush the response to the client at
+	// least this often while it is being written, so clients see
+	// progress on long-lived responses. Only output that has
+	// already passed through the replacements is flushed; bytes
+	// held back because they might be part of a match are not.
+	// Zero or negative disables periodic flushing.
+	FlushInterval caddy.Duration `json:"flush_interval,omitempty"`
+
+	// In streaming mode, the maximum number of body bytes to accept
+	// from upstream. As a safety valve against runaway upstreams,
+	// the body is truncated at this many bytes, and writing more
+	// fails with the error "max_stream_bytes exceeded", which
+	// usually makes the upstream stop. The limit applies to the
+	// body before replacements. Default: no limit.
+	MaxStreamBytes int64 `json:"max_stream_bytes,omitempty"`
+
+	// In streaming mode, the longest match that is found, at most
+	// 4000 bytes. A match is found no matter how many writes from
+	// upstream it is split across, since up to this many bytes are
+	// held back at the end of each write in case a match continues
+	// in the next one; a regexp match that is longer may be missed.
+	// Bodies spilled to disk and request bodies are replaced the
+	// same way. Each replacement of a streamed body holds up to
+	// this many bytes in memory, and a larger window delays the
+	// bytes it holds until more of the body arrives. It must be at
+	// least as long as the longest search, before placeholders are
+	// expanded. Default: 2048, or the length of the longest search
+	// if that is longer.
+	StreamWindow int `json:"stream_window,omitempty"`
+
+	// If true, a streamed response is held back until one of the
+	// replacements has replaced a match, so that its headers can be
+	// left alone if the body contains none: DropHeaders and
+	// CSPScriptHashes only apply once a match is replaced, as in
+	// buffer mode. The start of the body, up to the first match, is
+	// then sent and the rest of it is streamed. A response without matches is buffered as a whole
+	// and sent with a correct Content-Length. This bounds buffering
+	// to the head of documents whose replacements are near their
+	// start, such as an injection into <head>. Requires stream mode
+	// or stream_status_codes.
+	BufferUntilFirstMatch bool `json:"buffer_until_first_match,omitempty"`
+
+	// The initial capacity of the buffers that hold response
+	// bodies in buffer mode. Pre-sizing buffers for workloads
+	// dominated by large responses avoids repeatedly growing
+	// them. Default: 0, which lets buffers grow as needed.
+	BufferSize int `json:"buffer_size,omitempty"`
+
+	// The status code of the error returned when a required
+	// replacement made no replacements. Default: 500.
+	RequiredStatus int `json:"required_status,omitempty"`
+
+	// What to do in buffer mode when the body from upstream doesn't
+	// have the length its Content-Length header declares: "fix"
+	// (the default) replaces it anyway and sets Content-Length to
+	// the length of the result; "error" fails with 502 Bad Gateway,
+	// to surface the upstream bug; "trust-upstream" passes the
+	// response through without replacements and with the upstream's
+	// Content-Length, which may break the connection to the client.
+	ContentLengthMismatch string `json:"content_length_mismatch,omitempty"`
+
+	// If true, replacements are also performed on the values of
+	// response trailers, such as a gRPC-web status message. Each
+	// value is replaced separately. Buffer mode only; trailers of
+	// streamed responses are left alone.
+	Trailers bool `json:"trailers,omitempty"`
+
 	// Only run replacements on responses that match against this ResponseMmatcher.
 	Matcher *caddyhttp.ResponseMatcher `json:"match,omitempty"`
 
+	// The maximum number of replacements that may be configured.
+	// Guards against accidentally generated configs exploding memory
+	// usage. Default: 1000000. A negative value disables the limit.
+	MaxRules int `json:"max_rules,omitempty"`
+
+	// The maximum size of a compiled regular expression, measured
+	// in program instructions. Patterns that compile to a larger
+	// program are rejected. The default of 1000000 is far above
+	// generated alternations of thousands of words, which compile
+	// to tens of thousands of instructions. A negative value
+	// disables the limit.
+	MaxRegexpSize int `json:"max_regexp_size,omitempty"`
+
+	// The maximum length in bytes of a substring search. In stream
+	// mode, every substring replacement holds back up to one byte
+	// less than its search in each response, in case it is the
+	// start of a match, so long searches cost memory for every
+	// concurrent stream. Placeholders count as they are written.
+	// Default: 1 MiB. A negative value disables the limit.
+	MaxSearchLength int `json:"max_search_length,omitempty"`
+
+	// If set, and the response is multipart (for example a
+	// multipart/x-mixed-replace stream), replacements are only
+	// performed on the bodies of the parts with these indices,
+	// counting from 0. Part headers are never modified. Responses
+	// that are not multipart are replaced as a whole.
+	MultipartParts []int `json:"multipart_parts,omitempty"`
+
+	// If true, only perform replacements when the request's Accept
+	// header accepts the Content-Type of the response. This avoids
+	// rewriting content that was negotiated as something else, such
+	// as raw text requested by a tool.
+	MatchAccept bool `json:"match_accept,omitempty"`
+
+	// Responses whose media type matches one of these patterns are
+	// not replaced, such as "application/javascript" or "image/*".
+	// Patterns are matched as globs (see path.Match), ignoring case
+	// and parameters. This takes precedence over the matcher, so a
+	// type that both allows and excludes is not replaced.
+	ExcludeContentTypes []string `json:"exclude_content_types,omitempty"`
+
+	// If true, responses that were served from a cache upstream, as
+	// told by one of the CacheHeaders, are passed through without
+	// replacements, so rules that were already applied before the
+	// response was cached aren't applied twice.
+	SkipIfCached bool `json:"skip_if_cached,omitempty"`
+
+	// The headers that indicate a cached response for SkipIfCached.
+	// An entry "Name" matches if the response has the header at all;
+	// "Name: value" matches if one of its values contains value,
+	// ignoring case. Default: "Age" and "X-Cache: HIT".
+	CacheHeaders []string `json:"cache_headers,omitempty"`
+
+	// Responses whose Age header says they have been in a cache for
+	// longer than this are passed through without replacements, so
+	// stale, long-cached content isn't processed again. Ages are
+	// whole seconds; a response exactly MaxAge old is still
+	// replaced. An Age header that isn't a number is ignored.
+	// Default: 0, which disables the check.
+	MaxAge caddy.Duration `json:"max_age,omitempty"`
+
+	// Response headers that mark a response as already rewritten,
+	// such as X-Rewritten, mapped to a regular expression that one
+	// of the header's values must match in full, such as "1|true".
+	// An empty expression matches any value. Responses with one of
+	// these headers are passed through without replacements.
+	SkipIfHeader map[string]string `json:"skip_if_header,omitempty"`
+
+	// If true, every environment variable referenced with an
+	// {env.NAME} placeholder in a search or replace value must be
+	// set, or provisioning fails. Otherwise unset variables
+	// silently become empty.
+	RequireEnv bool `json:"require_env,omitempty"`
+
+	// If set, only requests whose URL path starts with one of
+	// these prefixes are replaced. A value containing any of the
+	// characters *?[ is matched as a glob (see path.Match) against
+	// the whole path instead. Other requests pass through
+	// without being buffered.
+	Paths []string `json:"paths,omitempty"`
+
+	// If set, only requests whose URL path matches this regular
+	// expression are replaced. If Paths is also set, a request
+	// matching either is replaced.
+	PathRegexp string `json:"path_regexp,omitempty"`
+
+	// If true, perform replacements on responses that are known to
+	// be binary, such as images, archives and fonts. By default
+	// these are skipped to avoid corrupting them.
+	ForceBinary bool `json:"force_binary,omitempty"`
+
+	// If true, streamed text/event-stream responses are replaced
+	// one server-sent event at a time, so a match can never span
+	// two events. Each event is held back until it is complete.
+	SSEBoundaryAware bool `json:"sse_boundary_aware,omitempty"`
+
+	// Which bodies to perform replacements on: "response" (the
+	// default), "request" or "both". Request bodies are replaced
+	// before they are passed to the next handler, such as a
+	// reverse proxy; in streaming mode their length becomes unknown.
+	Direction string `json:"direction,omitempty"`
+
+	// If set, request bodies are only replaced if their media type
+	// matches one of these patterns, such as
+	// "application/x-www-form-urlencoded", so that uploads of other
+	// types are passed on untouched. Patterns are matched like
+	// ExcludeContentTypes. Requests without a Content-Type don't
+	// match. Requires direction request or both.
+	RequestContentTypes []string `json:"request_content_types,omitempty"`
+
+	// The largest request body that is read into memory to be
+	// replaced in buffer mode, in bytes. Longer bodies are rejected
+	// with status 413. Default: 10 MiB. A negative value disables
+	// the limit.
+	MaxRequestBody int64 `json:"max_request_body,omitempty"`
+
+	// How to resolve replacements that match the same part of the
+	// body. With "first_wins" (the default), replacements are
+	// applied one after another, each to the output of the ones
+	// before it, so the first to match a region wins. With
+	// "longest_match_wins", all replacements are applied in a
+	// single pass and the longest match at each position wins;
+	// ties go to the replacement that would be applied first, and
+	// replacements never see each other's output.
+	ConflictResolution string `json:"conflict_resolution,omitempty"`
+
+	// If true, runs of adjacent substring replacements that always
+	// replace their matches with the same value are performed in a
+	// single pass over the body, rather than one pass each, when
+	// that can't change the result: none of them can match text
+	// overlapping a match of another, or text inserted by one
+	// before it, and only the last may delete its matches. Runs
+	// that don't qualify are split where needed. This only applies
+	// with first_wins, since longest_match_wins always performs
+	// the replacements in a single pass.
+	Optimize bool `json:"optimize,omitempty"`
+
+	// Path to a CSV file of additional substring replacements,
+	// which are appended to Replacements. Each row holds a search
+	// string followed by one or more replace values; values that
+	// contain the delimiter can be quoted.
+	ReplacementsCSV string `json:"replacements_csv,omitempty"`
+
+	// The field delimiter of ReplacementsCSV. Default: ",".
+	CSVDelimiter string `json:"csv_delimiter,omitempty"`
+
+	// If true, the first row of ReplacementsCSV is a header and
+	// is skipped.
+	CSVHeader bool `json:"csv_header,omitempty"`
+
+	// If true, a config without any replacements, such as one whose
+	// ReplacementsCSV is empty, passes everything through untouched
+	// instead of failing to load.
+	AllowEmpty bool `json:"allow_empty,omitempty"`
+
+	// If true, compressed responses are decoded before performing
+	// replacements and encoded again afterwards, using the same
+	// codings listed in the Content-Encoding header. Stacked codings
+	// such as "gzip, zstd" are supported in buffer mode; in stream
+	// mode, the body is decoded and encoded as it streams, with
+	// bounded memory, which is supported for a single coding only.
+	// Responses with a coding that can't be decoded, including br,
+	// are passed through untouched, even if it is only one of a
+	// stack such as "gzip, br".
+	Decompress bool `json:"decompress,omitempty"`
+
+	// If true, responses that were decoded because of Decompress
+	// are encoded again with the coding the client prefers
+	// according to its Accept-Encoding header, rather than the
+	// codings the upstream used. zstd, gzip and deflate are
+	// supported; br is never chosen, since it can't be encoded. If
+	// the client accepts none of them, the response is sent
+	// unencoded, unless the client refuses that too with
+	// "identity;q=0", in which case the upstream's codings are kept.
+	ReencodeForClient bool `json:"reencode_for_client,omitempty"`
+
+	// If true, buffered bodies are decoded from quoted-printable
+	// before they are replaced, so that searches match text written
+	// as =XX sequences, and encoded again afterwards. Responses
+	// with a Content-Transfer-Encoding header are only decoded if
+	// it is "quoted-printable"; those without one are always
+	// decoded. Bodies that aren't valid quoted-printable are
+	// passed through untouched. Buffer mode only, and not for
+	// bodies spilled to disk.
+	DecodeQuotedPrintable bool `json:"decode_quoted_printable,omitempty"`
+
+	// If true, each run of whitespace (spaces, tabs, newlines,
+	// carriage returns and form feeds) in the body is collapsed
+	// into a single space after the other replacements have been
+	// performed. In HTML responses, the contents of <pre>,
+	// <textarea>, <script> and <style> elements are left alone.
+	CollapseWhitespace bool `json:"collapse_whitespace,omitempty"`
+
+	// If true, http:// URLs in response bodies are rewritten to
+	// https://, after the other replacements, to avoid mixed
+	// content. In HTML responses, only URLs in attribute values
+	// that hold URLs, such as href, src and srcset, are rewritten,
+	// so text, comments and scripts are left alone; in other
+	// responses, any http:// that doesn't follow a letter or digit
+	// is. URLs with an explicit port other than 80 are left alone.
+	UpgradeInsecureURLs bool `json:"upgrade_insecure_urls,omitempty"`
+
+	// The hosts whose URLs UpgradeInsecureURLs rewrites, such as
+	// "example.com" or "*.example.com" for its subdomains. Hosts
+	// are matched ignoring case. Default: all hosts.
+	UpgradeHosts []string `json:"upgrade_hosts,omitempty"`
+
+	// The value that the {csp_nonce} token in replace values expands
+	// to, typically a placeholder such as
+	// "{http.request.header.X-Nonce}". Values that are not valid
+	// base64 expand to nothing. Default: the nonce that the
+	// Content-Security-Policy header of the response allows
+	// scripts with.
+	CSPNonce string `json:"csp_nonce,omitempty"`
+
+	// If true, the SHA-256 hashes of the inline scripts in replace,
+	// prefix and suffix values are added to the script-src of the
+	// Content-Security-Policy (and -Report-Only) headers of
+	// replaced responses, so that the policy allows the injected
+	// scripts. Scripts whose text depends on the match, such as
+	// through per-match tokens or, in regexp replacements, $
+	// signs, can't be hashed in advance and are left out.
+	CSPScriptHashes bool `json:"csp_script_hashes,omitempty"`
+
+	// If true, a UTF-8 byte order mark at the start of the body is
+	// removed after the other replacements, whether the upstream
+	// sent it or a replacement inserted it. The same bytes later in
+	// the body are left alone.
+	StripBOM bool `json:"strip_bom,omitempty"`
+
+	// The name of a function registered with RegisterBodyFunc that
+	// is applied to the whole body after the other replacements, in
+	// buffer mode. Functions can only be registered from Go code
+	// compiled into Caddy, so this is of no use with a stock build.
+	FuncTransform string `json:"func_transform,omitempty"`
+
+	// If true, entities such as &amp; in the text of HTML responses
+	// are decoded before matching, so plain patterns match the text
+	// as it is displayed. Text that is changed is encoded again,
+	// including what was inserted; tags, attribute values,
+	// comments, and the contents of <script> and <style> are
+	// replaced as they are. Matches can't span tags. Buffer mode
+	// only.
+	DecodeEntities bool `json:"decode_entities,omitempty"`
+
+	// If true, text inserted by a replacement is dropped when it is
+	// identical to the text inserted just before it and only
+	// whitespace separates the two, so a marker that appears twice
+	// in a row yields a single insertion. Matches left unchanged
+	// don't count as insertions and break a run like any other
+	// text.
+	Dedupe bool `json:"dedupe,omitempty"`
+
+	// Rewrites of the Domain attribute of Set-Cookie headers, from
+	// the upstream's domain to the domain to use instead. Domains
+	// are matched ignoring case and a leading dot.
+	CookieDomains map[string]string `json:"cookie_domains,omitempty"`
+
+	// Rewrites of the Path attribute of Set-Cookie headers, from a
+	// path prefix to the prefix to use instead. The longest prefix
+	// that ends at a slash or the end of the path wins.
+	CookiePaths map[string]string `json:"cookie_paths,omitempty"`
+
+	// If true, the replacements are also performed on the target
+	// URLs of Link headers, such as </app.js>; rel=preload, in the
+	// final response and in informational responses like 103 Early
+	// Hints. The parameters of each link are kept as they are.
+	LinkHeaders bool `json:"link_headers,omitempty"`
+
+	// Which parts of the response body replacements are performed
+	// on: "all" (the default), "comments" or "non-comments".
+	// Comments are recognized in HTML (<!-- -->), JavaScript (//
+	// and /* */) and CSS (/* */); responses of other types have no
+	// comments.
+	Scope string `json:"scope,omitempty"`
+
+	// A value, usually containing placeholders, that seeds the
+	// random choice of which matches to replace for replacements
+	// with a sample_rate. Requests with the same key, such as the
+	// same session cookie, get the same matches replaced. By
+	// default the choice is random for every response.
+	StickyKey string `json:"sticky_key,omitempty"`
+
+	// If true, replacements with several replace values and no
+	// weights choose one for each response, as if they had equal
+	// weights, rather than once for each pooled transformer. The
+	// choices of all replacements in a response, including those
+	// with weights, come from the same draw, so replacements with
+	// the same number of values or the same weights choose the
+	// same index and the variants of a page stay coherent. With
+	// StickyKey, the draw is derived from the key.
+	CorrelatedRandom bool `json:"correlated_random,omitempty"`
+
+	// If true, in buffer mode, response bodies that grow past
+	// SpillThreshold are moved to a temporary file instead of being
+	// held in memory, and replaced from there.
+	SpillToDisk bool `json:"spill_to_disk,omitempty"`
+
+	// The size of a buffered response body, in bytes, beyond which
+	// it is spilled to disk. Default: 10 MiB.
+	SpillThreshold int64 `json:"spill_threshold,omitempty"`
+
+	// The directory for the temporary files of spilled response
+	// bodies. Default: the system's temporary directory.
+	TempDir string `json:"temp_dir,omitempty"`
+
+	// If true, in buffer mode, the response body as it was received
+	// from upstream, before decoding and replacements, is stored as
+	// a []byte in the request variable
+	// "replace_response.original_body", so that handlers and logs
+	// later in the chain can use it, for example through the
+	// {http.vars.replace_response.original_body} placeholder. This
+	// keeps a second copy of every buffered body until the request
+	// is done. Bodies that are spilled to disk are not stored.
+	ExposeOriginal bool `json:"expose_original,omitempty"`
+
+	// For debugging rules: if set, in buffer mode, the first
+	// PreviewBytes bytes of the replaced body, before it is encoded
+	// again, are sent base64-encoded in the X-Replace-Preview
+	// response header, so a rule can be checked without downloading
+	// the whole body. At most 1024.
+	PreviewBytes int `json:"preview_bytes,omitempty"`
+
+	// For debugging rules: if true, in buffer mode, the length of
+	// the body before and after replacements is sent in the
+	// X-Original-Length and X-Modified-Length response headers, so
+	// it can be seen at a glance whether and how much a body
+	// changed. Both are measured like PreviewBytes, after decoding
+	// and before encoding again.
+	LengthHeaders bool `json:"length_headers,omitempty"`
+
+	// If true, the search and replace values of every replacement
+	// are logged for each request, with the placeholders in them
+	// expanded for that request, to debug placeholders that don't
+	// expand as expected. Only use this while debugging, since it
+	// logs every request.
+	DebugConfig bool `json:"debug_config,omitempty"`
+
+	// The placeholders whose values are replaced with REDACTED in
+	// the DebugConfig log, such as "http.request.header.X-Token".
+	// A trailing * matches all placeholders with that prefix.
+	// Setting this replaces the default, which redacts env.*,
+	// file.*, http.request.cookie.* and the Authorization, Cookie
+	// and Proxy-Authorization request headers.
+	DebugRedact []string `json:"debug_redact,omitempty"`
+
+	// If true, the outcome of each response is recorded in Caddy's
+	// access log, in a replace_response field: the mode it was
+	// replaced in ("buffer" or "stream", or "none" if it wasn't),
+	// the number of matches replaced and the rules that replaced
+	// them, by name or else by index. JSON pointer and invert rules
+	// are not counted.
+	AccessLogFields bool `json:"access_log_fields,omitempty"`
+
+	// If true, a transformer is built while provisioning, so the
+	// first request after a config load or reload doesn't pay for
+	// it. This is skipped if any search or replace value contains
+	// a placeholder, since those can't be resolved without a
+	// request.
+	PrewarmPool bool `json:"prewarm_pool,omitempty"`
+
+	// The maximum number of responses that are replaced at the
+	// same time by this handler, to keep heavy replacements on
+	// large bodies from saturating the CPU. In buffer mode, a slot
+	// is held from when the whole body has been received until it
+	// is replaced; in stream mode, for as long as the response
+	// streams. Default: no limit.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+
+	// What happens to a response when MaxConcurrent responses are
+	// already being replaced: "wait" (the default) waits for one
+	// of them to finish, or for the client to go away, and "bypass"
+	// passes the response through without replacements.
+	ConcurrencyPolicy string `json:"concurrency_policy,omitempty"`
+
+	// In buffer mode, the largest factor by which the replacements
+	// may grow a body, as a guard against runaway replacements: 10
+	// allows a 1 KB body to become up to 10 KB. The sizes are
+	// compared before the body is encoded again for Decompress.
+	// Default: no limit.
+	MaxExpansionRatio float64 `json:"max_expansion_ratio,omitempty"`
+
+	// What happens to a response whose body grew by more than
+	// MaxExpansionRatio: "error" (the default) fails the request
+	// with 500 Internal Server Error, and "passthrough" sends the
+	// original body without replacements.
+	ExpansionPolicy string `json:"expansion_policy,omitempty"`
+
+	// If true, a buffered body must be valid UTF-8, after it is
+	// decoded for Decompress, before it is replaced, so that rules
+	// written for UTF-8 don't silently fail to match a body in
+	// another encoding. Buffer mode only, and not for bodies
+	// spilled to disk.
+	RequireUTF8 bool `json:"require_utf8,omitempty"`
+
+	// What happens to a response that RequireUTF8 rejects: "error"
+	// (the default) fails the request with 502 Bad Gateway, and
+	// "skip" passes it through without replacements.
+	InvalidUTF8 string `json:"invalid_utf8,omitempty"`
+
+	// A JSON file of feature flags, such as {"banner": true}, that
+	// turns replacements with a flag_key on and off without a
+	// config reload. The file is checked for changes at most once a
+	// second, and read again when its modification time or size
+	// changes. If it can't be read or parsed then, the flags it
+	// last had are kept. It must exist when the config is loaded.
+	FlagsFile string `json:"flags_file,omitempty"`
+
+	// Response headers that depend on the body, such as a digest
+	// or an integrity header, which are removed when the body is
+	// modified so that stale values don't reach the client. In
+	// buffer mode, they are kept if the replacements left the body
+	// as it was; streamed bodies, and bodies spilled to disk, are
+	// assumed to be modified.
+	DropHeaders []string `json:"drop_headers,omitempty"`
+
+	pathRe *regexp.Regexp
+
+	// the flags of FlagsFile
+	flags *flagSet
+
+	// the MaxMatchSize of regexp transformers, from StreamWindow
+	window int
+
+	// compiled SkipIfHeader entries
+	skipHeaders []skipHeader
+
+	logger *zap.Logger
+
+	// replacements in the order they are applied
+	rules []*Replacement
+
+	// replacements by JSON Pointer, in the order they are applied
+	pointerRules []*Replacement
+
+	// replacements with invert set, in the order they are applied
+	invertRules []*Replacement
+
+	// the function FuncTransform refers to
+	bodyFunc BodyFunc
+
+	// the only rule, if streamed and spilled response bodies are
+	// replaced without the transformer; see singleLiteral
+	single *literal
+
+	// whether each rule with once set has fired
+	fired []atomic.Bool
+
+	// number of responses and request bodies replaced since the
+	// config was loaded, for every_nth
+	responseCount *atomic.Uint64
+	requestCount  *atomic.Uint64
+
+	// when the handler was provisioned, for activate_after
+	provisioned time.Time
+
 	transformerPool *sync.Pool
 
-	repl *caddy.Replacer
+	// pool of response buffers, if BufferSize is set
+	bufPool *sync.Pool
+
+	// one element for each response being replaced, if
+	// MaxConcurrent is set
+	slots chan struct{}
+
+	// builds a transformer for the pool, with the placeholders of
+	// the request it is first taken for
+	newTransformer func(requestRepl *caddy.Replacer) *replacer
 }
 
 // CaddyModule returns the Caddy module information.
@@ -78,194 +657,2053 @@ func (Handler) CaddyModule() caddy.ModuleInfo {
 
 // Provision implements caddy.Provisioner.
 func (h *Handler) Provision(ctx caddy.Context) error {
-	if len(h.Replacements) == 0 {
-		return fmt.Errorf("no replacements configured")
+	h.logger = ctx.Logger()
+	h.responseCount = new(atomic.Uint64)
+	h.requestCount = new(atomic.Uint64)
+	h.provisioned = time.Now()
+
+	if h.ReplacementsCSV != "" {
+		repls, err := loadCSVReplacements(h.ReplacementsCSV, h.CSVDelimiter, h.CSVHeader)
+		if err != nil {
+			return fmt.Errorf("loading replacements_csv %s: %v", h.ReplacementsCSV, err)
+		}
+		h.Replacements = append(h.Replacements, repls...)
 	}
 
-	// prepare each replacement
+	if len(h.Replacements) == 0 && !h.UpgradeInsecureURLs && !h.StripBOM && !h.CollapseWhitespace && h.FuncTransform == "" {
+		if !h.AllowEmpty {
+			return fmt.Errorf("no replacements configured")
+		}
+		h.logger.Info("no replacements configured, passing everything through")
+		return nil
+	}
+
+	maxRules := h.MaxRules
+	if maxRules == 0 {
+		maxRules = defaultMaxRules
+	}
+	if maxRules > 0 && len(h.Replacements) > maxRules {
+		return fmt.Errorf("too many replacements configured: %d exceeds max_rules of %d", len(h.Replacements), maxRules)
+	}
+
+	maxRegexpSize := h.MaxRegexpSize
+	if maxRegexpSize == 0 {
+		maxRegexpSize = defaultMaxRegexpSize
+	}
+	maxSearchLength := h.MaxSearchLength
+	if maxSearchLength == 0 {
+		maxSearchLength = defaultMaxSearchLength
+	}
+
+	// prepare each replacement, collecting all problems
+	// so they can be reported at once
+	var errs []error
 	for i, repl := range h.Replacements {
-		if repl.Search == "" && repl.SearchRegexp == "" {
-			return fmt.Errorf("replacement %d: no search or search_regexp configured", i)
+		repl.index = i
+		repl.correlated = h.CorrelatedRandom && len(repl.Replaces) > 1
+		repl.salt = 0
+		if !h.CorrelatedRandom {
+			repl.salt = ruleSalt(repl)
 		}
-		if repl.Search != "" && repl.SearchRegexp != "" {
-			return fmt.Errorf("replacement %d: cannot specify both search and search_regexp in same replacement", i)
+		if err := repl.provision(maxRegexpSize, maxSearchLength, h.RequireEnv); err != nil {
+			errs = append(errs, fmt.Errorf("replacement %d: %v", i, err))
 		}
-		if repl.SearchRegexp != "" {
-			re, err := regexp.Compile(repl.SearchRegexp)
-			if err != nil {
-				return fmt.Errorf("replacement %d: %v", i, err)
+		if repl.Required && h.Stream {
+			errs = append(errs, fmt.Errorf("replacement %d: required is not supported in streaming mode", i))
+		}
+		if repl.FlagKey != "" && h.FlagsFile == "" {
+			errs = append(errs, fmt.Errorf("replacement %d: flag_key requires flags_file", i))
+		}
+		if repl.Overlap && h.ConflictResolution == conflictLongestMatchWins {
+			errs = append(errs, fmt.Errorf("replacement %d: overlap can't be used with conflict_resolution %s", i, conflictLongestMatchWins))
+		}
+	}
+	for i, repl := range h.Replacements {
+		for j := 0; j < i; j++ {
+			if repl.equal(h.Replacements[j]) {
+				h.logger.Warn("duplicate replacement has no effect",
+					zap.Int("replacement", i),
+					zap.Int("duplicate_of", j))
+				break
 			}
-			repl.re = re
 		}
 	}
 
-	placeholderRepl := caddy.NewReplacer()
+	if err := h.provisionStreamWindow(); err != nil {
+		errs = append(errs, err)
+	}
 
+	switch h.Direction {
+	case "", directionResponse, directionRequest, directionBoth:
+	default:
+		errs = append(errs, fmt.Errorf("direction: must be %s, %s or %s, got %q", directionResponse, directionRequest, directionBoth, h.Direction))
+	}
+	if h.Optimize && h.ConflictResolution == conflictLongestMatchWins {
+		errs = append(errs, fmt.Errorf("optimize requires conflict_resolution %s", conflictFirstWins))
+	}
+	if len(h.RequestContentTypes) > 0 && !h.replacesRequest() {
+		errs = append(errs, fmt.Errorf("request_content_types requires direction %s or %s", directionRequest, directionBoth))
+	}
+	for _, p := range h.RequestContentTypes {
+		if _, err := path.Match(p, ""); err != nil {
+			errs = append(errs, fmt.Errorf("request_content_types: invalid pattern %q: %v", p, err))
+		}
+	}
 
-	h.transformerPool = &sync.Pool{
-		New: func() interface{} {
-			transforms := make([]transform.Transformer, len(h.Replacements))
-			for i, repl := range h.Replacements {
-				finalReplace := placeholderRepl.ReplaceKnown(repl.Replaces[randReplace.IntN(len(repl.Replaces))], "")
-
-				if repl.re != nil {
-					tr := replace.RegexpIndexFunc(repl.re, func(src []byte, index []int) []byte {
-						template := h.repl.ReplaceKnown(finalReplace, "")
-						return repl.re.Expand(nil, []byte(template), src, index)
-					})
-
-					// See: https://github.com/icholy/replace/issues/5#issuecomment-949757616
-					tr.MaxMatchSize = 2048
-					transforms[i] = tr
-				} else {
-					finalSearch := placeholderRepl.ReplaceKnown(repl.Search, "")
-					transforms[i] = replace.String(
-						h.repl.ReplaceKnown(finalSearch, ""),
-						h.repl.ReplaceKnown(finalReplace, ""),
-					)
-				}
-			}
-			return transform.Chain(transforms...)
-		},
+	switch h.ContentLengthMismatch {
+	case "", lengthMismatchFix, lengthMismatchError, lengthMismatchTrustUpstream:
+	default:
+		errs = append(errs, fmt.Errorf("content_length_mismatch: must be %s, %s or %s, got %q", lengthMismatchFix, lengthMismatchError, lengthMismatchTrustUpstream, h.ContentLengthMismatch))
 	}
 
-	return nil
-}
+	switch h.Scope {
+	case "", scopeAll, scopeComments, scopeNonComments:
+	default:
+		errs = append(errs, fmt.Errorf("scope: must be %s, %s or %s, got %q", scopeAll, scopeComments, scopeNonComments, h.Scope))
+	}
 
-// ServeHTTP implements caddyhttp.MiddlewareHandler.
-func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if err := checkUpgradeHosts(h.UpgradeHosts); err != nil {
+		errs = append(errs, err)
+	}
 
-	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
-	h.repl = repl
+	if err := checkDebugRedact(h.DebugRedact); err != nil {
+		errs = append(errs, err)
+	}
 
-	tr := h.transformerPool.Get().(transform.Transformer)
-	tr.Reset()
-	defer h.transformerPool.Put(tr)
+	if err := checkDropHeaders(h.DropHeaders); err != nil {
+		errs = append(errs, err)
+	}
 
-	if h.Stream {
-		// don't buffer response body, perform streaming replacement
-		fw := &replaceWriter{
-			ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
-			tr:                    tr,
-			handler:               h,
+	for i, s := range h.CacheHeaders {
+		if parseCacheIndicator(s).name == "" {
+			errs = append(errs, fmt.Errorf("cache_headers[%d]: missing header name in %q", i, s))
+		}
+	}
+
+	if skips, err := parseSkipHeaders(h.SkipIfHeader); err != nil {
+		errs = append(errs, err)
+	} else {
+		h.skipHeaders = skips
+	}
+
+	for _, p := range h.ExcludeContentTypes {
+		if _, err := path.Match(p, ""); err != nil {
+			errs = append(errs, fmt.Errorf("exclude_content_types: invalid pattern %q: %v", p, err))
+		}
+	}
+	for _, p := range h.Paths {
+		if _, err := path.Match(p, ""); err != nil {
+			errs = append(errs, fmt.Errorf("paths: invalid pattern %q: %v", p, err))
 		}
-		err := next.ServeHTTP(fw, r)
+	}
+	if h.PathRegexp != "" {
+		re, err := regexp.Compile(h.PathRegexp)
 		if err != nil {
-			return err
+			errs = append(errs, fmt.Errorf("path_regexp: %v", err))
 		}
-		// only close if there is no error; see PR #21
-		// as of May 2023, Close() only flushes remaining bytes, but
-		// this ends up calling WriteHeader() even if we don't want that
-		fw.Close()
-		return nil
+		h.pathRe = re
 	}
 
-	// get a buffer to hold the response body
-	respBuf := bufPool.Get().(*bytes.Buffer)
-	respBuf.Reset()
-	defer bufPool.Put(respBuf)
+	if h.PreviewBytes < 0 || h.PreviewBytes > maxPreviewBytes {
+		errs = append(errs, fmt.Errorf("preview_bytes: must be between 0 and %d, got %d", maxPreviewBytes, h.PreviewBytes))
+	}
 
-	// set up the response recorder
-	shouldBuf := func(status int, headers http.Header) bool {
-		if h.Matcher != nil {
-			return h.Matcher.Match(status, headers)
-		} else {
-			// Always replace if no matcher is specified
-			return true
+	if h.MaxAge < 0 {
+		errs = append(errs, fmt.Errorf("max_age: must not be negative, got %s", time.Duration(h.MaxAge)))
+	}
+	if h.SpillThreshold < 0 {
+		errs = append(errs, fmt.Errorf("spill_threshold: must not be negative, got %d", h.SpillThreshold))
+	}
+	if h.TempDir != "" {
+		if info, err := os.Stat(h.TempDir); err != nil {
+			errs = append(errs, fmt.Errorf("temp_dir: %v", err))
+		} else if !info.IsDir() {
+			errs = append(errs, fmt.Errorf("temp_dir: %s is not a directory", h.TempDir))
 		}
 	}
-	rec := caddyhttp.NewResponseRecorder(w, respBuf, shouldBuf)
 
-	// collect the response from upstream
-	err := next.ServeHTTP(rec, r)
-	if err != nil {
-		return err
+	if h.Stream {
+		for _, repl := range h.Replacements {
+			if repl.JSONPointer != "" {
+				errs = append(errs, fmt.Errorf("replacement %d: json_pointer requires buffer mode", repl.index))
+				break
+			}
+		}
 	}
-	if !rec.Buffered() {
-		return nil // Skipped, no need to replace
+	for _, repl := range h.Replacements {
+		if repl.Invert && h.Stream {
+			errs = append(errs, fmt.Errorf("replacement %d: invert requires buffer mode", repl.index))
+		} else if repl.Invert && h.SpillToDisk {
+			errs = append(errs, fmt.Errorf("replacement %d: invert can't be used with spill_to_disk", repl.index))
+		}
 	}
 
-	// TODO: could potentially use transform.Append here with a pooled byte slice as buffer?
-	result, _, err := transform.Bytes(tr, rec.Buffer().Bytes())
-	if err != nil {
-		return err
+	if h.BufferUntilFirstMatch && !h.Stream && len(h.StreamStatusCodes) == 0 {
+		errs = append(errs, fmt.Errorf("buffer_until_first_match: requires stream mode or stream_status_codes"))
 	}
 
-	// make sure length is correct, otherwise bad things can happen
-	if w.Header().Get("Content-Length") != "" {
-		w.Header().Set("Content-Length", strconv.Itoa(len(result)))
+	if len(h.StreamStatusCodes) > 0 {
+		if h.Stream {
+			errs = append(errs, fmt.Errorf("stream_status_codes: requires buffer mode"))
+		} else if err := checkStreamStatusCodes(h.StreamStatusCodes); err != nil {
+			errs = append(errs, err)
+		}
 	}
 
-	if status := rec.Status(); status > 0 {
-		w.WriteHeader(status)
+	if h.FuncTransform != "" {
+		if h.Stream {
+			errs = append(errs, fmt.Errorf("func_transform: requires buffer mode"))
+		} else if h.SpillToDisk {
+			errs = append(errs, fmt.Errorf("func_transform: can't be used with spill_to_disk"))
+		} else if fn, err := lookupBodyFunc(h.FuncTransform); err != nil {
+			errs = append(errs, err)
+		} else {
+			h.bodyFunc = fn
+		}
 	}
-	w.Write(result)
 
-	return nil
-}
+	if h.BufferSize < 0 {
+		errs = append(errs, fmt.Errorf("buffer_size: must not be negative, got %d", h.BufferSize))
+	} else if h.BufferSize > 0 {
+		size := h.BufferSize
+		h.bufPool = &sync.Pool{
+			New: func() interface{} {
+				return bytes.NewBuffer(make([]byte, 0, size))
+			},
+		}
+	}
 
-// Replacement is either a substring or regular expression replacement
-// to perform; precisely one must be specified, not both.
-type Replacement struct {
-	// A substring to search for. Mutually exclusive with search_regexp.
-	Search string `json:"search,omitempty"`
+	if h.MaxConcurrent < 0 {
+		errs = append(errs, fmt.Errorf("max_concurrent: must not be negative, got %d", h.MaxConcurrent))
+	} else if h.MaxConcurrent > 0 {
+		h.slots = make(chan struct{}, h.MaxConcurrent)
+	}
+	switch h.ConcurrencyPolicy {
+	case "", concurrencyWait, concurrencyBypass:
+	default:
+		errs = append(errs, fmt.Errorf("concurrency_policy: must be %s or %s, got %q", concurrencyWait, concurrencyBypass, h.ConcurrencyPolicy))
+	}
 
-	// A regular expression to search for. Mutually exclusive with search.
-	SearchRegexp string `json:"search_regexp,omitempty"`
+	if h.MaxExpansionRatio < 0 {
+		errs = append(errs, fmt.Errorf("max_expansion_ratio: must not be negative, got %g", h.MaxExpansionRatio))
+	} else if h.MaxExpansionRatio > 0 && h.Stream {
+		errs = append(errs, fmt.Errorf("max_expansion_ratio: requires buffer mode"))
+	}
+	switch h.ExpansionPolicy {
+	case "", expansionError, expansionPassthrough:
+	default:
+		errs = append(errs, fmt.Errorf("expansion_policy: must be %s or %s, got %q", expansionError, expansionPassthrough, h.ExpansionPolicy))
+	}
 
-	// The replacement strings/values. Required.
-	Replaces []string `json:"replace"`
+	if h.FlagsFile != "" {
+		flags, err := loadFlags(h.FlagsFile, h.logger)
+		if err != nil {
+			errs = append(errs, err)
+		}
+		h.flags = flags
+	}
 
-	re *regexp.Regexp
-}
+	if h.RequireUTF8 && h.Stream {
+		errs = append(errs, fmt.Errorf("require_utf8: requires buffer mode"))
+	}
+	if h.DecodeQuotedPrintable && h.Stream {
+		errs = append(errs, fmt.Errorf("decode_quoted_printable: requires buffer mode"))
+	}
+	if h.InvalidUTF8 != "" && !h.RequireUTF8 {
+		errs = append(errs, fmt.Errorf("invalid_utf8: requires require_utf8"))
+	}
+	switch h.InvalidUTF8 {
+	case "", invalidUTF8Error, invalidUTF8Skip:
+	default:
+		errs = append(errs, fmt.Errorf("invalid_utf8: must be %s or %s, got %q", invalidUTF8Error, invalidUTF8Skip, h.InvalidUTF8))
+	}
 
-// replaceWriter is used for streaming response body replacement. It
-// ensures the Content-Length header is removed and writes to tw,
-// which should be a transform writer that performs replacements.
-type replaceWriter struct {
-	*caddyhttp.ResponseWriterWrapper
-	wroteHeader bool
-	tw          io.WriteCloser
-	tr          transform.Transformer
-	handler     *Handler
-}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration:\n%w", errors.Join(errs...))
+	}
 
-func (fw *replaceWriter) WriteHeader(status int) {
-	if fw.wroteHeader {
-		return
+	// order replacements by priority, keeping config order for ties
+	h.rules = make([]*Replacement, len(h.Replacements))
+	copy(h.rules, h.Replacements)
+	sort.SliceStable(h.rules, func(i, j int) bool {
+		return h.rules[i].Priority > h.rules[j].Priority
+	})
+	// replacements by JSON Pointer and inverted ones don't go
+	// through the transformer
+	rules := h.rules[:0]
+	for _, repl := range h.rules {
+		if repl.JSONPointer != "" {
+			h.pointerRules = append(h.pointerRules, repl)
+		} else if repl.Invert {
+			h.invertRules = append(h.invertRules, repl)
+		} else {
+			rules = append(rules, repl)
+		}
 	}
-	fw.wroteHeader = true
+	h.rules = rules
+	h.fired = make([]atomic.Bool, len(h.rules))
 
-	if fw.handler.Matcher == nil || fw.handler.Matcher.Match(status, fw.ResponseWriterWrapper.Header()) {
-		// we don't know the length after replacements since
-		// we're not buffering it all to find out
-		fw.Header().Del("Content-Length")
-		fw.tw = transform.NewWriter(fw.ResponseWriterWrapper, fw.tr)
+	placeholderRepl := caddy.NewReplacer()
+
+	switch h.ConflictResolution {
+	case "", conflictFirstWins:
+	case conflictLongestMatchWins:
+		expr, _ := combinedPattern(h.rules, func(repl *Replacement) string {
+			return placeholderRepl.ReplaceKnown(repl.Search, "")
+		})
+		if _, err := regexp.Compile(expr); err != nil {
+			return fmt.Errorf("conflict_resolution: combining replacements: %v", err)
+		}
+	default:
+		return fmt.Errorf("conflict_resolution: must be %s or %s, got %q", conflictFirstWins, conflictLongestMatchWins, h.ConflictResolution)
 	}
 
-	fw.ResponseWriterWrapper.WriteHeader(status)
-}
+	h.single = h.singleLiteral(placeholderRepl)
 
-func (fw *replaceWriter) Write(d []byte) (int, error) {
-	if !fw.wroteHeader {
-		fw.WriteHeader(http.StatusOK)
+	poolMetrics.init.Do(initPoolMetrics)
+	h.transformerPool = new(sync.Pool)
+	h.newTransformer = func(requestRepl *caddy.Replacer) *replacer {
+		poolMetrics.created.Inc()
+		rt := newReplacer(len(h.rules))
+		rt.repl = requestRepl
+		if h.ConflictResolution == conflictLongestMatchWins && len(h.rules) > 0 {
+			if h.hasOptionalRules() {
+				rt.Transformer = &conditionalTransformer{h: h, rt: rt, placeholderRepl: placeholderRepl, built: make(map[string]transform.Transformer)}
+			} else {
+				rt.Transformer = h.newLongestMatchTransformer(placeholderRepl, rt, nil)
+			}
+			if h.Dedupe {
+				rt.Transformer = transform.Chain(rt.Transformer, new(deduper))
+			}
+			return rt
+		}
+
+		transforms := make([]transform.Transformer, 0, len(h.rules)+1)
+		// with optimize, the static substring replacements
+		// waiting to be merged with the ones after them
+		var lits []literal
+		for i, repl := range h.rules {
+			if !repl.hasVariants() {
+				finalReplace := repl.chooseReplace(placeholderRepl, 0)
+				if h.Optimize && repl.re == nil && !h.decidesPerMatch(repl, finalReplace) {
+					if lit := h.staticLiteral(repl, finalReplace, placeholderRepl, rt.repl); lit.search != "" {
+						lits = append(lits, lit)
+						continue
+					}
+				}
+				transforms = append(transforms, mergeLiterals(lits)...)
+				lits = nil
+				transforms = append(transforms, h.newRuleTransformer(i, repl, finalReplace, placeholderRepl, rt))
+				continue
+			}
+			transforms = append(transforms, mergeLiterals(lits)...)
+			lits = nil
+			vt := &variantTransformer{rt: rt, repl: repl, variants: make([]transform.Transformer, len(repl.Replaces))}
+			for v, r := range repl.Replaces {
+				vt.variants[v] = h.newRuleTransformer(i, repl, placeholderRepl.ReplaceKnown(r, ""), placeholderRepl, rt)
+			}
+			transforms = append(transforms, vt)
+		}
+		transforms = append(transforms, mergeLiterals(lits)...)
+		if h.Dedupe {
+			transforms = append(transforms, new(deduper))
+		}
+		rt.Transformer = transform.Chain(transforms...)
+		return rt
 	}
 
-	if fw.tw != nil {
-		return fw.tw.Write(d)
-	} else {
-		return fw.ResponseWriterWrapper.Write(d)
+	if h.PrewarmPool {
+		if h.placeholderFree() {
+			h.transformerPool.Put(h.newTransformer(placeholderRepl))
+		} else {
+			h.logger.Info("not prewarming transformer pool, replacements contain placeholders")
+		}
 	}
+
+	return nil
 }
 
-func (fw *replaceWriter) Close() error {
-	if fw.tw != nil {
-		// Close if we have a transform writer, the underlying one does not need to be closed.
-		return fw.tw.Close()
+// placeholderFree reports whether no search or replace value contains
+// a placeholder, so that transformers can be built without a request.
+func (h *Handler) placeholderFree() bool {
+	for _, repl := range h.rules {
+		if strings.Contains(repl.Search, "{") || strings.Contains(repl.SearchRegexp, "{") {
+			return false
+		}
+		for _, r := range repl.Replaces {
+			if strings.Contains(r, "{") {
+				return false
+			}
+		}
 	}
-	return nil
+	return true
 }
 
+// newRuleTransformer returns a transformer that performs repl, the
+// i'th rule, replacing its matches with finalReplace.
+func (h *Handler) newRuleTransformer(i int, repl *Replacement, finalReplace string, placeholderRepl *caddy.Replacer, rt *replacer) transform.Transformer {
+	var pos *positionTracker
+	if repl.hasRegion() {
+		pos = new(positionTracker)
+	}
+	// skip reports whether a match should be left unchanged, and
+	// counts it otherwise
+	skip := func(src []byte, index []int) bool {
+		if (pos != nil && !pos.inRegion(repl, src, index)) || !rt.sampled(repl) || !h.fire(rt, i) || !rt.firstValue(i, repl, src[index[0]:index[1]]) {
+			return true
+		}
+		rt.count(i, repl)
+		return false
+	}
+
+	var tr transform.Transformer
+	if repl.re != nil {
+		// the match is substituted by Expand, since its text may
+		// contain $ signs
+		finalTemplate := strings.ReplaceAll(finalReplace, matchPlaceholder, "${0}")
+		replaceMatch := h.marked(func(src []byte, index []int) []byte {
+			if repl.cond != nil && !repl.cond.holds(rt.repl, repl.re, src, index) {
+				return src[index[0]:index[1]]
+			}
+			var patched []byte
+			if repl.DecodeMatchBase64 {
+				// matches that aren't base64 are not counted
+				var ok bool
+				if patched, ok = repl.patchBase64(rt.repl, rt.pointOf(repl), src, index); !ok {
+					return src[index[0]:index[1]]
+				}
+			}
+			if skip(src, index) {
+				return src[index[0]:index[1]]
+			}
+			rt.setMatch(src[index[0]:index[1]])
+			if patched != nil {
+				return patched
+			}
+			if repl.Mask != "" {
+				return repl.maskMatch(src, index)
+			}
+			if repl.HashMatch != "" {
+				return repl.hashMatch(src, index)
+			}
+			if repl.wraps() {
+				return repl.wrap(rt.repl, src[index[0]:index[1]])
+			}
+			if repl.bodyFunc != nil {
+				return repl.transformMatch(rt.repl, src[index[0]:index[1]])
+			}
+			if repl.tmpl != nil {
+				return h.executeTemplate(repl, repl.re, src, index)
+			}
+			if repl.files != nil {
+				if contents, ok := h.fileReplacement(rt, i); ok {
+					return contents
+				}
+				return src[index[0]:index[1]]
+			}
+			template := rt.expandTokens([]byte(repl.escape(rt.repl.ReplaceKnown(finalTemplate, ""))))
+			return repl.matchCase(src[index[0]:index[1]], repl.re.Expand(nil, template, src, index))
+		})
+
+		if repl.Overlap {
+			otr := newOverlapTransformer(repl.re, replaceMatch)
+			otr.MaxMatchSize = h.window
+			tr = otr
+		} else {
+			rtr := replace.RegexpIndexFunc(repl.re, replaceMatch)
+			// See: https://github.com/icholy/replace/issues/5#issuecomment-949757616
+			rtr.MaxMatchSize = h.window
+			tr = rtr
+		}
+	} else if h.decidesPerMatch(repl, finalReplace) {
+		// deciding per match is only possible with the
+		// regexp transformer
+		finalSearch := rt.repl.ReplaceKnown(placeholderRepl.ReplaceKnown(repl.Search, ""), "")
+		replacement := []byte(repl.escape(rt.repl.ReplaceKnown(strings.ReplaceAll(finalReplace, matchPlaceholder, finalSearch), "")))
+		if repl.Mask != "" {
+			replacement = repl.mask([]byte(finalSearch))
+		}
+		if repl.HashMatch != "" {
+			replacement = repl.hash([]byte(finalSearch))
+		}
+		rtr := replace.RegexpIndexFunc(regexp.MustCompile(repl.caseSearch(finalSearch)), h.marked(func(src []byte, index []int) []byte {
+			if rt.omits(repl) || skip(src, index) {
+				return src[index[0]:index[1]]
+			}
+			rt.setMatch(src[index[0]:index[1]])
+			if repl.tmpl != nil {
+				return h.executeTemplate(repl, nil, src, index)
+			}
+			if repl.wraps() {
+				return repl.wrap(rt.repl, src[index[0]:index[1]])
+			}
+			if repl.bodyFunc != nil {
+				return repl.transformMatch(rt.repl, src[index[0]:index[1]])
+			}
+			if repl.files != nil {
+				if contents, ok := h.fileReplacement(rt, i); ok {
+					return contents
+				}
+				return src[index[0]:index[1]]
+			}
+			return repl.matchCase(src[index[0]:index[1]], rt.expandTokens(replacement))
+		}))
+		rtr.MaxMatchSize = h.window
+		tr = rtr
+	} else {
+		lit := h.staticLiteral(repl, finalReplace, placeholderRepl, rt.repl)
+		tr = replace.String(lit.search, lit.replace)
+	}
+
+	if pos != nil {
+		pos.Transformer = tr
+		return pos
+	}
+	return tr
+}
+
+// decidesPerMatch reports whether the substring replacement repl,
+// replacing its matches with finalReplace, has to decide for each
+// match whether and how to replace it, rather than always replacing
+// it with the same value.
+func (h *Handler) decidesPerMatch(repl *Replacement, finalReplace string) bool {
+	return repl.hasRegion() || repl.Required || (repl.SampleRate > 0 && repl.SampleRate < 1) || hasMatchTokens(finalReplace) || repl.tmpl != nil || repl.files != nil || repl.Once || repl.OncePerValue || repl.EveryNth > 1 || repl.ActivateAfter > 0 || repl.PreserveCase || repl.wraps() || repl.bodyFunc != nil || repl.cond != nil || repl.FlagKey != "" || repl.counter != nil || h.Dedupe || h.BufferUntilFirstMatch || h.AccessLogFields
+}
+
+// staticLiteral returns the final search and replace values of the
+// substring replacement repl, for which decidesPerMatch is false.
+func (h *Handler) staticLiteral(repl *Replacement, finalReplace string, placeholderRepl, requestRepl *caddy.Replacer) literal {
+	finalSearch := requestRepl.ReplaceKnown(placeholderRepl.ReplaceKnown(repl.Search, ""), "")
+	replacement := repl.escape(requestRepl.ReplaceKnown(strings.ReplaceAll(finalReplace, matchPlaceholder, finalSearch), ""))
+	if repl.Mask != "" {
+		replacement = string(repl.mask([]byte(finalSearch)))
+	}
+	if repl.HashMatch != "" {
+		replacement = string(repl.hash([]byte(finalSearch)))
+	}
+	return literal{search: finalSearch, replace: replacement}
+}
+
+var envPlaceholderRe = regexp.MustCompile(`\{env\.([^{}]+)\}`)
+
+// executeTemplate returns the result of the template of repl for a
+// match, or the match unchanged if executing it fails.
+func (h *Handler) executeTemplate(repl *Replacement, re *regexp.Regexp, src []byte, index []int) []byte {
+	result, err := repl.execute(re, src, index)
+	if err != nil {
+		h.logger.Warn("executing replacement template failed, leaving match unchanged",
+			zap.Int("replacement", repl.index),
+			zap.Error(err))
+		return src[index[0]:index[1]]
+	}
+	return result
+}
+
+// missingEnv returns the name of the first environment variable
+// referenced by an {env.NAME} placeholder in s that is not set.
+func missingEnv(s string) string {
+	for _, m := range envPlaceholderRe.FindAllStringSubmatch(s, -1) {
+		if _, ok := os.LookupEnv(m[1]); !ok {
+			return m[1]
+		}
+	}
+	return ""
+}
+
+// regexpProgramSize returns the number of instructions in the
+// compiled program for expr, which approximates its memory cost.
+func regexpProgramSize(expr string) (int, error) {
+	re, err := syntax.Parse(expr, syntax.Perl)
+	if err != nil {
+		return 0, err
+	}
+	prog, err := syntax.Compile(re.Simplify())
+	if err != nil {
+		return 0, err
+	}
+	return len(prog.Inst), nil
+}
+
+// checkEmptyAlternation returns an error if expr contains an
+// alternation with an empty branch, such as "foo|" or "(|bar)". These
+// are almost always mistakes, and make the expression match the empty
+// string at every position. The branches are checked as written,
+// since the parser factors common prefixes out of alternations and
+// turns "foo|foobar" into "foo(?:|bar)".
+func checkEmptyAlternation(expr string) error {
+	if _, err := syntax.Parse(expr, syntax.Perl); err != nil {
+		return err
+	}
+	// whether the current branch is empty so far, and whether it
+	// follows a |
+	empty, alternative := true, false
+	for i := 0; i < len(expr); i++ {
+		switch expr[i] {
+		case '\\':
+			if strings.HasPrefix(expr[i:], `\Q`) {
+				end := strings.Index(expr[i:], `\E`)
+				if end < 0 {
+					end = len(expr) - i
+				}
+				if end > 2 {
+					empty = false
+				}
+				i += end + 1
+				continue
+			}
+			i++
+			empty = false
+		case '[':
+			i += classLength(expr[i:]) - 1
+			empty = false
+		case '(':
+			if rest, ok := strings.CutPrefix(expr[i:], "(?"); ok {
+				// skip the name or flags of the group
+				end := strings.IndexAny(rest, ":)>")
+				i += len("(?") + end
+				if rest[end] == ')' {
+					// only sets flags, so it matches nothing
+					continue
+				}
+			}
+			empty, alternative = true, false
+		case '|':
+			if empty {
+				return fmt.Errorf("regexp %q contains an empty alternative", expr)
+			}
+			empty, alternative = true, true
+		case ')':
+			if empty && alternative {
+				return fmt.Errorf("regexp %q contains an empty alternative", expr)
+			}
+			empty = false
+		case '*', '+', '?':
+			// quantifiers only repeat what comes before them
+		default:
+			empty = false
+		}
+	}
+	if empty && alternative {
+		return fmt.Errorf("regexp %q contains an empty alternative", expr)
+	}
+	return nil
+}
+
+// classLength returns the length of the character class at the start
+// of expr, which has been parsed successfully.
+func classLength(expr string) int {
+	i := 1
+	if strings.HasPrefix(expr[i:], "^") {
+		i++
+	}
+	// a ] right at the start is part of the class
+	if strings.HasPrefix(expr[i:], "]") {
+		i++
+	}
+	for i < len(expr) {
+		switch {
+		case expr[i] == '\\':
+			i += 2
+		case strings.HasPrefix(expr[i:], "[:"):
+			if end := strings.Index(expr[i+2:], ":]"); end >= 0 {
+				i += end + 4
+			} else {
+				i++
+			}
+		case expr[i] == ']':
+			return i + 1
+		default:
+			i++
+		}
+	}
+	return len(expr)
+}
+
+// ServeHTTP implements caddyhttp.MiddlewareHandler.
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	enclosing := h.enclosingNest(w, r)
+	if h.rewritesCookies() {
+		w = &cookieWriter{
+			ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+			handler:               h,
+		}
+	}
+
+	if len(h.rules) == 0 && len(h.pointerRules) == 0 && len(h.invertRules) == 0 && !h.UpgradeInsecureURLs && !h.StripBOM && !h.CollapseWhitespace && h.bodyFunc == nil {
+		// only possible with allow_empty
+		return next.ServeHTTP(w, r)
+	}
+
+	if !h.matchPath(r.URL.Path) {
+		h.logDecision(r, "skipping replacements on request path not matched")
+		h.logOutcome(r, nil)
+		return next.ServeHTTP(w, r)
+	}
+
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+
+	if h.DebugConfig {
+		h.logEffectiveConfig(r, repl)
+	}
+
+	if h.replacesRequest() {
+		if !h.matchesRequestType(r) {
+			h.logDecision(r, "skipping replacements on request content type not matched",
+				zap.String("content_type", r.Header.Get("Content-Type")))
+		} else if err := h.replaceRequestBody(r); err != nil {
+			if errors.Is(err, errRequestBodyTooLarge) {
+				return caddyhttp.Error(http.StatusRequestEntityTooLarge, err)
+			}
+			return caddyhttp.Error(http.StatusBadRequest, err)
+		}
+	}
+	if !h.replacesResponse() {
+		return next.ServeHTTP(w, r)
+	}
+
+	if enclosing != nil {
+		enclosing.join(h, r)
+		return next.ServeHTTP(w, r)
+	}
+
+	tr := h.checkoutReplacer(repl)
+	tr.Reset()
+	tr.seed(h.sampleSeed(repl))
+	tr.repl = repl
+	tr.mode = ""
+	defer h.releaseReplacer(tr)
+	defer h.logOutcome(r, tr)
+
+	if h.LinkHeaders {
+		w = &linkWriter{
+			ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+			tr:                    tr,
+		}
+	}
+
+	if h.Stream {
+		// don't buffer response body, perform streaming replacement
+		fw := h.newReplaceWriter(w, r, tr)
+		return fw.finish(next.ServeHTTP(fw, r))
+	}
+
+	// get a buffer to hold the response body
+	pool := &bufPool
+	if h.bufPool != nil {
+		pool = h.bufPool
+	}
+	respBuf := pool.Get().(*bytes.Buffer)
+	respBuf.Reset()
+	defer pool.Put(respBuf)
+
+	// set up the response recorder; the response is buffered if
+	// this handler or one nested in it replaces it
+	var nested *nest
+	var replacing bool
+	shouldBuf := func(status int, headers http.Header) bool {
+		buffer := nested.decide(status, headers)
+		if replacing = h.shouldReplace(r, status, headers); replacing {
+			h.countBody(tr, false)
+			tr.mode = "buffer"
+		}
+		return replacing || buffer
+	}
+	rec := caddyhttp.NewResponseRecorder(w, respBuf, shouldBuf)
+
+	// collect the response from upstream
+	var buf http.ResponseWriter = flushGuard{rec, rec}
+	var sw *spillWriter
+	if h.SpillToDisk {
+		sw = &spillWriter{ResponseRecorder: rec, threshold: h.spillThreshold(), dir: h.TempDir}
+		defer sw.cleanup()
+		buf = flushGuard{sw, rec}
+	} else if len(h.StreamStatusCodes) == 0 {
+		nested = &nest{w: buf}
+		r = r.WithContext(context.WithValue(r.Context(), nestKey{}, nested))
+	}
+	var err error
+	if len(h.StreamStatusCodes) > 0 {
+		hw := &hybridWriter{
+			ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+			handler:               h,
+			stream:                h.newReplaceWriter(w, r, tr),
+			buffer:                buf,
+		}
+		err = next.ServeHTTP(hw, r)
+		if hw.streamed {
+			return hw.stream.finish(err)
+		}
+	} else {
+		err = next.ServeHTTP(buf, r)
+	}
+	if err == nil && sw != nil && sw.file != nil {
+		return h.writeSpilled(w, r, rec, sw.file, tr)
+	}
+	if err != nil {
+		return err
+	}
+	if !rec.Buffered() {
+		return nil // Skipped, no need to replace
+	}
+	h.logDecision(r, "buffered response for replacements",
+		zap.Int("status", rec.Status()),
+		zap.Int("size", rec.Buffer().Len()))
+
+	body := rec.Buffer().Bytes()
+	changed := false
+	if nested != nil {
+		body, changed, err = nested.replace(rec.Status(), rec.Header(), body)
+		if err != nil {
+			return err
+		}
+	}
+	result := body
+	if replacing {
+		var ok bool
+		result, ok, err = h.replaceBuffered(r, rec.Status(), rec.Header(), body, tr)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			result = body
+		}
+		changed = changed || ok
+	}
+	if !changed {
+		return rec.WriteResponse()
+	}
+
+	// make sure length is correct, otherwise bad things can happen
+	if w.Header().Get("Content-Length") != "" {
+		w.Header().Set("Content-Length", strconv.Itoa(len(result)))
+	}
+
+	// the upstream may have written a body without a status,
+	// which implies 200; write it explicitly now that the headers
+	// are final
+	status := rec.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(result)
+
+	return nil
+}
+
+// replaceBuffered performs the replacements of tr on body, the
+// buffered response to r with the given status and headers, and
+// returns the result. The headers are updated to match, except for
+// Content-Length. It reports false if the body is to be passed
+// through as it is.
+func (h *Handler) replaceBuffered(r *http.Request, status int, header http.Header, body []byte, tr *replacer) ([]byte, bool, error) {
+	repl := tr.repl
+	if ok, err := h.lengthMismatch(r, status, header, int64(len(body))); !ok {
+		return nil, false, err
+	}
+	if h.ExposeOriginal {
+		// the buffer goes back to the pool, so keep a copy
+		caddyhttp.SetVar(r.Context(), originalBodyVar, bytes.Clone(body))
+	}
+
+	var err error
+	var encodings []string
+	if h.Decompress {
+		var ok bool
+		encodings, ok = contentEncodings(header)
+		if !ok {
+			h.logDecision(r, "skipping replacements on response with unsupported encoding",
+				zap.Strings("content_encoding", header.Values("Content-Encoding")))
+			return nil, false, nil
+		}
+		if len(encodings) > 0 {
+			body, err = decodeBody(body, encodings)
+			if err != nil {
+				h.logDecision(r, "skipping replacements on response that could not be decoded",
+					zap.Error(err))
+				return nil, false, nil
+			}
+		}
+	}
+
+	var qpBody []byte
+	if h.decodesQuotedPrintable(header) {
+		qpBody = body
+		body, err = decodeQuotedPrintable(body)
+		if err != nil {
+			h.logDecision(r, "skipping replacements on response that is not valid quoted-printable",
+				zap.Error(err))
+			return nil, false, nil
+		}
+	}
+
+	if !h.ForceBinary && header.Get("Content-Type") == "" && isBinaryContent(body) {
+		h.logDecision(r, "skipping replacements on binary response")
+		return nil, false, nil
+	}
+	if ok, err := h.checkUTF8(r, body); !ok {
+		return nil, false, err
+	}
+
+	if ok, err := h.acquireSlot(r); !ok {
+		if err != nil {
+			return nil, false, err
+		}
+		return nil, false, nil
+	}
+	defer h.releaseSlot()
+
+	h.takeNonce(tr, header)
+	rt := h.responseTransformer(tr, header)
+
+	var result []byte
+	if boundary := h.multipartBoundary(header); boundary != "" {
+		var out bytes.Buffer
+		mw := newMultipartWriter(&out, rt, boundary, h.partSelected)
+		if _, err := mw.Write(body); err != nil {
+			return nil, false, err
+		}
+		if err := mw.Close(); err != nil {
+			return nil, false, err
+		}
+		result = out.Bytes()
+	} else if h.DecodeEntities && isHTML(header) {
+		result, err = replaceHTMLText(rt, body)
+		if err != nil {
+			return nil, false, err
+		}
+	} else {
+		// TODO: could potentially use transform.Append here with a pooled byte slice as buffer?
+		result, _, err = transform.Bytes(rt, body)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	if len(h.pointerRules) > 0 && isJSON(header) {
+		result = h.replaceJSONPointers(r, repl, tr, result)
+	}
+	if len(h.invertRules) > 0 {
+		result = h.replaceInverted(repl, result)
+	}
+	if h.bodyFunc != nil {
+		result = h.bodyFunc(result, repl)
+	}
+	if ok, err := h.checkExpansion(r, len(body), len(result)); !ok {
+		return nil, false, err
+	}
+
+	for i, repl := range h.rules {
+		if repl.Required && tr.counts[i] == 0 && tr.inNth(repl) && tr.active(repl) && !tr.omits(repl) {
+			code := h.RequiredStatus
+			if code == 0 {
+				code = http.StatusInternalServerError
+			}
+			return nil, false, caddyhttp.Error(code, fmt.Errorf("required replacement %d made no replacements", repl.index))
+		}
+	}
+
+	if !bytes.Equal(result, body) {
+		h.dropHeaders(header)
+		h.addScriptHashes(header, tr)
+	}
+	if h.Trailers {
+		if err := replaceTrailers(header, tr); err != nil {
+			return nil, false, err
+		}
+	}
+	h.varySelectHeaders(header)
+
+	if h.PreviewBytes > 0 {
+		preview := result
+		if len(preview) > h.PreviewBytes {
+			preview = preview[:h.PreviewBytes]
+		}
+		header.Set(previewHeader, base64.StdEncoding.EncodeToString(preview))
+	}
+	if h.LengthHeaders {
+		header.Set(originalLengthHeader, strconv.Itoa(len(body)))
+		header.Set(modifiedLengthHeader, strconv.Itoa(len(result)))
+	}
+
+	if qpBody != nil {
+		result, err = encodeQuotedPrintable(result, qpBody)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	if len(encodings) > 0 && h.ReencodeForClient {
+		if encoding, ok := chooseEncoding(r.Header.Get("Accept-Encoding")); !ok {
+			h.logDecision(r, "keeping upstream content coding, client accepts no other")
+		} else if encoding != "" {
+			encodings = []string{encoding}
+			header.Set("Content-Encoding", encoding)
+		} else {
+			encodings = nil
+			header.Del("Content-Encoding")
+		}
+		addVary(header, "Accept-Encoding")
+	}
+	if len(encodings) > 0 {
+		result, err = encodeBody(result, encodings)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	return result, true, nil
+}
+
+// matchPath reports whether requests for the URL path p should have
+// their responses replaced.
+func (h *Handler) matchPath(p string) bool {
+	if len(h.Paths) == 0 && h.pathRe == nil {
+		return true
+	}
+	for _, prefix := range h.Paths {
+		if strings.ContainsAny(prefix, "*?[") {
+			if ok, _ := path.Match(prefix, p); ok {
+				return true
+			}
+		} else if strings.HasPrefix(p, prefix) {
+			return true
+		}
+	}
+	return h.pathRe != nil && h.pathRe.MatchString(p)
+}
+
+// shouldReplace reports whether replacements should be performed on
+// the response to r with the given status and headers.
+func (h *Handler) shouldReplace(r *http.Request, status int, header http.Header) bool {
+	if h.MatchAccept && !accepts(r.Header.Get("Accept"), header.Get("Content-Type")) {
+		h.logDecision(r, "skipping replacements on response not accepted by client",
+			zap.String("accept", r.Header.Get("Accept")),
+			zap.String("content_type", header.Get("Content-Type")))
+		return false
+	}
+	if ct := header.Get("Content-Type"); matchesContentType(h.ExcludeContentTypes, ct) {
+		h.logDecision(r, "skipping replacements on excluded content type",
+			zap.String("content_type", ct))
+		return false
+	}
+	if h.SkipIfCached {
+		if indicator := h.cachedBy(header); indicator != "" {
+			h.logDecision(r, "skipping replacements on cached response",
+				zap.String("indicator", indicator))
+			return false
+		}
+	}
+	if h.MaxAge > 0 {
+		if age, ok := responseAge(header); ok && age > time.Duration(h.MaxAge) {
+			h.logDecision(r, "skipping replacements on response older than max_age",
+				zap.Duration("age", age))
+			return false
+		}
+	}
+	if name := h.skippedBy(header); name != "" {
+		h.logDecision(r, "skipping replacements on response marked by header",
+			zap.String("header", name))
+		return false
+	}
+	if h.Matcher != nil && !h.Matcher.Match(status, header) {
+		h.logDecision(r, "skipping replacements on response not matched",
+			zap.Int("status", status))
+		return false
+	}
+	if ct := header.Get("Content-Type"); !h.ForceBinary && isBinaryType(ct) {
+		h.logDecision(r, "skipping replacements on binary response",
+			zap.String("content_type", ct))
+		return false
+	}
+	// Always replace if no matcher is specified
+	return true
+}
+
+// responseTransformer returns the transformer to apply to the body of
+// a response with the given headers, given the pooled transformer tr
+// that performs the configured replacements.
+func (h *Handler) responseTransformer(tr transform.Transformer, header http.Header) transform.Transformer {
+	switch h.Scope {
+	case scopeComments, scopeNonComments:
+		comments := h.Scope == scopeComments
+		if syntax := commentSyntaxOf(header); syntax != nil {
+			tr = newScopeTransformer(tr, syntax, comments)
+		} else if comments {
+			// nothing to replace
+			tr = transform.Nop
+		}
+	}
+	if h.UpgradeInsecureURLs {
+		tr = transform.Chain(tr, newURLUpgrader(h.UpgradeHosts, isHTML(header)))
+	}
+	if h.CollapseWhitespace {
+		tr = transform.Chain(tr, newWhitespaceCollapser(isHTML(header)))
+	}
+	if h.StripBOM {
+		tr = transform.Chain(tr, new(bomStripper))
+	}
+	return tr
+}
+
+// wrapsTransformer reports whether responseTransformer may wrap the
+// transformer it is given.
+func (h *Handler) wrapsTransformer() bool {
+	return h.Scope == scopeComments || h.Scope == scopeNonComments || h.UpgradeInsecureURLs || h.CollapseWhitespace || h.StripBOM
+}
+
+// mode returns the name of the mode replacements are performed in.
+func (h *Handler) mode() string {
+	if h.Stream {
+		return "stream"
+	}
+	if len(h.StreamStatusCodes) > 0 {
+		return "hybrid"
+	}
+	return "buffer"
+}
+
+// logDecision logs how the response to r is being handled at debug
+// level, along with the mode. Nothing is encoded unless debug logging
+// is enabled.
+func (h *Handler) logDecision(r *http.Request, msg string, fields ...zap.Field) {
+	if ce := h.logger.Check(zapcore.DebugLevel, msg); ce != nil {
+		ce.Write(append(fields,
+			zap.String("mode", h.mode()),
+			zap.String("uri", r.RequestURI))...)
+	}
+}
+
+// multipartBoundary returns the multipart boundary of a response with
+// the given headers if replacements should be restricted to some of
+// its parts, or the empty string otherwise.
+func (h *Handler) multipartBoundary(header http.Header) string {
+	if len(h.MultipartParts) == 0 {
+		return ""
+	}
+	return multipartBoundary(header)
+}
+
+// partSelected reports whether replacements should be performed on
+// the multipart part with the given index.
+func (h *Handler) partSelected(part int) bool {
+	for _, p := range h.MultipartParts {
+		if p == part {
+			return true
+		}
+	}
+	return false
+}
+
+// Replacement is either a substring or regular expression replacement
+// to perform; precisely one must be specified, not both.
+type Replacement struct {
+	// A name for this replacement, used as the rule label of the
+	// replacements_total metric so that replacements can be told
+	// apart on dashboards. It must be a static value; placeholders
+	// are not allowed, to keep the number of label values bounded.
+	// Matches replaced by unnamed replacements are not counted.
+	Name string `json:"name,omitempty"`
+
+	// A substring to search for. Mutually exclusive with search_regexp.
+	Search string `json:"search,omitempty"`
+
+	// A regular expression to search for. Mutually exclusive with search.
+	SearchRegexp string `json:"search_regexp,omitempty"`
+
+	// If true, . in search_regexp matches newlines too, as with the
+	// (?s) flag, so that a pattern such as "<!--.*?-->" matches
+	// across lines.
+	DotAll bool `json:"dot_all,omitempty"`
+
+	// If true, ^ and $ in search_regexp match at the start and end
+	// of each line, as with the (?m) flag, rather than only at the
+	// start and end of the text being matched.
+	Multiline bool `json:"multiline,omitempty"`
+
+	// If true, matches of search_regexp may overlap: after a match,
+	// the next one is searched for from the character after its
+	// start instead of from its end, so "aa" matches "aaa" twice.
+	// A run of overlapping matches is replaced by the replacement
+	// of each match in turn, so with "<$0>" as the replacement,
+	// "aaa" becomes "<aa><aa>". The search_regexp can't contain ^,
+	// \A, \b or \B, and regions are not supported. Not supported
+	// with conflict_resolution longest_match_wins.
+	Overlap bool `json:"overlap,omitempty"`
+
+	// The replacement strings/values, one of which is chosen at
+	// random, or according to weights. A single string is accepted too. Required, unless
+	// mask is set. The tokens {counter} and {uuid} are expanded
+	// for each match, to an incrementing number that restarts with
+	// every response and to a random UUID. The placeholder
+	// {http.replace_response.match} is the text of the match.
+	Replaces []string `json:"replace"`
+
+	// If true, the replace value is JSON-escaped after its
+	// placeholders are expanded, so that quotes, backslashes and
+	// control characters in placeholder values can't break out of
+	// the JSON string the value is inserted into. The surrounding
+	// quotes are not added. Submatches inserted with $1 and the
+	// like come from the body and are left as they are.
+	EscapeJSON bool `json:"escape_json,omitempty"`
+
+	// If true, the replace value takes on the casing of the match:
+	// it is lowercased if all letters of the match are lowercase,
+	// uppercased if they are all uppercase and there are at least
+	// two, and lowercased with its first letter uppercased if only
+	// the first letter of the match is uppercase. With any other
+	// casing, such as "iPhone", or with no letters, the value is
+	// used as it is. A search is matched ignoring case; with
+	// search_regexp, use the (?i) flag for that.
+	PreserveCase bool `json:"preserve_case,omitempty"`
+
+	// The relative weights of the replace values, one for each.
+	// If set, one value is chosen for each response, with a
+	// probability proportional to its weight, instead of at
+	// random for each transformer. With the handler's sticky_key,
+	// the key's hash determines the choice, so the same key always
+	// gets the same value, and keys are split between the values
+	// according to the weights. Each replacement chooses
+	// independently of the others, since the hash is salted with
+	// its name or index, unless the handler has correlated_random.
+	Weights []float64 `json:"weights,omitempty"`
+
+	// The name of a request header whose value picks the replace
+	// value for each response, by looking it up in header_map,
+	// instead of choosing at random or by weights. Values are
+	// matched exactly; the header's values are joined with commas
+	// if it is sent more than once.
+	SelectByHeader string `json:"select_by_header,omitempty"`
+
+	// The index into replace for each value of the select_by_header
+	// header, such as {"US": 0, "DE": 1}.
+	HeaderMap map[string]int `json:"header_map,omitempty"`
+
+	// The index into replace used when the select_by_header header
+	// is missing or its value is not in header_map. Default: 0.
+	HeaderDefault int `json:"header_default,omitempty"`
+
+	// Replacements with a higher priority are applied before those
+	// with a lower priority; replacements with equal priority are
+	// applied in config order. Since each replacement operates on
+	// the output of the ones before it, this determines how
+	// replacements cascade. Default: 0.
+	Priority int `json:"priority,omitempty"`
+
+	// The fraction of matches to replace, between 0 and 1; the
+	// rest are left unchanged. Which matches are replaced is
+	// random, unless the handler has a sticky_key. Default: 1.
+	SampleRate float64 `json:"sample_rate,omitempty"`
+
+	// Only replace matches within this region of the body, given
+	// as a range of byte offsets, from from_offset (inclusive) to
+	// to_offset (exclusive), and/or a range of line numbers,
+	// from from_line to to_line (both inclusive, counting from 1).
+	// A match must lie entirely within the byte range, and start
+	// within the line range. Positions refer to the body as seen
+	// by this replacement, i.e. after the replacements applied
+	// before it. Zero leaves that end of a range open.
+	FromOffset int64 `json:"from_offset,omitempty"`
+	ToOffset   int64 `json:"to_offset,omitempty"`
+	FromLine   int   `json:"from_line,omitempty"`
+	ToLine     int   `json:"to_line,omitempty"`
+
+	// If true, only a match that starts at the very start of the
+	// body, or ends at its very end, is replaced. Unlike ^ and $,
+	// these never match at line boundaries. Like regions, they
+	// refer to the body as seen by this replacement.
+	AnchorStart bool `json:"anchor_start,omitempty"`
+	AnchorEnd   bool `json:"anchor_end,omitempty"`
+
+	// If true, responses in which this replacement made no
+	// replacements fail with the handler's required_status
+	// instead of being served, for rewrites that must not be
+	// missed, such as redacting a secret. Buffer mode only.
+	Required bool `json:"required,omitempty"`
+
+	// If true, this replacement is only performed in the first
+	// response in which it matches, after which it is disabled
+	// server-wide until the config is reloaded. All matches in
+	// that response are replaced.
+	Once bool `json:"once,omitempty"`
+
+	// If true, only the first match of each distinct value is
+	// replaced in a response, and later matches of the same text
+	// are left unchanged, such as to link a glossary term only
+	// where it first appears. Values are compared exactly, or
+	// ignoring case if the search does: with preserve_case, or a
+	// search_regexp that starts with the (?i) flag.
+	OncePerValue bool `json:"once_per_value,omitempty"`
+
+	// If set, this replacement is only performed in every Nth
+	// response that is replaced, server-wide, such as every 100th
+	// for a value of 100; other responses are left alone. Unlike
+	// sample_rate, this decides per response rather than per
+	// match. The count restarts when the config is reloaded.
+	// Request bodies are counted separately.
+	EveryNth int `json:"every_nth,omitempty"`
+
+	// If set, this replacement only becomes active this long after
+	// the config is loaded, for example to show a banner some time
+	// after a deploy. Until then, responses are replaced as if it
+	// weren't there. Each response is decided as a whole when its
+	// body starts. The delay restarts when the config is reloaded.
+	ActivateAfter caddy.Duration `json:"activate_after,omitempty"`
+
+	// The name of a feature flag in the handler's flags_file. This
+	// replacement is only performed while the flag is true; if it
+	// is false or missing from the file, responses are replaced as
+	// if it weren't there. Each response is decided as a whole when
+	// its body starts.
+	FlagKey string `json:"flag_key,omitempty"`
+
+	// Replace each match with this character, repeated once for
+	// every byte of the match, or every rune with mask_by "runes".
+	// This hides secrets while preserving the layout. Mutually
+	// exclusive with replace.
+	Mask string `json:"mask,omitempty"`
+
+	// Whether mask counts the length of a match in "bytes" (the
+	// default) or "runes".
+	MaskBy string `json:"mask_by,omitempty"`
+
+	// Replace each match with the hex-encoded hash of its bytes,
+	// computed with this algorithm: "md5", "sha1", "sha256" or
+	// "sha512". This can turn an asset reference into a content
+	// addressed name. Mutually exclusive with replace, mask,
+	// template, replace_file and decode_match_base64.
+	HashMatch string `json:"hash_match,omitempty"`
+
+	// If set, the hash of hash_match is cut off after this many hex
+	// digits. Default: 0, the whole hash.
+	HashLength int `json:"hash_length,omitempty"`
+
+	// Text inserted before and after each match, which is kept
+	// as it is, such as "<mark>" and "</mark>". Unlike replacing
+	// with $0 or the match placeholder, the match needs no
+	// escaping, even for a search. Placeholders are expanded.
+	// Mutually exclusive with replace, mask, hash_match, template,
+	// replace_file and decode_match_base64.
+	Prefix string `json:"prefix,omitempty"`
+	Suffix string `json:"suffix,omitempty"`
+
+	// The capture group of a search_regexp match that mask,
+	// hash_match or decode_match_base64 applies to, leaving the
+	// rest of the match intact. Default: 0, the whole match.
+	Group int `json:"group,omitempty"`
+
+	// If true, the match, or its capture group Group, is base64
+	// decoded, the base64_replacements are performed on the decoded
+	// content, and the result is encoded again in its place. It is
+	// URL-safe base64 if it contains - or _, and unpadded if its
+	// length is not a multiple of 4; otherwise it is standard,
+	// padded base64. Matches that aren't valid base64 are left
+	// unchanged. Requires search_regexp; mutually exclusive
+	// with replace, mask, template and replace_file.
+	DecodeMatchBase64 bool `json:"decode_match_base64,omitempty"`
+
+	// The replacements performed, in order, on the content decoded
+	// by decode_match_base64. Only search, search_regexp and replace
+	// can be used.
+	Base64Replacements []*Replacement `json:"base64_replacements,omitempty"`
+
+	// A text/template executed for each match to produce its
+	// replacement. The match is available as {{.Full}}, capture
+	// groups as {{.Group 1}} and named groups as {{.Named "name"}}.
+	// If executing the template fails, the match is left unchanged.
+	// Mutually exclusive with replace and mask.
+	Template string `json:"template,omitempty"`
+
+	// A file whose contents replace each match. It is read again
+	// when it changes, so edits show up in the next response. The
+	// path may contain placeholders, as long as their values are
+	// not "." or ".." and contain no slashes. If the file can't be
+	// read, matches are left unchanged. Mutually exclusive with
+	// replace, mask and template.
+	ReplaceFile string `json:"replace_file,omitempty"`
+
+	// The name of a body func registered with RegisterBodyFunc that
+	// transforms each match; it is given the text of the match and
+	// the request's replacer, and returns its replacement. Mutually
+	// exclusive with replace, mask, hash_match, prefix, suffix,
+	// template, replace_file and decode_match_base64.
+	FuncTransform string `json:"func_transform,omitempty"`
+
+	// If true, func_transform is applied to the text between the
+	// matches of search_regexp, which are left as they are, rather
+	// than to the matches, to transform everything except what they
+	// protect. The func is called once for each region between two
+	// matches, before the first and after the last, except for
+	// regions that are empty because matches are adjacent or at the
+	// start or end of the body; a body without matches is a single
+	// region. Regions depend on the whole body, so inverted
+	// replacements are performed in buffer mode only, after the
+	// other replacements, in order of priority, and not on bodies
+	// spilled to disk. They can only be combined with
+	// search_regexp, func_transform and priority.
+	Invert bool `json:"invert,omitempty"`
+
+	// A JSON Pointer (RFC 6901), such as "/items/0/name", to a value
+	// in JSON response bodies to replace instead of searching the
+	// whole body. A path such as "$.items[0].name" or
+	// "$['items'][-1]" is accepted too. Negative array indices
+	// count from the end, so -1 is the last element. Without search
+	// or search_regexp, the value is set to the replace value, as a
+	// string; with them, they are replaced within the value, which
+	// must be a string. Bodies that aren't valid JSON and pointers
+	// that refer to no value, such as an index out of range, are
+	// left alone. Buffer mode only.
+	JSONPointer string `json:"json_pointer,omitempty"`
+
+	// index in the handler's config, for error messages
+	index int
+
+	// whether one of several replace values is chosen for each
+	// response, by the handler's CorrelatedRandom
+	correlated bool
+
+	// mixed into the draw of each response to choose the weighted
+	// value of this replacement; zero with CorrelatedRandom
+	salt uint64
+
+	// A condition on the capture groups of a search_regexp match,
+	// or on a placeholder of the request; matches for which it does
+	// not hold are left unchanged. The syntax is
+	// `$<group> == "<value>"` or `$<group> != "<value>"`, where
+	// <group> is a group number or a braced group name, as in `$1`
+	// or `${name}`, and <value> is a double-quoted string. Instead
+	// of a group, a placeholder such as `{http.request.proto}` can
+	// be compared, which is evaluated for each request, so the
+	// rule only applies to some requests. Group conditions require
+	// search_regexp.
+	When string `json:"when,omitempty"`
+
+	re      *regexp.Regexp
+	cond    *condition
+	tmpl    *template.Template
+	files   *fileCache
+	pointer []string
+	counter prometheus.Counter
+
+	// the function FuncTransform refers to
+	bodyFunc BodyFunc
+}
+
+// UnmarshalJSON unmarshals a replacement, accepting either a single
+// string or an array of strings for the replace values.
+func (repl *Replacement) UnmarshalJSON(b []byte) error {
+	type replacement Replacement
+	aux := struct {
+		*replacement
+		Replaces json.RawMessage `json:"replace"`
+	}{replacement: (*replacement)(repl)}
+
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&aux); err != nil {
+		return err
+	}
+
+	repl.Replaces = nil
+	raw := bytes.TrimSpace(aux.Replaces)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil
+	}
+	if raw[0] == '"' {
+		var single string
+		if err := json.Unmarshal(raw, &single); err != nil {
+			return err
+		}
+		repl.Replaces = []string{single}
+		return nil
+	}
+	return json.Unmarshal(raw, &repl.Replaces)
+}
+
+// provision validates the replacement and prepares it for use.
+func (repl *Replacement) provision(maxRegexpSize, maxSearchLength int, requireEnv bool) error {
+	if strings.ContainsAny(repl.Name, "{}") {
+		return fmt.Errorf("name %q must not contain placeholders", repl.Name)
+	}
+	if repl.Name != "" {
+		ruleMetrics.init.Do(initRuleMetrics)
+		repl.counter = ruleMetrics.replacements.WithLabelValues(repl.Name)
+	}
+	if repl.Search == "" && repl.SearchRegexp == "" && repl.JSONPointer == "" {
+		return fmt.Errorf("no search, search_regexp or json_pointer configured")
+	}
+	if repl.Search != "" && repl.SearchRegexp != "" {
+		return fmt.Errorf("cannot specify both search and search_regexp in same replacement")
+	}
+	if maxSearchLength > 0 && len(repl.Search) > maxSearchLength {
+		return fmt.Errorf("search length %d exceeds max_search_length of %d", len(repl.Search), maxSearchLength)
+	}
+	if err := repl.checkJSONPointer(); err != nil {
+		return err
+	}
+	if err := repl.checkMask(); err != nil {
+		return err
+	}
+	if err := repl.checkHash(); err != nil {
+		return err
+	}
+	if err := repl.checkWrap(); err != nil {
+		return err
+	}
+	if err := repl.checkFuncTransform(); err != nil {
+		return err
+	}
+	if err := repl.checkInvert(); err != nil {
+		return err
+	}
+	if err := repl.parseTemplate(); err != nil {
+		return err
+	}
+	if repl.ReplaceFile != "" {
+		if len(repl.Replaces) > 0 || repl.Mask != "" || repl.Template != "" {
+			return fmt.Errorf("replace_file is mutually exclusive with replace, mask and template")
+		}
+		repl.files = new(fileCache)
+	}
+	if len(repl.Replaces) == 0 && repl.Mask == "" && repl.HashMatch == "" && !repl.wraps() && repl.Template == "" && repl.ReplaceFile == "" && repl.FuncTransform == "" && !repl.DecodeMatchBase64 {
+		return fmt.Errorf("no replace values, mask, hash_match, prefix or suffix, template, replace_file, func_transform or decode_match_base64 configured")
+	}
+	if repl.EscapeJSON {
+		if len(repl.Replaces) == 0 {
+			return fmt.Errorf("escape_json requires replace values")
+		}
+		if repl.JSONPointer != "" {
+			return fmt.Errorf("escape_json has no effect with json_pointer, whose values are always encoded")
+		}
+	}
+	if err := repl.checkPreserveCase(); err != nil {
+		return err
+	}
+	if err := repl.checkRegion(); err != nil {
+		return err
+	}
+	if repl.SampleRate < 0 || repl.SampleRate > 1 {
+		return fmt.Errorf("sample_rate must be between 0 and 1, got %v", repl.SampleRate)
+	}
+	if repl.EveryNth < 0 {
+		return fmt.Errorf("every_nth must not be negative, got %d", repl.EveryNth)
+	}
+	if repl.ActivateAfter < 0 {
+		return fmt.Errorf("activate_after must not be negative, got %v", time.Duration(repl.ActivateAfter))
+	}
+	if err := repl.checkRegexpFlags(); err != nil {
+		return err
+	}
+	if err := repl.checkOverlap(); err != nil {
+		return err
+	}
+	if repl.SearchRegexp != "" {
+		expr := repl.regexpSource()
+		if maxRegexpSize > 0 {
+			size, err := regexpProgramSize(expr)
+			if err != nil {
+				return err
+			}
+			if size > maxRegexpSize {
+				return fmt.Errorf("compiled regexp size %d exceeds max_regexp_size of %d", size, maxRegexpSize)
+			}
+		}
+		if err := checkEmptyAlternation(expr); err != nil {
+			return err
+		}
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return err
+		}
+		repl.re = re
+	}
+	if requireEnv {
+		for _, val := range append([]string{repl.Search, repl.ReplaceFile, repl.Prefix, repl.Suffix}, repl.Replaces...) {
+			if name := missingEnv(val); name != "" {
+				return fmt.Errorf("environment variable %s is not set", name)
+			}
+		}
+	}
+	if repl.When != "" {
+		cond, err := parseCondition(repl.When, repl.re)
+		if err != nil {
+			return err
+		}
+		repl.cond = cond
+	}
+	if err := repl.checkGroup(); err != nil {
+		return err
+	}
+	if err := repl.checkBase64(maxRegexpSize, maxSearchLength, requireEnv); err != nil {
+		return err
+	}
+	if err := repl.checkWeights(); err != nil {
+		return err
+	}
+	return repl.checkSelectByHeader()
+}
+
+// chooseReplace picks one of the replace values, with global
+// placeholders expanded. With weights or select_by_header, it is the
+// one chooseVariant returns for point, between 0 and 1; otherwise it
+// is picked at random. It returns the empty string for masking
+// replacements.
+func (repl *Replacement) chooseReplace(placeholderRepl *caddy.Replacer, point float64) string {
+	if len(repl.Replaces) == 0 {
+		return ""
+	}
+	if repl.hasVariants() {
+		return placeholderRepl.ReplaceKnown(repl.Replaces[repl.chooseVariant(placeholderRepl, point)], "")
+	}
+	randMu.Lock()
+	i := randReplace.IntN(len(repl.Replaces))
+	randMu.Unlock()
+	return placeholderRepl.ReplaceKnown(repl.Replaces[i], "")
+}
+
+// escape returns s JSON-escaped, without the quotes, if EscapeJSON is
+// set, and s unchanged otherwise.
+func (repl *Replacement) escape(s string) string {
+	if !repl.EscapeJSON {
+		return s
+	}
+	var buf strings.Builder
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	// encoding a string can't fail
+	_ = enc.Encode(s)
+	out := strings.TrimSuffix(buf.String(), "\n")
+	return out[1 : len(out)-1]
+}
+
+// equal reports whether repl and other perform the same replacement.
+func (repl *Replacement) equal(other *Replacement) bool {
+	if repl.Search != other.Search || repl.SearchRegexp != other.SearchRegexp || repl.DotAll != other.DotAll || repl.Multiline != other.Multiline || repl.Overlap != other.Overlap ||
+		repl.When != other.When || repl.Mask != other.Mask || repl.MaskBy != other.MaskBy ||
+		repl.HashMatch != other.HashMatch || repl.HashLength != other.HashLength || repl.Group != other.Group ||
+		repl.Prefix != other.Prefix || repl.Suffix != other.Suffix || repl.FuncTransform != other.FuncTransform || repl.Invert != other.Invert ||
+		repl.Template != other.Template || repl.ReplaceFile != other.ReplaceFile ||
+		repl.JSONPointer != other.JSONPointer || repl.EscapeJSON != other.EscapeJSON || repl.OncePerValue != other.OncePerValue || repl.PreserveCase != other.PreserveCase || repl.FlagKey != other.FlagKey ||
+		repl.DecodeMatchBase64 != other.DecodeMatchBase64 || len(repl.Base64Replacements) != len(other.Base64Replacements) ||
+		repl.SelectByHeader != other.SelectByHeader || repl.HeaderDefault != other.HeaderDefault || len(repl.HeaderMap) != len(other.HeaderMap) ||
+		len(repl.Replaces) != len(other.Replaces) || len(repl.Weights) != len(other.Weights) {
+		return false
+	}
+	for i := range repl.Replaces {
+		if repl.Replaces[i] != other.Replaces[i] {
+			return false
+		}
+	}
+	for i := range repl.Weights {
+		if repl.Weights[i] != other.Weights[i] {
+			return false
+		}
+	}
+	for value, i := range repl.HeaderMap {
+		if j, ok := other.HeaderMap[value]; !ok || i != j {
+			return false
+		}
+	}
+	for i := range repl.Base64Replacements {
+		if !repl.Base64Replacements[i].equal(other.Base64Replacements[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// replaceWriter is used for streaming response body replacement. It
+// ensures the Content-Length header is removed from replaced responses
+// and writes to tw, which should be a transform writer that performs
+// replacements.
+type replaceWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	wroteHeader bool
+	tw          io.WriteCloser
+	tr          *replacer
+	handler     *Handler
+	req         *http.Request
+
+	// whether a MaxConcurrent slot was taken for the response
+	holdsSlot bool
+
+	// the start of the replaced body, with BufferUntilFirstMatch
+	head *headBuffer
+
+	// bytes received from upstream so far, and whether the
+	// stream was cut off at MaxStreamBytes
+	written   int64
+	truncated bool
+
+	// guards writes against the delayed flush
+	mu           sync.Mutex
+	flushPending bool
+	flushTimer   *time.Timer
+	closed       bool
+}
+
+// newReplaceWriter returns a replaceWriter that streams the response
+// to r through tr to w.
+func (h *Handler) newReplaceWriter(w http.ResponseWriter, r *http.Request, tr *replacer) *replaceWriter {
+	return &replaceWriter{
+		ResponseWriterWrapper: &caddyhttp.ResponseWriterWrapper{ResponseWriter: w},
+		tr:                    tr,
+		handler:               h,
+		req:                   r,
+	}
+}
+
+func (fw *replaceWriter) WriteHeader(status int) {
+	if fw.wroteHeader {
+		return
+	}
+	// informational responses such as 103 Early Hints precede the
+	// final one and have no body, so they are passed through
+	if status >= 100 && status <= 199 {
+		fw.ResponseWriterWrapper.WriteHeader(status)
+		return
+	}
+	fw.wroteHeader = true
+
+	// responses that can't or don't have a body are passed through
+	// as-is, so their headers are left alone
+	if fw.handler.shouldReplace(fw.req, status, fw.ResponseWriterWrapper.Header()) &&
+		bodyAllowed(status) && fw.Header().Get("Content-Length") != "0" {
+		if encoding, ok := fw.handler.streamEncoding(fw.req, fw.Header()); ok {
+			// if the client went away while waiting for a slot,
+			// there is no point in replacing
+			if ok, _ := fw.handler.acquireSlot(fw.req); ok {
+				fw.holdsSlot = true
+				fw.startReplacing(status, encoding)
+			}
+		}
+	}
+	if fw.tw == nil {
+		fw.checkPassthroughLength()
+	}
+
+	// the head buffer writes the header once it is sent
+	if fw.head == nil {
+		fw.ResponseWriterWrapper.WriteHeader(status)
+	}
+}
+
+// checkPassthroughLength removes the Content-Length header of a
+// response that is passed through without replacements if the body
+// won't have that length, because MaxStreamBytes will cut it off.
+// Otherwise the client would wait for bytes that never come.
+func (fw *replaceWriter) checkPassthroughLength() {
+	max := fw.handler.MaxStreamBytes
+	declared := fw.Header().Get("Content-Length")
+	if max <= 0 || declared == "" {
+		return
+	}
+	if length, err := strconv.ParseInt(declared, 10, 64); err != nil || length > max {
+		fw.Header().Del("Content-Length")
+		fw.handler.logDecision(fw.req, "removing Content-Length of streamed response longer than max_stream_bytes",
+			zap.String("content_length", declared))
+	}
+}
+
+// startReplacing sets up the writer that performs replacements on
+// the body, decoding it first if it is encoded with encoding.
+func (fw *replaceWriter) startReplacing(status int, encoding string) {
+	fw.handler.countBody(fw.tr, false)
+	fw.tr.mode = "stream"
+	fw.handler.takeNonce(fw.tr, fw.Header())
+	tr := fw.handler.responseTransformer(fw.tr, fw.Header())
+	replace := func(dst io.Writer) io.WriteCloser {
+		if boundary := fw.handler.multipartBoundary(fw.Header()); boundary != "" {
+			return newMultipartWriter(dst, tr, boundary, fw.handler.partSelected)
+		}
+		if fw.handler.SSEBoundaryAware && isEventStream(fw.Header()) {
+			return newSSEWriter(dst, tr)
+		}
+		if fw.handler.single != nil {
+			return newLiteralWriter(dst, *fw.handler.single)
+		}
+		return newTransformWriter(dst, tr)
+	}
+
+	// the transform writer flushes on Close even if there is
+	// nothing to flush, so drop empty writes
+	dst := nonEmptyWriter{fw.ResponseWriterWrapper}
+	var head *headBuffer
+	if fw.handler.BufferUntilFirstMatch {
+		head = &headBuffer{fw: fw, status: status, hadLength: fw.Header().Get("Content-Length") != ""}
+		dst = nonEmptyWriter{head}
+	}
+	if encoding == "" {
+		fw.tw = replace(dst)
+	} else {
+		reencoding := encoding
+		if fw.handler.ReencodeForClient {
+			if chosen, ok := chooseEncoding(fw.req.Header.Get("Accept-Encoding")); ok {
+				reencoding = chosen
+			}
+		}
+		cw, err := newCodingWriter(dst, encoding, reencoding, replace)
+		if err != nil {
+			fw.handler.logDecision(fw.req, "skipping replacements on streamed response that could not be re-encoded",
+				zap.Error(err))
+			return
+		}
+		fw.tw = cw
+		if fw.handler.ReencodeForClient {
+			if reencoding != "" {
+				fw.Header().Set("Content-Encoding", reencoding)
+			} else {
+				fw.Header().Del("Content-Encoding")
+			}
+			addVary(fw.Header(), "Accept-Encoding")
+		}
+	}
+
+	// we don't know the length after replacements since
+	// we're not buffering it all to find out
+	fw.Header().Del("Content-Length")
+	if head == nil {
+		fw.handler.dropHeaders(fw.Header())
+		fw.handler.addScriptHashes(fw.Header(), fw.tr)
+	}
+	fw.handler.varySelectHeaders(fw.Header())
+	fw.head = head
+	fw.handler.logDecision(fw.req, "streaming response through replacements",
+		zap.Int("status", status))
+}
+
+func (fw *replaceWriter) Write(d []byte) (int, error) {
+	if !fw.wroteHeader {
+		fw.WriteHeader(http.StatusOK)
+	}
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+
+	if interval := time.Duration(fw.handler.FlushInterval); interval > 0 && !fw.flushPending {
+		fw.flushPending = true
+		fw.flushTimer = time.AfterFunc(interval, fw.delayedFlush)
+	}
+
+	if fw.truncated {
+		return 0, errMaxStreamBytes
+	}
+	var limitErr error
+	if max := fw.handler.MaxStreamBytes; max > 0 && fw.written+int64(len(d)) > max {
+		d = d[:max-fw.written]
+		limitErr = errMaxStreamBytes
+	}
+	fw.written += int64(len(d))
+
+	var n int
+	var err error
+	if fw.tw != nil {
+		n, err = fw.tw.Write(d)
+	} else {
+		n, err = fw.ResponseWriterWrapper.Write(d)
+	}
+	if err != nil || limitErr == nil {
+		return n, err
+	}
+
+	// the stream is cut off here, so write out whatever the
+	// transform is still holding on to
+	fw.truncated = true
+	if fw.tw != nil {
+		err = fw.tw.Close()
+		fw.tw = nil
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, limitErr
+}
+
+// ReadFrom implements io.ReaderFrom, which the file server uses through
+// io.Copy, by writing what it reads with Write. The ReadFrom of the
+// wrapped writer would send it to the client without replacements.
+func (fw *replaceWriter) ReadFrom(r io.Reader) (int64, error) {
+	return io.Copy(nonEmptyWriter{fw}, r)
+}
+
+// Flush implements http.Flusher.
+func (fw *replaceWriter) Flush() {
+	_ = fw.FlushError()
+}
+
+// FlushError flushes the replaced output to the client when the
+// upstream flushes, so progressive responses keep arriving in pieces.
+// Bytes that the transformer is holding back, because they might be
+// part of a match, are not flushed; they are written once more of
+// the body arrives.
+func (fw *replaceWriter) FlushError() error {
+	if !fw.wroteHeader {
+		fw.WriteHeader(http.StatusOK)
+	}
+
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.closed || fw.head.holding() {
+		return nil
+	}
+	if fw.flushPending {
+		// this flush covers the delayed one
+		fw.flushTimer.Stop()
+		fw.flushPending = false
+	}
+	return http.NewResponseController(fw.ResponseWriterWrapper).Flush()
+}
+
+// delayedFlush flushes everything written to the underlying
+// response writer so far.
+func (fw *replaceWriter) delayedFlush() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	if fw.closed || fw.head.holding() {
+		fw.flushPending = false
+		return
+	}
+	_ = http.NewResponseController(fw.ResponseWriterWrapper).Flush()
+	fw.flushPending = false
+}
+
+// stopFlushing cancels any pending delayed flush. The writer must
+// not be written to afterwards.
+func (fw *replaceWriter) stopFlushing() {
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	fw.closed = true
+	if fw.flushTimer != nil {
+		fw.flushTimer.Stop()
+	}
+}
+
+func (fw *replaceWriter) Close() error {
+	fw.stopFlushing()
+	if fw.tw != nil {
+		// Close if we have a transform writer, the underlying one does not need to be closed.
+		if err := fw.tw.Close(); err != nil {
+			return err
+		}
+	}
+	if fw.head != nil {
+		return fw.head.end()
+	}
+	return nil
+}
+
+// finish ends the streamed response once the upstream handler has
+// returned err.
+func (fw *replaceWriter) finish(err error) error {
+	if fw.holdsSlot {
+		defer fw.handler.releaseSlot()
+	}
+	if err != nil {
+		fw.stopFlushing()
+		// without closing it, the decoder goroutine would wait for
+		// the rest of the body forever
+		if cw, ok := fw.tw.(*codingWriter); ok {
+			cw.Abort()
+		}
+		return err
+	}
+	// only close if there is no error; see PR #21
+	// as of May 2023, Close() only flushes remaining bytes, but
+	// this ends up calling WriteHeader() even if we don't want that
+	fw.Close()
+	return nil
+}
+
+var errMaxStreamBytes = errors.New("max_stream_bytes exceeded")
+
+// replaceTrailers performs the replacements of tr on the values of
+// the trailers in header, both those announced in the Trailer header
+// and those set with the http.TrailerPrefix.
+func replaceTrailers(header http.Header, tr transform.Transformer) error {
+	announced := make(map[string]bool)
+	for _, value := range header.Values("Trailer") {
+		for _, key := range strings.Split(value, ",") {
+			announced[http.CanonicalHeaderKey(strings.TrimSpace(key))] = true
+		}
+	}
+	for key, values := range header {
+		if !announced[key] && !strings.HasPrefix(key, http.TrailerPrefix) {
+			continue
+		}
+		for i, value := range values {
+			tr.Reset()
+			replaced, _, err := transform.String(tr, value)
+			if err != nil {
+				return err
+			}
+			values[i] = replaced
+		}
+	}
+	return nil
+}
+
+// bodyAllowed reports whether a response with the given status may
+// have a body.
+func bodyAllowed(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// nonEmptyWriter is an io.Writer that does not pass zero-length
+// writes on to the underlying writer.
+type nonEmptyWriter struct {
+	io.Writer
+}
+
+func (w nonEmptyWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	return w.Writer.Write(p)
+}
+
+// newTransformWriter returns a transform.Writer that writes to w
+// through t, wrapped so that Write consumes all of its input unless
+// it fails, as io.Writer requires. A transform.Writer on its own
+// consumes less than it is given, without an error, when the input
+// that t holds back, such as the start of a long search string,
+// fills more than half of its buffer.
+func newTransformWriter(w io.Writer, t transform.Transformer) io.WriteCloser {
+	return fullWriter{transform.NewWriter(w, t)}
+}
+
+// fullWriter writes the rest of the input again for as long as the
+// underlying writer makes progress.
+type fullWriter struct {
+	io.WriteCloser
+}
+
+func (w fullWriter) Write(p []byte) (int, error) {
+	var n int
+	for n < len(p) {
+		m, err := w.WriteCloser.Write(p[n:])
+		n += m
+		if err != nil {
+			return n, err
+		}
+		if m == 0 {
+			return n, io.ErrShortWrite
+		}
+	}
+	return n, nil
+}
+
+const (
+	defaultMaxRules        = 1000000
+	defaultMaxRegexpSize   = 1000000
+	defaultMaxSearchLength = 1 << 20
+	defaultMaxRequestBody  = 10 << 20
+)
+
 var bufPool = sync.Pool{
 	New: func() interface{} {
 		return new(bytes.Buffer)
@@ -277,6 +2715,7 @@ var (
 	_ caddy.Provisioner           = (*Handler)(nil)
 	_ caddyhttp.MiddlewareHandler = (*Handler)(nil)
 	_ caddyfile.Unmarshaler       = (*Handler)(nil)
+	_ json.Unmarshaler            = (*Replacement)(nil)
 
 	_ http.ResponseWriter = (*replaceWriter)(nil)
 )
@@ -0,0 +1,1188 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// provision provisions h or fails the test.
+func provision(t testing.TB, h *Handler) *Handler {
+	t.Helper()
+	if err := provisionErr(h); err != nil {
+		t.Fatalf("provisioning: %v", err)
+	}
+	h.logger = zap.NewNop()
+	return h
+}
+
+// provisionErr provisions h and returns the error.
+func provisionErr(h *Handler) error {
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	return h.Provision(ctx)
+}
+
+// newRequest returns a request with a Caddy replacer in its context,
+// as the server would pass it to the handler.
+func newRequest(method, target string, body io.Reader) *http.Request {
+	r := httptest.NewRequest(method, target, body)
+	return r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+}
+
+// replacerOf returns the Caddy replacer of r.
+func replacerOf(r *http.Request) *caddy.Replacer {
+	return r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+}
+
+// upstream returns a handler that responds with contentType and
+// writes each of chunks separately, flushing after each one.
+func upstream(contentType string, chunks ...string) caddyhttp.Handler {
+	return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", contentType)
+		for _, chunk := range chunks {
+			if _, err := io.WriteString(w, chunk); err != nil {
+				return err
+			}
+			w.(http.Flusher).Flush()
+		}
+		return nil
+	})
+}
+
+// serve passes r through h to next and returns the recorded response.
+func serve(t testing.TB, h *Handler, r *http.Request, next caddyhttp.Handler) *httptest.ResponseRecorder {
+	t.Helper()
+	w := httptest.NewRecorder()
+	if err := h.ServeHTTP(w, r, next); err != nil {
+		t.Fatalf("serving: %v", err)
+	}
+	return w
+}
+
+// replaced returns the body of a text/plain response made of chunks
+// after passing through h.
+func replaced(t testing.TB, h *Handler, chunks ...string) string {
+	t.Helper()
+	return serve(t, h, newRequest("GET", "/", nil), upstream("text/plain", chunks...)).Body.String()
+}
+
+// splitEvery splits s into chunks of n bytes.
+func splitEvery(s string, n int) []string {
+	var chunks []string
+	for len(s) > n {
+		chunks = append(chunks, s[:n])
+		s = s[n:]
+	}
+	return append(chunks, s)
+}
+
+func TestProvisionDefaults(t *testing.T) {
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}}})
+	if got := replaced(t, h, "banana"); got != "bbnbnb" {
+		t.Errorf("got %q, want %q", got, "bbnbnb")
+	}
+}
+
+func TestCheckEmptyAlternation(t *testing.T) {
+	for _, tt := range []struct {
+		expr  string
+		empty bool
+	}{
+		{"foo|bar", false},
+		{"foo|foobar", false},
+		{"ab|a", false},
+		{"(foo|foobar)baz", false},
+		{"(?:a|ab)c", false},
+		{"(?P<x>a|ab)", false},
+		{"(?<x>a|ab)", false},
+		{"(?i)a|b", false},
+		{"[|]|a", false},
+		{`\||a`, false},
+		{`[]|]|a`, false},
+		{"[[:alpha:]|]|a", false},
+		{`\Q|\E|a`, false},
+		{"a{2}|b", false},
+		{"()", false},
+		{"a|b*", false},
+		{"foo|", true},
+		{"|foo", true},
+		{"(|bar)", true},
+		{"(bar|)", true},
+		{"a||b", true},
+		{"(?:a|)b", true},
+		{"(?i)|a", true},
+		{"a|(?i)", true},
+		{`\Q\E|a`, true},
+	} {
+		err := checkEmptyAlternation(tt.expr)
+		if (err != nil) != tt.empty {
+			t.Errorf("%q: got error %v, want empty alternative %v", tt.expr, err, tt.empty)
+		}
+	}
+}
+
+func TestProvisionLimits(t *testing.T) {
+	// a generated alternation of many words that share no prefixes
+	words := make([]string, 20000)
+	for i := range words {
+		var b strings.Builder
+		for n := i; b.Len() < 8; n /= 26 {
+			b.WriteByte(byte('a' + (n*7+b.Len())%26))
+		}
+		words[i] = b.String()
+	}
+	alternation := strings.Join(words, "|")
+	for _, tt := range []struct {
+		name    string
+		handler *Handler
+		err     string
+	}{
+		{
+			name:    "large alternation",
+			handler: &Handler{Replacements: []*Replacement{{SearchRegexp: alternation, Replaces: []string{"x"}}}},
+		},
+		{
+			name:    "long search",
+			handler: &Handler{Replacements: []*Replacement{{Search: strings.Repeat("x", 100000), Replaces: []string{"y"}}}},
+		},
+		{
+			name:    "many rules",
+			handler: &Handler{Replacements: manyRules(11000)},
+		},
+		{
+			name:    "max_regexp_size",
+			handler: &Handler{MaxRegexpSize: 10000, Replacements: []*Replacement{{SearchRegexp: alternation, Replaces: []string{"x"}}}},
+			err:     "replacement 0: compiled regexp size",
+		},
+		{
+			name:    "max_regexp_size off",
+			handler: &Handler{MaxRegexpSize: -1, Replacements: []*Replacement{{SearchRegexp: alternation, Replaces: []string{"x"}}}},
+		},
+		{
+			name:    "max_search_length",
+			handler: &Handler{MaxSearchLength: 3, Replacements: []*Replacement{{Search: "abcd", Replaces: []string{"x"}}}},
+			err:     "replacement 0: search length 4 exceeds max_search_length of 3",
+		},
+		{
+			name:    "max_rules",
+			handler: &Handler{MaxRules: 2, Replacements: manyRules(3)},
+			err:     "3 exceeds max_rules of 2",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := provisionErr(tt.handler)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMaxRegexpSize(t *testing.T) {
+	const expr = "[a-z]{100}"
+	size, err := regexpProgramSize(expr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name  string
+		max   int
+		rules []*Replacement
+		err   string
+	}{
+		{name: "at the limit", max: size, rules: []*Replacement{{SearchRegexp: expr, Replaces: []string{"x"}}}},
+		{
+			name:  "names the rule",
+			max:   size - 1,
+			rules: []*Replacement{{SearchRegexp: "a", Replaces: []string{"x"}}, {SearchRegexp: expr, Replaces: []string{"x"}}},
+			err:   "replacement 1: compiled regexp size " + strconv.Itoa(size) + " exceeds max_regexp_size of " + strconv.Itoa(size-1),
+		},
+		{name: "substring searches don't count", max: 1, rules: []*Replacement{{Search: strings.Repeat("a", 100), Replaces: []string{"x"}}}},
+		{name: "invalid regexp", max: size, rules: []*Replacement{{SearchRegexp: "a(", Replaces: []string{"x"}}}, err: "replacement 0: error parsing regexp"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := provisionErr(&Handler{MaxRegexpSize: tt.max, Replacements: tt.rules})
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestMaxSearchLength(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		max   int
+		rules []*Replacement
+		err   string
+	}{
+		{name: "at the limit", max: 4, rules: []*Replacement{{Search: "abcd", Replaces: []string{"x"}}}},
+		{name: "default", rules: []*Replacement{{Search: strings.Repeat("a", defaultMaxSearchLength), Replaces: []string{"x"}}}},
+		{name: "over the default", rules: []*Replacement{{Search: strings.Repeat("a", defaultMaxSearchLength+1), Replaces: []string{"x"}}}, err: "replacement 0: search length"},
+		{name: "off", max: -1, rules: []*Replacement{{Search: strings.Repeat("a", defaultMaxSearchLength+1), Replaces: []string{"x"}}}},
+		{
+			name:  "names the rule",
+			max:   3,
+			rules: []*Replacement{{Search: "abc", Replaces: []string{"x"}}, {Search: "abcd", Replaces: []string{"x"}}},
+			err:   "replacement 1: search length 4 exceeds max_search_length of 3",
+		},
+		{name: "placeholders as written", max: 10, rules: []*Replacement{{Search: "{http.request.host}", Replaces: []string{"x"}}}, err: "search length 19"},
+		{name: "regexps don't count", max: 3, rules: []*Replacement{{SearchRegexp: "abcd", Replaces: []string{"x"}}}},
+		{
+			name:  "base64 replacements",
+			max:   3,
+			rules: []*Replacement{{SearchRegexp: "[a-z]+", DecodeMatchBase64: true, Base64Replacements: []*Replacement{{Search: "abcd", Replaces: []string{"x"}}}}},
+			err:   "search length 4 exceeds max_search_length of 3",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := provisionErr(&Handler{MaxSearchLength: tt.max, Replacements: tt.rules})
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+// manyRules returns n distinct substring replacements.
+func manyRules(n int) []*Replacement {
+	rules := make([]*Replacement, n)
+	for i := range rules {
+		rules[i] = &Replacement{Search: "rule-" + strconv.Itoa(i) + ";", Replaces: []string{"x"}}
+	}
+	return rules
+}
+
+func TestPriority(t *testing.T) {
+	rule := func(search, replace string, priority int) *Replacement {
+		return &Replacement{Search: search, Replaces: []string{replace}, Priority: priority}
+	}
+	for _, tt := range []struct {
+		name  string
+		rules []*Replacement
+		want  string
+	}{
+		{name: "config order", rules: []*Replacement{rule("a", "b", 0), rule("b", "c", 0)}, want: "cc"},
+		{name: "reversed by priority", rules: []*Replacement{rule("a", "b", 0), rule("b", "c", 1)}, want: "bc"},
+		{name: "negative priority runs last", rules: []*Replacement{rule("a", "b", -1), rule("b", "c", 0)}, want: "bc"},
+		{name: "ties keep config order", rules: []*Replacement{rule("b", "c", 1), rule("a", "b", 0), rule("c", "d", 1)}, want: "bd"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, stream := range []bool{false, true} {
+				h := provision(t, &Handler{Stream: stream, Replacements: tt.rules})
+				if got := replaced(t, h, "ab"); got != tt.want {
+					t.Errorf("stream %v: got %q, want %q", stream, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRequireEnv(t *testing.T) {
+	t.Setenv("REPLACE_TEST_SET", "set")
+	for _, tt := range []struct {
+		name       string
+		rule       *Replacement
+		requireEnv bool
+		err        string
+	}{
+		{name: "set search", rule: &Replacement{Search: "{env.REPLACE_TEST_SET}", Replaces: []string{"x"}}, requireEnv: true},
+		{name: "set replace", rule: &Replacement{Search: "a", Replaces: []string{"{env.REPLACE_TEST_SET}"}}, requireEnv: true},
+		{name: "missing search", rule: &Replacement{Search: "{env.REPLACE_TEST_MISSING}", Replaces: []string{"x"}}, requireEnv: true, err: "environment variable REPLACE_TEST_MISSING is not set"},
+		{name: "missing replace", rule: &Replacement{Search: "a", Replaces: []string{"b", "{env.REPLACE_TEST_MISSING}"}}, requireEnv: true, err: "environment variable REPLACE_TEST_MISSING is not set"},
+		{name: "missing prefix", rule: &Replacement{Search: "a", Prefix: "{env.REPLACE_TEST_MISSING}"}, requireEnv: true, err: "environment variable REPLACE_TEST_MISSING is not set"},
+		{name: "missing but not required", rule: &Replacement{Search: "a", Replaces: []string{"{env.REPLACE_TEST_MISSING}"}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := provisionErr(&Handler{RequireEnv: tt.requireEnv, Replacements: []*Replacement{tt.rule}})
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("got error %v, want %q", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestRequireEnvValue(t *testing.T) {
+	t.Setenv("REPLACE_TEST_SET", "set")
+	h := provision(t, &Handler{RequireEnv: true, Replacements: []*Replacement{{Search: "{env.REPLACE_TEST_SET}", Replaces: []string{"done"}}}})
+	if got := replaced(t, h, "is set"); got != "is done" {
+		t.Errorf("got %q, want %q", got, "is done")
+	}
+}
+
+func TestPaths(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		paths      []string
+		pathRegexp string
+		path       string
+		replaced   bool
+	}{
+		{name: "no paths", path: "/any", replaced: true},
+		{name: "prefix", paths: []string{"/docs/"}, path: "/docs/a.html", replaced: true},
+		{name: "prefix excluded", paths: []string{"/docs/"}, path: "/api/a.json"},
+		{name: "second prefix", paths: []string{"/docs/", "/blog"}, path: "/blog/post", replaced: true},
+		{name: "glob", paths: []string{"/*/index.html"}, path: "/en/index.html", replaced: true},
+		{name: "glob matches the whole path", paths: []string{"/*/index.html"}, path: "/en/us/index.html"},
+		{name: "regexp", pathRegexp: `\.html$`, path: "/a/b.html", replaced: true},
+		{name: "regexp excluded", pathRegexp: `\.html$`, path: "/a/b.json"},
+		{name: "prefix or regexp", paths: []string{"/docs/"}, pathRegexp: `\.html$`, path: "/b.html", replaced: true},
+		{name: "neither prefix nor regexp", paths: []string{"/docs/"}, pathRegexp: `\.html$`, path: "/b.json"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, stream := range []bool{false, true} {
+				h := provision(t, &Handler{Stream: stream, Paths: tt.paths, PathRegexp: tt.pathRegexp, Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}}})
+				want := "a"
+				if tt.replaced {
+					want = "b"
+				}
+				w := serve(t, h, newRequest("GET", tt.path, nil), upstream("text/plain", "a"))
+				if got := w.Body.String(); got != want {
+					t.Errorf("stream %v: got %q, want %q", stream, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPathsInvalid(t *testing.T) {
+	for _, h := range []*Handler{
+		{Paths: []string{"/[a"}},
+		{PathRegexp: "("},
+	} {
+		h.Replacements = []*Replacement{{Search: "a", Replaces: []string{"b"}}}
+		if err := provisionErr(h); err == nil {
+			t.Errorf("paths %q, path_regexp %q: no error", h.Paths, h.PathRegexp)
+		}
+	}
+}
+
+func TestProvisionErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		handler *Handler
+		errs    []string
+	}{
+		{
+			name:    "empty alternation",
+			handler: &Handler{Replacements: []*Replacement{{SearchRegexp: "foo|", Replaces: []string{"x"}}}},
+			errs:    []string{`replacement 0: regexp "foo|" contains an empty alternative`},
+		},
+		{
+			name:    "invalid regexp",
+			handler: &Handler{Replacements: []*Replacement{{SearchRegexp: "(", Replaces: []string{"x"}}}},
+			errs:    []string{"replacement 0: "},
+		},
+		{
+			name: "all errors at once",
+			handler: &Handler{Stream: true, Replacements: []*Replacement{
+				{SearchRegexp: "(|a)", Replaces: []string{"x"}},
+				{Search: "ok", Replaces: []string{"x"}},
+				{Search: "b", Replaces: []string{"x"}, Required: true},
+				{Search: "c", Replaces: []string{"x"}, FlagKey: "c"},
+			}, BufferSize: -1},
+			errs: []string{
+				"invalid configuration:",
+				`replacement 0: regexp "(|a)" contains an empty alternative`,
+				"replacement 2: required is not supported in streaming mode",
+				"replacement 3: flag_key requires flags_file",
+				"buffer_size: must not be negative, got -1",
+			},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			err := provisionErr(tt.handler)
+			if err == nil {
+				t.Fatal("no error")
+			}
+			for _, want := range tt.errs {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not contain %q", err, want)
+				}
+			}
+			if strings.Contains(err.Error(), "replacement 1:") {
+				t.Errorf("error %q reports the valid replacement", err)
+			}
+		})
+	}
+}
+
+func TestReplacementEqual(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		a, b  *Replacement
+		equal bool
+	}{
+		{name: "same substring", a: &Replacement{Search: "a", Replaces: []string{"b"}}, b: &Replacement{Search: "a", Replaces: []string{"b"}}, equal: true},
+		{name: "same regexp", a: &Replacement{SearchRegexp: "a+", Replaces: []string{"b"}}, b: &Replacement{SearchRegexp: "a+", Replaces: []string{"b"}}, equal: true},
+		{name: "substring and regexp", a: &Replacement{Search: "a", Replaces: []string{"b"}}, b: &Replacement{SearchRegexp: "a", Replaces: []string{"b"}}},
+		{name: "different replace", a: &Replacement{Search: "a", Replaces: []string{"b"}}, b: &Replacement{Search: "a", Replaces: []string{"c"}}},
+		{name: "more replaces", a: &Replacement{Search: "a", Replaces: []string{"b"}}, b: &Replacement{Search: "a", Replaces: []string{"b", "c"}}},
+		{name: "different weights", a: &Replacement{Search: "a", Replaces: []string{"b", "c"}, Weights: []float64{1, 2}}, b: &Replacement{Search: "a", Replaces: []string{"b", "c"}, Weights: []float64{2, 1}}},
+		{name: "different condition", a: &Replacement{Search: "a", Replaces: []string{"b"}}, b: &Replacement{Search: "a", Replaces: []string{"b"}, When: "{path} == /"}},
+		{name: "different header map", a: &Replacement{Search: "a", Replaces: []string{"b", "c"}, SelectByHeader: "X", HeaderMap: map[string]int{"1": 0}}, b: &Replacement{Search: "a", Replaces: []string{"b", "c"}, SelectByHeader: "X", HeaderMap: map[string]int{"1": 1}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.a.equal(tt.b); got != tt.equal {
+				t.Errorf("got %v, want %v", got, tt.equal)
+			}
+			if got := tt.b.equal(tt.a); got != tt.equal {
+				t.Errorf("reversed: got %v, want %v", got, tt.equal)
+			}
+		})
+	}
+}
+
+func TestDuplicateReplacement(t *testing.T) {
+	// a duplicate is only reported, and has no effect
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}, {Search: "a", Replaces: []string{"b"}}}})
+	if got := replaced(t, h, "aa"); got != "bb" {
+		t.Errorf("got %q, want %q", got, "bb")
+	}
+}
+
+func TestLogDecision(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		handler     *Handler
+		path        string
+		contentType string
+		msg         string
+		mode        string
+	}{
+		{name: "buffered", handler: &Handler{}, path: "/", contentType: "text/plain", msg: "buffered response for replacements", mode: "buffer"},
+		{name: "streamed", handler: &Handler{Stream: true}, path: "/", contentType: "text/plain", msg: "streaming response through replacements", mode: "stream"},
+		{name: "path skipped", handler: &Handler{Paths: []string{"/docs/"}}, path: "/api", contentType: "text/plain", msg: "skipping replacements on request path not matched", mode: "buffer"},
+		{name: "not matched", handler: &Handler{Matcher: &caddyhttp.ResponseMatcher{StatusCode: []int{404}}}, path: "/", contentType: "text/plain", msg: "skipping replacements on response not matched", mode: "buffer"},
+		{name: "binary", handler: &Handler{Stream: true}, path: "/", contentType: "image/png", msg: "skipping replacements on binary response", mode: "stream"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.handler.Replacements = []*Replacement{{Search: "a", Replaces: []string{"b"}}}
+			h := provision(t, tt.handler)
+			core, logs := observer.New(zapcore.DebugLevel)
+			h.logger = zap.New(core)
+			serve(t, h, newRequest("GET", tt.path, nil), upstream(tt.contentType, "a"))
+			entries := logs.FilterMessage(tt.msg).All()
+			if len(entries) != 1 {
+				t.Fatalf("got %d %q entries in %v", len(entries), tt.msg, logs.All())
+			}
+			fields := entries[0].ContextMap()
+			if fields["mode"] != tt.mode || fields["uri"] != tt.path {
+				t.Errorf("got fields %v, want mode %q and uri %q", fields, tt.mode, tt.path)
+			}
+		})
+	}
+}
+
+func TestLogDecisionDisabled(t *testing.T) {
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}}})
+	core, logs := observer.New(zapcore.InfoLevel)
+	h.logger = zap.New(core)
+	replaced(t, h, "a")
+	if logs.Len() != 0 {
+		t.Errorf("logged %v above debug level", logs.All())
+	}
+}
+
+// statusRecorder records the status and headers at the time
+// WriteHeader is called, and whether it was called before Write.
+type statusRecorder struct {
+	*httptest.ResponseRecorder
+	status       int
+	header       http.Header
+	implicitSent bool
+}
+
+func (sr *statusRecorder) WriteHeader(status int) {
+	if sr.status == 0 {
+		sr.status = status
+		sr.header = sr.Header().Clone()
+	}
+	sr.ResponseRecorder.WriteHeader(status)
+}
+
+func (sr *statusRecorder) Write(p []byte) (int, error) {
+	if sr.status == 0 {
+		sr.implicitSent = true
+	}
+	return sr.ResponseRecorder.Write(p)
+}
+
+func TestWriteWithoutStatus(t *testing.T) {
+	writeOnly := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "5")
+		_, err := w.Write([]byte("a a a"))
+		return err
+	})
+	for _, tt := range []struct {
+		name    string
+		handler *Handler
+	}{
+		{name: "buffer", handler: &Handler{}},
+		{name: "spill", handler: &Handler{SpillToDisk: true, SpillThreshold: 1, TempDir: t.TempDir()}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.handler.Replacements = []*Replacement{{Search: "a", Replaces: []string{"bb"}}}
+			h := provision(t, tt.handler)
+			w := &statusRecorder{ResponseRecorder: httptest.NewRecorder()}
+			if err := h.ServeHTTP(w, newRequest("GET", "/", nil), writeOnly); err != nil {
+				t.Fatal(err)
+			}
+			if w.implicitSent {
+				t.Error("body written without an explicit status")
+			}
+			if w.status != http.StatusOK {
+				t.Errorf("status %d, want %d", w.status, http.StatusOK)
+			}
+			if got := w.header.Get("Content-Length"); got != "8" {
+				t.Errorf("Content-Length %q when the status was written, want %q", got, "8")
+			}
+			if got := w.Body.String(); got != "bb bb bb" {
+				t.Errorf("got %q, want %q", got, "bb bb bb")
+			}
+		})
+	}
+}
+
+// benchmarkServe measures h serving a text/html response of body,
+// written by the upstream in chunks of 4096 bytes.
+func benchmarkServe(b *testing.B, h *Handler, body []byte) {
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		for i := 0; i < len(body); i += 4096 {
+			end := i + 4096
+			if end > len(body) {
+				end = len(body)
+			}
+			if _, err := w.Write(body[i:end]); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	r := newRequest("GET", "/", nil)
+	b.SetBytes(int64(len(body)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := h.ServeHTTP(httptest.NewRecorder(), r, next); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// page returns an HTML body of n bytes with a match of "foo" in each
+// line.
+func page(n int) []byte {
+	const line = "<p>Hello World, some text goes here foo</p>\n"
+	return []byte(strings.Repeat(line, n/len(line)+1)[:n])
+}
+
+func TestBufferSize(t *testing.T) {
+	h := provision(t, &Handler{BufferSize: 1 << 16, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+	if got := h.bufPool.Get().(*bytes.Buffer).Cap(); got < 1<<16 {
+		t.Errorf("buffer capacity %d, want at least %d", got, 1<<16)
+	}
+	body := page(1 << 17)
+	w := serve(t, h, newRequest("GET", "/", nil), upstream("text/html", string(body)))
+	if want := bytes.ReplaceAll(body, []byte("foo"), []byte("bar")); !bytes.Equal(w.Body.Bytes(), want) {
+		t.Error("body larger than buffer_size not replaced")
+	}
+}
+
+func BenchmarkBufferSize(b *testing.B) {
+	for _, size := range []int{64 << 10, 1 << 20} {
+		for _, bufferSize := range []int{0, 2 * size} {
+			b.Run(strconv.Itoa(size>>10)+"KB/buffer_size="+strconv.Itoa(bufferSize>>10)+"KB", func(b *testing.B) {
+				h := provision(b, &Handler{BufferSize: bufferSize, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+				benchmarkServe(b, h, page(size))
+			})
+		}
+	}
+}
+
+func TestRequired(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		rules  []*Replacement
+		status int
+		body   string
+		err    int
+		want   string
+	}{
+		{name: "matched", rules: []*Replacement{{Search: "secret", Replaces: []string{"***"}, Required: true}}, body: "a secret", want: "a ***"},
+		{name: "no match", rules: []*Replacement{{Search: "secret", Replaces: []string{"***"}, Required: true}}, body: "nothing", err: http.StatusInternalServerError},
+		{name: "no match with status", rules: []*Replacement{{Search: "secret", Replaces: []string{"***"}, Required: true}}, status: http.StatusBadGateway, body: "nothing", err: http.StatusBadGateway},
+		{name: "other rule matched", rules: []*Replacement{{Search: "a", Replaces: []string{"b"}}, {Search: "secret", Replaces: []string{"***"}, Required: true}}, body: "a", err: http.StatusInternalServerError},
+		{name: "not required", rules: []*Replacement{{Search: "secret", Replaces: []string{"***"}}}, body: "nothing", want: "nothing"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{RequiredStatus: tt.status, Replacements: tt.rules})
+			w := httptest.NewRecorder()
+			err := h.ServeHTTP(w, newRequest("GET", "/", nil), upstream("text/plain", tt.body))
+			if tt.err == 0 {
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got := w.Body.String(); got != tt.want {
+					t.Errorf("got %q, want %q", got, tt.want)
+				}
+				return
+			}
+			var herr caddyhttp.HandlerError
+			if !errors.As(err, &herr) || herr.StatusCode != tt.err {
+				t.Fatalf("got error %v, want status %d", err, tt.err)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("wrote %q before failing", w.Body.String())
+			}
+		})
+	}
+}
+
+func TestTrailers(t *testing.T) {
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Trailer", "Grpc-Message, Grpc-Status")
+		if _, err := io.WriteString(w, "a foo"); err != nil {
+			return err
+		}
+		w.Header().Set("Grpc-Message", "foo failed")
+		w.Header().Set("Grpc-Status", "2")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "foo")
+		return nil
+	})
+	for _, tt := range []struct {
+		name     string
+		trailers bool
+		stream   bool
+		want     string
+		late     string
+	}{
+		{name: "replaced", trailers: true, want: "bar failed", late: "bar"},
+		{name: "off", want: "foo failed", late: "foo"},
+		{name: "streamed", trailers: true, stream: true, want: "foo failed", late: "foo"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{Trailers: tt.trailers, Stream: tt.stream, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+			res := serve(t, h, newRequest("GET", "/", nil), next).Result()
+			if got := res.Trailer.Get("Grpc-Message"); got != tt.want {
+				t.Errorf("Grpc-Message %q, want %q", got, tt.want)
+			}
+			if got := res.Trailer.Get("Grpc-Status"); got != "2" {
+				t.Errorf("Grpc-Status %q, want %q", got, "2")
+			}
+			if got := res.Trailer.Get("X-Late"); got != tt.late {
+				t.Errorf("X-Late %q, want %q", got, tt.late)
+			}
+			body, _ := io.ReadAll(res.Body)
+			if string(body) != "a bar" {
+				t.Errorf("body %q, want %q", body, "a bar")
+			}
+		})
+	}
+}
+
+func TestReplacementJSON(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		json string
+		want []string
+		err  bool
+	}{
+		{name: "array", json: `{"search": "a", "replace": ["b", "c"]}`, want: []string{"b", "c"}},
+		{name: "single string", json: `{"search": "a", "replace": "b"}`, want: []string{"b"}},
+		{name: "empty string", json: `{"search": "a", "replace": ""}`, want: []string{""}},
+		{name: "empty array", json: `{"search": "a", "replace": []}`, want: []string{}},
+		{name: "missing", json: `{"search": "a", "mask": "*"}`},
+		{name: "null", json: `{"search": "a", "replace": null}`},
+		{name: "number", json: `{"search": "a", "replace": 1}`, err: true},
+		{name: "unknown field", json: `{"search": "a", "replace": "b", "replacee": "c"}`, err: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var repl Replacement
+			err := json.Unmarshal([]byte(tt.json), &repl)
+			if tt.err {
+				if err == nil {
+					t.Fatal("no error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(repl.Replaces, tt.want) {
+				t.Errorf("got %q, want %q", repl.Replaces, tt.want)
+			}
+			if repl.Search != "a" {
+				t.Errorf("search %q, want %q", repl.Search, "a")
+			}
+
+			// the normalized form reads back the same
+			b, err := json.Marshal(&repl)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var again Replacement
+			if err := json.Unmarshal(b, &again); err != nil {
+				t.Fatal(err)
+			}
+			if !again.equal(&repl) {
+				t.Errorf("%s read back as %+v", b, again)
+			}
+		})
+	}
+}
+
+func TestAllowEmpty(t *testing.T) {
+	if err := provisionErr(&Handler{}); err == nil || !strings.Contains(err.Error(), "no replacements configured") {
+		t.Errorf("empty config: got error %v", err)
+	}
+	for _, stream := range []bool{false, true} {
+		h := provision(t, &Handler{AllowEmpty: true, Stream: stream})
+		w := newFlushRecorder()
+		if err := h.ServeHTTP(w, newRequest("GET", "/", nil), upstream("text/plain", "foo", "bar")); err != nil {
+			t.Fatal(err)
+		}
+		if got := w.Body.String(); got != "foobar" {
+			t.Errorf("stream %v: got %q, want %q", stream, got, "foobar")
+		}
+		// passed through as it is written, without buffering
+		if got := w.flushes(); !reflect.DeepEqual(got, []string{"foo", "foobar"}) {
+			t.Errorf("stream %v: flushed %q", stream, got)
+		}
+	}
+
+	// such as a replacements file that is empty for now
+	csv := filepath.Join(t.TempDir(), "empty.csv")
+	if err := os.WriteFile(csv, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if err := provisionErr(&Handler{ReplacementsCSV: csv}); err == nil {
+		t.Error("empty replacements_csv: no error")
+	}
+	provision(t, &Handler{ReplacementsCSV: csv, AllowEmpty: true})
+}
+
+// hintsRecorder is a ResponseRecorder that also records the
+// informational responses written before the final one, with the Link
+// headers they were sent with.
+type hintsRecorder struct {
+	*httptest.ResponseRecorder
+	informational []int
+	links         [][]string
+}
+
+func (hr *hintsRecorder) WriteHeader(status int) {
+	if status >= 100 && status <= 199 {
+		hr.informational = append(hr.informational, status)
+		hr.links = append(hr.links, hr.Header().Values("Link"))
+		return
+	}
+	hr.ResponseRecorder.WriteHeader(status)
+}
+
+func TestEarlyHints(t *testing.T) {
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Link", "</style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		_, err := io.WriteString(w, "foo")
+		return err
+	})
+	for _, stream := range []bool{false, true} {
+		h := provision(t, &Handler{Stream: stream, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+		w := &hintsRecorder{ResponseRecorder: httptest.NewRecorder()}
+		if err := h.ServeHTTP(w, newRequest("GET", "/", nil), next); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(w.informational, []int{http.StatusEarlyHints}) {
+			t.Errorf("stream %v: informational responses %v, want 103", stream, w.informational)
+		} else if want := []string{"</style.css>; rel=preload; as=style"}; !reflect.DeepEqual(w.links[0], want) {
+			t.Errorf("stream %v: hints sent with Link %q, want %q", stream, w.links[0], want)
+		}
+		if w.Code != http.StatusOK || w.Body.String() != "bar" {
+			t.Errorf("stream %v: got %d %q, want 200 %q", stream, w.Code, w.Body.String(), "bar")
+		}
+	}
+}
+
+func TestExposeOriginal(t *testing.T) {
+	encoded, err := encodeBody([]byte("a foo"), []string{"gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name   string
+		h      *Handler
+		next   caddyhttp.Handler
+		want   []byte
+		stored bool
+	}{
+		{
+			name:   "buffered",
+			h:      &Handler{ExposeOriginal: true},
+			next:   upstream("text/plain", "a f", "oo"),
+			want:   []byte("a foo"),
+			stored: true,
+		},
+		{
+			name:   "before decoding",
+			h:      &Handler{ExposeOriginal: true, Decompress: true},
+			next:   encodedUpstream(t, "a foo", "gzip"),
+			want:   encoded,
+			stored: true,
+		},
+		{
+			name: "off",
+			h:    &Handler{},
+			next: upstream("text/plain", "a foo"),
+		},
+		{
+			name: "streamed",
+			h:    &Handler{ExposeOriginal: true, Stream: true},
+			next: upstream("text/plain", "a foo"),
+		},
+		{
+			name: "skipped",
+			h:    &Handler{ExposeOriginal: true},
+			next: upstream("image/png", "a foo"),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.h.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}
+			h := provision(t, tt.h)
+			r := newRequest("GET", "/", nil)
+			r = r.WithContext(context.WithValue(r.Context(), caddyhttp.VarsCtxKey, map[string]any{}))
+			// a handler earlier in the chain reads the variable once
+			// the response has been replaced
+			w := serve(t, h, r, tt.next)
+			got, ok := caddyhttp.GetVar(r.Context(), originalBodyVar).([]byte)
+			if ok != tt.stored || !bytes.Equal(got, tt.want) {
+				t.Errorf("original body %q (stored %v), want %q (stored %v)", got, ok, tt.want, tt.stored)
+			}
+			if tt.stored && !tt.h.Decompress && w.Body.String() != "a bar" {
+				t.Errorf("body %q, want %q", w.Body.String(), "a bar")
+			}
+		})
+	}
+}
+
+func TestCaddyfileExposeOriginal(t *testing.T) {
+	h, err := parse("replace {\n\texpose_original\n\tfoo bar\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.ExposeOriginal {
+		t.Error("expose_original not set")
+	}
+	for _, input := range []string{
+		"replace {\n\texpose_original\n\texpose_original\n}",
+		"replace {\n\texpose_original yes\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+func TestPreviewBytes(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		h    *Handler
+		next caddyhttp.Handler
+		want string
+	}{
+		{name: "cut", h: &Handler{PreviewBytes: 5}, next: upstream("text/plain", "a foo b", " foo"), want: "a bar"},
+		{name: "short body", h: &Handler{PreviewBytes: 100}, next: upstream("text/plain", "a foo"), want: "a bar"},
+		{name: "decoded", h: &Handler{PreviewBytes: 100, Decompress: true}, next: encodedUpstream(t, "a foo", "gzip"), want: "a bar"},
+		{name: "largest", h: &Handler{PreviewBytes: maxPreviewBytes}, next: upstream("text/plain", strings.Repeat("foo", 1000)), want: strings.Repeat("bar", 1000)[:maxPreviewBytes]},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.h.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}
+			h := provision(t, tt.h)
+			w := serve(t, h, newRequest("GET", "/", nil), tt.next)
+			got, err := base64.StdEncoding.DecodeString(w.Header().Get(previewHeader))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("preview %q, want %q", got, tt.want)
+			}
+		})
+	}
+	for _, tt := range []struct {
+		name string
+		h    *Handler
+	}{
+		{"off", &Handler{}},
+		{"streamed", &Handler{PreviewBytes: 5, Stream: true}},
+	} {
+		tt.h.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}
+		h := provision(t, tt.h)
+		w := serve(t, h, newRequest("GET", "/", nil), upstream("text/plain", "a foo"))
+		if _, ok := w.Header()[previewHeader]; ok {
+			t.Errorf("%s: preview header %q sent", tt.name, w.Header().Get(previewHeader))
+		}
+	}
+	for _, n := range []int{-1, maxPreviewBytes + 1} {
+		if err := provisionErr(&Handler{PreviewBytes: n, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}}); err == nil {
+			t.Errorf("preview_bytes %d: no error", n)
+		}
+	}
+}
+
+func TestLengthHeaders(t *testing.T) {
+	for _, tt := range []struct {
+		name         string
+		h            *Handler
+		next         caddyhttp.Handler
+		wantOriginal string
+		wantModified string
+	}{
+		{name: "longer", h: &Handler{}, next: upstream("text/plain", "a foo b", " foo"), wantOriginal: "11", wantModified: "17"},
+		{name: "several matches", h: &Handler{}, next: upstream("text/plain", "a foofoo"), wantOriginal: "8", wantModified: "14"},
+		{name: "unchanged", h: &Handler{}, next: upstream("text/plain", "a b"), wantOriginal: "3", wantModified: "3"},
+		{name: "decoded", h: &Handler{Decompress: true}, next: encodedUpstream(t, "a foo", "gzip"), wantOriginal: "5", wantModified: "8"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.h.LengthHeaders = true
+			tt.h.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"barbaz"}}}
+			h := provision(t, tt.h)
+			w := serve(t, h, newRequest("GET", "/", nil), tt.next)
+			if got := w.Header().Get(originalLengthHeader); got != tt.wantOriginal {
+				t.Errorf("%s %q, want %q", originalLengthHeader, got, tt.wantOriginal)
+			}
+			if got := w.Header().Get(modifiedLengthHeader); got != tt.wantModified {
+				t.Errorf("%s %q, want %q", modifiedLengthHeader, got, tt.wantModified)
+			}
+		})
+	}
+	for _, tt := range []struct {
+		name string
+		h    *Handler
+	}{
+		{"off", &Handler{}},
+		{"streamed", &Handler{LengthHeaders: true, Stream: true}},
+	} {
+		tt.h.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}
+		h := provision(t, tt.h)
+		w := serve(t, h, newRequest("GET", "/", nil), upstream("text/plain", "a foo"))
+		for _, name := range []string{originalLengthHeader, modifiedLengthHeader} {
+			if _, ok := w.Header()[name]; ok {
+				t.Errorf("%s: %s %q sent", tt.name, name, w.Header().Get(name))
+			}
+		}
+	}
+}
+
+func TestChunkedTrailers(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		stream   bool
+		trailers bool
+		want     string
+	}{
+		{name: "buffered", want: "foo failed"},
+		{name: "buffered with trailers", trailers: true, want: "bar failed"},
+		{name: "streamed", stream: true, want: "foo failed"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{Stream: tt.stream, Trailers: tt.trailers, Replacements: []*Replacement{
+				{Search: "foo", Replaces: []string{"bar"}},
+				// the size line of each 10 byte chunk
+				{Search: "a\r\n", Replaces: []string{"!"}},
+			}})
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Trailer", "Grpc-Message")
+				for i := 0; i < 3; i++ {
+					if _, err := io.WriteString(w, "xy foo 0\r\n"); err != nil {
+						return err
+					}
+					w.(http.Flusher).Flush()
+				}
+				w.Header().Set("Grpc-Message", "foo failed")
+				w.Header().Set(http.TrailerPrefix+"X-Late", "late")
+				return nil
+			})
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddy.NewReplacer()))
+				if err := h.ServeHTTP(w, r, next); err != nil {
+					t.Error(err)
+				}
+			}))
+			defer srv.Close()
+
+			res, err := http.Get(srv.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer res.Body.Close()
+			body, err := io.ReadAll(res.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(res.TransferEncoding, []string{"chunked"}) {
+				t.Errorf("Transfer-Encoding %q, want chunked", res.TransferEncoding)
+			}
+			if want := strings.Repeat("xy bar 0\r\n", 3); string(body) != want {
+				t.Errorf("body %q, want %q", body, want)
+			}
+			if got := res.Trailer.Get("Grpc-Message"); got != tt.want {
+				t.Errorf("Grpc-Message %q, want %q", got, tt.want)
+			}
+			if got := res.Trailer.Get("X-Late"); got != "late" {
+				t.Errorf("X-Late %q, want %q", got, "late")
+			}
+		})
+	}
+}
+
+func TestBufferedFlush(t *testing.T) {
+	// flushes of a buffered response don't send it before it is
+	// replaced
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+	w := newFlushRecorder()
+	if err := h.ServeHTTP(w, newRequest("GET", "/", nil), upstream("text/plain", "a f", "oo")); err != nil {
+		t.Fatal(err)
+	}
+	if flushes := w.flushes(); len(flushes) != 0 {
+		t.Errorf("flushed %q", flushes)
+	}
+	if w.Body.String() != "a bar" {
+		t.Errorf("body %q, want %q", w.Body.String(), "a bar")
+	}
+
+	// responses that aren't buffered are flushed as usual
+	w = newFlushRecorder()
+	if err := h.ServeHTTP(w, newRequest("GET", "/", nil), upstream("image/png", "a f", "oo")); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a f", "a foo"}; !reflect.DeepEqual(w.flushes(), want) {
+		t.Errorf("flushed %q, want %q", w.flushes(), want)
+	}
+}
+
+func TestEscapeJSON(t *testing.T) {
+	const value = "a \"quoted\"\nline\\ \t</script> \x01 ü"
+	for _, tt := range []struct {
+		name string
+		h    *Handler
+		repl *Replacement
+	}{
+		{name: "substring", repl: &Replacement{Search: "__UA__", Replaces: []string{"{ua}"}, EscapeJSON: true}},
+		{name: "regexp", repl: &Replacement{SearchRegexp: "__(UA)__", Replaces: []string{"{ua}"}, EscapeJSON: true}},
+		{name: "longest match", h: &Handler{ConflictResolution: conflictLongestMatchWins}, repl: &Replacement{Search: "__UA__", Replaces: []string{"{ua}"}, EscapeJSON: true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			const body = `{"agent": "__UA__", "other": "x"}`
+			for _, mode := range []struct {
+				name   string
+				stream bool
+				chunk  int
+			}{{"buffer", false, len(body)}, {"stream", true, len(body)}, {"stream bytewise", true, 1}} {
+				h := &Handler{}
+				if tt.h != nil {
+					*h = *tt.h
+				}
+				h.Stream = mode.stream
+				h.Replacements = []*Replacement{tt.repl}
+				provision(t, h)
+				r := newRequest("GET", "/", nil)
+				replacerOf(r).Set("ua", value)
+				w := serve(t, h, r, upstream("application/json", splitEvery(body, mode.chunk)...))
+				var doc map[string]string
+				if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+					t.Fatalf("%s: invalid JSON %q: %v", mode.name, w.Body.String(), err)
+				}
+				if doc["agent"] != value || doc["other"] != "x" {
+					t.Errorf("%s: got %q", mode.name, doc)
+				}
+			}
+		})
+	}
+
+	// the quotes are not added, so the value can go into a string
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "X", Replaces: []string{"{v}"}, EscapeJSON: true}}})
+	r := newRequest("GET", "/", nil)
+	replacerOf(r).Set("v", `"`)
+	if got := serve(t, h, r, upstream("text/plain", `"aXb"`)).Body.String(); got != `"a\"b"` {
+		t.Errorf("got %s, want %s", got, `"a\"b"`)
+	}
+
+	// submatches come from the body and are not escaped
+	h = provision(t, &Handler{Replacements: []*Replacement{{SearchRegexp: `<(.)>`, Replaces: []string{"$1{v}"}, EscapeJSON: true}}})
+	r = newRequest("GET", "/", nil)
+	replacerOf(r).Set("v", "\n")
+	if got := serve(t, h, r, upstream("text/plain", `<">`)).Body.String(); got != `"\n` {
+		t.Errorf("got %s, want %s", got, `"\n`)
+	}
+
+	for _, repl := range []*Replacement{
+		{Search: "a", Mask: "*", EscapeJSON: true},
+		{JSONPointer: "/a", Replaces: []string{"b"}, EscapeJSON: true},
+	} {
+		if err := provisionErr(&Handler{Replacements: []*Replacement{repl}}); err == nil {
+			t.Errorf("%+v: no error", repl)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+)
+
+// The values of hash_match.
+const (
+	hashMD5    = "md5"
+	hashSHA1   = "sha1"
+	hashSHA256 = "sha256"
+	hashSHA512 = "sha512"
+)
+
+// hashFuncs are the hash functions for the values of hash_match.
+var hashFuncs = map[string]func() hash.Hash{
+	hashMD5:    md5.New,
+	hashSHA1:   sha1.New,
+	hashSHA256: sha256.New,
+	hashSHA512: sha512.New,
+}
+
+// checkHash returns an error if the hash_match settings of repl are
+// invalid.
+func (repl *Replacement) checkHash() error {
+	if repl.HashMatch == "" {
+		if repl.HashLength != 0 {
+			return fmt.Errorf("hash_length requires hash_match")
+		}
+		return nil
+	}
+	newHash, ok := hashFuncs[repl.HashMatch]
+	if !ok {
+		return fmt.Errorf("hash_match must be %s, %s, %s or %s, got %q", hashMD5, hashSHA1, hashSHA256, hashSHA512, repl.HashMatch)
+	}
+	if len(repl.Replaces) > 0 || repl.Mask != "" || repl.Template != "" || repl.ReplaceFile != "" || repl.DecodeMatchBase64 {
+		return fmt.Errorf("hash_match is mutually exclusive with replace, mask, template, replace_file and decode_match_base64")
+	}
+	if size := hex.EncodedLen(newHash().Size()); repl.HashLength < 0 || repl.HashLength > size {
+		return fmt.Errorf("hash_length must be between 1 and %d for %s, got %d", size, repl.HashMatch, repl.HashLength)
+	}
+	return nil
+}
+
+// hash returns the hex-encoded hash of match, truncated to
+// HashLength characters if that is set.
+func (repl *Replacement) hash(match []byte) []byte {
+	h := hashFuncs[repl.HashMatch]()
+	h.Write(match)
+	sum := hex.AppendEncode(nil, h.Sum(nil))
+	if repl.HashLength > 0 {
+		return sum[:repl.HashLength]
+	}
+	return sum
+}
+
+// hashMatch returns the match described by index with the capture
+// group of repl replaced by its hash, or the whole match if the group
+// is 0. If the group didn't participate in the match, it is returned
+// unchanged.
+func (repl *Replacement) hashMatch(src []byte, index []int) []byte {
+	match := src[index[0]:index[1]]
+	if repl.Group == 0 {
+		return repl.hash(match)
+	}
+	start, end := index[2*repl.Group], index[2*repl.Group+1]
+	if start < 0 {
+		return match
+	}
+	hashed := make([]byte, 0, len(match))
+	hashed = append(hashed, src[index[0]:start]...)
+	hashed = append(hashed, repl.hash(src[start:end])...)
+	return append(hashed, src[end:index[1]]...)
+}
@@ -0,0 +1,90 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import "testing"
+
+func TestHashMatch(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		repl *Replacement
+		body string
+		want string
+	}{
+		{name: "md5", repl: &Replacement{Search: "abc", HashMatch: "md5"}, body: "<abc>", want: "<900150983cd24fb0d6963f7d28e17f72>"},
+		{name: "sha1", repl: &Replacement{Search: "abc", HashMatch: "sha1"}, body: "<abc>", want: "<a9993e364706816aba3e25717850c26c9cd0d89d>"},
+		{name: "sha256", repl: &Replacement{Search: "abc", HashMatch: "sha256"}, body: "<abc>", want: "<ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad>"},
+		{
+			name: "sha512",
+			repl: &Replacement{Search: "abc", HashMatch: "sha512"},
+			body: "<abc>",
+			want: "<ddaf35a193617abacc417349ae20413112e6fa4e89a97ea20a9eeee64b55d39a2192992a274fc1a836ba3c23a3feebbd454d4423643ce80e2a9ac94fa54ca49f>",
+		},
+		{name: "truncated", repl: &Replacement{Search: "abc", HashMatch: "sha256", HashLength: 8}, body: "<abc>", want: "<ba7816bf>"},
+		{name: "full length", repl: &Replacement{Search: "abc", HashMatch: "md5", HashLength: 32}, body: "abc", want: "900150983cd24fb0d6963f7d28e17f72"},
+		{name: "regexp", repl: &Replacement{SearchRegexp: `a\w+`, HashMatch: "md5"}, body: "abc and", want: "900150983cd24fb0d6963f7d28e17f72 be5d5d37542d75f93a87094459f76678"},
+		{
+			name: "capture group",
+			repl: &Replacement{SearchRegexp: `src="/(\w+)\.js"`, HashMatch: "md5", Group: 1, HashLength: 8},
+			body: `<script src="/abc.js">`,
+			want: `<script src="/90015098.js">`,
+		},
+		{
+			name: "group that didn't participate",
+			repl: &Replacement{SearchRegexp: `id=(?:x|(\w+))`, HashMatch: "md5", Group: 1},
+			body: "id=x id=abc",
+			want: "id=x id=900150983cd24fb0d6963f7d28e17f72",
+		},
+		{name: "empty match", repl: &Replacement{SearchRegexp: `<()>`, HashMatch: "md5", Group: 1}, body: "<>", want: "<d41d8cd98f00b204e9800998ecf8427e>"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []struct {
+				name     string
+				stream   bool
+				conflict string
+				chunk    int
+			}{
+				{"buffer", false, "", len(tt.body)},
+				{"stream", true, "", len(tt.body)},
+				{"stream bytewise", true, "", 1},
+				{"longest match", false, conflictLongestMatchWins, len(tt.body)},
+			} {
+				h := provision(t, &Handler{Stream: mode.stream, ConflictResolution: mode.conflict, Replacements: []*Replacement{tt.repl}})
+				if got := replaced(t, h, splitEvery(tt.body, mode.chunk)...); got != tt.want {
+					t.Errorf("%s: got %q, want %q", mode.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestHashMatchInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		repl *Replacement
+	}{
+		{"unknown algorithm", &Replacement{Search: "a", HashMatch: "crc32"}},
+		{"upper case algorithm", &Replacement{Search: "a", HashMatch: "SHA256"}},
+		{"with replace", &Replacement{Search: "a", HashMatch: "md5", Replaces: []string{"b"}}},
+		{"with mask", &Replacement{Search: "a", HashMatch: "md5", Mask: "*"}},
+		{"negative length", &Replacement{Search: "a", HashMatch: "md5", HashLength: -1}},
+		{"too long", &Replacement{Search: "a", HashMatch: "md5", HashLength: 33}},
+		{"length without hash", &Replacement{Search: "a", Replaces: []string{"b"}, HashLength: 8}},
+	} {
+		if err := provisionErr(&Handler{Replacements: []*Replacement{tt.repl}}); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
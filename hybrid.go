@@ -0,0 +1,112 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// checkStreamStatusCodes returns an error if one of the codes is
+// neither a final status nor a status class.
+func checkStreamStatusCodes(codes []int) error {
+	for _, code := range codes {
+		if (code < 2 || code > 5) && (code < 200 || code > 599) {
+			return fmt.Errorf("stream_status_codes: invalid status code %d", code)
+		}
+	}
+	return nil
+}
+
+// streamsStatus reports whether a response with the given status is
+// streamed rather than buffered.
+func (h *Handler) streamsStatus(status int) bool {
+	for _, code := range h.StreamStatusCodes {
+		if caddyhttp.StatusCodeMatches(status, code) {
+			return true
+		}
+	}
+	return false
+}
+
+// hybridWriter is the writer the upstream writes to in buffer mode
+// when StreamStatusCodes is set. Once the final status is known, the
+// response goes either to stream, if the status is one of
+// StreamStatusCodes, or to buffer otherwise, for the rest of it.
+// Informational responses are passed through before the choice is
+// made.
+type hybridWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	handler *Handler
+	stream  *replaceWriter
+	buffer  http.ResponseWriter
+
+	// the writer chosen for the response, and whether it is stream
+	target   http.ResponseWriter
+	streamed bool
+}
+
+func (hw *hybridWriter) WriteHeader(status int) {
+	if hw.target == nil {
+		if status >= 100 && status <= 199 {
+			hw.ResponseWriterWrapper.WriteHeader(status)
+			return
+		}
+		hw.choose(status)
+	}
+	hw.target.WriteHeader(status)
+}
+
+// choose sets the writer for a response with the given status.
+func (hw *hybridWriter) choose(status int) {
+	if hw.handler.streamsStatus(status) {
+		hw.target, hw.streamed = hw.stream, true
+		return
+	}
+	hw.target = hw.buffer
+}
+
+func (hw *hybridWriter) Write(p []byte) (int, error) {
+	if hw.target == nil {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return hw.target.Write(p)
+}
+
+// ReadFrom implements io.ReaderFrom by copying to the chosen writer,
+// rather than past it to the client's writer.
+func (hw *hybridWriter) ReadFrom(r io.Reader) (int64, error) {
+	if hw.target == nil {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return io.Copy(hw.target, r)
+}
+
+// Flush implements http.Flusher.
+func (hw *hybridWriter) Flush() {
+	_ = hw.FlushError()
+}
+
+// FlushError flushes the chosen writer. A flush before the status is
+// written implies 200, as it does for the client's writer.
+func (hw *hybridWriter) FlushError() error {
+	if hw.target == nil {
+		hw.WriteHeader(http.StatusOK)
+	}
+	return http.NewResponseController(hw.target).Flush()
+}
@@ -0,0 +1,171 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// statusUpstream responds with status and chunks, flushing after each
+// and declaring the length of the whole body.
+func statusUpstream(status int, chunks ...string) caddyhttp.Handler {
+	return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		n := 0
+		for _, chunk := range chunks {
+			n += len(chunk)
+		}
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Length", strconv.Itoa(n))
+		w.WriteHeader(status)
+		for _, chunk := range chunks {
+			if _, err := io.WriteString(w, chunk); err != nil {
+				return err
+			}
+			w.(http.Flusher).Flush()
+		}
+		return nil
+	})
+}
+
+func TestStreamStatusCodes(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		codes    []int
+		status   int
+		streamed bool
+	}{
+		{name: "streamed 200", codes: []int{200}, status: http.StatusOK, streamed: true},
+		{name: "buffered 500", codes: []int{200}, status: http.StatusInternalServerError},
+		{name: "buffered 404", codes: []int{200}, status: http.StatusNotFound},
+		{name: "class", codes: []int{2}, status: http.StatusPartialContent, streamed: true},
+		{name: "buffered outside the class", codes: []int{2}, status: http.StatusBadGateway},
+		{name: "one of several", codes: []int{200, 5}, status: http.StatusServiceUnavailable, streamed: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{StreamStatusCodes: tt.codes, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar!"}}}})
+			w := newFlushRecorder()
+			if err := h.ServeHTTP(w, newRequest("GET", "/", nil), statusUpstream(tt.status, "<p>fo", "o</p>", "<p>foo</p>")); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if want := "<p>bar!</p><p>bar!</p>"; w.Body.String() != want {
+				t.Errorf("body %q, want %q", w.Body.String(), want)
+			}
+			if tt.streamed {
+				// the replaced output arrives as upstream flushes,
+				// without a length
+				if want := []string{"<p>", "<p>bar!</p>", "<p>bar!</p><p>bar!</p>"}; !reflect.DeepEqual(w.flushes(), want) {
+					t.Errorf("flushed %q, want %q", w.flushes(), want)
+				}
+				if got := w.Header().Get("Content-Length"); got != "" {
+					t.Errorf("Content-Length %q, want none", got)
+				}
+			} else {
+				if flushes := w.flushes(); len(flushes) != 0 {
+					t.Errorf("buffered response flushed %q", flushes)
+				}
+				if got := w.Header().Get("Content-Length"); got != "22" {
+					t.Errorf("Content-Length %q, want %q", got, "22")
+				}
+			}
+		})
+	}
+}
+
+func TestStreamStatusCodesMixed(t *testing.T) {
+	// the same handler streams some responses and buffers others
+	h := provision(t, &Handler{StreamStatusCodes: []int{200}, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}, Required: true}}})
+	w := newFlushRecorder()
+	if err := h.ServeHTTP(w, newRequest("GET", "/", nil), statusUpstream(http.StatusOK, "a ", "b")); err != nil {
+		t.Fatalf("streamed: %v", err)
+	}
+	if w.Body.String() != "a b" || len(w.flushes()) == 0 {
+		t.Errorf("streamed: got %q after %d flushes", w.Body.String(), len(w.flushes()))
+	}
+	// required only applies to buffered responses
+	err := h.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "/", nil), statusUpstream(http.StatusInternalServerError, "a ", "b"))
+	var herr caddyhttp.HandlerError
+	if !errors.As(err, &herr) || herr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("buffered: got error %v, want status 500", err)
+	}
+}
+
+func TestStreamStatusCodesImplicit(t *testing.T) {
+	h := provision(t, &Handler{StreamStatusCodes: []int{200}, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Link", "</style.css>; rel=preload")
+		w.WriteHeader(http.StatusEarlyHints)
+		w.Header().Set("Content-Type", "text/plain")
+		// no status: implies 200
+		_, err := io.WriteString(w, "foo")
+		return err
+	})
+	w := &hintsRecorder{ResponseRecorder: httptest.NewRecorder()}
+	if err := h.ServeHTTP(w, newRequest("GET", "/", nil), next); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(w.informational, []int{http.StatusEarlyHints}) {
+		t.Errorf("informational responses %v, want 103", w.informational)
+	}
+	if w.Code != http.StatusOK || w.Body.String() != "bar" {
+		t.Errorf("got %d %q, want 200 %q", w.Code, w.Body.String(), "bar")
+	}
+}
+
+func TestStreamStatusCodesInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		h    *Handler
+	}{
+		{"stream mode", &Handler{Stream: true, StreamStatusCodes: []int{200}}},
+		{"informational", &Handler{StreamStatusCodes: []int{103}}},
+		{"class 1", &Handler{StreamStatusCodes: []int{1}}},
+		{"out of range", &Handler{StreamStatusCodes: []int{600}}},
+	} {
+		tt.h.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}
+		if err := provisionErr(tt.h); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
+
+func TestCaddyfileStreamStatus(t *testing.T) {
+	h, err := parse("replace {\n\tstream_status 200 2xx 503\n\tfoo bar\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []int{200, 2, 503}; !reflect.DeepEqual(h.StreamStatusCodes, want) {
+		t.Errorf("stream_status %v, want %v", h.StreamStatusCodes, want)
+	}
+	for _, input := range []string{
+		"replace {\n\tstream_status\n}",
+		"replace {\n\tstream_status ok\n}",
+		"replace {\n\tstream_status 200\n\tstream_status 500\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// checkInvert returns an error if invert is set on repl without the
+// options it needs, or with options it doesn't work with.
+func (repl *Replacement) checkInvert() error {
+	if !repl.Invert {
+		return nil
+	}
+	if repl.SearchRegexp == "" || repl.FuncTransform == "" {
+		return fmt.Errorf("invert requires search_regexp and func_transform")
+	}
+	if repl.Name != "" || repl.When != "" || repl.hasRegion() || repl.SampleRate != 0 || repl.Once || repl.OncePerValue || repl.EveryNth != 0 ||
+		repl.ActivateAfter != 0 || repl.FlagKey != "" || repl.Required || repl.PreserveCase || repl.Group != 0 || repl.JSONPointer != "" || repl.Overlap {
+		return fmt.Errorf("invert can only be combined with search_regexp, func_transform and priority")
+	}
+	return nil
+}
+
+// replaceInverted performs the replacements with invert set on body,
+// in order, and returns the result.
+func (h *Handler) replaceInverted(placeholders *caddy.Replacer, body []byte) []byte {
+	for _, rule := range h.invertRules {
+		body = rule.transformBetween(placeholders, body)
+	}
+	return body
+}
+
+// transformBetween returns body with the text between the matches of
+// repl, and before the first and after the last, transformed by its
+// body func, and the matches left as they are. The func is called
+// once for each such region that is not empty, so matches that are
+// adjacent or at the very start or end of the body leave nothing to
+// transform there; without matches, the whole body is one region.
+func (repl *Replacement) transformBetween(placeholders *caddy.Replacer, body []byte) []byte {
+	out := make([]byte, 0, len(body))
+	prev := 0
+	for _, m := range repl.re.FindAllIndex(body, -1) {
+		out = repl.appendRegion(out, placeholders, body[prev:m[0]])
+		out = append(out, body[m[0]:m[1]]...)
+		prev = m[1]
+	}
+	return repl.appendRegion(out, placeholders, body[prev:])
+}
+
+// appendRegion appends region to out, transformed by the body func
+// of repl unless it is empty.
+func (repl *Replacement) appendRegion(out []byte, placeholders *caddy.Replacer, region []byte) []byte {
+	if len(region) == 0 {
+		return out
+	}
+	return append(out, repl.transformMatch(placeholders, region)...)
+}
@@ -0,0 +1,113 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import "testing"
+
+func TestInvert(t *testing.T) {
+	code := `<code>.*?</code>`
+	for _, tt := range []struct {
+		name  string
+		rules []*Replacement
+		body  string
+		want  string
+	}{
+		{
+			name:  "several protected regions",
+			rules: []*Replacement{{SearchRegexp: code, FuncTransform: "test.upper", Invert: true}},
+			body:  "run <code>make all</code> then <code>make test</code> and done",
+			want:  "RUN <code>make all</code> THEN <code>make test</code> AND DONE",
+		},
+		{
+			name:  "each region once",
+			rules: []*Replacement{{SearchRegexp: code, FuncTransform: "test.brackets", Invert: true}},
+			body:  "a <code>x</code> b <code>y</code> c",
+			want:  "[a ]<code>x</code>[ b ]<code>y</code>[ c]",
+		},
+		{
+			name:  "adjacent matches",
+			rules: []*Replacement{{SearchRegexp: code, FuncTransform: "test.brackets", Invert: true}},
+			body:  "a <code>x</code><code>y</code> b",
+			want:  "[a ]<code>x</code><code>y</code>[ b]",
+		},
+		{
+			name:  "matches at the start and the end",
+			rules: []*Replacement{{SearchRegexp: code, FuncTransform: "test.brackets", Invert: true}},
+			body:  "<code>x</code> a <code>y</code>",
+			want:  "<code>x</code>[ a ]<code>y</code>",
+		},
+		{
+			name:  "the whole body matches",
+			rules: []*Replacement{{SearchRegexp: code, FuncTransform: "test.brackets", Invert: true}},
+			body:  "<code>x</code>",
+			want:  "<code>x</code>",
+		},
+		{
+			name:  "no matches",
+			rules: []*Replacement{{SearchRegexp: code, FuncTransform: "test.brackets", Invert: true}},
+			body:  "plain text",
+			want:  "[plain text]",
+		},
+		{
+			name:  "empty matches",
+			rules: []*Replacement{{SearchRegexp: `x*`, FuncTransform: "test.brackets", Invert: true}},
+			body:  "axb",
+			want:  "[a]x[b]",
+		},
+		{
+			name: "after the other replacements",
+			rules: []*Replacement{
+				{SearchRegexp: code, FuncTransform: "test.upper", Invert: true},
+				{Search: "foo", Replaces: []string{"<code>foo</code>"}},
+			},
+			body: "a foo b",
+			want: "A <code>foo</code> B",
+		},
+		{
+			name: "in order of priority",
+			rules: []*Replacement{
+				{SearchRegexp: `\[.*?\]`, FuncTransform: "test.upper", Invert: true},
+				{SearchRegexp: code, FuncTransform: "test.brackets", Invert: true, Priority: 1},
+			},
+			body: "a <code>x</code> b",
+			want: "[a ]<CODE>X</CODE>[ b]",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{Replacements: tt.rules})
+			if got := replaced(t, h, splitEvery(tt.body, 3)...); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInvertInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		h    *Handler
+	}{
+		{"without func_transform", &Handler{Replacements: []*Replacement{{SearchRegexp: "a", Replaces: []string{"b"}, Invert: true}}}},
+		{"substring search", &Handler{Replacements: []*Replacement{{Search: "a", FuncTransform: "test.upper", Invert: true}}}},
+		{"with once", &Handler{Replacements: []*Replacement{{SearchRegexp: "a", FuncTransform: "test.upper", Invert: true, Once: true}}}},
+		{"with group", &Handler{Replacements: []*Replacement{{SearchRegexp: "(a)", FuncTransform: "test.upper", Invert: true, Group: 1}}}},
+		{"streamed", &Handler{Stream: true, Replacements: []*Replacement{{SearchRegexp: "a", FuncTransform: "test.upper", Invert: true}}}},
+		{"spilled", &Handler{SpillToDisk: true, Replacements: []*Replacement{{SearchRegexp: "a", FuncTransform: "test.upper", Invert: true}}}},
+	} {
+		if err := provisionErr(tt.h); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// isJSON reports whether a response with the given headers is JSON.
+func isJSON(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// checkJSONPointer validates the json_pointer of repl, if any, and the
+// options it is combined with.
+func (repl *Replacement) checkJSONPointer() error {
+	if repl.JSONPointer == "" {
+		return nil
+	}
+	if repl.Mask != "" || repl.HashMatch != "" || repl.Overlap || repl.wraps() || repl.FuncTransform != "" || repl.Template != "" || repl.ReplaceFile != "" || repl.When != "" ||
+		repl.hasRegion() || repl.SampleRate != 0 || repl.Once || repl.OncePerValue || repl.EveryNth != 0 || repl.ActivateAfter != 0 ||
+		repl.Required || repl.DecodeMatchBase64 || repl.PreserveCase || repl.FlagKey != "" {
+		return fmt.Errorf("json_pointer can only be combined with search, search_regexp, replace and priority")
+	}
+	parse := parseJSONPointer
+	if strings.HasPrefix(repl.JSONPointer, "$") {
+		parse = parseJSONPath
+	}
+	tokens, err := parse(repl.JSONPointer)
+	if err != nil {
+		return err
+	}
+	repl.pointer = tokens
+	return nil
+}
+
+// parseJSONPointer splits an RFC 6901 JSON Pointer into its reference
+// tokens, with ~1 and ~0 unescaped.
+func parseJSONPointer(ptr string) ([]string, error) {
+	if !strings.HasPrefix(ptr, "/") {
+		return nil, fmt.Errorf("json_pointer %q must start with /", ptr)
+	}
+	tokens := strings.Split(ptr[1:], "/")
+	for i, tok := range tokens {
+		for j := 0; j < len(tok); j++ {
+			if tok[j] == '~' && (j+1 == len(tok) || (tok[j+1] != '0' && tok[j+1] != '1')) {
+				return nil, fmt.Errorf("json_pointer %q: ~ must be followed by 0 or 1", ptr)
+			}
+		}
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(tok, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+// parseJSONPath splits a path such as $.items[2].name or
+// $['a.b'][-1] into the reference tokens of the JSON Pointer that
+// refers to the same value. Wildcards, filters and recursive descent
+// are not supported.
+func parseJSONPath(path string) ([]string, error) {
+	var tokens []string
+	rest := path[1:]
+	for rest != "" {
+		switch {
+		case rest[0] == '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end < 0 {
+				end = len(rest) - 1
+			}
+			name := rest[1 : 1+end]
+			if name == "" || name == "*" {
+				return nil, fmt.Errorf("json_pointer %q: member name missing or not supported after .", path)
+			}
+			tokens = append(tokens, name)
+			rest = rest[1+end:]
+
+		case strings.HasPrefix(rest, "['") || strings.HasPrefix(rest, `["`):
+			quote := rest[1]
+			var name strings.Builder
+			i := 2
+			for ; i < len(rest) && rest[i] != quote; i++ {
+				if rest[i] == '\\' && i+1 < len(rest) {
+					i++
+				}
+				name.WriteByte(rest[i])
+			}
+			if i+1 >= len(rest) || rest[i+1] != ']' {
+				return nil, fmt.Errorf("json_pointer %q: unterminated member name", path)
+			}
+			tokens = append(tokens, name.String())
+			rest = rest[i+2:]
+
+		case rest[0] == '[':
+			end := strings.IndexByte(rest, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("json_pointer %q: missing ]", path)
+			}
+			if _, ok := parseArrayIndex(rest[1:end]); !ok {
+				return nil, fmt.Errorf("json_pointer %q: %q is not an array index", path, rest[1:end])
+			}
+			tokens = append(tokens, rest[1:end])
+			rest = rest[end+1:]
+
+		default:
+			return nil, fmt.Errorf("json_pointer %q: expected . or [ before %q", path, rest)
+		}
+	}
+	return tokens, nil
+}
+
+// parseArrayIndex returns the array index that tok stands for, which
+// counts from the end of the array if it is negative, so that -1 is
+// the last element. Like RFC 6901, it accepts no leading zeros, so
+// that each index has a single spelling. It reports false if tok is
+// not an index, which includes "-", the element after the last.
+func parseArrayIndex(tok string) (int, bool) {
+	digits := strings.TrimPrefix(tok, "-")
+	if digits == "" || digits[0] < '0' || digits[0] > '9' || (len(digits) > 1 && digits[0] == '0') || tok == "-0" {
+		return 0, false
+	}
+	index, err := strconv.Atoi(tok)
+	return index, err == nil
+}
+
+// replaceJSONPointers performs the replacements that target a value
+// by JSON Pointer on doc. The rest of the document is kept byte for
+// byte. Documents that aren't valid JSON, and pointers that refer to
+// no value, are left alone. rt chooses the values of weighted
+// replacements.
+func (h *Handler) replaceJSONPointers(r *http.Request, repl *caddy.Replacer, rt *replacer, doc []byte) []byte {
+	if !json.Valid(doc) {
+		h.logDecision(r, "skipping JSON pointer replacements on invalid JSON")
+		return doc
+	}
+	for _, rule := range h.pointerRules {
+		start, end, ok := jsonValueSpan(doc, rule.pointer)
+		if !ok {
+			h.logDecision(r, "JSON pointer refers to no value",
+				zap.String("json_pointer", rule.JSONPointer))
+			continue
+		}
+		value, ok := rule.replaceJSONValue(repl, rt.pointOf(rule), doc[start:end])
+		if !ok {
+			continue
+		}
+		if rule.counter != nil {
+			rule.counter.Inc()
+		}
+		out := make([]byte, 0, len(doc)-(end-start)+len(value))
+		out = append(out, doc[:start]...)
+		out = append(out, value...)
+		doc = append(out, doc[end:]...)
+	}
+	return doc
+}
+
+// replaceJSONValue returns the new encoding of the JSON value raw. If
+// repl has no search, the value is set to the replace value as a
+// string. Otherwise, the search is replaced within the value, which
+// must be a string. It reports false if the value is left unchanged.
+func (repl *Replacement) replaceJSONValue(placeholders *caddy.Replacer, point float64, raw []byte) ([]byte, bool) {
+	value := repl.chooseReplace(placeholders, point)
+	if repl.Search != "" || repl.re != nil {
+		var s string
+		if raw[0] != '"' || json.Unmarshal(raw, &s) != nil {
+			return nil, false
+		}
+		var replaced string
+		if repl.re != nil {
+			replaced = repl.re.ReplaceAllString(s, value)
+		} else {
+			replaced = strings.ReplaceAll(s, placeholders.ReplaceKnown(repl.Search, ""), value)
+		}
+		if replaced == s {
+			return nil, false
+		}
+		value = replaced
+	}
+
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(value); err != nil {
+		return nil, false
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), true
+}
+
+// jsonValueSpan returns the offsets of the value that tokens refer to
+// in doc, which must be valid JSON. Object members are looked up by
+// name, taking the first of duplicate names, and array elements by
+// decimal index, counting from the end if it is negative. It reports
+// false if there is no such value, such as for an index that is out
+// of range.
+func jsonValueSpan(doc []byte, tokens []string) (start, end int, ok bool) {
+	start = skipJSONSpace(doc, 0)
+	for _, tok := range tokens {
+		switch doc[start] {
+		case '{':
+			i, found := skipJSONSpace(doc, start+1), false
+			for doc[i] != '}' {
+				keyEnd := skipJSONValue(doc, i)
+				var key string
+				if err := json.Unmarshal(doc[i:keyEnd], &key); err != nil {
+					return 0, 0, false
+				}
+				// skip the colon
+				i = skipJSONSpace(doc, skipJSONSpace(doc, keyEnd)+1)
+				if key == tok {
+					found = true
+					break
+				}
+				i = skipJSONSpace(doc, skipJSONValue(doc, i))
+				if doc[i] == ',' {
+					i = skipJSONSpace(doc, i+1)
+				}
+			}
+			if !found {
+				return 0, 0, false
+			}
+			start = i
+
+		case '[':
+			index, ok := parseArrayIndex(tok)
+			if !ok {
+				return 0, 0, false
+			}
+			if index < 0 {
+				if index += jsonArrayLength(doc, start); index < 0 {
+					return 0, 0, false
+				}
+			}
+			i := skipJSONSpace(doc, start+1)
+			for ; index > 0 && doc[i] != ']'; index-- {
+				i = skipJSONSpace(doc, skipJSONValue(doc, i))
+				if doc[i] == ',' {
+					i = skipJSONSpace(doc, i+1)
+				}
+			}
+			if doc[i] == ']' {
+				return 0, 0, false
+			}
+			start = i
+
+		default:
+			// scalars have no members
+			return 0, 0, false
+		}
+	}
+	return start, skipJSONValue(doc, start), true
+}
+
+// jsonArrayLength returns the number of elements of the JSON array
+// that starts at offset i of doc, which must be valid JSON.
+func jsonArrayLength(doc []byte, i int) int {
+	n := 0
+	for i = skipJSONSpace(doc, i+1); doc[i] != ']'; n++ {
+		i = skipJSONSpace(doc, skipJSONValue(doc, i))
+		if doc[i] == ',' {
+			i = skipJSONSpace(doc, i+1)
+		}
+	}
+	return n
+}
+
+// skipJSONValue returns the offset just past the JSON value that
+// starts at offset i of doc, which must be valid JSON.
+func skipJSONValue(doc []byte, i int) int {
+	switch doc[i] {
+	case '"':
+		for j := i + 1; j < len(doc); j++ {
+			switch doc[j] {
+			case '\\':
+				j++
+			case '"':
+				return j + 1
+			}
+		}
+		return len(doc)
+	case '{', '[':
+		depth := 0
+		for j := i; j < len(doc); j++ {
+			switch doc[j] {
+			case '"':
+				j = skipJSONValue(doc, j) - 1
+			case '{', '[':
+				depth++
+			case '}', ']':
+				depth--
+				if depth == 0 {
+					return j + 1
+				}
+			}
+		}
+		return len(doc)
+	}
+	// a number, true, false or null
+	j := i
+	for j < len(doc) && !strings.ContainsRune(" \t\r\n,]}", rune(doc[j])) {
+		j++
+	}
+	return j
+}
+
+// skipJSONSpace returns the offset of the first byte at or after i
+// that is not JSON whitespace.
+func skipJSONSpace(doc []byte, i int) int {
+	for i < len(doc) && strings.ContainsRune(" \t\r\n", rune(doc[i])) {
+		i++
+	}
+	return i
+}
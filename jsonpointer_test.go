@@ -0,0 +1,267 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestJSONPointer(t *testing.T) {
+	const doc = `{"user": {"name": "foo", "age": 3, "tags": ["a", "b", "c"]}, "items": [{"name": "x"}, {"name": "y"}], "a/b": {"~c": "z"}}`
+	for _, tt := range []struct {
+		name        string
+		repl        *Replacement
+		contentType string
+		body        string
+		want        string
+	}{
+		{
+			name: "nested member",
+			repl: &Replacement{JSONPointer: "/user/name", Replaces: []string{"bar"}},
+			want: strings.Replace(doc, `"name": "foo"`, `"name": "bar"`, 1),
+		},
+		{
+			name: "sets a non-string value",
+			repl: &Replacement{JSONPointer: "/user/age", Replaces: []string{"old"}},
+			want: strings.Replace(doc, `"age": 3`, `"age": "old"`, 1),
+		},
+		{
+			name: "array element",
+			repl: &Replacement{JSONPointer: "/user/tags/1", Replaces: []string{"B"}},
+			want: strings.Replace(doc, `"b"`, `"B"`, 1),
+		},
+		{
+			name: "member of an array element",
+			repl: &Replacement{JSONPointer: "/items/1/name", Replaces: []string{"Y"}},
+			want: strings.Replace(doc, `"y"`, `"Y"`, 1),
+		},
+		{
+			name: "negative index",
+			repl: &Replacement{JSONPointer: "/user/tags/-1", Replaces: []string{"C"}},
+			want: strings.Replace(doc, `"c"]`, `"C"]`, 1),
+		},
+		{
+			name: "escaped tokens",
+			repl: &Replacement{JSONPointer: "/a~1b/~0c", Replaces: []string{"Z"}},
+			want: strings.Replace(doc, `"z"`, `"Z"`, 1),
+		},
+		{
+			name: "JSON path",
+			repl: &Replacement{JSONPointer: "$.items[0].name", Replaces: []string{"X"}},
+			want: strings.Replace(doc, `"x"`, `"X"`, 1),
+		},
+		{
+			name: "JSON path with quoted members",
+			repl: &Replacement{JSONPointer: "$['a/b'][\"~c\"]", Replaces: []string{"Z"}},
+			want: strings.Replace(doc, `"z"`, `"Z"`, 1),
+		},
+		{
+			name: "search within the value",
+			repl: &Replacement{JSONPointer: "/user/name", Search: "o", Replaces: []string{"0"}},
+			want: strings.Replace(doc, `"foo"`, `"f00"`, 1),
+		},
+		{
+			name: "regexp within the value",
+			repl: &Replacement{JSONPointer: "/items/0/name", SearchRegexp: "(x)", Replaces: []string{"[$1]"}},
+			want: strings.Replace(doc, `"x"`, `"[x]"`, 1),
+		},
+		{
+			name: "replace value is escaped",
+			repl: &Replacement{JSONPointer: "/user/name", Replaces: []string{`"<b>"`}},
+			want: strings.Replace(doc, `"foo"`, `"\"<b>\""`, 1),
+		},
+		{
+			name: "missing member",
+			repl: &Replacement{JSONPointer: "/user/email", Replaces: []string{"bar"}},
+			want: doc,
+		},
+		{
+			name: "index out of range",
+			repl: &Replacement{JSONPointer: "/user/tags/3", Replaces: []string{"bar"}},
+			want: doc,
+		},
+		{
+			name: "negative index out of range",
+			repl: &Replacement{JSONPointer: "/user/tags/-4", Replaces: []string{"bar"}},
+			want: doc,
+		},
+		{
+			name: "index into an object",
+			repl: &Replacement{JSONPointer: "/items/x", Replaces: []string{"bar"}},
+			want: doc,
+		},
+		{
+			name: "member of a scalar",
+			repl: &Replacement{JSONPointer: "/user/name/first", Replaces: []string{"bar"}},
+			want: doc,
+		},
+		{
+			name: "search within a non-string value",
+			repl: &Replacement{JSONPointer: "/user/age", Search: "3", Replaces: []string{"4"}},
+			want: doc,
+		},
+		{
+			name: "other fields are left alone",
+			repl: &Replacement{JSONPointer: "/items/0/name", Search: "y", Replaces: []string{"Y"}},
+			want: doc,
+		},
+		{
+			name: "invalid JSON",
+			repl: &Replacement{JSONPointer: "/user/name", Replaces: []string{"bar"}},
+			body: `{"user": {"name": "foo"}`,
+			want: `{"user": {"name": "foo"}`,
+		},
+		{
+			name:        "JSON subtype",
+			repl:        &Replacement{JSONPointer: "/user/name", Replaces: []string{"bar"}},
+			contentType: "application/problem+json",
+			want:        strings.Replace(doc, `"foo"`, `"bar"`, 1),
+		},
+		{
+			name:        "not JSON",
+			repl:        &Replacement{JSONPointer: "/user/name", Replaces: []string{"bar"}},
+			contentType: "text/plain",
+			want:        doc,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body, contentType := tt.body, tt.contentType
+			if body == "" {
+				body = doc
+			}
+			if contentType == "" {
+				contentType = "application/json"
+			}
+			h := provision(t, &Handler{Replacements: []*Replacement{tt.repl}})
+			w := serve(t, h, newRequest("GET", "/", nil), upstream(contentType, body))
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestJSONPointerWithSearch(t *testing.T) {
+	// pointer rules run after the rest of the replacements
+	h := provision(t, &Handler{Replacements: []*Replacement{
+		{Search: "foo", Replaces: []string{"bar"}},
+		{JSONPointer: "/b", Replaces: []string{"baz"}},
+	}})
+	w := serve(t, h, newRequest("GET", "/", nil), upstream("application/json", `{"a":"foo","b":"foo"}`))
+	if got, want := w.Body.String(), `{"a":"bar","b":"baz"}`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestJSONPointerInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		repl *Replacement
+	}{
+		{"no leading slash", &Replacement{JSONPointer: "user/name", Replaces: []string{"x"}}},
+		{"bad escape", &Replacement{JSONPointer: "/user~2name", Replaces: []string{"x"}}},
+		{"trailing tilde", &Replacement{JSONPointer: "/user~", Replaces: []string{"x"}}},
+		{"path without member name", &Replacement{JSONPointer: "$.", Replaces: []string{"x"}}},
+		{"path wildcard", &Replacement{JSONPointer: "$.items.*", Replaces: []string{"x"}}},
+		{"path index", &Replacement{JSONPointer: "$.items[x]", Replaces: []string{"x"}}},
+		{"path leading zero", &Replacement{JSONPointer: "$.items[01]", Replaces: []string{"x"}}},
+		{"path unterminated", &Replacement{JSONPointer: "$['items", Replaces: []string{"x"}}},
+		{"path missing bracket", &Replacement{JSONPointer: "$.items[0", Replaces: []string{"x"}}},
+		{"combined with once", &Replacement{JSONPointer: "/user", Replaces: []string{"x"}, Once: true}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := provisionErr(&Handler{Replacements: []*Replacement{tt.repl}}); err == nil {
+				t.Error("expected an error")
+			}
+		})
+	}
+}
+
+func TestParseJSONPath(t *testing.T) {
+	for _, tt := range []struct {
+		path string
+		want []string
+	}{
+		{"$", nil},
+		{"$.items", []string{"items"}},
+		{"$.items[2].name", []string{"items", "2", "name"}},
+		{"$.items[-1]", []string{"items", "-1"}},
+		{"$['a.b']['c d']", []string{"a.b", "c d"}},
+		{`$["a'b"]`, []string{"a'b"}},
+		{`$['it\'s']`, []string{"it's"}},
+		{"$['a/b'].c", []string{"a/b", "c"}},
+		{"$[0][1]", []string{"0", "1"}},
+	} {
+		got, err := parseJSONPath(tt.path)
+		if err != nil {
+			t.Errorf("%q: %v", tt.path, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.path, got, tt.want)
+		}
+	}
+	for _, path := range []string{"$.", "$..items", "$.*", "$[*]", "$items", "$[-]", "$[-0]", "$[1", "$['a'", "$['a'b]"} {
+		if _, err := parseJSONPath(path); err == nil {
+			t.Errorf("%q: no error", path)
+		}
+	}
+}
+
+func TestParseArrayIndex(t *testing.T) {
+	for _, tt := range []struct {
+		tok   string
+		index int
+		ok    bool
+	}{
+		{"0", 0, true},
+		{"12", 12, true},
+		{"-1", -1, true},
+		{"-12", -12, true},
+		{"-", 0, false},
+		{"-0", 0, false},
+		{"01", 0, false},
+		{"+1", 0, false},
+		{"1a", 0, false},
+		{"", 0, false},
+	} {
+		if index, ok := parseArrayIndex(tt.tok); index != tt.index || ok != tt.ok {
+			t.Errorf("%q: got %d, %v, want %d, %v", tt.tok, index, ok, tt.index, tt.ok)
+		}
+	}
+}
+
+func TestJSONPathNegativeIndices(t *testing.T) {
+	for _, tt := range []struct {
+		pointer string
+		body    string
+		want    string
+	}{
+		{"$.a[-1]", `{"a": [1, 2, 3]}`, `{"a": [1, 2, "x"]}`},
+		{"$.a[-3]", `{"a": [1, 2, 3]}`, `{"a": ["x", 2, 3]}`},
+		{"$.a[-1].b", `{"a": [{"b": 1}, { "b" : [ 2 ] } ]}`, `{"a": [{"b": 1}, { "b" : "x" } ]}`},
+		{"/a/-1/-1", `{"a": [[1], [2, {"c": 3}]]}`, `{"a": [[1], [2, "x"]]}`},
+		{"$.a[-1]", `{"a": []}`, `{"a": []}`},
+		{"$.a[-1]", `{"a": [ ]}`, `{"a": [ ]}`},
+		{"$.a[-4]", `{"a": [1, 2, 3]}`, `{"a": [1, 2, 3]}`},
+	} {
+		h := provision(t, &Handler{Replacements: []*Replacement{{JSONPointer: tt.pointer, Replaces: []string{"x"}}}})
+		if got := serve(t, h, newRequest("GET", "/", nil), upstream("application/json", tt.body)).Body.String(); got != tt.want {
+			t.Errorf("%s in %s: got %s, want %s", tt.pointer, tt.body, got, tt.want)
+		}
+	}
+}
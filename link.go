@@ -0,0 +1,122 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"golang.org/x/text/transform"
+)
+
+// rewriteLinks performs the replacements of tr on the target URI of
+// each link-value in value, a Link header value as in RFC 8288. The
+// parameters, such as rel=preload, and the separators are kept as
+// they are. If a replacement fails, value is returned unchanged.
+func rewriteLinks(value string, tr transform.Transformer) string {
+	var b strings.Builder
+	rest := value
+	for {
+		start := strings.IndexByte(rest, '<')
+		if start < 0 {
+			break
+		}
+		end := strings.IndexByte(rest[start:], '>')
+		if end < 0 {
+			break
+		}
+		end += start
+
+		tr.Reset()
+		target, _, err := transform.String(tr, rest[start+1:end])
+		if err != nil {
+			return value
+		}
+		b.WriteString(rest[:start+1])
+		b.WriteString(target)
+		b.WriteByte('>')
+
+		rest = rest[end+1:]
+		n := linkParamsEnd(rest)
+		b.WriteString(rest[:n])
+		rest = rest[n:]
+	}
+	b.WriteString(rest)
+	return b.String()
+}
+
+// linkParamsEnd returns the offset just past the comma that ends the
+// parameters at the start of s, or len(s) if they run to the end.
+// Commas in quoted parameter values don't end them.
+func linkParamsEnd(s string) int {
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		switch {
+		case quoted && s[i] == '\\':
+			i++
+		case s[i] == '"':
+			quoted = !quoted
+		case !quoted && s[i] == ',':
+			return i + 1
+		}
+	}
+	return len(s)
+}
+
+// linkWriter rewrites the Link headers of a response, and of the
+// informational responses such as 103 Early Hints before it, just
+// before they are written.
+type linkWriter struct {
+	*caddyhttp.ResponseWriterWrapper
+	tr          transform.Transformer
+	wroteHeader bool
+
+	// values that were already rewritten for an informational
+	// response, and are still in the header map
+	rewritten map[string]bool
+}
+
+func (lw *linkWriter) WriteHeader(status int) {
+	if lw.wroteHeader {
+		return
+	}
+	if status < 100 || status > 199 {
+		lw.wroteHeader = true
+	}
+	values := lw.Header().Values("Link")
+	for i, value := range values {
+		if lw.rewritten[value] {
+			continue
+		}
+		values[i] = rewriteLinks(value, lw.tr)
+		if lw.rewritten == nil {
+			lw.rewritten = make(map[string]bool)
+		}
+		lw.rewritten[values[i]] = true
+	}
+	lw.ResponseWriterWrapper.WriteHeader(status)
+}
+
+func (lw *linkWriter) Write(p []byte) (int, error) {
+	lw.WriteHeader(http.StatusOK)
+	return lw.ResponseWriterWrapper.Write(p)
+}
+
+func (lw *linkWriter) ReadFrom(r io.Reader) (int64, error) {
+	lw.WriteHeader(http.StatusOK)
+	return lw.ResponseWriterWrapper.ReadFrom(r)
+}
@@ -0,0 +1,148 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestLinkHeaders(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		values []string
+		want   []string
+	}{
+		{
+			name:   "single link",
+			values: []string{"<https://internal/app.js>; rel=preload; as=script"},
+			want:   []string{"<https://public/app.js>; rel=preload; as=script"},
+		},
+		{
+			name:   "several link-values",
+			values: []string{"<https://internal/a.css>; rel=preload; as=style, <https://internal/b.js>;rel=modulepreload"},
+			want:   []string{"<https://public/a.css>; rel=preload; as=style, <https://public/b.js>;rel=modulepreload"},
+		},
+		{
+			name:   "several headers",
+			values: []string{"<https://internal/a.css>; rel=preload", "<https://other/b.js>; rel=preload"},
+			want:   []string{"<https://public/a.css>; rel=preload", "<https://other/b.js>; rel=preload"},
+		},
+		{
+			name:   "parameters are kept",
+			values: []string{`<https://internal/a>; rel="preload"; title="https://internal, <https://internal/b>"`},
+			want:   []string{`<https://public/a>; rel="preload"; title="https://internal, <https://internal/b>"`},
+		},
+		{
+			name:   "escaped quote in a parameter",
+			values: []string{`<https://internal/a>; title="x\", <https://internal/b>", <https://internal/c>`},
+			want:   []string{`<https://public/a>; title="x\", <https://internal/b>", <https://public/c>`},
+		},
+		{
+			name:   "unterminated target",
+			values: []string{"<https://internal/a>, <https://internal/b"},
+			want:   []string{"<https://public/a>, <https://internal/b"},
+		},
+		{
+			name:   "no target",
+			values: []string{"rel=preload"},
+			want:   []string{"rel=preload"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, stream := range []bool{false, true} {
+				h := provision(t, &Handler{Stream: stream, LinkHeaders: true, Replacements: []*Replacement{{Search: "//internal/", Replaces: []string{"//public/"}}}})
+				next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+					w.Header()["Link"] = append([]string(nil), tt.values...)
+					w.Header().Set("Content-Type", "text/html")
+					_, err := io.WriteString(w, "https://internal/")
+					return err
+				})
+				w := serve(t, h, newRequest("GET", "/", nil), next)
+				if got := w.Header().Values("Link"); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("stream %v: Link %q, want %q", stream, got, tt.want)
+				}
+				if got := w.Body.String(); got != "https://public/" {
+					t.Errorf("stream %v: body %q, want %q", stream, got, "https://public/")
+				}
+			}
+		})
+	}
+}
+
+func TestLinkHeadersOff(t *testing.T) {
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "internal", Replaces: []string{"public"}}}})
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Link", "</internal.js>; rel=preload")
+		w.Header().Set("Content-Type", "text/html")
+		_, err := io.WriteString(w, "internal")
+		return err
+	})
+	w := serve(t, h, newRequest("GET", "/", nil), next)
+	if got := w.Header().Get("Link"); got != "</internal.js>; rel=preload" {
+		t.Errorf("Link %q, want it unchanged", got)
+	}
+}
+
+func TestLinkHeadersEarlyHints(t *testing.T) {
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Link", "</static/style.css>; rel=preload; as=style")
+		w.WriteHeader(http.StatusEarlyHints)
+		// a link added for the final response only
+		w.Header().Add("Link", "</static/app.js>; rel=preload; as=script")
+		w.Header().Set("Content-Type", "text/html")
+		w.WriteHeader(http.StatusOK)
+		_, err := io.WriteString(w, "ok")
+		return err
+	})
+	for _, stream := range []bool{false, true} {
+		h := provision(t, &Handler{Stream: stream, LinkHeaders: true, Replacements: []*Replacement{{Search: "/static/", Replaces: []string{"/static/v2/"}}}})
+		w := &hintsRecorder{ResponseRecorder: httptest.NewRecorder()}
+		if err := h.ServeHTTP(w, newRequest("GET", "/", nil), next); err != nil {
+			t.Fatal(err)
+		}
+		if want := [][]string{{"</static/v2/style.css>; rel=preload; as=style"}}; !reflect.DeepEqual(w.links, want) {
+			t.Errorf("stream %v: hints sent with Link %q, want %q", stream, w.links, want)
+		}
+		// the link rewritten for the hints is not rewritten twice
+		want := []string{"</static/v2/style.css>; rel=preload; as=style", "</static/v2/app.js>; rel=preload; as=script"}
+		if got := w.Header().Values("Link"); !reflect.DeepEqual(got, want) {
+			t.Errorf("stream %v: Link %q, want %q", stream, got, want)
+		}
+	}
+}
+
+func TestCaddyfileLinkHeaders(t *testing.T) {
+	h, err := parse("replace {\n\tlink_headers\n\tfoo bar\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.LinkHeaders {
+		t.Error("link_headers not set")
+	}
+	for _, input := range []string{
+		"replace {\n\tlink_headers\n\tlink_headers\n}",
+		"replace {\n\tlink_headers on\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
+
+// Units in which the length of a masked match is measured.
+const (
+	maskByBytes = "bytes"
+	maskByRunes = "runes"
+)
+
+// checkMask returns an error if the mask settings of repl are invalid.
+func (repl *Replacement) checkMask() error {
+	if repl.Mask == "" {
+		if repl.MaskBy != "" {
+			return fmt.Errorf("mask_by requires mask")
+		}
+		return nil
+	}
+	if utf8.RuneCountInString(repl.Mask) != 1 {
+		return fmt.Errorf("mask must be a single character, got %q", repl.Mask)
+	}
+	if len(repl.Replaces) > 0 {
+		return fmt.Errorf("cannot specify both mask and replace in same replacement")
+	}
+	switch repl.MaskBy {
+	case "", maskByBytes, maskByRunes:
+	default:
+		return fmt.Errorf("mask_by must be %s or %s, got %q", maskByBytes, maskByRunes, repl.MaskBy)
+	}
+	return nil
+}
+
+// mask returns match with every byte, or every rune with mask_by
+// runes, replaced by the mask character.
+func (repl *Replacement) mask(match []byte) []byte {
+	n := len(match)
+	if repl.MaskBy == maskByRunes {
+		n = utf8.RuneCount(match)
+	}
+	return bytes.Repeat([]byte(repl.Mask), n)
+}
+
+// maskMatch returns the match described by index with the capture
+// group of repl masked, or the whole match if the group is 0. If the
+// group didn't participate in the match, it is returned unchanged.
+func (repl *Replacement) maskMatch(src []byte, index []int) []byte {
+	match := src[index[0]:index[1]]
+	if repl.Group == 0 {
+		return repl.mask(match)
+	}
+	start, end := index[2*repl.Group], index[2*repl.Group+1]
+	if start < 0 {
+		return match
+	}
+	masked := make([]byte, 0, len(match))
+	masked = append(masked, src[index[0]:start]...)
+	masked = append(masked, repl.mask(src[start:end])...)
+	return append(masked, src[end:index[1]]...)
+}
+
+// checkGroup returns an error if the group of repl is invalid. It
+// must be called after the search_regexp is compiled.
+func (repl *Replacement) checkGroup() error {
+	if repl.Group == 0 {
+		return nil
+	}
+	if (repl.Mask == "" && repl.HashMatch == "" && !repl.DecodeMatchBase64) || repl.re == nil {
+		return fmt.Errorf("group requires mask, hash_match or decode_match_base64, and search_regexp")
+	}
+	if repl.Group < 0 || repl.Group > repl.re.NumSubexp() {
+		return fmt.Errorf("group %d is out of range, search_regexp has %d groups", repl.Group, repl.re.NumSubexp())
+	}
+	return nil
+}
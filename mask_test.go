@@ -0,0 +1,113 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestMask(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		repl Replacement
+		body string
+		want string
+	}{
+		{name: "substring", repl: Replacement{Search: "secret", Mask: "*"}, body: "a secret!", want: "a ******!"},
+		{name: "regexp", repl: Replacement{SearchRegexp: `\d+`, Mask: "#"}, body: "pin 1234, id 56", want: "pin ####, id ##"},
+		{name: "bytes by default", repl: Replacement{SearchRegexp: `ü+`, Mask: "*"}, body: "üü", want: "****"},
+		{name: "runes", repl: Replacement{SearchRegexp: `ü+`, Mask: "*", MaskBy: maskByRunes}, body: "üü", want: "**"},
+		{name: "multibyte mask", repl: Replacement{Search: "ab", Mask: "•"}, body: "ab", want: "••"},
+		{name: "group", repl: Replacement{SearchRegexp: `key=(\w+)`, Mask: "*", Group: 1}, body: "key=abc&x", want: "key=***&x"},
+		{name: "group not matched", repl: Replacement{SearchRegexp: `key(=\w+)?`, Mask: "*", Group: 1}, body: "key", want: "key"},
+		{name: "empty match", repl: Replacement{SearchRegexp: `x*`, Mask: "*"}, body: "ab", want: "ab"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, stream := range []bool{false, true} {
+				repl := tt.repl
+				h := provision(t, &Handler{Stream: stream, Replacements: []*Replacement{&repl}})
+				if got := replaced(t, h, splitEvery(tt.body, 1)...); got != tt.want {
+					t.Errorf("stream %v: got %q, want %q", stream, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestGroup(t *testing.T) {
+	sum := md5.Sum([]byte("/app.js"))
+	for _, tt := range []struct {
+		name string
+		repl Replacement
+		body string
+		want string
+	}{
+		{name: "middle group", repl: Replacement{SearchRegexp: `(\w+)@(\w+)\.(\w+)`, Mask: "*", Group: 2}, body: "me@host.com", want: "me@****.com"},
+		{name: "last group", repl: Replacement{SearchRegexp: `(\w+)@(\w+)\.(\w+)`, Mask: "*", Group: 3}, body: "me@host.com", want: "me@host.***"},
+		{name: "named group", repl: Replacement{SearchRegexp: `pin: (?P<pin>\d+)`, Mask: "#", Group: 1}, body: "pin: 1234", want: "pin: ####"},
+		{name: "every match", repl: Replacement{SearchRegexp: `k=(\w+)`, Mask: "*", Group: 1}, body: "k=ab&k=cde", want: "k=**&k=***"},
+		{name: "whole match", repl: Replacement{SearchRegexp: `k=(\w+)`, Mask: "*"}, body: "k=ab", want: "****"},
+		{name: "hash_match", repl: Replacement{SearchRegexp: `src="([^"]+)"`, HashMatch: "md5", Group: 1}, body: `<script src="/app.js">`, want: `<script src="` + hex.EncodeToString(sum[:]) + `">`},
+		{
+			name: "decode_match_base64",
+			repl: Replacement{SearchRegexp: `token=([\w+/=]+)`, DecodeMatchBase64: true, Group: 1, Base64Replacements: []*Replacement{{Search: "user", Replaces: []string{"anon"}}}},
+			body: "token=" + base64.StdEncoding.EncodeToString([]byte("user:1")) + ";",
+			want: "token=" + base64.StdEncoding.EncodeToString([]byte("anon:1")) + ";",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []struct {
+				name    string
+				stream  bool
+				longest bool
+			}{{"buffer", false, false}, {"stream", true, false}, {"longest match", false, true}} {
+				repl := tt.repl
+				h := &Handler{Stream: mode.stream, Replacements: []*Replacement{&repl}}
+				if mode.longest {
+					h.ConflictResolution = conflictLongestMatchWins
+				}
+				if got := replaced(t, provision(t, h), tt.body); got != tt.want {
+					t.Errorf("%s: got %q, want %q", mode.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestMaskInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		repl Replacement
+		err  string
+	}{
+		{repl: Replacement{Search: "a", Mask: "**"}, err: "mask must be a single character"},
+		{repl: Replacement{Search: "a", Mask: "*", Replaces: []string{"b"}}, err: "cannot specify both mask and replace"},
+		{repl: Replacement{Search: "a", Mask: "*", MaskBy: "words"}, err: "mask_by must be bytes or runes"},
+		{repl: Replacement{Search: "a", MaskBy: maskByRunes, Replaces: []string{"b"}}, err: "mask_by requires mask"},
+		{repl: Replacement{SearchRegexp: "(a)", Mask: "*", Group: 2}, err: "group 2 is out of range"},
+		{repl: Replacement{SearchRegexp: "(a)", Mask: "*", Group: -1}, err: "group -1 is out of range"},
+		{repl: Replacement{SearchRegexp: "(a)", Group: 1, Replaces: []string{"b"}}, err: "group requires mask, hash_match or decode_match_base64"},
+		{repl: Replacement{Search: "a", Mask: "*", Group: 1}, err: "group requires mask, hash_match or decode_match_base64, and search_regexp"},
+	} {
+		repl := tt.repl
+		err := provisionErr(&Handler{Replacements: []*Replacement{&repl}})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%+v: got error %v, want %q", tt.repl, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,204 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"strings"
+
+	"github.com/icholy/replace"
+	"golang.org/x/text/transform"
+)
+
+// literal is a substring replacement with its final search and
+// replace values.
+type literal struct {
+	search, replace string
+}
+
+// canOverlap reports whether occurrences of a and b can overlap in
+// some text: one contains the other, or a suffix of one is a prefix
+// of the other.
+func canOverlap(a, b string) bool {
+	if strings.Contains(a, b) || strings.Contains(b, a) {
+		return true
+	}
+	for n := 1; n < len(a) && n < len(b); n++ {
+		if a[len(a)-n:] == b[:n] || b[len(b)-n:] == a[:n] {
+			return true
+		}
+	}
+	return false
+}
+
+// mergesWith reports whether lit can be performed in the same pass as
+// the literals of group, which come before it, with the same result as
+// performing them one after another. That is the case if lit can't
+// match text that overlaps a match of one of them, or text inserted by
+// one of them, so that applying them first doesn't change what lit
+// replaces. Deleting a match could join text into a new match of lit,
+// so group can't contain empty replace values.
+func (lit literal) mergesWith(group []literal) bool {
+	for _, prev := range group {
+		if prev.replace == "" || canOverlap(prev.search, lit.search) || canOverlap(prev.replace, lit.search) {
+			return false
+		}
+	}
+	return true
+}
+
+// mergeLiterals returns transformers that perform lits in order, like
+// a chain of replace.String transformers would, with each run of lits
+// for which mergesWith holds performed by a single literalSet.
+func mergeLiterals(lits []literal) []transform.Transformer {
+	var transforms []transform.Transformer
+	var group []literal
+	flush := func() {
+		switch len(group) {
+		case 0:
+		case 1:
+			transforms = append(transforms, replace.String(group[0].search, group[0].replace))
+		default:
+			transforms = append(transforms, newLiteralSet(group))
+		}
+		group = nil
+	}
+	for _, lit := range lits {
+		if !lit.mergesWith(group) {
+			flush()
+		}
+		group = append(group, lit)
+	}
+	flush()
+	return transforms
+}
+
+// literalSet is a transformer that replaces the occurrences of several
+// search strings in a single pass. None of them may overlap another,
+// which mergesWith ensures, so at most one matches at each position.
+// The search strings are kept in a trie; root maps the first byte of a
+// search to its node, and each node the next byte to the next one.
+// Node numbers start at 1, so 0 means there is no such node.
+type literalSet struct {
+	transform.NopResetter
+
+	root  [256]int32
+	nodes []literalNode
+}
+
+type literalNode struct {
+	keys []byte
+	next []int32
+	// the replace value, if a search ends here
+	replace []byte
+	leaf    bool
+}
+
+func newLiteralSet(lits []literal) *literalSet {
+	ls := new(literalSet)
+	for _, lit := range lits {
+		node := &ls.root[lit.search[0]]
+		for k := 1; ; k++ {
+			if *node == 0 {
+				ls.nodes = append(ls.nodes, literalNode{})
+				*node = int32(len(ls.nodes))
+			}
+			if k == len(lit.search) {
+				break
+			}
+			node = ls.nodes[*node-1].child(lit.search[k])
+		}
+		leaf := &ls.nodes[*node-1]
+		leaf.replace, leaf.leaf = []byte(lit.replace), true
+	}
+	return ls
+}
+
+// child returns a pointer to the number of the child of nd for b,
+// adding it with number 0 if there is none yet.
+func (nd *literalNode) child(b byte) *int32 {
+	for i, key := range nd.keys {
+		if key == b {
+			return &nd.next[i]
+		}
+	}
+	nd.keys = append(nd.keys, b)
+	nd.next = append(nd.next, 0)
+	return &nd.next[len(nd.next)-1]
+}
+
+// match returns the length and the replace value of the search matching
+// at the start of p, or 0 if there is none. It reports false if more
+// input is needed to tell.
+func (ls *literalSet) match(p []byte, atEOF bool) (int, []byte, bool) {
+	node := ls.root[p[0]]
+	for k := 1; ; k++ {
+		nd := &ls.nodes[node-1]
+		if nd.leaf {
+			return k, nd.replace, true
+		}
+		if k == len(p) {
+			return 0, nil, atEOF
+		}
+		node = 0
+		for i, key := range nd.keys {
+			if key == p[k] {
+				node = nd.next[i]
+				break
+			}
+		}
+		if node == 0 {
+			return 0, nil, true
+		}
+	}
+}
+
+func (ls *literalSet) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc < len(src) {
+		// copy the bytes that can't start a match at once
+		end := nSrc
+		for end < len(src) && ls.root[src[end]] == 0 {
+			end++
+		}
+		if end > nSrc {
+			n := copy(dst[nDst:], src[nSrc:end])
+			nDst += n
+			nSrc += n
+			if nSrc < end {
+				return nDst, nSrc, transform.ErrShortDst
+			}
+			continue
+		}
+
+		n, replace, ok := ls.match(src[nSrc:], atEOF)
+		if !ok {
+			return nDst, nSrc, transform.ErrShortSrc
+		}
+		if n == 0 {
+			if nDst == len(dst) {
+				return nDst, nSrc, transform.ErrShortDst
+			}
+			dst[nDst] = src[nSrc]
+			nDst++
+			nSrc++
+			continue
+		}
+		if len(dst)-nDst < len(replace) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		nDst += copy(dst[nDst:], replace)
+		nSrc += n
+	}
+	return nDst, nSrc, nil
+}
@@ -0,0 +1,253 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"golang.org/x/text/transform"
+)
+
+func TestOptimize(t *testing.T) {
+	rule := func(search, replace string) *Replacement {
+		return &Replacement{Search: search, Replaces: []string{replace}}
+	}
+	long := strings.Repeat("one two three, ", 1000)
+	for _, tt := range []struct {
+		name  string
+		rules []*Replacement
+		body  string
+		want  string
+	}{
+		{
+			name:  "independent",
+			rules: []*Replacement{rule("one", "1"), rule("two", "2"), rule("three", "3")},
+			body:  "one two three",
+			want:  "1 2 3",
+		},
+		{
+			name:  "later search overlaps an earlier one",
+			rules: []*Replacement{rule("abc", "x"), rule("cd", "y")},
+			body:  "abcd cd",
+			want:  "xd y",
+		},
+		{
+			name:  "later search contained in an earlier one",
+			rules: []*Replacement{rule("foobar", "x"), rule("bar", "y")},
+			body:  "foobar bar",
+			want:  "x y",
+		},
+		{
+			name:  "earlier replace inserts a later search",
+			rules: []*Replacement{rule("a", "bb"), rule("b", "c")},
+			body:  "ab",
+			want:  "ccc",
+		},
+		{
+			name:  "earlier replace deletes its matches",
+			rules: []*Replacement{rule("-", ""), rule("ab", "x")},
+			body:  "a-b ab",
+			want:  "x x",
+		},
+		{
+			name:  "last replace deletes its matches",
+			rules: []*Replacement{rule("a", "1"), rule("b", "")},
+			body:  "abab",
+			want:  "11",
+		},
+		{
+			name:  "regexp between literals",
+			rules: []*Replacement{rule("one", "1"), {SearchRegexp: `\d`, Replaces: []string{"#"}}, rule("two", "2")},
+			body:  "one two",
+			want:  "# 2",
+		},
+		{
+			name:  "rule that decides per match",
+			rules: []*Replacement{rule("one", "1"), {Search: "two", Replaces: []string{"2"}, OncePerValue: true}, rule("three", "3")},
+			body:  "one two three two",
+			want:  "1 2 3 two",
+		},
+		{
+			name:  "searches sharing a prefix",
+			rules: []*Replacement{rule("cart", "1"), rule("cat", "2"), rule("ca", "3")},
+			body:  "cat cart ca c",
+			want:  "2 1 3 c",
+		},
+		{
+			name:  "body longer than the buffers",
+			rules: []*Replacement{rule("one", "uno uno"), rule("two", "dos dos"), rule("three", "tres tres")},
+			body:  long,
+			want:  strings.NewReplacer("one", "uno uno", "two", "dos dos", "three", "tres tres").Replace(long),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []struct {
+				name   string
+				stream bool
+				chunk  int
+			}{{"buffer", false, len(tt.body)}, {"stream", true, len(tt.body)}, {"stream bytewise", true, 1}} {
+				for _, optimize := range []bool{false, true} {
+					rules := make([]*Replacement, len(tt.rules))
+					for i, repl := range tt.rules {
+						r := *repl
+						rules[i] = &r
+					}
+					h := provision(t, &Handler{Optimize: optimize, Stream: mode.stream, Replacements: rules})
+					if got := replaced(t, h, splitEvery(tt.body, mode.chunk)...); got != tt.want {
+						t.Errorf("%s, optimize %v: got %.60q, want %.60q", mode.name, optimize, got, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMergeLiterals(t *testing.T) {
+	for _, tt := range []struct {
+		lits []literal
+		// the number of literals performed by each transformer
+		want []int
+	}{
+		{[]literal{{"a", "1"}}, []int{1}},
+		{[]literal{{"a", "1"}, {"b", "2"}, {"c", "3"}}, []int{3}},
+		{[]literal{{"ab", "1"}, {"bc", "2"}, {"d", "3"}}, []int{1, 2}},
+		{[]literal{{"a", "b"}, {"b", "c"}}, []int{1, 1}},
+		{[]literal{{"a", ""}, {"b", "c"}}, []int{1, 1}},
+		{[]literal{{"a", "1"}, {"b", ""}}, []int{2}},
+		{[]literal{{"a", "1"}, {"b", "2"}, {"ab", "3"}, {"c", "4"}}, []int{2, 2}},
+	} {
+		transforms := mergeLiterals(tt.lits)
+		got := make([]int, len(transforms))
+		for i, tr := range transforms {
+			got[i] = 1
+			if ls, ok := tr.(*literalSet); ok {
+				got[i] = 0
+				for _, nd := range ls.nodes {
+					if nd.leaf {
+						got[i]++
+					}
+				}
+			}
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%v: got %v, want %v", tt.lits, got, tt.want)
+		}
+	}
+}
+
+func TestCanOverlap(t *testing.T) {
+	for _, tt := range []struct {
+		a, b string
+		want bool
+	}{
+		{"abc", "abc", true},
+		{"abc", "b", true},
+		{"b", "abc", true},
+		{"abc", "cd", true},
+		{"cd", "abc", true},
+		{"abc", "def", false},
+		{"aba", "bab", true},
+		{"ab", "ba", true},
+		{"a", "b", false},
+	} {
+		if got := canOverlap(tt.a, tt.b); got != tt.want {
+			t.Errorf("canOverlap(%q, %q) = %v, want %v", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+func TestLiteralSet(t *testing.T) {
+	ls := newLiteralSet([]literal{{"cat", "dog"}, {"cart", "wagon"}, {"x", ""}})
+	for _, tt := range []struct {
+		in, want string
+	}{
+		{"", ""},
+		{"cat", "dog"},
+		{"ca", "ca"},
+		{"car", "car"},
+		{"cart cat cax", "wagon dog ca"},
+		{"ccat", "cdog"},
+		{"xxx", ""},
+	} {
+		got, _, err := transform.String(ls, tt.in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.in, got, tt.want)
+		}
+		// a destination that only fits the longest replace value
+		var out []byte
+		dst := make([]byte, len("wagon"))
+		src, atEOF := []byte(tt.in), true
+		for {
+			nDst, nSrc, err := ls.Transform(dst, src, atEOF)
+			out = append(out, dst[:nDst]...)
+			src = src[nSrc:]
+			if err == nil {
+				break
+			}
+			if err != transform.ErrShortDst || nSrc == 0 && nDst == 0 {
+				t.Fatalf("%q: %v", tt.in, err)
+			}
+		}
+		if string(out) != tt.want {
+			t.Errorf("%q with a short destination: got %q, want %q", tt.in, out, tt.want)
+		}
+	}
+	if _, _, err := ls.Transform(make([]byte, 10), []byte("ca"), false); err != transform.ErrShortSrc {
+		t.Errorf("partial match: got %v, want %v", err, transform.ErrShortSrc)
+	}
+}
+
+func TestOptimizeInvalid(t *testing.T) {
+	if err := provisionErr(&Handler{Optimize: true, ConflictResolution: conflictLongestMatchWins, Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}}}); err == nil {
+		t.Error("longest_match_wins: no error")
+	}
+}
+
+func TestCaddyfileOptimize(t *testing.T) {
+	h, err := parse("replace {\n\toptimize\n\tfoo bar\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.Optimize {
+		t.Error("optimize not set")
+	}
+	for _, input := range []string{
+		"replace {\n\toptimize yes\n}",
+		"replace {\n\toptimize\n\toptimize\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+func BenchmarkOptimize(b *testing.B) {
+	body := page(1 << 20)
+	for _, n := range []int{4, 32} {
+		for _, optimize := range []bool{false, true} {
+			b.Run(strconv.Itoa(n)+" rules/optimize="+strconv.FormatBool(optimize), func(b *testing.B) {
+				rules := append(manyRules(n-1), &Replacement{Search: "foo", Replaces: []string{"bar"}})
+				h := provision(b, &Handler{Optimize: optimize, Replacements: rules})
+				benchmarkServe(b, h, body)
+			})
+		}
+	}
+}
@@ -0,0 +1,107 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"sync"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// poolMetrics are the metrics of the transformer pools of all
+// handlers. They are registered with the default registry, which
+// Caddy's metrics handler serves, the first time a handler is
+// provisioned.
+var poolMetrics = struct {
+	init    sync.Once
+	gets    prometheus.Counter
+	created prometheus.Counter
+	inUse   prometheus.Gauge
+}{}
+
+func initPoolMetrics() {
+	const ns, sub = "caddy", "replace_response"
+
+	poolMetrics.gets = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "transformer_gets_total",
+		Help:      "Number of transformers taken from the pool.",
+	})
+	poolMetrics.created = promauto.NewCounter(prometheus.CounterOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "transformers_created_total",
+		Help:      "Number of transformers built because the pool was empty.",
+	})
+	poolMetrics.inUse = promauto.NewGauge(prometheus.GaugeOpts{
+		Namespace: ns,
+		Subsystem: sub,
+		Name:      "transformers_in_use",
+		Help:      "Number of transformers currently replacing a response.",
+	})
+}
+
+// ruleMetrics are the metrics of replacements that have a name. Like
+// poolMetrics, they are registered the first time a handler is
+// provisioned.
+var ruleMetrics = struct {
+	init         sync.Once
+	replacements *prometheus.CounterVec
+}{}
+
+func initRuleMetrics() {
+	ruleMetrics.replacements = promauto.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "caddy",
+		Subsystem: "replace_response",
+		Name:      "replacements_total",
+		Help:      "Number of matches replaced, by the name of the replacement.",
+	}, []string{"rule"})
+}
+
+// count records that the i'th rule, repl, replaced a match in the
+// body being replaced by rt.
+func (rt *replacer) count(i int, repl *Replacement) {
+	rt.counts[i]++
+	if repl.counter != nil {
+		repl.counter.Inc()
+	}
+}
+
+// getReplacer takes a transformer from the pool, or builds one for the
+// request of repl if the pool is empty.
+func (h *Handler) getReplacer(repl *caddy.Replacer) *replacer {
+	poolMetrics.gets.Inc()
+	if rt, ok := h.transformerPool.Get().(*replacer); ok {
+		return rt
+	}
+	return h.newTransformer(repl)
+}
+
+// checkoutReplacer takes a transformer from the pool for a response.
+// It must be given back with releaseReplacer.
+func (h *Handler) checkoutReplacer(repl *caddy.Replacer) *replacer {
+	poolMetrics.inUse.Inc()
+	return h.getReplacer(repl)
+}
+
+// releaseReplacer returns a transformer taken by checkoutReplacer to
+// the pool.
+func (h *Handler) releaseReplacer(rt *replacer) {
+	poolMetrics.inUse.Dec()
+	h.transformerPool.Put(rt)
+}
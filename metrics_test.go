@@ -0,0 +1,178 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPrewarmPool(t *testing.T) {
+	poolMetrics.init.Do(initPoolMetrics)
+	for _, tt := range []struct {
+		name     string
+		handler  *Handler
+		prewarms bool
+	}{
+		{name: "prewarmed", handler: &Handler{PrewarmPool: true, Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}}}, prewarms: true},
+		{name: "off", handler: &Handler{Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}}}},
+		{name: "placeholders", handler: &Handler{PrewarmPool: true, Replacements: []*Replacement{{Search: "a", Replaces: []string{"{http.request.host}"}}}}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := tt.handler
+			// provisioning again, as on a config reload, builds a
+			// new pool
+			for reload := 0; reload < 2; reload++ {
+				before := testutil.ToFloat64(poolMetrics.created)
+				old := h.transformerPool
+				provision(t, h)
+				if h.transformerPool == old {
+					t.Fatalf("reload %d: pool not rebuilt", reload)
+				}
+				if built := testutil.ToFloat64(poolMetrics.created) - before; (built == 1) != tt.prewarms || built > 1 {
+					t.Errorf("reload %d: built %v transformers while provisioning, want prewarming %v", reload, built, tt.prewarms)
+				}
+			}
+			if !tt.prewarms || raceEnabled {
+				return
+			}
+			before := testutil.ToFloat64(poolMetrics.created)
+			if got := replaced(t, h, "a"); got != "b" {
+				t.Errorf("got %q, want %q", got, "b")
+			}
+			if built := testutil.ToFloat64(poolMetrics.created) - before; built != 0 {
+				t.Errorf("first request built %v transformers", built)
+			}
+		})
+	}
+}
+
+func TestReloadGoroutines(t *testing.T) {
+	h := &Handler{PrewarmPool: true, Stream: true, FlushInterval: caddy.Duration(time.Second), Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}}}
+	provision(t, h)
+	before := runtime.NumGoroutine()
+	for i := 0; i < 50; i++ {
+		provision(t, h)
+		replaced(t, h, "a")
+	}
+	// give goroutines that are about to exit a chance to do so
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("%d goroutines before reloading, %d after", before, after)
+	}
+}
+
+func TestPoolMetrics(t *testing.T) {
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}}})
+	gets, created, inUse := testutil.ToFloat64(poolMetrics.gets), testutil.ToFloat64(poolMetrics.created), testutil.ToFloat64(poolMetrics.inUse)
+	for i := 0; i < 3; i++ {
+		replaced(t, h, "a")
+	}
+	if got := testutil.ToFloat64(poolMetrics.gets) - gets; got != 3 {
+		t.Errorf("%v gets for 3 responses", got)
+	}
+	if got := testutil.ToFloat64(poolMetrics.inUse); got != inUse {
+		t.Errorf("%v transformers in use after the responses, want %v", got, inUse)
+	}
+
+	// transformers checked out at the same time are built anew
+	const n = 20
+	gets, created = testutil.ToFloat64(poolMetrics.gets), testutil.ToFloat64(poolMetrics.created)
+	checkedOut := make(chan *replacer, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			checkedOut <- h.checkoutReplacer(caddy.NewReplacer())
+		}()
+	}
+	wg.Wait()
+	if got := testutil.ToFloat64(poolMetrics.inUse) - inUse; got != n {
+		t.Errorf("%v transformers in use, want %d", got, n)
+	}
+	if got := testutil.ToFloat64(poolMetrics.gets) - gets; got != n {
+		t.Errorf("%v gets, want %d", got, n)
+	}
+	if got := testutil.ToFloat64(poolMetrics.created) - created; got < n-1 || got > n {
+		t.Errorf("%v transformers built for %d concurrent checkouts", got, n)
+	}
+	for i := 0; i < n; i++ {
+		h.releaseReplacer(<-checkedOut)
+	}
+	if got := testutil.ToFloat64(poolMetrics.inUse); got != inUse {
+		t.Errorf("%v transformers in use after releasing them, want %v", got, inUse)
+	}
+}
+
+func TestRuleMetrics(t *testing.T) {
+	for _, mode := range []struct {
+		name    string
+		stream  bool
+		longest bool
+	}{{"buffer", false, false}, {"stream", true, false}, {"longest match", false, true}} {
+		t.Run(mode.name, func(t *testing.T) {
+			h := &Handler{Stream: mode.stream, Replacements: []*Replacement{
+				{Name: "greeting", Search: "hello", Replaces: []string{"hi"}},
+				{Name: "digits", SearchRegexp: `\d+`, Replaces: []string{"#"}},
+				{Search: "x", Replaces: []string{"y"}},
+				// matches are counted once for each name
+				{Name: "greeting", Search: "bye", Replaces: []string{"ciao"}},
+			}}
+			if mode.longest {
+				h.ConflictResolution = conflictLongestMatchWins
+			}
+			provision(t, h)
+			counted := func(name string) float64 {
+				return testutil.ToFloat64(ruleMetrics.replacements.WithLabelValues(name))
+			}
+			greeting, digits := counted("greeting"), counted("digits")
+			if got := replaced(t, h, "hello 12 x 3 hello bye"); got != "hi # y # hi ciao" {
+				t.Fatalf("got %q", got)
+			}
+			if got := counted("greeting") - greeting; got != 3 {
+				t.Errorf("greeting: %v replacements counted, want 3", got)
+			}
+			if got := counted("digits") - digits; got != 2 {
+				t.Errorf("digits: %v replacements counted, want 2", got)
+			}
+		})
+	}
+}
+
+func TestRuleMetricsJSONPointer(t *testing.T) {
+	h := provision(t, &Handler{Replacements: []*Replacement{{Name: "pointer", JSONPointer: "/a", Replaces: []string{"b"}}}})
+	before := testutil.ToFloat64(ruleMetrics.replacements.WithLabelValues("pointer"))
+	serve(t, h, newRequest("GET", "/", nil), upstream("application/json", `{"a":"x"}`))
+	serve(t, h, newRequest("GET", "/", nil), upstream("application/json", `{"c":"x"}`))
+	if got := testutil.ToFloat64(ruleMetrics.replacements.WithLabelValues("pointer")) - before; got != 1 {
+		t.Errorf("%v replacements counted, want 1", got)
+	}
+}
+
+func TestRuleNameInvalid(t *testing.T) {
+	err := provisionErr(&Handler{Replacements: []*Replacement{{Name: "{http.request.host}", Search: "a", Replaces: []string{"b"}}}})
+	if err == nil || !strings.Contains(err.Error(), "must not contain placeholders") {
+		t.Errorf("got error %v", err)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"golang.org/x/text/transform"
+)
+
+// multipartBoundary returns the boundary of a multipart response
+// body, or the empty string if the response is not multipart.
+func multipartBoundary(header http.Header) string {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return ""
+	}
+	return params["boundary"]
+}
+
+// multipartWriter performs replacements on selected parts of a
+// multipart body, such as a multipart/x-mixed-replace stream. The
+// preamble, the delimiters, the headers of each part and the bodies of
+// unselected parts are written to w untouched. Bytes that might be the
+// start of a delimiter are held back until enough of the stream has
+// been seen to tell.
+type multipartWriter struct {
+	w        io.Writer
+	tr       transform.Transformer
+	boundary []byte
+	selected func(part int) bool
+
+	// index of the current part; -1 while in the preamble
+	part     int
+	inHeader bool
+	tw       io.WriteCloser
+	buf      []byte
+}
+
+func newMultipartWriter(w io.Writer, tr transform.Transformer, boundary string, selected func(part int) bool) *multipartWriter {
+	return &multipartWriter{
+		w:        w,
+		tr:       tr,
+		boundary: []byte(boundary),
+		selected: selected,
+		part:     -1,
+	}
+}
+
+// delimiter returns the byte sequence that ends the current section.
+// The first delimiter may appear at the very start of the body, so
+// the leading CRLF is only required after the preamble.
+func (mw *multipartWriter) delimiter() []byte {
+	if mw.part < 0 {
+		return append([]byte("--"), mw.boundary...)
+	}
+	return append([]byte("\r\n--"), mw.boundary...)
+}
+
+// sink returns the writer for the body of the current section.
+func (mw *multipartWriter) sink() io.Writer {
+	if mw.tw != nil {
+		return mw.tw
+	}
+	return mw.w
+}
+
+func (mw *multipartWriter) Write(p []byte) (int, error) {
+	mw.buf = append(mw.buf, p...)
+	for {
+		if mw.inHeader {
+			idx := bytes.Index(mw.buf, []byte("\r\n\r\n"))
+			if idx < 0 {
+				return len(p), mw.emit(mw.w, 3)
+			}
+			if _, err := mw.w.Write(mw.buf[:idx+4]); err != nil {
+				return 0, err
+			}
+			mw.buf = mw.buf[idx+4:]
+			mw.inHeader = false
+			if mw.selected(mw.part) {
+				mw.tr.Reset()
+				mw.tw = newTransformWriter(mw.w, mw.tr)
+			}
+			continue
+		}
+
+		delim := mw.delimiter()
+		idx := bytes.Index(mw.buf, delim)
+		if idx < 0 {
+			return len(p), mw.emit(mw.sink(), len(delim)-1)
+		}
+		if _, err := mw.sink().Write(mw.buf[:idx]); err != nil {
+			return 0, err
+		}
+		if err := mw.closePart(); err != nil {
+			return 0, err
+		}
+		if _, err := mw.w.Write(delim); err != nil {
+			return 0, err
+		}
+		mw.buf = mw.buf[idx+len(delim):]
+		mw.part++
+		mw.inHeader = true
+	}
+}
+
+// emit writes all buffered bytes except the last keep bytes to dst.
+func (mw *multipartWriter) emit(dst io.Writer, keep int) error {
+	n := len(mw.buf) - keep
+	if n <= 0 {
+		return nil
+	}
+	if _, err := dst.Write(mw.buf[:n]); err != nil {
+		return err
+	}
+	mw.buf = append(mw.buf[:0], mw.buf[n:]...)
+	return nil
+}
+
+// closePart flushes the transform writer of the current part, if any.
+func (mw *multipartWriter) closePart() error {
+	if mw.tw == nil {
+		return nil
+	}
+	err := mw.tw.Close()
+	mw.tw = nil
+	return err
+}
+
+// Close writes any remaining buffered bytes. It does not close w.
+func (mw *multipartWriter) Close() error {
+	if _, err := mw.sink().Write(mw.buf); err != nil {
+		return err
+	}
+	mw.buf = mw.buf[:0]
+	return mw.closePart()
+}
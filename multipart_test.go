@@ -0,0 +1,85 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMultipartParts(t *testing.T) {
+	part := func(body string) string {
+		return "--frame\r\nContent-Type: text/plain\r\nX-Foo: foo\r\n\r\n" + body + "\r\n"
+	}
+	body := "preamble foo\r\n" + part("foo 0") + part("foo 1") + part("foo 2") + "--frame--\r\nepilogue foo"
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		parts       []int
+		want        string
+	}{
+		{
+			name:        "first part",
+			contentType: "multipart/x-mixed-replace; boundary=frame",
+			parts:       []int{0},
+			want:        "preamble foo\r\n" + part("bar 0") + part("foo 1") + part("foo 2") + "--frame--\r\nepilogue foo",
+		},
+		{
+			name:        "some parts",
+			contentType: "multipart/x-mixed-replace; boundary=frame",
+			parts:       []int{1, 2},
+			want:        "preamble foo\r\n" + part("foo 0") + part("bar 1") + part("bar 2") + "--frame--\r\nepilogue foo",
+		},
+		{
+			name:        "part out of range",
+			contentType: "multipart/x-mixed-replace; boundary=frame",
+			parts:       []int{5},
+			want:        body,
+		},
+		{
+			name:        "not multipart",
+			contentType: "text/plain",
+			parts:       []int{0},
+			want:        strings.ReplaceAll(body, "foo", "bar"),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, stream := range []bool{false, true} {
+				for _, chunk := range []int{len(body), 7, 1} {
+					h := provision(t, &Handler{Stream: stream, MultipartParts: tt.parts, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+					w := serve(t, h, newRequest("GET", "/", nil), upstream(tt.contentType, splitEvery(body, chunk)...))
+					if got := w.Body.String(); got != tt.want {
+						t.Errorf("stream %v, chunks of %d: got %q, want %q", stream, chunk, got, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestMultipartPartsCaddyfile(t *testing.T) {
+	h, err := parse("replace {\n\tmultipart_parts 0 2\n\tfoo bar\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.MultipartParts) != 2 || h.MultipartParts[0] != 0 || h.MultipartParts[1] != 2 {
+		t.Errorf("parts %v", h.MultipartParts)
+	}
+	for _, input := range []string{"multipart_parts", "multipart_parts -1", "multipart_parts x", "multipart_parts 0\n\tmultipart_parts 1"} {
+		if _, err := parse("replace {\n\t" + input + "\n}"); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
@@ -0,0 +1,126 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
+)
+
+// nestKey is the context key of the nest of a handler that buffers
+// the response.
+type nestKey struct{}
+
+// nest lets handlers nested directly inside a handler that buffers
+// the response perform their replacements on its buffer, instead of
+// each buffering the whole body again. Nested handlers join the nest
+// as the request passes through them, and the buffering handler
+// performs their replacements, innermost first, before its own.
+type nest struct {
+	// the writer the buffering handler passes to the next handler;
+	// only handlers that get this very writer can join, so that
+	// the response isn't changed in between, such as by encode
+	w http.ResponseWriter
+
+	stages []*nestedStage
+}
+
+// nestedStage is a handler that joined a nest.
+type nestedStage struct {
+	h *Handler
+	r *http.Request
+
+	// whether the handler replaces the response, decided when its
+	// headers are written
+	replace bool
+}
+
+// enclosingNest returns the nest that h can join for the request r,
+// written to w, or nil if it must buffer the response itself.
+func (h *Handler) enclosingNest(w http.ResponseWriter, r *http.Request) *nest {
+	n, _ := r.Context().Value(nestKey{}).(*nest)
+	if n == nil || n.w != w {
+		return nil
+	}
+	if h.Stream || h.SpillToDisk || len(h.StreamStatusCodes) > 0 || h.LinkHeaders {
+		return nil
+	}
+	return n
+}
+
+// join adds h to the nest, to replace the response to r.
+func (n *nest) join(h *Handler, r *http.Request) {
+	n.stages = append(n.stages, &nestedStage{h: h, r: r})
+	h.logDecision(r, "deferring replacements to the enclosing handler's buffer")
+}
+
+// decide reports whether one of the nested handlers replaces a
+// response with the given status and headers. n may be nil.
+func (n *nest) decide(status int, header http.Header) bool {
+	if n == nil {
+		return false
+	}
+	replace := false
+	for _, s := range n.stages {
+		s.replace = s.h.shouldReplace(s.r, status, header)
+		replace = replace || s.replace
+	}
+	return replace
+}
+
+// replace performs the replacements of the nested handlers on body,
+// innermost first, and returns the result. It reports whether any of
+// them changed the body, in which case Content-Length is updated.
+func (n *nest) replace(status int, header http.Header, body []byte) ([]byte, bool, error) {
+	changed := false
+	for i := len(n.stages) - 1; i >= 0; i-- {
+		s := n.stages[i]
+		if !s.replace {
+			continue
+		}
+		out, ok, err := s.run(status, header, body)
+		if err != nil {
+			return nil, false, err
+		}
+		if !ok {
+			continue
+		}
+		body, changed = out, true
+		// the next handler checks the length against it
+		if header.Get("Content-Length") != "" {
+			header.Set("Content-Length", strconv.Itoa(len(body)))
+		}
+	}
+	return body, changed, nil
+}
+
+// run performs the replacements of the nested handler on body.
+func (s *nestedStage) run(status int, header http.Header, body []byte) ([]byte, bool, error) {
+	repl := s.r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	tr := s.h.checkoutReplacer(repl)
+	tr.Reset()
+	tr.seed(s.h.sampleSeed(repl))
+	tr.repl = repl
+	defer s.h.releaseReplacer(tr)
+
+	s.h.countBody(tr, false)
+	s.h.logDecision(s.r, "replacing response in the enclosing handler's buffer",
+		zap.Int("status", status),
+		zap.Int("size", len(body)))
+	return s.h.replaceBuffered(s.r, status, header, body, tr)
+}
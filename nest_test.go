@@ -0,0 +1,180 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// stack returns a handler that passes requests through the handlers,
+// the first one outermost, to next. It records the writer that each
+// handler and next are given.
+func stack(handlers []*Handler, next caddyhttp.Handler, writers *[]http.ResponseWriter) caddyhttp.Handler {
+	for i := len(handlers) - 1; i >= 0; i-- {
+		h, inner := handlers[i], next
+		next = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+			*writers = append(*writers, w)
+			return h.ServeHTTP(w, r, inner)
+		})
+	}
+	return next
+}
+
+func TestNestedHandlers(t *testing.T) {
+	rule := func(search, replace string) []*Replacement {
+		return []*Replacement{{Search: search, Replaces: []string{replace}}}
+	}
+	for _, tt := range []struct {
+		name     string
+		handlers []*Handler
+		body     string
+		want     string
+		// whether the handlers after the first share its buffer
+		shared bool
+	}{
+		{
+			name:     "two handlers",
+			handlers: []*Handler{{Replacements: rule("bar", "baz")}, {Replacements: rule("foo", "bar")}},
+			body:     "foo bar",
+			want:     "baz baz",
+			shared:   true,
+		},
+		{
+			name:     "three handlers, innermost first",
+			handlers: []*Handler{{Replacements: rule("c", "d")}, {Replacements: rule("b", "c")}, {Replacements: rule("a", "b")}},
+			body:     "a",
+			want:     "d",
+			shared:   true,
+		},
+		{
+			name:     "only the nested handler replaces",
+			handlers: []*Handler{{ExcludeContentTypes: []string{"text/*"}, Replacements: rule("foo", "x")}, {Replacements: rule("foo", "bar")}},
+			body:     "foo",
+			want:     "bar",
+			shared:   true,
+		},
+		{
+			name:     "only the outer handler replaces",
+			handlers: []*Handler{{Replacements: rule("foo", "bar")}, {ExcludeContentTypes: []string{"text/*"}, Replacements: rule("foo", "x")}},
+			body:     "foo",
+			want:     "bar",
+			shared:   true,
+		},
+		{
+			name:     "nested handler streams",
+			handlers: []*Handler{{Replacements: rule("bar", "baz")}, {Stream: true, Replacements: rule("foo", "bar")}},
+			body:     "foo bar",
+			want:     "baz baz",
+		},
+		{
+			name:     "outer handler streams",
+			handlers: []*Handler{{Stream: true, Replacements: rule("bar", "baz")}, {Replacements: rule("foo", "bar")}},
+			body:     "foo bar",
+			want:     "baz baz",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, h := range tt.handlers {
+				provision(t, h)
+			}
+			var writers []http.ResponseWriter
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				writers = append(writers, w)
+				return upstream("text/plain", tt.body).ServeHTTP(w, r)
+			})
+			w := httptest.NewRecorder()
+			if err := stack(tt.handlers, next, &writers).ServeHTTP(w, newRequest("GET", "/", nil)); err != nil {
+				t.Fatal(err)
+			}
+			if w.Body.String() != tt.want {
+				t.Errorf("body %q, want %q", w.Body.String(), tt.want)
+			}
+			// the writers of the handlers and of the upstream
+			shared := true
+			for _, hw := range writers[2:] {
+				shared = shared && hw == writers[1]
+			}
+			if shared != tt.shared {
+				t.Errorf("buffer shared %v, want %v", shared, tt.shared)
+			}
+		})
+	}
+}
+
+func TestNestedHandlersWrapped(t *testing.T) {
+	// a handler in between that wraps the writer may change the
+	// response, so the nested handler buffers it again
+	outer := provision(t, &Handler{Replacements: []*Replacement{{Search: "bar", Replaces: []string{"baz"}}}})
+	inner := provision(t, &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+	var got http.ResponseWriter
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		got = w
+		return upstream("text/plain", "foo").ServeHTTP(w, r)
+	})
+	wrapped := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		ww := &caddyhttp.ResponseWriterWrapper{ResponseWriter: w}
+		if err := inner.ServeHTTP(ww, r, next); err != nil {
+			return err
+		}
+		if got == ww {
+			t.Error("nested handler joined through a wrapped writer")
+		}
+		return nil
+	})
+	if body := serve(t, outer, newRequest("GET", "/", nil), wrapped).Body.String(); body != "baz" {
+		t.Errorf("body %q, want %q", body, "baz")
+	}
+}
+
+func TestNestedHandlersContentLength(t *testing.T) {
+	var writers []http.ResponseWriter
+	handlers := []*Handler{
+		provision(t, &Handler{Replacements: []*Replacement{{Search: "bar", Replaces: []string{"bazz"}}}}),
+		provision(t, &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}}),
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Length", "3")
+		_, err := w.Write([]byte("foo"))
+		return err
+	})
+	w := httptest.NewRecorder()
+	if err := stack(handlers, next, &writers).ServeHTTP(w, newRequest("GET", "/", nil)); err != nil {
+		t.Fatal(err)
+	}
+	if w.Body.String() != "bazz" {
+		t.Errorf("body %q, want %q", w.Body.String(), "bazz")
+	}
+	if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len("bazz")) {
+		t.Errorf("Content-Length %q, want %q", got, "4")
+	}
+}
+
+func TestNestedHandlersRequired(t *testing.T) {
+	var writers []http.ResponseWriter
+	handlers := []*Handler{
+		provision(t, &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}}),
+		provision(t, &Handler{Replacements: []*Replacement{{Search: "missing", Replaces: []string{"x"}, Required: true}}}),
+	}
+	err := stack(handlers, upstream("text/plain", "foo"), &writers).ServeHTTP(httptest.NewRecorder(), newRequest("GET", "/", nil))
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusInternalServerError {
+		t.Errorf("error %v, want a 500 handler error", err)
+	}
+}
@@ -0,0 +1,45 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import "time"
+
+// countBody numbers the body about to be replaced by rt, counting
+// responses and request bodies separately, for rules with every_nth,
+// notes when it started, for rules with activate_after, and takes the
+// current feature flags, for rules with flag_key.
+func (h *Handler) countBody(rt *replacer, request bool) {
+	if request {
+		rt.nth = h.requestCount.Add(1)
+	} else {
+		rt.nth = h.responseCount.Add(1)
+	}
+	rt.elapsed = time.Since(h.provisioned)
+	rt.flags = h.flags.current()
+}
+
+// inNth reports whether repl applies to the body being replaced by rt,
+// given its every_nth.
+func (rt *replacer) inNth(repl *Replacement) bool {
+	return repl.EveryNth <= 1 || rt.nth%uint64(repl.EveryNth) == 0
+}
+
+// active reports whether repl applies to the body being replaced by
+// rt, given its activate_after. The whole body is decided at once, so
+// a response that is replaced while the rule activates is not
+// replaced halfway.
+func (rt *replacer) active(repl *Replacement) bool {
+	return rt.elapsed >= time.Duration(repl.ActivateAfter)
+}
@@ -0,0 +1,203 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestEveryNth(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		nth      int
+		requests int
+		want     int
+	}{
+		{name: "every 100th", nth: 100, requests: 300, want: 3},
+		{name: "every 3rd", nth: 3, requests: 10, want: 3},
+		{name: "more than the requests", nth: 100, requests: 99, want: 0},
+		{name: "every response", nth: 1, requests: 10, want: 10},
+		{name: "unset", nth: 0, requests: 10, want: 10},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, stream := range []bool{false, true} {
+				h := provision(t, &Handler{Stream: stream, Replacements: []*Replacement{
+					{Search: "<!-- banner -->", Replaces: []string{"<div>try it</div>"}, EveryNth: tt.nth},
+					{Search: "foo", Replaces: []string{"bar"}},
+				}})
+				var got []int
+				for i := 1; i <= tt.requests; i++ {
+					body := replaced(t, h, "<!-- banner -->foo")
+					if !strings.HasSuffix(body, "bar") {
+						t.Fatalf("stream %v: response %d: other rule not applied: %q", stream, i, body)
+					}
+					if strings.HasPrefix(body, "<div>") {
+						got = append(got, i)
+					}
+				}
+				if len(got) != tt.want {
+					t.Errorf("stream %v: replaced in responses %v, want %d of them", stream, got, tt.want)
+				}
+				for _, i := range got {
+					if tt.nth > 1 && i%tt.nth != 0 {
+						t.Errorf("stream %v: replaced in response %d", stream, i)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestEveryNthWholeResponse(t *testing.T) {
+	// all matches of a counted response are replaced, and none of
+	// the others
+	h := provision(t, &Handler{Stream: true, Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}, EveryNth: 2}}})
+	for i, want := range []string{"a a a", "b b b", "a a a", "b b b"} {
+		if got := replaced(t, h, "a ", "a", " a"); got != want {
+			t.Errorf("response %d: got %q, want %q", i+1, got, want)
+		}
+	}
+}
+
+func TestEveryNthReload(t *testing.T) {
+	rule := &Replacement{Search: "a", Replaces: []string{"b"}, EveryNth: 2}
+	h := provision(t, &Handler{Replacements: []*Replacement{rule}})
+	if got := replaced(t, h, "a"); got != "a" {
+		t.Errorf("first response: got %q", got)
+	}
+	// a reload provisions it again, and the count restarts
+	h = provision(t, &Handler{Replacements: []*Replacement{rule}})
+	if got := replaced(t, h, "a"); got != "a" {
+		t.Errorf("first response after reload: got %q", got)
+	}
+	if got := replaced(t, h, "a"); got != "b" {
+		t.Errorf("second response after reload: got %q", got)
+	}
+}
+
+func TestEveryNthRequestsCountedSeparately(t *testing.T) {
+	h := provision(t, &Handler{Direction: directionBoth, Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}, EveryNth: 2}}})
+	// the request body and the response of the first exchange are
+	// each the first of their kind
+	for i, want := range []string{"a", "b", "a", "b"} {
+		if got := serve(t, h, newRequest("POST", "/", strings.NewReader("a")), echo).Body.String(); got != want {
+			t.Errorf("exchange %d: got %q, want %q", i+1, got, want)
+		}
+	}
+}
+
+func TestEveryNthConcurrent(t *testing.T) {
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}, EveryNth: 10}}})
+	const responses = 1000
+	var mu sync.Mutex
+	seen := make(map[uint64]bool)
+	var wg sync.WaitGroup
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < responses/10; i++ {
+				rt := h.checkoutReplacer(caddy.NewReplacer())
+				h.countBody(rt, false)
+				mu.Lock()
+				seen[rt.nth] = true
+				mu.Unlock()
+				h.releaseReplacer(rt)
+			}
+		}()
+	}
+	wg.Wait()
+	// every response got its own number
+	for n := uint64(1); n <= responses; n++ {
+		if !seen[n] {
+			t.Fatalf("no response numbered %d", n)
+		}
+	}
+}
+
+func TestEveryNthInvalid(t *testing.T) {
+	if err := provisionErr(&Handler{Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}, EveryNth: -1}}}); err == nil {
+		t.Error("negative every_nth: no error")
+	}
+}
+
+func TestActivateAfter(t *testing.T) {
+	const delay = 50 * time.Millisecond
+	for _, stream := range []bool{false, true} {
+		h := provision(t, &Handler{Stream: stream, Replacements: []*Replacement{
+			{Search: "<!-- banner -->", Replaces: []string{"<div>new</div>"}, ActivateAfter: caddy.Duration(delay)},
+			{Search: "foo", Replaces: []string{"bar"}},
+		}})
+		if got := replaced(t, h, "<!-- banner -->foo"); got != "<!-- banner -->bar" {
+			t.Errorf("stream %v: before the delay: got %q", stream, got)
+		}
+		time.Sleep(delay)
+		if got := replaced(t, h, "<!-- banner -->foo"); got != "<div>new</div>bar" {
+			t.Errorf("stream %v: after the delay: got %q", stream, got)
+		}
+
+		// the delay restarts with the config
+		provision(t, h)
+		if got := replaced(t, h, "<!-- banner -->foo"); got != "<!-- banner -->bar" {
+			t.Errorf("stream %v: after provisioning again: got %q", stream, got)
+		}
+	}
+}
+
+func TestActivateAfterWholeResponse(t *testing.T) {
+	// a response that started before the rule was active is not
+	// replaced halfway through
+	const delay = 20 * time.Millisecond
+	h := provision(t, &Handler{Stream: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}, ActivateAfter: caddy.Duration(delay)}}})
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/plain")
+		if _, err := io.WriteString(w, "foo "); err != nil {
+			return err
+		}
+		w.(http.Flusher).Flush()
+		time.Sleep(2 * delay)
+		_, err := io.WriteString(w, "foo")
+		return err
+	})
+	if got := serve(t, h, newRequest("GET", "/", nil), next).Body.String(); got != "foo foo" {
+		t.Errorf("got %q, want %q", got, "foo foo")
+	}
+}
+
+func TestActivateAfterRequired(t *testing.T) {
+	// a rule that isn't active yet is not missed
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}, Required: true, ActivateAfter: caddy.Duration(time.Hour)}}})
+	if got := replaced(t, h, "no match"); got != "no match" {
+		t.Errorf("got %q, want %q", got, "no match")
+	}
+	h.provisioned = time.Now().Add(-time.Hour)
+	if err := h.ServeHTTP(newFlushRecorder(), newRequest("GET", "/", nil), upstream("text/plain", "no match")); err == nil {
+		t.Error("active required rule without match: no error")
+	}
+}
+
+func TestActivateAfterInvalid(t *testing.T) {
+	if err := provisionErr(&Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}, ActivateAfter: caddy.Duration(-time.Second)}}}); err == nil {
+		t.Error("negative activate_after: no error")
+	}
+}
@@ -0,0 +1,60 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import "strings"
+
+// fire reports whether the i-th rule may replace a match in the
+// response being replaced by rt. A rule with every_nth only fires in
+// every Nth response, a rule with a flag_key only while its flag is
+// on, and a rule with once set fires only in the first response in
+// which it matches, for as long as the config is loaded.
+func (h *Handler) fire(rt *replacer, i int) bool {
+	if !rt.inNth(h.rules[i]) || !rt.active(h.rules[i]) || !rt.flagged(h.rules[i]) {
+		return false
+	}
+	if !h.rules[i].Once || rt.once[i] {
+		return true
+	}
+	if h.fired[i].CompareAndSwap(false, true) {
+		rt.once[i] = true
+		return true
+	}
+	return false
+}
+
+// firstValue reports whether match is the first match with its value
+// that the i-th rule, repl, replaces in the response being replaced by
+// rt, and records it. It always reports true unless repl has
+// once_per_value.
+func (rt *replacer) firstValue(i int, repl *Replacement, match []byte) bool {
+	if !repl.OncePerValue {
+		return true
+	}
+	value := string(match)
+	if set, _, _ := strings.Cut(leadingFlags(repl.SearchRegexp), "-"); repl.PreserveCase || strings.Contains(set, "i") {
+		value = strings.ToLower(value)
+	}
+	seen := rt.seen[i]
+	if seen == nil {
+		seen = make(map[string]bool)
+		rt.seen[i] = seen
+	}
+	if seen[value] {
+		return false
+	}
+	seen[value] = true
+	return true
+}
@@ -0,0 +1,158 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+func TestOnce(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		h := provision(t, &Handler{Stream: stream, Replacements: []*Replacement{
+			{Search: "banner", Replaces: []string{"NEW"}, Once: true},
+			{Search: "a", Replaces: []string{"A"}},
+		}})
+		for i, tt := range []struct{ body, want string }{
+			{"no match", "no mAtch"},
+			{"banner banner", "NEW NEW"},
+			{"banner", "bAnner"},
+			{"banner", "bAnner"},
+		} {
+			if got := replaced(t, h, tt.body); got != tt.want {
+				t.Errorf("stream %v, response %d: got %q, want %q", stream, i, got, tt.want)
+			}
+		}
+
+		// until the config is reloaded
+		provision(t, h)
+		if got := replaced(t, h, "banner"); got != "NEW" {
+			t.Errorf("stream %v, after reload: got %q, want %q", stream, got, "NEW")
+		}
+	}
+}
+
+func TestOnceConcurrent(t *testing.T) {
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "banner", Replaces: []string{"NEW"}, Once: true}}})
+	var fired atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rt := newReplacer(len(h.rules))
+			// a response asks again for each of its matches,
+			// and the one that fired keeps firing
+			n := 0
+			for j := 0; j < 3; j++ {
+				if h.fire(rt, 0) {
+					n++
+				}
+			}
+			switch n {
+			case 3:
+				fired.Add(1)
+			case 0:
+			default:
+				t.Errorf("fired for %d of 3 matches", n)
+			}
+		}()
+	}
+	wg.Wait()
+	if got := fired.Load(); got != 1 {
+		t.Errorf("fired in %d responses, want 1", got)
+	}
+}
+
+func TestOncePerValue(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		repl Replacement
+		body string
+		want string
+	}{
+		{
+			name: "substring",
+			repl: Replacement{Search: "Caddy", Replaces: []string{"<a>Caddy</a>"}, OncePerValue: true},
+			body: "Caddy is a server. Caddy is written in Go.",
+			want: "<a>Caddy</a> is a server. Caddy is written in Go.",
+		},
+		{
+			name: "distinct values of a regexp",
+			repl: Replacement{SearchRegexp: `Caddy|Go`, Replaces: []string{"[$0]"}, OncePerValue: true},
+			body: "Caddy Go Caddy Go",
+			want: "[Caddy] [Go] Caddy Go",
+		},
+		{
+			name: "case sensitive",
+			repl: Replacement{SearchRegexp: `(?:C|c)addy`, Replaces: []string{"[$0]"}, OncePerValue: true},
+			body: "Caddy caddy Caddy caddy",
+			want: "[Caddy] [caddy] Caddy caddy",
+		},
+		{
+			name: "regexp ignoring case",
+			repl: Replacement{SearchRegexp: `(?i)caddy`, Replaces: []string{"[$0]"}, OncePerValue: true},
+			body: "Caddy caddy CADDY",
+			want: "[Caddy] caddy CADDY",
+		},
+		{
+			name: "preserve_case",
+			repl: Replacement{Search: "caddy", Replaces: []string{"server"}, PreserveCase: true, OncePerValue: true},
+			body: "Caddy caddy",
+			want: "Server caddy",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []struct {
+				name     string
+				stream   bool
+				conflict string
+				chunk    int
+			}{{"buffer", false, "", len(tt.body)}, {"stream", true, "", len(tt.body)}, {"stream bytewise", true, "", 1}, {"longest match", false, conflictLongestMatchWins, len(tt.body)}} {
+				repl := tt.repl
+				h := provision(t, &Handler{Stream: mode.stream, ConflictResolution: mode.conflict, Replacements: []*Replacement{&repl}})
+				// each response starts over
+				for i := 0; i < 2; i++ {
+					if got := replaced(t, h, splitEvery(tt.body, mode.chunk)...); got != tt.want {
+						t.Errorf("%s, response %d: got %q, want %q", mode.name, i, got, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestOncePerValueRules(t *testing.T) {
+	// each rule keeps track of its own values
+	h := provision(t, &Handler{Replacements: []*Replacement{
+		{Search: "a", Replaces: []string{"1"}, OncePerValue: true},
+		{Search: "1", Replaces: []string{"2"}, OncePerValue: true},
+	}})
+	if got := replaced(t, h, "a a 1"); got != "2 a 1" {
+		t.Errorf("got %q, want %q", got, "2 a 1")
+	}
+}
+
+func TestOncePerValueInvalid(t *testing.T) {
+	for _, repl := range []*Replacement{
+		{Search: "a", Replaces: []string{"b"}, OncePerValue: true, Invert: true},
+		{Search: "a", Replaces: []string{"b"}, OncePerValue: true, JSONPointer: "/a"},
+	} {
+		if err := provisionErr(&Handler{Replacements: []*Replacement{repl}}); err == nil {
+			t.Errorf("%+v: no error", repl)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"unicode/utf8"
+
+	"golang.org/x/text/transform"
+)
+
+// checkOverlap returns an error if overlap is set on repl without a
+// search_regexp, with a region, or with a search_regexp that depends
+// on the text before a match. Overlapping matches are searched for
+// from within earlier matches, where ^, \A, \b and \B can't tell what
+// comes before.
+func (repl *Replacement) checkOverlap() error {
+	if !repl.Overlap {
+		return nil
+	}
+	if repl.SearchRegexp == "" {
+		return fmt.Errorf("overlap requires search_regexp")
+	}
+	if repl.hasRegion() {
+		return fmt.Errorf("overlap can't be combined with from_offset, to_offset, from_line, to_line, anchor_start and anchor_end")
+	}
+	re, err := syntax.Parse(repl.regexpSource(), syntax.Perl)
+	if err != nil {
+		return err
+	}
+	var walk func(*syntax.Regexp) bool
+	walk = func(re *syntax.Regexp) bool {
+		switch re.Op {
+		case syntax.OpBeginLine, syntax.OpBeginText, syntax.OpWordBoundary, syntax.OpNoWordBoundary:
+			return true
+		}
+		for _, sub := range re.Sub {
+			if walk(sub) {
+				return true
+			}
+		}
+		return false
+	}
+	if walk(re) {
+		return fmt.Errorf("overlap can't be used with a search_regexp containing ^, \\A, \\b or \\B")
+	}
+	return nil
+}
+
+// overlapTransformer is like the transformer of replace.RegexpIndexFunc,
+// but it finds overlapping matches: after a match, the next one is
+// searched for from the character after the start of the match rather
+// than from its end. Each match is replaced by the result of replace,
+// and a run of overlapping matches is replaced by their results, one
+// after another, so text covered by any match is dropped and text in
+// between matches is kept. An empty match inserts its replacement
+// without covering anything.
+type overlapTransformer struct {
+	re      *regexp.Regexp
+	replace func(src []byte, index []int) []byte
+
+	// MaxMatchSize is as for replace.RegexpTransformer.
+	MaxMatchSize int
+
+	// number of bytes at the start of the next src that are covered
+	// by a match that was already replaced
+	covered int
+	// replacement that didn't fit into dst yet
+	overflow []byte
+	// whether an empty match at the end of the body was replaced
+	ended bool
+}
+
+func newOverlapTransformer(re *regexp.Regexp, replace func(src []byte, index []int) []byte) *overlapTransformer {
+	return &overlapTransformer{re: re, replace: replace}
+}
+
+func (t *overlapTransformer) Reset() {
+	t.covered = 0
+	t.overflow = nil
+	t.ended = false
+}
+
+func (t *overlapTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	if len(t.overflow) > 0 {
+		n := copy(dst, t.overflow)
+		nDst += n
+		t.overflow = t.overflow[n:]
+		if len(t.overflow) > 0 {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		t.overflow = nil
+	}
+	// covEnd is where the text covered by replaced matches ends
+	covEnd := t.covered
+	defer func() {
+		t.covered = 0
+		if covEnd > nSrc {
+			t.covered = covEnd - nSrc
+		}
+	}()
+
+	// keep copies the text up to end that isn't covered, and
+	// consumes everything up to end
+	keep := func(end int) bool {
+		if covEnd > nSrc {
+			nSrc = covEnd
+			if nSrc > end {
+				nSrc = end
+			}
+		}
+		n := copy(dst[nDst:], src[nSrc:end])
+		nDst += n
+		nSrc += n
+		return nSrc == end
+	}
+
+	for !t.ended {
+		index := t.re.FindSubmatchIndex(src[nSrc:])
+		if index == nil {
+			break
+		}
+		for i := range index {
+			if index[i] >= 0 {
+				index[i] += nSrc
+			}
+		}
+		if !atEOF && !utf8.FullRune(src[index[1]:]) {
+			// it could potentially match more, also if src ends
+			// within a character
+			if !keep(index[0]) {
+				return nDst, nSrc, transform.ErrShortDst
+			}
+			break
+		}
+		if !keep(index[0]) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		rep := t.replace(src, index)
+		if index[1] > covEnd {
+			covEnd = index[1]
+		}
+		if index[0] == len(src) {
+			t.ended = true
+		} else {
+			_, size := utf8.DecodeRune(src[index[0]:])
+			nSrc = index[0] + size
+			if covEnd < nSrc {
+				// the match was empty, so the character after it
+				// is kept; rep may be part of src
+				start := index[0]
+				if covEnd > start {
+					start = covEnd
+				}
+				rep = append(rep[:len(rep):len(rep)], src[start:nSrc]...)
+				covEnd = nSrc
+			}
+		}
+		n := copy(dst[nDst:], rep)
+		nDst += n
+		if n < len(rep) {
+			t.overflow = rep[n:]
+			return nDst, nSrc, transform.ErrShortDst
+		}
+	}
+	if atEOF {
+		if !keep(len(src)) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		return nDst, nSrc, nil
+	}
+	// skip any bytes which exceed the max match size
+	if end := len(src) - t.MaxMatchSize; end > nSrc {
+		if !keep(end) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+	}
+	return nDst, nSrc, transform.ErrShortSrc
+}
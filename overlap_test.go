@@ -0,0 +1,109 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOverlap(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		search      string
+		replace     string
+		body        string
+		want        string
+		wantOverlap string
+	}{
+		{name: "repeated characters", search: "aa", replace: "<$0>", body: "aaa", want: "<aa>a", wantOverlap: "<aa><aa>"},
+		{name: "run of matches", search: "aa", replace: "X", body: "baaaab", want: "bXXb", wantOverlap: "bXXXb"},
+		{name: "text between matches is kept", search: "aba", replace: "[$0]", body: "ababa-aba", want: "[aba]ba-[aba]", wantOverlap: "[aba][aba]-[aba]"},
+		{name: "no overlaps", search: "o+", replace: "0", body: "foo boo", want: "f0 b0", wantOverlap: "f00 b00"},
+		{name: "submatches", search: `(\d)(\d)`, replace: "$2$1,", body: "123", want: "21,3", wantOverlap: "21,32,"},
+		{name: "multibyte characters", search: "éé", replace: "E", body: "ééé!", want: "Eé!", wantOverlap: "EE!"},
+		{name: "no match", search: "zz", replace: "-", body: "abc", want: "abc", wantOverlap: "abc"},
+		{name: "long body", search: "aa", replace: "b", body: strings.Repeat("a", 10000), want: strings.Repeat("b", 5000), wantOverlap: strings.Repeat("b", 9999)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, overlap := range []bool{false, true} {
+				want := tt.want
+				if overlap {
+					want = tt.wantOverlap
+				}
+				for _, mode := range []struct {
+					name   string
+					stream bool
+					chunk  int
+				}{{"buffer", false, len(tt.body)}, {"stream", true, len(tt.body)}, {"stream bytewise", true, 1}} {
+					h := provision(t, &Handler{Stream: mode.stream, Replacements: []*Replacement{{SearchRegexp: tt.search, Replaces: []string{tt.replace}, Overlap: overlap}}})
+					if got := replaced(t, h, splitEvery(tt.body, mode.chunk)...); got != want {
+						t.Errorf("%s, overlap %v: got %.60q, want %.60q", mode.name, overlap, got, want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestOverlapEmptyMatches(t *testing.T) {
+	for _, mode := range []struct {
+		name   string
+		stream bool
+		chunk  int
+	}{{"buffer", false, 3}, {"stream", true, 3}, {"stream bytewise", true, 1}} {
+		h := provision(t, &Handler{Stream: mode.stream, Replacements: []*Replacement{{SearchRegexp: "x*", Replaces: []string{"-"}, Overlap: true}}})
+		if got := replaced(t, h, splitEvery("abx", mode.chunk)...); got != "-a-b--" {
+			t.Errorf("%s: got %q, want %q", mode.name, got, "-a-b--")
+		}
+	}
+}
+
+func TestOverlapInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		h    *Handler
+	}{
+		{"substring search", &Handler{Replacements: []*Replacement{{Search: "aa", Replaces: []string{"b"}, Overlap: true}}}},
+		{"line start", &Handler{Replacements: []*Replacement{{SearchRegexp: "^aa", Replaces: []string{"b"}, Overlap: true}}}},
+		{"text start", &Handler{Replacements: []*Replacement{{SearchRegexp: `\Aaa`, Replaces: []string{"b"}, Overlap: true}}}},
+		{"word boundary", &Handler{Replacements: []*Replacement{{SearchRegexp: `a\b`, Replaces: []string{"b"}, Overlap: true}}}},
+		{"no word boundary", &Handler{Replacements: []*Replacement{{SearchRegexp: `(a|\B)a`, Replaces: []string{"b"}, Overlap: true}}}},
+		{"region", &Handler{Replacements: []*Replacement{{SearchRegexp: "aa", Replaces: []string{"b"}, Overlap: true, FromOffset: 1}}}},
+		{"longest match", &Handler{ConflictResolution: conflictLongestMatchWins, Replacements: []*Replacement{{SearchRegexp: "aa", Replaces: []string{"b"}, Overlap: true}}}},
+		{"invert", &Handler{Replacements: []*Replacement{{SearchRegexp: "aa", Replaces: []string{"b"}, Overlap: true, Invert: true}}}},
+	} {
+		if err := provisionErr(tt.h); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+	// $ only depends on the text after a match
+	if err := provisionErr(&Handler{Replacements: []*Replacement{{SearchRegexp: "aa$", Replaces: []string{"b"}, Overlap: true}}}); err != nil {
+		t.Errorf("end of text: %v", err)
+	}
+}
+
+func TestCaddyfileOverlap(t *testing.T) {
+	h, err := parse("replace {\n\tre aa b {\n\t\toverlap\n\t}\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Replacements) != 1 || !h.Replacements[0].Overlap {
+		t.Errorf("overlap not set: %+v", h.Replacements)
+	}
+	if _, err := parse("replace {\n\tre aa b {\n\t\toverlap yes\n\t}\n}"); err == nil {
+		t.Error("overlap yes: no error")
+	}
+}
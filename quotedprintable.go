@@ -0,0 +1,95 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime/quotedprintable"
+	"net/http"
+	"strings"
+)
+
+// decodesQuotedPrintable reports whether a buffered response with
+// the given headers is decoded from quoted-printable: with
+// DecodeQuotedPrintable, if its Content-Transfer-Encoding says so or
+// if it has none.
+func (h *Handler) decodesQuotedPrintable(header http.Header) bool {
+	if !h.DecodeQuotedPrintable {
+		return false
+	}
+	encoding := strings.TrimSpace(header.Get("Content-Transfer-Encoding"))
+	return encoding == "" || strings.EqualFold(encoding, "quoted-printable")
+}
+
+// decodeQuotedPrintable returns body decoded from quoted-printable.
+// The decoder of mime/quotedprintable passes some invalid sequences
+// through as they are, so these are rejected first; encoding the
+// result again would change them.
+func decodeQuotedPrintable(body []byte) ([]byte, error) {
+	if err := checkQuotedPrintable(body); err != nil {
+		return nil, err
+	}
+	return io.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+}
+
+// checkQuotedPrintable returns an error if body contains a byte that
+// is not 7-bit text, or an = that is not followed by two hex digits
+// or, after optional whitespace, by a line break or the end of body.
+func checkQuotedPrintable(body []byte) error {
+	for i := 0; i < len(body); i++ {
+		b := body[i]
+		if b > '~' || (b < ' ' && b != '\t' && b != '\r' && b != '\n') {
+			return fmt.Errorf("invalid byte %#02x at offset %d", b, i)
+		}
+		if b != '=' {
+			continue
+		}
+		if i+2 < len(body) && isHexDigit(body[i+1]) && isHexDigit(body[i+2]) {
+			i += 2
+			continue
+		}
+		rest := bytes.TrimLeft(body[i+1:], " \t")
+		if len(rest) > 0 && !bytes.HasPrefix(rest, []byte("\r\n")) && rest[0] != '\n' {
+			return fmt.Errorf("invalid escape at offset %d", i)
+		}
+	}
+	return nil
+}
+
+func isHexDigit(b byte) bool {
+	return (b >= '0' && b <= '9') || (b >= 'A' && b <= 'F') || (b >= 'a' && b <= 'f')
+}
+
+// encodeQuotedPrintable returns body encoded as quoted-printable. The
+// encoder ends lines with CRLF, so if the original encoding, orig,
+// ended them with LF only, the result does too.
+func encodeQuotedPrintable(body, orig []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	qw := quotedprintable.NewWriter(&buf)
+	if _, err := qw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := qw.Close(); err != nil {
+		return nil, err
+	}
+	// carriage returns that aren't part of a line break are
+	// encoded as =0D, so this only affects line breaks
+	if !bytes.Contains(orig, []byte("\r\n")) {
+		return bytes.ReplaceAll(buf.Bytes(), []byte("\r\n"), []byte("\n")), nil
+	}
+	return buf.Bytes(), nil
+}
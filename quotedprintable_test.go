@@ -0,0 +1,196 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"io"
+	"mime/quotedprintable"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// qpEncode returns s encoded as quoted-printable.
+func qpEncode(t *testing.T, s string) string {
+	t.Helper()
+	var buf bytes.Buffer
+	qw := quotedprintable.NewWriter(&buf)
+	if _, err := io.WriteString(qw, s); err != nil {
+		t.Fatal(err)
+	}
+	if err := qw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.String()
+}
+
+// qpDecode returns s decoded from quoted-printable.
+func qpDecode(t *testing.T, s string) string {
+	t.Helper()
+	b, err := io.ReadAll(quotedprintable.NewReader(strings.NewReader(s)))
+	if err != nil {
+		t.Fatalf("decoding %q: %v", s, err)
+	}
+	return string(b)
+}
+
+// qpUpstream responds with body and the given Content-Transfer-Encoding.
+func qpUpstream(transferEncoding, body string) caddyhttp.Handler {
+	return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/plain")
+		if transferEncoding != "" {
+			w.Header().Set("Content-Transfer-Encoding", transferEncoding)
+		}
+		_, err := io.WriteString(w, body)
+		return err
+	})
+}
+
+func TestDecodeQuotedPrintable(t *testing.T) {
+	long := strings.Repeat("lorem ipsum ", 10)
+	for _, tt := range []struct {
+		name string
+		text string
+		want string
+	}{
+		{name: "escaped search", text: "Grüße aus dem Café", want: "Grüße aus dem Teehaus"},
+		{name: "search across a soft line break", text: long + "Café" + long, want: long + "Teehaus" + long},
+		{name: "several lines", text: "Café\r\nnoch ein Café\r\n", want: "Teehaus\r\nnoch ein Teehaus\r\n"},
+		{name: "equals signs", text: "a=b Café", want: "a=b Teehaus"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{DecodeQuotedPrintable: true, Replacements: []*Replacement{{Search: "Café", Replaces: []string{"Teehaus"}}}})
+			encoded := qpEncode(t, tt.text)
+			if strings.Contains(encoded, "Café") {
+				t.Fatalf("search not encoded in %q", encoded)
+			}
+			for _, transferEncoding := range []string{"", "quoted-printable", "Quoted-Printable"} {
+				got := serve(t, h, newRequest("GET", "/", nil), qpUpstream(transferEncoding, encoded)).Body.String()
+				if err := checkQuotedPrintable([]byte(got)); err != nil {
+					t.Fatalf("%q: result %q: %v", transferEncoding, got, err)
+				}
+				if decoded := qpDecode(t, got); decoded != tt.want {
+					t.Errorf("%q: decoded %q, want %q", transferEncoding, decoded, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeQuotedPrintableLineBreaks(t *testing.T) {
+	h := provision(t, &Handler{DecodeQuotedPrintable: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+	for _, tt := range []struct {
+		body string
+		want string
+	}{
+		{"a foo\nb f=\noo\n", "a bar\nb bar\n"},
+		{"a foo\r\nb f=\r\noo\r\n", "a bar\r\nb bar\r\n"},
+	} {
+		if got := serve(t, h, newRequest("GET", "/", nil), qpUpstream("", tt.body)).Body.String(); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeQuotedPrintableSkipped(t *testing.T) {
+	h := provision(t, &Handler{DecodeQuotedPrintable: true, Replacements: []*Replacement{{Search: "f=6Fo", Replaces: []string{"x"}}, {Search: "foo", Replaces: []string{"bar"}}}})
+	for _, tt := range []struct {
+		name             string
+		transferEncoding string
+		body             string
+		want             string
+	}{
+		{name: "other transfer encoding", transferEncoding: "7bit", body: "f=6Fo foo", want: "x bar"},
+		{name: "8-bit byte", body: "f=6Fo café", want: "f=6Fo café"},
+		{name: "invalid escape", body: "f=6Fo =ZZ foo", want: "f=6Fo =ZZ foo"},
+		{name: "lone equals sign", body: "f=6Fo a = b", want: "f=6Fo a = b"},
+	} {
+		if got := serve(t, h, newRequest("GET", "/", nil), qpUpstream(tt.transferEncoding, tt.body)).Body.String(); got != tt.want {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	h = provision(t, &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+	if got := serve(t, h, newRequest("GET", "/", nil), qpUpstream("", "f=6Fo foo")).Body.String(); got != "f=6Fo bar" {
+		t.Errorf("not enabled: got %q", got)
+	}
+}
+
+func TestDecodeQuotedPrintableDecompressed(t *testing.T) {
+	h := provision(t, &Handler{Decompress: true, DecodeQuotedPrintable: true, Replacements: []*Replacement{{Search: "Café", Replaces: []string{"Teehaus"}}}})
+	w := serve(t, h, newRequest("GET", "/", nil), encodedUpstream(t, qpEncode(t, "im Café"), "gzip"))
+	body := w.Body.Bytes()
+	if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+		var err error
+		if body, err = decodeBody(body, []string{encoding}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := qpDecode(t, string(body)); got != "im Teehaus" {
+		t.Errorf("got %q, want %q", got, "im Teehaus")
+	}
+}
+
+func TestCheckQuotedPrintable(t *testing.T) {
+	for _, tt := range []struct {
+		body  string
+		valid bool
+	}{
+		{"plain", true},
+		{"a=3Db", true},
+		{"a=3db", true},
+		{"soft=\r\nbreak", true},
+		{"soft=\nbreak", true},
+		{"soft= \t\r\nbreak", true},
+		{"ends with=", true},
+		{"tab\there", true},
+		{"a=3", false},
+		{"a=G0", false},
+		{"a = b", false},
+		{"caf\xc3\xa9", false},
+		{"nul\x00", false},
+	} {
+		if err := checkQuotedPrintable([]byte(tt.body)); (err == nil) != tt.valid {
+			t.Errorf("%q: error %v, want valid %v", tt.body, err, tt.valid)
+		}
+	}
+}
+
+func TestDecodeQuotedPrintableInvalid(t *testing.T) {
+	if err := provisionErr(&Handler{DecodeQuotedPrintable: true, Stream: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}}); err == nil {
+		t.Error("stream mode: no error")
+	}
+}
+
+func TestCaddyfileDecodeQuotedPrintable(t *testing.T) {
+	h, err := parse("replace {\n\tdecode_quoted_printable\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.DecodeQuotedPrintable {
+		t.Error("decode_quoted_printable not set")
+	}
+	for _, input := range []string{
+		"replace {\n\tdecode_quoted_printable yes\n}",
+		"replace {\n\tdecode_quoted_printable\n\tdecode_quoted_printable\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
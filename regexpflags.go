@@ -0,0 +1,74 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"fmt"
+	"strings"
+)
+
+// regexpSource returns the search_regexp of repl with the flags of
+// DotAll and Multiline prepended.
+func (repl *Replacement) regexpSource() string {
+	flags := ""
+	if repl.DotAll {
+		flags += "s"
+	}
+	if repl.Multiline {
+		flags += "m"
+	}
+	if flags == "" {
+		return repl.SearchRegexp
+	}
+	return "(?" + flags + ")" + repl.SearchRegexp
+}
+
+// checkRegexpFlags returns an error if dot_all or multiline is set
+// without a search_regexp, or if the search_regexp starts with a flag
+// group that clears the flag it sets, such as (?-s) with dot_all.
+func (repl *Replacement) checkRegexpFlags() error {
+	if !repl.DotAll && !repl.Multiline {
+		return nil
+	}
+	if repl.SearchRegexp == "" {
+		return fmt.Errorf("dot_all and multiline require search_regexp")
+	}
+	_, cleared, _ := strings.Cut(leadingFlags(repl.SearchRegexp), "-")
+	if repl.DotAll && strings.Contains(cleared, "s") {
+		return fmt.Errorf("dot_all conflicts with the flags that search_regexp starts with, which clear s")
+	}
+	if repl.Multiline && strings.Contains(cleared, "m") {
+		return fmt.Errorf("multiline conflicts with the flags that search_regexp starts with, which clear m")
+	}
+	return nil
+}
+
+// leadingFlags returns the flags of the flag group that expr starts
+// with, such as "i-s" for "(?i-s)", or the empty string if it doesn't
+// start with one. Groups with flags, such as "(?s:...)", only apply
+// within the group and are not counted.
+func leadingFlags(expr string) string {
+	rest, ok := strings.CutPrefix(expr, "(?")
+	if !ok {
+		return ""
+	}
+	end := strings.IndexFunc(rest, func(r rune) bool {
+		return !isASCIILetter(byte(r)) && r != '-'
+	})
+	if end < 0 || rest[end] != ')' {
+		return ""
+	}
+	return rest[:end]
+}
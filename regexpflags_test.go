@@ -0,0 +1,143 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import "testing"
+
+func TestRegexpFlags(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		repl Replacement
+		body string
+		want string
+	}{
+		{
+			name: "dot matches no newline by default",
+			repl: Replacement{SearchRegexp: "<!--.*?-->", Replaces: []string{""}},
+			body: "a<!-- x -->b<!--\nx\n-->c",
+			want: "ab<!--\nx\n-->c",
+		},
+		{
+			name: "dot_all",
+			repl: Replacement{SearchRegexp: "<!--.*?-->", Replaces: []string{""}, DotAll: true},
+			body: "a<!-- x -->b<!--\nx\n-->c",
+			want: "abc",
+		},
+		{
+			name: "anchors match the whole text by default",
+			repl: Replacement{SearchRegexp: "^#.*", Replaces: []string{"-"}},
+			body: "# one\n# two\nthree",
+			want: "-\n# two\nthree",
+		},
+		{
+			name: "multiline",
+			repl: Replacement{SearchRegexp: "^#[^\n]*", Replaces: []string{"-"}, Multiline: true},
+			body: "# one\n# two\nthree #",
+			want: "-\n-\nthree #",
+		},
+		{
+			name: "multiline end of line",
+			repl: Replacement{SearchRegexp: " +$", Replaces: []string{""}, Multiline: true},
+			body: "one  \ntwo \nthree",
+			want: "one\ntwo\nthree",
+		},
+		{
+			name: "dot_all and multiline",
+			repl: Replacement{SearchRegexp: "^BEGIN.*?END$", Replaces: []string{"X"}, DotAll: true, Multiline: true},
+			body: "a\nBEGIN\nb\nEND\nc",
+			want: "a\nX\nc",
+		},
+		{
+			name: "other leading flags are kept",
+			repl: Replacement{SearchRegexp: "(?i)<!--.*?-->", Replaces: []string{""}, DotAll: true},
+			body: "a<!--\nX\n-->b",
+			want: "ab",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []struct {
+				name     string
+				stream   bool
+				conflict string
+			}{{"buffer", false, ""}, {"stream", true, ""}, {"longest match", false, conflictLongestMatchWins}} {
+				repl := tt.repl
+				h := provision(t, &Handler{Stream: mode.stream, ConflictResolution: mode.conflict, Replacements: []*Replacement{&repl}})
+				if got := replaced(t, h, tt.body); got != tt.want {
+					t.Errorf("%s: got %q, want %q", mode.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRegexpFlagsInvalid(t *testing.T) {
+	for _, repl := range []*Replacement{
+		{Search: "a", Replaces: []string{"b"}, DotAll: true},
+		{Search: "a", Replaces: []string{"b"}, Multiline: true},
+		{SearchRegexp: "(?-s)a.", Replaces: []string{"b"}, DotAll: true},
+		{SearchRegexp: "(?i-ms)^a", Replaces: []string{"b"}, Multiline: true},
+	} {
+		if err := provisionErr(&Handler{Replacements: []*Replacement{repl}}); err == nil {
+			t.Errorf("%+v: no error", repl)
+		}
+	}
+	// a group with flags only applies within the group
+	if err := provisionErr(&Handler{Replacements: []*Replacement{{SearchRegexp: "(?-s:a.)b", Replaces: []string{"c"}, DotAll: true}}}); err != nil {
+		t.Errorf("flag group: %v", err)
+	}
+}
+
+func TestLeadingFlags(t *testing.T) {
+	for _, tt := range []struct {
+		expr string
+		want string
+	}{
+		{"abc", ""},
+		{"(?i)abc", "i"},
+		{"(?i-s)abc", "i-s"},
+		{"(?-m)abc", "-m"},
+		{"(?s:a.)b", ""},
+		{"(?P<name>a)", ""},
+		{"(?i", ""},
+	} {
+		if got := leadingFlags(tt.expr); got != tt.want {
+			t.Errorf("%q: got %q, want %q", tt.expr, got, tt.want)
+		}
+	}
+}
+
+func TestCaddyfileRegexpFlags(t *testing.T) {
+	h, err := parse("replace {\n\tre a.b c {\n\t\tdot_all\n\t\tmultiline\n\t}\n\tre d e\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(h.Replacements) != 2 {
+		t.Fatalf("got %d replacements, want 2", len(h.Replacements))
+	}
+	if repl := h.Replacements[0]; !repl.DotAll || !repl.Multiline {
+		t.Errorf("first rule: dot_all %v, multiline %v", repl.DotAll, repl.Multiline)
+	}
+	if repl := h.Replacements[1]; repl.DotAll || repl.Multiline {
+		t.Errorf("second rule: dot_all %v, multiline %v", repl.DotAll, repl.Multiline)
+	}
+	for _, input := range []string{
+		"replace {\n\tre a b {\n\t\tdot_all yes\n\t}\n}",
+		"replace {\n\tre a b {\n\t\tignore_case\n\t}\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
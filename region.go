@@ -0,0 +1,109 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"fmt"
+
+	"golang.org/x/text/transform"
+)
+
+// hasRegion reports whether repl is limited to a region of the body.
+func (repl *Replacement) hasRegion() bool {
+	return repl.FromOffset > 0 || repl.ToOffset > 0 || repl.FromLine > 0 || repl.ToLine > 0 ||
+		repl.AnchorStart || repl.AnchorEnd
+}
+
+// checkRegion returns an error if the region of repl is invalid.
+func (repl *Replacement) checkRegion() error {
+	if repl.FromOffset < 0 || repl.ToOffset < 0 || repl.FromLine < 0 || repl.ToLine < 0 {
+		return fmt.Errorf("region offsets and lines must not be negative")
+	}
+	if repl.ToOffset > 0 && repl.ToOffset < repl.FromOffset {
+		return fmt.Errorf("to_offset %d is before from_offset %d", repl.ToOffset, repl.FromOffset)
+	}
+	if repl.ToLine > 0 && repl.ToLine < repl.FromLine {
+		return fmt.Errorf("to_line %d is before from_line %d", repl.ToLine, repl.FromLine)
+	}
+	return nil
+}
+
+// positionTracker wraps a transformer and keeps track of the absolute
+// position in its input, so that matches can be limited to a region.
+type positionTracker struct {
+	transform.Transformer
+
+	// bytes and newlines consumed before the current src
+	offset int64
+	lines  int
+	// whether the current src runs to the end of the body
+	atEOF bool
+	// whether a match at the start or the end of the body was let
+	// through already
+	startDone, endDone bool
+
+	// newlines in the current src before countedTo, which saves
+	// counting from the start of src for every match
+	countedTo    int
+	countedLines int
+}
+
+func (p *positionTracker) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	p.countedTo, p.countedLines = 0, 0
+	p.atEOF = atEOF
+	nDst, nSrc, err = p.Transformer.Transform(dst, src, atEOF)
+	p.offset += int64(nSrc)
+	p.lines += bytes.Count(src[:nSrc], []byte("\n"))
+	return nDst, nSrc, err
+}
+
+func (p *positionTracker) Reset() {
+	p.offset, p.lines = 0, 0
+	p.startDone, p.endDone = false, false
+	p.Transformer.Reset()
+}
+
+// inRegion reports whether the match described by index, in the src
+// currently being transformed, lies within the region of repl and
+// satisfies its anchors.
+func (p *positionTracker) inRegion(repl *Replacement, src []byte, index []int) bool {
+	start, end := p.offset+int64(index[0]), p.offset+int64(index[1])
+	if start < repl.FromOffset || (repl.ToOffset > 0 && end > repl.ToOffset) {
+		return false
+	}
+	if (repl.AnchorStart && start != 0) || (repl.AnchorEnd && !(p.atEOF && index[1] == len(src))) {
+		return false
+	}
+	// the transformer offers a match again if it doesn't consume
+	// it, as with an empty match while it waits for more of the
+	// body, or at the end when it runs out of room in dst
+	if (repl.AnchorStart && p.startDone) || (repl.AnchorEnd && p.endDone) {
+		return false
+	}
+	p.startDone = p.startDone || repl.AnchorStart
+	p.endDone = p.endDone || repl.AnchorEnd
+	if repl.FromLine == 0 && repl.ToLine == 0 {
+		return true
+	}
+
+	if index[0] < p.countedTo {
+		p.countedTo, p.countedLines = 0, 0
+	}
+	p.countedLines += bytes.Count(src[p.countedTo:index[0]], []byte("\n"))
+	p.countedTo = index[0]
+	line := p.lines + p.countedLines + 1
+	return line >= repl.FromLine && (repl.ToLine == 0 || line <= repl.ToLine)
+}
@@ -0,0 +1,183 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRegion(t *testing.T) {
+	const body = "ab\nab\nab"
+	for _, tt := range []struct {
+		name string
+		repl Replacement
+		want string
+	}{
+		{name: "whole body", repl: Replacement{}, want: "xb\nxb\nxb"},
+		{name: "from first byte", repl: Replacement{FromOffset: 0, ToOffset: 1}, want: "xb\nab\nab"},
+		{name: "from offset inclusive", repl: Replacement{FromOffset: 3}, want: "ab\nxb\nxb"},
+		{name: "from offset past a match start", repl: Replacement{FromOffset: 4}, want: "ab\nab\nxb"},
+		{name: "to offset exclusive", repl: Replacement{ToOffset: 3}, want: "xb\nab\nab"},
+		{name: "to offset cuts a match", repl: Replacement{SearchRegexp: "ab", ToOffset: 4}, want: "x\nab\nab"},
+		{name: "to offset at match end", repl: Replacement{SearchRegexp: "ab", ToOffset: 5}, want: "x\nx\nab"},
+		{name: "offset range", repl: Replacement{FromOffset: 3, ToOffset: 4}, want: "ab\nxb\nab"},
+		{name: "to offset at the end", repl: Replacement{ToOffset: int64(len(body))}, want: "xb\nxb\nxb"},
+		{name: "offset past the end", repl: Replacement{FromOffset: 100}, want: body},
+		{name: "first line", repl: Replacement{ToLine: 1}, want: "xb\nab\nab"},
+		{name: "from line", repl: Replacement{FromLine: 2}, want: "ab\nxb\nxb"},
+		{name: "line range", repl: Replacement{FromLine: 2, ToLine: 2}, want: "ab\nxb\nab"},
+		{name: "last line", repl: Replacement{FromLine: 3, ToLine: 3}, want: "ab\nab\nxb"},
+		{name: "line past the end", repl: Replacement{FromLine: 4}, want: body},
+		{name: "lines and offsets", repl: Replacement{FromLine: 2, ToOffset: 5}, want: "ab\nxb\nab"},
+		{name: "anchor start", repl: Replacement{AnchorStart: true}, want: "xb\nab\nab"},
+		{name: "anchor end", repl: Replacement{Search: "b", AnchorEnd: true}, want: "ab\nab\nax"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			repl := tt.repl
+			if repl.SearchRegexp == "" && repl.Search == "" {
+				repl.Search = "a"
+			}
+			repl.Replaces = []string{"x"}
+			for _, mode := range []struct {
+				name   string
+				stream bool
+				chunk  int
+			}{{"buffer", false, len(body)}, {"stream", true, len(body)}, {"stream bytewise", true, 1}} {
+				h := provision(t, &Handler{Stream: mode.stream, Replacements: []*Replacement{&repl}})
+				if got := replaced(t, h, splitEvery(body, mode.chunk)...); got != tt.want {
+					t.Errorf("%s: got %q, want %q", mode.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestRegionInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		repl Replacement
+		err  string
+	}{
+		{repl: Replacement{FromOffset: -1}, err: "must not be negative"},
+		{repl: Replacement{ToLine: -1}, err: "must not be negative"},
+		{repl: Replacement{FromOffset: 5, ToOffset: 4}, err: "to_offset 4 is before from_offset 5"},
+		{repl: Replacement{FromLine: 3, ToLine: 2}, err: "to_line 2 is before from_line 3"},
+	} {
+		repl := tt.repl
+		repl.Search, repl.Replaces = "a", []string{"x"}
+		err := provisionErr(&Handler{Replacements: []*Replacement{&repl}})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%+v: got error %v, want %q", tt.repl, err, tt.err)
+		}
+	}
+}
+
+func TestAnchors(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		rules       []*Replacement
+		body        string
+		want        string
+		notBytewise bool
+	}{
+		{
+			name:  "prepend a missing doctype",
+			rules: []*Replacement{{SearchRegexp: `^(?:<!DOCTYPE html>\n)?`, Replaces: []string{"<!DOCTYPE html>\n"}, AnchorStart: true}},
+			body:  "<p>a</p>\n<p>b</p>",
+			want:  "<!DOCTYPE html>\n<p>a</p>\n<p>b</p>",
+		},
+		{
+			name:  "keep a present doctype",
+			rules: []*Replacement{{SearchRegexp: `^(?:<!DOCTYPE html>\n)?`, Replaces: []string{"<!DOCTYPE html>\n"}, AnchorStart: true}},
+			body:  "<!DOCTYPE html>\n<p>a</p>",
+			want:  "<!DOCTYPE html>\n<p>a</p>",
+			// the optional group matches empty before the rest
+			// of the doctype arrives
+			notBytewise: true,
+		},
+		{
+			name:  "append a footer",
+			rules: []*Replacement{{SearchRegexp: `$`, Replaces: []string{"<footer>"}, AnchorEnd: true}},
+			body:  "<p>a</p>\n<p>b</p>\n",
+			want:  "<p>a</p>\n<p>b</p>\n<footer>",
+		},
+		{
+			name:  "multiline start only at the body start",
+			rules: []*Replacement{{SearchRegexp: `(?m)^`, Replaces: []string{"> "}, AnchorStart: true}},
+			body:  "a\nb\nc",
+			want:  "> a\nb\nc",
+		},
+		{
+			name:  "multiline end only at the body end",
+			rules: []*Replacement{{SearchRegexp: `(?m)$`, Replaces: []string{";"}, AnchorEnd: true}},
+			body:  "a\nb\nc",
+			want:  "a\nb\nc;",
+		},
+		{
+			name:  "match not at the start",
+			rules: []*Replacement{{Search: "b", Replaces: []string{"x"}, AnchorStart: true}},
+			body:  "abab",
+			want:  "abab",
+		},
+		{
+			name:  "match not at the end",
+			rules: []*Replacement{{Search: "a", Replaces: []string{"x"}, AnchorEnd: true}},
+			body:  "abab",
+			want:  "abab",
+		},
+		{
+			name:  "both anchors need the whole body",
+			rules: []*Replacement{{Search: "ab ab", Replaces: []string{"x"}, AnchorStart: true, AnchorEnd: true}},
+			body:  "ab ab",
+			want:  "x",
+		},
+		{
+			name:  "both anchors on part of the body",
+			rules: []*Replacement{{Search: "ab", Replaces: []string{"x"}, AnchorStart: true, AnchorEnd: true}},
+			body:  "ab ab",
+			want:  "ab ab",
+		},
+		{
+			name: "body as seen by the replacement",
+			rules: []*Replacement{
+				{Search: "<!-- x -->", Replaces: []string{""}},
+				{Search: "a", Replaces: []string{"x"}, AnchorStart: true},
+			},
+			body: "<!-- x -->ab",
+			want: "xb",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []struct {
+				name   string
+				stream bool
+				chunk  int
+			}{{"buffer", false, len(tt.body)}, {"stream", true, len(tt.body)}, {"stream bytewise", true, 1}} {
+				if tt.notBytewise && mode.chunk == 1 {
+					continue
+				}
+				var rules []*Replacement
+				for _, rule := range tt.rules {
+					copied := *rule
+					rules = append(rules, &copied)
+				}
+				h := provision(t, &Handler{Stream: mode.stream, Replacements: rules})
+				if got := replaced(t, h, splitEvery(tt.body, mode.chunk)...); got != tt.want {
+					t.Errorf("%s: got %q, want %q", mode.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,119 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/text/transform"
+)
+
+// Directions in which replacements can be performed.
+const (
+	directionResponse = "response"
+	directionRequest  = "request"
+	directionBoth     = "both"
+)
+
+// replacesRequest reports whether request bodies should be replaced.
+func (h *Handler) replacesRequest() bool {
+	return h.Direction == directionRequest || h.Direction == directionBoth
+}
+
+// replacesResponse reports whether response bodies should be replaced.
+func (h *Handler) replacesResponse() bool {
+	return h.Direction == "" || h.Direction == directionResponse || h.Direction == directionBoth
+}
+
+// matchesRequestType reports whether the body of r has one of the
+// RequestContentTypes, or whether there are none.
+func (h *Handler) matchesRequestType(r *http.Request) bool {
+	return len(h.RequestContentTypes) == 0 || matchesContentType(h.RequestContentTypes, r.Header.Get("Content-Type"))
+}
+
+// errRequestBodyTooLarge is returned by replaceRequestBody for a body
+// longer than MaxRequestBody in buffer mode.
+var errRequestBodyTooLarge = errors.New("request body exceeds max_request_body")
+
+// replaceRequestBody performs replacements on the body of r. In
+// streaming mode the body is wrapped so that replacements happen as
+// it is read, and its length becomes unknown; otherwise the body is
+// read into memory first so its length can be set correctly, up to
+// MaxRequestBody bytes.
+func (h *Handler) replaceRequestBody(r *http.Request) error {
+	if r.Body == nil || r.Body == http.NoBody {
+		return nil
+	}
+	if !h.ForceBinary && isBinaryType(r.Header.Get("Content-Type")) {
+		return nil
+	}
+
+	// in streaming mode, the transformer is not returned to the
+	// pool, since the body may still be read after the handler
+	// chain has returned, and it is not counted as in use
+	repl := r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer)
+	tr := h.getReplacer(repl)
+	tr.Reset()
+	tr.seed(h.sampleSeed(repl))
+	tr.repl = repl
+	h.countBody(tr, true)
+	h.takeNonce(tr, nil)
+
+	if h.Stream {
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{transform.NewReader(r.Body, tr), r.Body}
+		r.ContentLength = -1
+		r.Header.Del("Content-Length")
+		return nil
+	}
+
+	defer h.transformerPool.Put(tr)
+	limit := h.MaxRequestBody
+	if limit == 0 {
+		limit = defaultMaxRequestBody
+	}
+	var body []byte
+	var err error
+	if limit > 0 {
+		body, err = io.ReadAll(io.LimitReader(r.Body, limit+1))
+	} else {
+		body, err = io.ReadAll(r.Body)
+	}
+	r.Body.Close()
+	if err != nil {
+		return err
+	}
+	if limit > 0 && int64(len(body)) > limit {
+		return errRequestBodyTooLarge
+	}
+	result, _, err := transform.Bytes(tr, body)
+	if err != nil {
+		return err
+	}
+	result = h.replaceInverted(repl, result)
+	r.Body = io.NopCloser(bytes.NewReader(result))
+	r.ContentLength = int64(len(result))
+	if r.Header.Get("Content-Length") != "" {
+		r.Header.Set("Content-Length", strconv.Itoa(len(result)))
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// echo responds with the body and Content-Length of the request.
+var echo = caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("X-Request-Length", r.Header.Get("Content-Length"))
+	_, err = w.Write(body)
+	return err
+})
+
+func TestRequestBody(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		handler     *Handler
+		contentType string
+		body        string
+		want        string
+		wantLength  string
+		wantStatus  int
+	}{
+		{
+			name:        "buffered",
+			handler:     &Handler{Direction: directionRequest},
+			contentType: "application/json",
+			body:        `{"a":"foo"}`,
+			want:        `{"a":"foobar"}`,
+			wantLength:  "14",
+		},
+		{
+			name:        "streamed",
+			handler:     &Handler{Direction: directionRequest, Stream: true},
+			contentType: "application/json",
+			body:        `{"a":"foo"}`,
+			want:        `{"a":"foobar"}`,
+		},
+		{
+			name:        "content type not matched",
+			handler:     &Handler{Direction: directionRequest, RequestContentTypes: []string{"application/json"}},
+			contentType: "text/plain",
+			body:        "foo",
+			want:        "foo",
+			wantLength:  "3",
+		},
+		{
+			name:        "binary",
+			handler:     &Handler{Direction: directionRequest},
+			contentType: "image/png",
+			body:        "foo",
+			want:        "foo",
+			wantLength:  "3",
+		},
+		{
+			name:        "at max_request_body",
+			handler:     &Handler{Direction: directionRequest, MaxRequestBody: 3},
+			contentType: "text/plain",
+			body:        "foo",
+			want:        "foobar",
+			wantLength:  "6",
+		},
+		{
+			name:        "over max_request_body",
+			handler:     &Handler{Direction: directionRequest, MaxRequestBody: 3},
+			contentType: "text/plain",
+			body:        "foo!",
+			wantStatus:  http.StatusRequestEntityTooLarge,
+		},
+		{
+			name:        "max_request_body off",
+			handler:     &Handler{Direction: directionRequest, MaxRequestBody: -1},
+			contentType: "text/plain",
+			body:        strings.Repeat("x", defaultMaxRequestBody) + "foo",
+			want:        strings.Repeat("x", defaultMaxRequestBody) + "foobar",
+			wantLength:  "10485766",
+		},
+		{
+			name:        "over max_request_body streamed",
+			handler:     &Handler{Direction: directionRequest, MaxRequestBody: 3, Stream: true},
+			contentType: "text/plain",
+			body:        "foo!",
+			want:        "foobar!",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.handler.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"foobar"}}}
+			h := provision(t, tt.handler)
+			r := newRequest("POST", "/", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", tt.contentType)
+			r.Header.Set("Content-Length", strconv.Itoa(len(tt.body)))
+			w := httptest.NewRecorder()
+			err := h.ServeHTTP(w, r, echo)
+			if tt.wantStatus != 0 {
+				var herr caddyhttp.HandlerError
+				if !errors.As(err, &herr) || herr.StatusCode != tt.wantStatus {
+					t.Fatalf("got error %v, want status %d", err, tt.wantStatus)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("body %.40q, want %.40q", got, tt.want)
+			}
+			if got := w.Header().Get("X-Request-Length"); got != tt.wantLength {
+				t.Errorf("Content-Length %q, want %q", got, tt.wantLength)
+			}
+		})
+	}
+}
+
+func TestRequestContentTypes(t *testing.T) {
+	for _, tt := range []struct {
+		patterns    []string
+		contentType string
+		want        string
+	}{
+		{[]string{"application/x-www-form-urlencoded"}, "application/x-www-form-urlencoded", "a=foobar"},
+		{[]string{"application/x-www-form-urlencoded"}, "application/x-www-form-urlencoded; charset=utf-8", "a=foobar"},
+		{[]string{"application/x-www-form-urlencoded"}, "Application/X-WWW-Form-Urlencoded", "a=foobar"},
+		{[]string{"application/x-www-form-urlencoded"}, "multipart/form-data; boundary=x", "a=foo"},
+		{[]string{"application/*"}, "application/json", "a=foobar"},
+		{[]string{"text/plain", "application/json"}, "application/json", "a=foobar"},
+		{[]string{"application/*"}, "text/plain", "a=foo"},
+		{[]string{"application/*"}, "", "a=foo"},
+	} {
+		for _, direction := range []string{directionRequest, directionBoth} {
+			h := provision(t, &Handler{Direction: direction, RequestContentTypes: tt.patterns, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"foobar"}}}})
+			r := newRequest("POST", "/", strings.NewReader("a=foo"))
+			if tt.contentType != "" {
+				r.Header.Set("Content-Type", tt.contentType)
+			}
+			var got []byte
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				var err error
+				got, err = io.ReadAll(r.Body)
+				return err
+			})
+			if err := h.ServeHTTP(httptest.NewRecorder(), r, next); err != nil {
+				t.Fatal(err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("%s %v %q: got %q, want %q", direction, tt.patterns, tt.contentType, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestRequestContentTypesInvalid(t *testing.T) {
+	for _, h := range []*Handler{
+		{RequestContentTypes: []string{"application/json"}},
+		{Direction: directionResponse, RequestContentTypes: []string{"application/json"}},
+		{Direction: directionRequest, RequestContentTypes: []string{"application/[json"}},
+	} {
+		h.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}
+		if err := provisionErr(h); err == nil {
+			t.Errorf("%+v: no error", h)
+		}
+	}
+}
+
+func TestCaddyfileRequestContentTypes(t *testing.T) {
+	h, err := parse("replace {\n\trequest_content_types application/json text/*\n\trequest_content_types application/x-www-form-urlencoded\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"application/json", "text/*", "application/x-www-form-urlencoded"}; !reflect.DeepEqual(h.RequestContentTypes, want) {
+		t.Errorf("request_content_types %q, want %q", h.RequestContentTypes, want)
+	}
+	if _, err := parse("replace {\n\trequest_content_types\n}"); err == nil {
+		t.Error("no patterns: no error")
+	}
+}
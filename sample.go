@@ -0,0 +1,140 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"hash/fnv"
+	"math/rand/v2"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"golang.org/x/text/transform"
+)
+
+// replacer is a pooled transformer that performs the configured
+// replacements, along with the state it needs for a single response.
+// It is not safe for concurrent use.
+type replacer struct {
+	transform.Transformer
+
+	// per-response random source used for sampling matches
+	src *rand.PCG
+	rng *rand.Rand
+
+	// number of matches replaced in the current response, by rule
+	counts []int
+
+	// last value of the {counter} token in the current response
+	counter int64
+
+	// the draw that places the current response in the
+	// distributions of weighted replacements; see pointOf
+	draw uint64
+
+	// whether each rule with once set fired in the current response
+	once []bool
+
+	// the values replaced in the current response, by rule, for
+	// rules with once_per_value
+	seen map[int]map[string]bool
+
+	// number of the current body, counting from 1, for every_nth;
+	// set by countBody and kept by Reset, which the transform
+	// package calls again before transforming
+	nth uint64
+
+	// how long after provisioning the current body started, for
+	// activate_after; set and kept like nth
+	elapsed time.Duration
+
+	// the feature flags for the current body, for flag_key; set and
+	// kept like nth
+	flags map[string]bool
+
+	// how the current response is replaced, "buffer" or "stream",
+	// or empty if it isn't; set when replacing starts and kept by
+	// Reset like nth
+	mode string
+
+	// the value of the {csp_nonce} token for the current body; set
+	// by takeNonce and kept like nth
+	nonce string
+
+	// contents of the replacement files read for the current
+	// response, by rule; nil if reading failed
+	files map[int][]byte
+
+	// replacer of the request whose body or response is replaced
+	repl *caddy.Replacer
+}
+
+func newReplacer(rules int) *replacer {
+	src := rand.NewPCG(rand.Uint64(), rand.Uint64())
+	return &replacer{src: src, rng: rand.New(src), counts: make([]int, rules), once: make([]bool, rules), seen: make(map[int]map[string]bool), files: make(map[int][]byte)}
+}
+
+// Reset prepares the replacer for a new response.
+func (rt *replacer) Reset() {
+	for i := range rt.counts {
+		rt.counts[i] = 0
+		rt.once[i] = false
+	}
+	for i := range rt.seen {
+		delete(rt.seen, i)
+	}
+	for i := range rt.files {
+		delete(rt.files, i)
+	}
+	rt.counter = 0
+	rt.Transformer.Reset()
+}
+
+// seed reseeds the random source for a new response, and chooses the
+// values of weighted replacements.
+func (rt *replacer) seed(seed uint64) {
+	rt.src.Seed(seed, seed2)
+	rt.draw = seed
+}
+
+// pointOf returns where the current response falls in the
+// distribution of the weighted values of repl, between 0 and 1. The
+// draw is salted with the rule, so that rules choose independently
+// of each other, unless CorrelatedRandom left the salt at zero.
+func (rt *replacer) pointOf(repl *Replacement) float64 {
+	return unitInterval(rt.draw ^ repl.salt)
+}
+
+// sampled reports whether the current match of repl should be
+// replaced, according to its sample rate.
+func (rt *replacer) sampled(repl *Replacement) bool {
+	if repl.SampleRate <= 0 || repl.SampleRate >= 1 {
+		return true
+	}
+	return rt.rng.Float64() < repl.SampleRate
+}
+
+// sampleSeed returns the seed for sampling matches and choosing
+// weighted values in the response to the request with the given
+// replacer. If StickyKey is configured, the same key always gives the
+// same seed, so the same matches and values are replaced; otherwise
+// the seed is random.
+func (h *Handler) sampleSeed(repl *caddy.Replacer) uint64 {
+	if h.StickyKey == "" {
+		return rand.Uint64()
+	}
+	hash := fnv.New64a()
+	hash.Write([]byte(repl.ReplaceAll(h.StickyKey, "")))
+	return hash.Sum64()
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestSampleRate(t *testing.T) {
+	const n = 10000
+	body := strings.Repeat("a", n)
+	for _, tt := range []struct {
+		rate     float64
+		min, max int
+	}{
+		{rate: 0, min: n, max: n},
+		{rate: 1, min: n, max: n},
+		{rate: 0.1, min: 800, max: 1200},
+		{rate: 0.5, min: 4700, max: 5300},
+		{rate: 0.9, min: 8800, max: 9200},
+	} {
+		for _, stream := range []bool{false, true} {
+			h := provision(t, &Handler{Stream: stream, Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}, SampleRate: tt.rate}}})
+			got := strings.Count(replaced(t, h, splitEvery(body, 1000)...), "b")
+			if got < tt.min || got > tt.max {
+				t.Errorf("rate %v, stream %v: replaced %d of %d matches, want between %d and %d", tt.rate, stream, got, n, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+func TestSampleRateInvalid(t *testing.T) {
+	for _, rate := range []float64{-0.1, 1.5} {
+		err := provisionErr(&Handler{Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}, SampleRate: rate}}})
+		if err == nil || !strings.Contains(err.Error(), "sample_rate must be between 0 and 1") {
+			t.Errorf("rate %v: got error %v", rate, err)
+		}
+	}
+}
+
+func TestSampleRateStickyKey(t *testing.T) {
+	h := provision(t, &Handler{StickyKey: "{session}", Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}, SampleRate: 0.5}}})
+	body := strings.Repeat("a", 200)
+	response := func(session string) string {
+		r := newRequest("GET", "/", nil)
+		replacerOf(r).Set("session", session)
+		return serve(t, h, r, upstream("text/plain", body)).Body.String()
+	}
+	first := response("one")
+	// responses are replaced one after another, and others in
+	// between don't change the choice
+	response("two")
+	if again := response("one"); again != first {
+		t.Errorf("same key gave %q, then %q", first, again)
+	}
+	if other := response("two"); other == first {
+		t.Errorf("different keys both gave %q", first)
+	}
+}
+
+func TestSampleRateResetsPerResponse(t *testing.T) {
+	// without a sticky key, responses don't repeat the same choice
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}, SampleRate: 0.5}}})
+	body := strings.Repeat("a", 200)
+	if first, second := replaced(t, h, body), replaced(t, h, body); first == second {
+		t.Errorf("two responses both gave %q", first)
+	}
+}
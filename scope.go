@@ -0,0 +1,288 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+
+	"golang.org/x/text/transform"
+)
+
+// Parts of a response body that replacements are performed on.
+const (
+	scopeAll         = "all"
+	scopeComments    = "comments"
+	scopeNonComments = "non-comments"
+)
+
+// commentSyntax describes the comments of a language.
+type commentSyntax struct {
+	// openers of comments that end at a newline
+	line []string
+	// openers of block comments, and the closer of each
+	blocks [][2]string
+	// whether ', " and ` start string literals, which can't contain
+	// comments
+	quotes bool
+}
+
+var (
+	htmlComments = &commentSyntax{blocks: [][2]string{{"<!--", "-->"}}}
+	jsComments   = &commentSyntax{line: []string{"//"}, blocks: [][2]string{{"/*", "*/"}}, quotes: true}
+	cssComments  = &commentSyntax{blocks: [][2]string{{"/*", "*/"}}, quotes: true}
+)
+
+// commentSyntaxes are the comment syntaxes of the recognized media types.
+var commentSyntaxes = map[string]*commentSyntax{
+	"text/html":                htmlComments,
+	"application/xhtml+xml":    htmlComments,
+	"text/javascript":          jsComments,
+	"application/javascript":   jsComments,
+	"application/x-javascript": jsComments,
+	"application/ecmascript":   jsComments,
+	"text/ecmascript":          jsComments,
+	"text/css":                 cssComments,
+}
+
+// commentSyntaxOf returns the comment syntax of a response with the
+// given headers, or nil if it has no recognized comments.
+func commentSyntaxOf(header http.Header) *commentSyntax {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return nil
+	}
+	return commentSyntaxes[mediaType]
+}
+
+// lexState is the position of a scopeTransformer in the syntax of
+// the body.
+type lexState struct {
+	// inside a line comment, or the index of the block comment
+	// plus one
+	line  bool
+	block int
+
+	// the quote of the string literal we are in, and whether the
+	// next byte is escaped
+	quote   byte
+	escaped bool
+
+	// bytes of a comment opener left to skip
+	skip int
+
+	// bytes of the block comment's closer at the very end of the
+	// input consumed so far
+	closing int
+}
+
+func (st lexState) inComment() bool {
+	return st.line || st.block > 0
+}
+
+// scopeTransformer applies a transformer only to the comments of a
+// body, or only to everything else. The comments include their
+// delimiters, but not the newline that ends a line comment. Each
+// section of the body is transformed as if it were a whole body, so
+// matches can't span sections.
+type scopeTransformer struct {
+	tr       transform.Transformer
+	syntax   *commentSyntax
+	comments bool
+
+	st lexState
+	// tr has seen the end of a section, but not written all of its
+	// output yet
+	flushing bool
+}
+
+func newScopeTransformer(tr transform.Transformer, syntax *commentSyntax, comments bool) *scopeTransformer {
+	return &scopeTransformer{tr: tr, syntax: syntax, comments: comments}
+}
+
+func (s *scopeTransformer) Reset() {
+	s.st = lexState{}
+	s.flushing = false
+	s.tr.Reset()
+}
+
+func (s *scopeTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for {
+		if s.flushing {
+			var d int
+			d, _, err = s.tr.Transform(dst[nDst:], nil, true)
+			nDst += d
+			if err != nil {
+				return nDst, nSrc, err
+			}
+			s.flushing = false
+		}
+
+		n, next, boundary, short := s.scan(s.st, src[nSrc:], atEOF)
+		section := src[nSrc : nSrc+n]
+		final := boundary || (atEOF && nSrc+n == len(src))
+		selected := s.st.inComment() == s.comments
+
+		var d, c int
+		if selected {
+			d, c, err = s.tr.Transform(dst[nDst:], section, final)
+		} else {
+			d = copy(dst[nDst:], section)
+			c = d
+			if c < len(section) {
+				err = transform.ErrShortDst
+			}
+		}
+		nDst += d
+		nSrc += c
+
+		if c < len(section) {
+			s.st = s.advance(s.st, section[:c])
+			return nDst, nSrc, err
+		}
+		if boundary {
+			s.st = next
+		} else {
+			s.st = s.advance(s.st, section)
+		}
+		if err != nil {
+			// the whole section was consumed, but not all of its
+			// output written
+			s.flushing = selected && final && err == transform.ErrShortDst
+			return nDst, nSrc, err
+		}
+
+		switch {
+		case short:
+			return nDst, nSrc, transform.ErrShortSrc
+		case !boundary:
+			return nDst, nSrc, nil
+		}
+	}
+}
+
+// scan returns the length n of the section of src starting in state
+// st. If boundary is true, the section ends there, and next is the
+// state at the start of the next one. If short is true, src ends
+// with what might be the start of a delimiter, and more input is
+// needed to tell where the section ends.
+func (s *scopeTransformer) scan(st lexState, src []byte, atEOF bool) (n int, next lexState, boundary, short bool) {
+	// hasDelim reports whether src[i:] starts with delim or, with
+	// short, whether it might once more input has been read
+	hasDelim := func(i int, delim string) (ok, short bool) {
+		rest := src[i:]
+		if len(rest) >= len(delim) {
+			return bytes.HasPrefix(rest, []byte(delim)), false
+		}
+		return false, !atEOF && bytes.HasPrefix([]byte(delim), rest)
+	}
+
+	for i := 0; i < len(src); i++ {
+		c := src[i]
+		switch {
+		case st.skip > 0:
+			st.skip--
+
+		case st.line:
+			if c == '\n' {
+				return i, lexState{}, true, false
+			}
+
+		case st.block > 0:
+			closer := s.syntax.blocks[st.block-1][1]
+			if i == 0 && st.closing > 0 {
+				rest := closer[st.closing:]
+				ok, short := hasDelim(i, rest)
+				if short {
+					return i, st, false, true
+				}
+				if ok {
+					return len(rest), lexState{}, true, false
+				}
+			}
+			st.closing = 0
+			ok, short := hasDelim(i, closer)
+			if short {
+				return i, st, false, true
+			}
+			if ok {
+				return i + len(closer), lexState{}, true, false
+			}
+
+		case st.quote != 0:
+			switch {
+			case st.escaped:
+				st.escaped = false
+			case c == '\\':
+				st.escaped = true
+			case c == st.quote:
+				st.quote = 0
+			case c == '\n' && st.quote != '`':
+				// unterminated string literal
+				st.quote = 0
+			}
+
+		default:
+			for _, opener := range s.syntax.line {
+				ok, short := hasDelim(i, opener)
+				if short {
+					return i, st, false, true
+				}
+				if ok {
+					return i, lexState{line: true, skip: len(opener)}, true, false
+				}
+			}
+			for b, block := range s.syntax.blocks {
+				ok, short := hasDelim(i, block[0])
+				if short {
+					return i, st, false, true
+				}
+				if ok {
+					return i, lexState{block: b + 1, skip: len(block[0])}, true, false
+				}
+			}
+			if s.syntax.quotes && (c == '\'' || c == '"' || c == '`') {
+				st.quote = c
+			}
+		}
+	}
+	return len(src), st, false, false
+}
+
+// advance returns the state after consuming b, which lies within a
+// single section starting in state st.
+func (s *scopeTransformer) advance(st lexState, b []byte) lexState {
+	// the end of the comment's body so far, which can't include
+	// the opener
+	var tail []byte
+	if st.block > 0 && st.skip < len(b) {
+		closer := s.syntax.blocks[st.block-1][1]
+		tail = append([]byte(closer[:st.closing]), b[st.skip:]...)
+	}
+
+	_, st, _, _ = s.scan(st, b, true)
+	if st.block > 0 {
+		// b may end with the start of the closer
+		closer := s.syntax.blocks[st.block-1][1]
+		for k := len(closer) - 1; k > 0; k-- {
+			if bytes.HasSuffix(tail, []byte(closer[:k])) {
+				st.closing = k
+				break
+			}
+		}
+	}
+	return st
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import "testing"
+
+func TestScope(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		scope       string
+		contentType string
+		search      string
+		body        string
+		want        string
+	}{
+		{name: "html comments", scope: scopeComments, contentType: "text/html", body: "x<!-- x -->x", want: "x<!-- Y -->x"},
+		{name: "html non-comments", scope: scopeNonComments, contentType: "text/html", body: "x<!-- x -->x", want: "Y<!-- x -->Y"},
+		{name: "html all", scope: scopeAll, contentType: "text/html", body: "x<!-- x -->x", want: "Y<!-- Y -->Y"},
+		{name: "html comment delimiters", scope: scopeComments, contentType: "text/html", body: "<!-- x --> -->", want: "<!-- Y --> -->"},
+		{name: "unclosed html comment", scope: scopeComments, contentType: "text/html", body: "x<!-- x", want: "x<!-- Y"},
+		{name: "js line comments", scope: scopeComments, contentType: "text/javascript", body: "x // x\nx", want: "x // Y\nx"},
+		{name: "js block comments", scope: scopeComments, contentType: "application/javascript", body: "x /* x\nx */ x", want: "x /* Y\nY */ x"},
+		{name: "js non-comments", scope: scopeNonComments, contentType: "text/javascript", body: "x // x\nx /* x */", want: "Y // x\nY /* x */"},
+		{name: "js strings", scope: scopeComments, contentType: "text/javascript", body: `"// x" '/* x */' ` + "`//x` // x", want: `"// x" '/* x */' ` + "`//x` // Y"},
+		{name: "js escaped quote", scope: scopeComments, contentType: "text/javascript", body: `"\" // x" // x`, want: `"\" // x" // Y`},
+		{name: "css comments", scope: scopeComments, contentType: "text/css", body: "a { x: 1 } /* x */ // x", want: "a { x: 1 } /* Y */ // x"},
+		{name: "no comments in plain text", scope: scopeComments, contentType: "text/plain", body: "x /* x */", want: "x /* x */"},
+		{name: "plain text is all non-comments", scope: scopeNonComments, contentType: "text/plain", body: "x /* x */", want: "Y /* Y */"},
+		{name: "matches don't span sections", scope: scopeNonComments, contentType: "text/html", search: "x.*x", body: "x<!---->x", want: "x<!---->x"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			search := tt.search
+			if search == "" {
+				search = "x"
+			}
+			rules := []*Replacement{{SearchRegexp: search, Replaces: []string{"Y"}}}
+			for _, mode := range []struct {
+				name   string
+				stream bool
+				chunk  int
+			}{{"buffer", false, len(tt.body)}, {"stream", true, len(tt.body)}, {"stream bytewise", true, 1}} {
+				h := provision(t, &Handler{Stream: mode.stream, Scope: tt.scope, Replacements: rules})
+				w := serve(t, h, newRequest("GET", "/", nil), upstream(tt.contentType, splitEvery(tt.body, mode.chunk)...))
+				if got := w.Body.String(); got != tt.want {
+					t.Errorf("%s: got %q, want %q", mode.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// checkSelectByHeader returns an error if the header selection
+// settings of repl are invalid.
+func (repl *Replacement) checkSelectByHeader() error {
+	if repl.SelectByHeader == "" {
+		if len(repl.HeaderMap) > 0 || repl.HeaderDefault != 0 {
+			return fmt.Errorf("header_map and header_default require select_by_header")
+		}
+		return nil
+	}
+	if len(repl.Weights) > 0 {
+		return fmt.Errorf("cannot specify both select_by_header and weights in same replacement")
+	}
+	if len(repl.Replaces) == 0 {
+		return fmt.Errorf("select_by_header requires replace values")
+	}
+	for value, i := range repl.HeaderMap {
+		if i < 0 || i >= len(repl.Replaces) {
+			return fmt.Errorf("header_map: index %d for %q is out of range, there are %d replace values", i, value, len(repl.Replaces))
+		}
+	}
+	if repl.HeaderDefault < 0 || repl.HeaderDefault >= len(repl.Replaces) {
+		return fmt.Errorf("header_default: index %d is out of range, there are %d replace values", repl.HeaderDefault, len(repl.Replaces))
+	}
+	return nil
+}
+
+// hasVariants reports whether the replace value of repl is chosen
+// for each response, by weights, by a request header or because of
+// CorrelatedRandom, rather than once for each transformer.
+func (repl *Replacement) hasVariants() bool {
+	return len(repl.Weights) > 0 || repl.SelectByHeader != "" || repl.correlated
+}
+
+// chooseVariant returns the index of the replace value for the
+// response to the request of placeholders: the one mapped to the
+// value of the SelectByHeader request header, or HeaderDefault if
+// the value isn't mapped or the header is missing, or otherwise the
+// weighted variant for point.
+func (repl *Replacement) chooseVariant(placeholders *caddy.Replacer, point float64) int {
+	if repl.SelectByHeader == "" {
+		return repl.variant(point)
+	}
+	value, _ := placeholders.GetString("http.request.header." + repl.SelectByHeader)
+	if i, ok := repl.HeaderMap[value]; ok {
+		return i
+	}
+	return repl.HeaderDefault
+}
+
+// varySelectHeaders adds the request headers that replace values are
+// selected by to the Vary header of a replaced response.
+func (h *Handler) varySelectHeaders(header http.Header) {
+	for _, repl := range h.Replacements {
+		if repl.SelectByHeader != "" {
+			addVary(header, repl.SelectByHeader)
+		}
+	}
+}
@@ -0,0 +1,91 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestSelectByHeader(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		header []string
+		def    int
+		want   string
+	}{
+		{name: "first mapped", header: []string{"US"}, want: "Hello"},
+		{name: "second mapped", header: []string{"DE"}, want: "Hallo"},
+		{name: "unmapped", header: []string{"FR"}, want: "Hello"},
+		{name: "unmapped with default", header: []string{"FR"}, def: 2, want: "Hi"},
+		{name: "missing", want: "Hello"},
+		{name: "missing with default", def: 2, want: "Hi"},
+		{name: "empty", header: []string{""}, def: 1, want: "Hallo"},
+		{name: "case matters", header: []string{"de"}, want: "Hello"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []struct {
+				name     string
+				stream   bool
+				conflict string
+			}{{"buffer", false, ""}, {"stream", true, ""}, {"longest match", false, conflictLongestMatchWins}} {
+				h := provision(t, &Handler{Stream: mode.stream, ConflictResolution: mode.conflict, Replacements: []*Replacement{{
+					Search:         "{greeting}",
+					Replaces:       []string{"Hello", "Hallo", "Hi"},
+					SelectByHeader: "X-Country",
+					HeaderMap:      map[string]int{"US": 0, "DE": 1},
+					HeaderDefault:  tt.def,
+				}}})
+				// the selection is made for each request
+				for i := 0; i < 3; i++ {
+					r := newRequest("GET", "/", nil)
+					for _, value := range tt.header {
+						r.Header.Add("X-Country", value)
+					}
+					r = r.WithContext(context.WithValue(r.Context(), caddy.ReplacerCtxKey, caddyhttp.NewTestReplacer(r)))
+					w := serve(t, h, r, upstream("text/html", "<h1>{greeting}</h1>"))
+					if want := "<h1>" + tt.want + "</h1>"; w.Body.String() != want {
+						t.Fatalf("%s: got %q, want %q", mode.name, w.Body.String(), want)
+					}
+					if got := w.Header().Get("Vary"); got != "X-Country" {
+						t.Errorf("%s: Vary %q, want %q", mode.name, got, "X-Country")
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestSelectByHeaderInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		repl *Replacement
+	}{
+		{"map without header", &Replacement{Search: "a", Replaces: []string{"b"}, HeaderMap: map[string]int{"x": 0}}},
+		{"default without header", &Replacement{Search: "a", Replaces: []string{"b", "c"}, HeaderDefault: 1}},
+		{"with weights", &Replacement{Search: "a", Replaces: []string{"b", "c"}, Weights: []float64{1, 1}, SelectByHeader: "X"}},
+		{"without replace values", &Replacement{Search: "a", Mask: "*", SelectByHeader: "X"}},
+		{"index out of range", &Replacement{Search: "a", Replaces: []string{"b", "c"}, SelectByHeader: "X", HeaderMap: map[string]int{"x": 2}}},
+		{"negative index", &Replacement{Search: "a", Replaces: []string{"b", "c"}, SelectByHeader: "X", HeaderMap: map[string]int{"x": -1}}},
+		{"default out of range", &Replacement{Search: "a", Replaces: []string{"b", "c"}, SelectByHeader: "X", HeaderDefault: 2}},
+	} {
+		if err := provisionErr(&Handler{Replacements: []*Replacement{tt.repl}}); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
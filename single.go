@@ -0,0 +1,141 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"io"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// singleLiteral returns the only rule if it is a substring replacement
+// that always replaces its matches with the same static value, and
+// nothing else is done to the body by the transformer, so that streamed
+// and spilled bodies can be written through a literalWriter instead,
+// which saves the buffers of a transform writer. It returns nil
+// otherwise. Buffered bodies still go through the transformer: for a
+// single replace.String it already is one pass over the body, and
+// bytes.ReplaceAll was measured to be no faster.
+func (h *Handler) singleLiteral(placeholderRepl *caddy.Replacer) *literal {
+	if len(h.rules) != 1 || h.ConflictResolution == conflictLongestMatchWins || !h.placeholderFree() || h.wrapsTransformer() {
+		return nil
+	}
+	repl := h.rules[0]
+	// several replace values without weights are chosen from at
+	// random for each transformer
+	if repl.re != nil || len(repl.Replaces) > 1 || repl.hasVariants() {
+		return nil
+	}
+	finalReplace := repl.chooseReplace(placeholderRepl, 0)
+	if h.decidesPerMatch(repl, finalReplace) {
+		return nil
+	}
+	// placeholderFree holds, so there are no request placeholders
+	lit := h.staticLiteral(repl, finalReplace, placeholderRepl, placeholderRepl)
+	if lit.search == "" {
+		return nil
+	}
+	return &lit
+}
+
+// literalWriter writes what is written to it to w with lit performed
+// on it, like a transform writer with a replace.String transformer. It
+// only holds back the end of each write that may be the start of a
+// match.
+type literalWriter struct {
+	w       io.Writer
+	search  []byte
+	replace []byte
+	pending []byte
+	// reused for the output of each write
+	buf []byte
+}
+
+// literalChunkSize is how much output literalWriter collects before
+// writing it to the underlying writer.
+const literalChunkSize = 4096
+
+func newLiteralWriter(w io.Writer, lit literal) *literalWriter {
+	return &literalWriter{w: w, search: []byte(lit.search), replace: []byte(lit.replace)}
+}
+
+func (lw *literalWriter) Write(p []byte) (int, error) {
+	data := p
+	if len(lw.pending) > 0 {
+		data = append(lw.pending, p...)
+	}
+	out := lw.buf[:0]
+	for {
+		i := bytes.Index(data, lw.search)
+		if i < 0 {
+			break
+		}
+		out = append(out, data[:i]...)
+		out = append(out, lw.replace...)
+		data = data[i+len(lw.search):]
+		if len(out) >= literalChunkSize {
+			if _, err := lw.w.Write(out); err != nil {
+				return 0, err
+			}
+			out = out[:0]
+		}
+	}
+	keep := lw.partialMatch(data)
+	rest := data[:len(data)-keep]
+	if len(out) > 0 {
+		out = append(out, rest...)
+		lw.buf = out[:0]
+	} else {
+		// no need to copy what isn't replaced
+		lw.buf = out
+		out = rest
+	}
+	if len(out) > 0 {
+		if _, err := lw.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	// data may be p or share its array with pending
+	lw.pending = append(lw.pending[:0:0], data[len(data)-keep:]...)
+	return len(p), nil
+}
+
+// partialMatch returns the length of the longest end of data that is
+// the start of the search string, but not all of it.
+func (lw *literalWriter) partialMatch(data []byte) int {
+	n := len(lw.search) - 1
+	if n > len(data) {
+		n = len(data)
+	}
+	for ; n > 0; n-- {
+		if bytes.HasPrefix(lw.search, data[len(data)-n:]) {
+			return n
+		}
+	}
+	return 0
+}
+
+// Close writes out what is held back. It does not close the
+// underlying writer.
+func (lw *literalWriter) Close() error {
+	if len(lw.pending) == 0 {
+		return nil
+	}
+	pending := lw.pending
+	lw.pending = nil
+	_, err := lw.w.Write(pending)
+	return err
+}
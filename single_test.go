@@ -0,0 +1,143 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSingleLiteral(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		h      *Handler
+		single bool
+	}{
+		{name: "static substring", h: &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}}, single: true},
+		{name: "empty replace", h: &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{""}}}}, single: true},
+		{name: "mask", h: &Handler{Replacements: []*Replacement{{Search: "secret", Mask: "*"}}}, single: true},
+		{name: "two rules", h: &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}, {Search: "baz", Replaces: []string{"qux"}}}}},
+		{name: "regexp", h: &Handler{Replacements: []*Replacement{{SearchRegexp: "fo+", Replaces: []string{"bar"}}}}},
+		{name: "several replace values", h: &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar", "baz"}}}}},
+		{name: "placeholder", h: &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"{path}"}}}}},
+		{name: "once", h: &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}, Once: true}}}},
+		{name: "match token", h: &Handler{Replacements: []*Replacement{{Search: "foo", Replaces: []string{"[{counter}]"}}}}},
+		{name: "longest match", h: &Handler{ConflictResolution: conflictLongestMatchWins, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}}},
+		{name: "collapse_whitespace", h: &Handler{CollapseWhitespace: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}}},
+		{name: "access_log_fields", h: &Handler{AccessLogFields: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}}},
+	} {
+		h := provision(t, tt.h)
+		if single := h.single != nil; single != tt.single {
+			t.Errorf("%s: single literal %v, want %v", tt.name, single, tt.single)
+		}
+	}
+}
+
+func TestSingleLiteralServe(t *testing.T) {
+	long := strings.Repeat("<p>foo</p>\n", 2000)
+	for _, tt := range []struct {
+		name   string
+		h      *Handler
+		chunks []string
+		want   string
+	}{
+		{name: "stream", h: &Handler{Stream: true}, chunks: []string{"a fo", "o b f", "oo"}, want: "a barbaz b barbaz"},
+		{name: "stream long body", h: &Handler{Stream: true}, chunks: splitEvery(long, 4096), want: strings.ReplaceAll(long, "foo", "barbaz")},
+		{name: "spilled", h: &Handler{SpillToDisk: true, SpillThreshold: 1000, TempDir: t.TempDir()}, chunks: splitEvery(long, 4096), want: strings.ReplaceAll(long, "foo", "barbaz")},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.h.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"barbaz"}}}
+			h := provision(t, tt.h)
+			if h.single == nil {
+				t.Fatal("not a single literal")
+			}
+			if got := replaced(t, h, tt.chunks...); got != tt.want {
+				t.Errorf("got %.40q, want %.40q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLiteralWriter(t *testing.T) {
+	for _, tt := range []struct {
+		search, replace string
+		body            string
+	}{
+		{"foo", "bar", "a foo b foo"},
+		{"foo", "", "foofoo foo"},
+		{"foo", "a longer value", "foo"},
+		{"aab", "X", "aaab aaaab aab"},
+		{"abab", "X", "abababab ababa"},
+		{"foo", "bar", "no match, but f"},
+		{"foo", "bar", "fo"},
+		{"x", "yy", strings.Repeat("x", 10000)},
+		{"foo", "bar", strings.Repeat("<p>foo</p>", 1000)},
+	} {
+		want := strings.ReplaceAll(tt.body, tt.search, tt.replace)
+		for _, chunk := range []int{1, 2, 3, 7, 4096, len(tt.body)} {
+			var out bytes.Buffer
+			lw := newLiteralWriter(&out, literal{tt.search, tt.replace})
+			for _, s := range splitEvery(tt.body, chunk) {
+				if n, err := lw.Write([]byte(s)); err != nil || n != len(s) {
+					t.Fatalf("%q: wrote %d of %d: %v", tt.body, n, len(s), err)
+				}
+			}
+			if err := lw.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if out.String() != want {
+				t.Errorf("%q in chunks of %d: got %.40q, want %.40q", tt.body, chunk, out.String(), want)
+			}
+		}
+	}
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("write failed")
+}
+
+func TestLiteralWriterError(t *testing.T) {
+	lw := newLiteralWriter(failingWriter{}, literal{"foo", "bar"})
+	if _, err := lw.Write([]byte("a foo")); err == nil {
+		t.Error("write: no error")
+	}
+	lw = newLiteralWriter(failingWriter{}, literal{"foo", "bar"})
+	if _, err := lw.Write([]byte("fo")); err != nil {
+		t.Fatalf("held back write: %v", err)
+	}
+	if err := lw.Close(); err == nil {
+		t.Error("close: no error")
+	}
+}
+
+func BenchmarkSingleLiteral(b *testing.B) {
+	for _, size := range []int{1 << 10, 64 << 10} {
+		for _, single := range []bool{false, true} {
+			b.Run(strconv.Itoa(size>>10)+"KB/single="+strconv.FormatBool(single), func(b *testing.B) {
+				h := provision(b, &Handler{Stream: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+				if !single {
+					h.single = nil
+				}
+				benchmarkServe(b, h, page(size))
+			})
+		}
+	}
+}
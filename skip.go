@@ -0,0 +1,82 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+)
+
+// skipHeader is a compiled entry of Handler.SkipIfHeader.
+type skipHeader struct {
+	name string
+	// nil if the header only has to be present
+	re *regexp.Regexp
+}
+
+// parseSkipHeaders compiles the entries of Handler.SkipIfHeader,
+// sorted by header name.
+func parseSkipHeaders(headers map[string]string) ([]skipHeader, error) {
+	skips := make([]skipHeader, 0, len(headers))
+	for name, value := range headers {
+		if name == "" {
+			return nil, fmt.Errorf("skip_if_header: missing header name")
+		}
+		skip := skipHeader{name: http.CanonicalHeaderKey(name)}
+		if value != "" {
+			if _, err := regexp.Compile(value); err != nil {
+				return nil, fmt.Errorf("skip_if_header: %s: %v", name, err)
+			}
+			// the value must match in full
+			skip.re = regexp.MustCompile("^(?:" + value + ")$")
+		}
+		skips = append(skips, skip)
+	}
+	sort.Slice(skips, func(i, j int) bool {
+		return skips[i].name < skips[j].name
+	})
+	return skips, nil
+}
+
+// matches reports whether header has the field and, if a value is
+// required, whether one of the field's values matches it.
+func (s skipHeader) matches(header http.Header) bool {
+	values := header.Values(s.name)
+	if len(values) == 0 {
+		return false
+	}
+	if s.re == nil {
+		return true
+	}
+	for _, v := range values {
+		if s.re.MatchString(v) {
+			return true
+		}
+	}
+	return false
+}
+
+// skippedBy returns the name of the first SkipIfHeader field that
+// header matches, or the empty string if there is none.
+func (h *Handler) skippedBy(header http.Header) string {
+	for _, s := range h.skipHeaders {
+		if s.matches(header) {
+			return s.name
+		}
+	}
+	return ""
+}
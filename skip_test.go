@@ -0,0 +1,86 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+func TestSkipIfHeader(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		skip   map[string]string
+		header http.Header
+		want   string
+	}{
+		{name: "present", skip: map[string]string{"X-Rewritten": ""}, header: http.Header{"X-Rewritten": {"1"}}, want: "foo"},
+		{name: "present and empty", skip: map[string]string{"X-Rewritten": ""}, header: http.Header{"X-Rewritten": {""}}, want: "foo"},
+		{name: "absent", skip: map[string]string{"X-Rewritten": ""}, want: "bar"},
+		{name: "name ignoring case", skip: map[string]string{"x-rewritten": ""}, header: http.Header{"X-Rewritten": {"1"}}, want: "foo"},
+		{name: "matching value", skip: map[string]string{"X-Rewritten": "1|true"}, header: http.Header{"X-Rewritten": {"true"}}, want: "foo"},
+		{name: "non-matching value", skip: map[string]string{"X-Rewritten": "1|true"}, header: http.Header{"X-Rewritten": {"0"}}, want: "bar"},
+		{name: "value must match in full", skip: map[string]string{"X-Rewritten": "1|true"}, header: http.Header{"X-Rewritten": {"10"}}, want: "bar"},
+		{name: "one of several values", skip: map[string]string{"X-Rewritten": "1"}, header: http.Header{"X-Rewritten": {"0", "1"}}, want: "foo"},
+		{name: "one of several headers", skip: map[string]string{"X-Rewritten": "", "X-Final": "yes"}, header: http.Header{"X-Final": {"yes"}}, want: "foo"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, stream := range []bool{false, true} {
+				h := provision(t, &Handler{Stream: stream, SkipIfHeader: tt.skip, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+				next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+					for name, values := range tt.header {
+						w.Header()[name] = values
+					}
+					w.Header().Set("Content-Type", "text/plain")
+					_, err := w.Write([]byte("foo"))
+					return err
+				})
+				w := serve(t, h, newRequest("GET", "/", nil), next)
+				if got := w.Body.String(); got != tt.want {
+					t.Errorf("stream %v: got %q, want %q", stream, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSkipIfHeaderInvalid(t *testing.T) {
+	for _, skip := range []map[string]string{{"": "1"}, {"X-Rewritten": "("}} {
+		if err := provisionErr(&Handler{SkipIfHeader: skip, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}}); err == nil {
+			t.Errorf("%q: no error", skip)
+		}
+	}
+}
+
+func TestCaddyfileSkipIfHeader(t *testing.T) {
+	h, err := parse("replace {\n\tskip_if_header X-Rewritten\n\tskip_if_header X-Final yes|1\n\tfoo bar\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"X-Rewritten": "", "X-Final": "yes|1"}; !reflect.DeepEqual(h.SkipIfHeader, want) {
+		t.Errorf("skip_if_header %q, want %q", h.SkipIfHeader, want)
+	}
+	for _, input := range []string{
+		"replace {\n\tskip_if_header\n}",
+		"replace {\n\tskip_if_header X-Final yes no\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
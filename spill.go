@@ -0,0 +1,269 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+)
+
+// defaultSpillThreshold is the size of a buffered body, in bytes,
+// beyond which it is moved to a temporary file if SpillToDisk is set.
+const defaultSpillThreshold = 10 << 20
+
+// spillWriter records a buffered response like the recorder it wraps,
+// until the body grows past threshold. The body is then moved to a
+// temporary file, and the rest of it is written there.
+type spillWriter struct {
+	caddyhttp.ResponseRecorder
+
+	threshold int64
+	dir       string
+	file      *os.File
+}
+
+func (sw *spillWriter) Write(p []byte) (int, error) {
+	if sw.file != nil {
+		return sw.file.Write(p)
+	}
+	n, err := sw.ResponseRecorder.Write(p)
+	if err != nil || !sw.Buffered() || int64(sw.Buffer().Len()) <= sw.threshold {
+		return n, err
+	}
+	file, err := os.CreateTemp(sw.dir, "caddy-replace-*")
+	if err != nil {
+		return n, fmt.Errorf("spilling response body: %v", err)
+	}
+	sw.file = file
+	if _, err := sw.Buffer().WriteTo(file); err != nil {
+		return n, fmt.Errorf("spilling response body: %v", err)
+	}
+	return n, nil
+}
+
+// Unwrap returns the underlying recorder.
+func (sw *spillWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseRecorder
+}
+
+// cleanup closes and removes the temporary file, if any.
+func (sw *spillWriter) cleanup() {
+	if sw.file != nil {
+		removeTemp(sw.file)
+	}
+}
+
+func removeTemp(file *os.File) {
+	file.Close()
+	os.Remove(file.Name())
+}
+
+// spillThreshold returns the configured spill threshold or its default.
+func (h *Handler) spillThreshold() int64 {
+	if h.SpillThreshold > 0 {
+		return h.SpillThreshold
+	}
+	return defaultSpillThreshold
+}
+
+// writeSpilled performs the replacements on a buffered response whose
+// body was spilled to file, and writes the result to w. The result is
+// written to another temporary file first, so that the headers can be
+// finalized before anything is sent, just like for bodies in memory.
+func (h *Handler) writeSpilled(w http.ResponseWriter, r *http.Request, rec caddyhttp.ResponseRecorder, file *os.File, tr *replacer) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	h.logDecision(r, "spilled response to disk for replacements",
+		zap.Int("status", rec.Status()),
+		zap.Int64("size", info.Size()))
+	if ok, err := h.lengthMismatch(r, rec.Status(), rec.Header(), info.Size()); !ok {
+		if err != nil {
+			return err
+		}
+		return sendFile(w, rec.Status(), file)
+	}
+
+	var encodings []string
+	if h.Decompress {
+		var ok bool
+		encodings, ok = contentEncodings(rec.Header())
+		if !ok {
+			h.logDecision(r, "skipping replacements on response with unsupported encoding",
+				zap.Strings("content_encoding", rec.Header().Values("Content-Encoding")))
+			return writeFile(w, rec.Status(), file)
+		}
+	}
+
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	var src io.Reader = file
+	for i := len(encodings) - 1; i >= 0; i-- {
+		dec, err := newDecoder(src, encodings[i])
+		if err != nil {
+			h.logDecision(r, "skipping replacements on response that could not be decoded",
+				zap.Error(fmt.Errorf("decoding %s: %v", encodings[i], err)))
+			return writeFile(w, rec.Status(), file)
+		}
+		defer dec.Close()
+		src = dec
+	}
+	br := bufio.NewReader(src)
+
+	if !h.ForceBinary && rec.Header().Get("Content-Type") == "" {
+		// a decoding error surfaces again below
+		sniff, _ := br.Peek(512)
+		if isBinaryContent(sniff) {
+			h.logDecision(r, "skipping replacements on binary response")
+			return writeFile(w, rec.Status(), file)
+		}
+	}
+
+	if ok, err := h.acquireSlot(r); !ok {
+		if err != nil {
+			return err
+		}
+		return writeFile(w, rec.Status(), file)
+	}
+	defer h.releaseSlot()
+
+	decoding := len(encodings) > 0
+	// the upstream's codings are kept with reencode_for_client if
+	// the client refuses unencoded responses and accepts no other
+	varyEncoding := decoding && h.ReencodeForClient
+	reencode := false
+	if varyEncoding {
+		var encoding string
+		if encoding, reencode = chooseEncoding(r.Header.Get("Accept-Encoding")); reencode {
+			encodings = nil
+			if encoding != "" {
+				encodings = []string{encoding}
+			}
+		}
+	}
+
+	out, err := os.CreateTemp(h.TempDir, "caddy-replace-*")
+	if err != nil {
+		return fmt.Errorf("spilling response body: %v", err)
+	}
+	defer removeTemp(out)
+
+	// the last coding applied is the one nearest the file
+	var dst io.Writer = out
+	encoders := make([]io.WriteCloser, len(encodings))
+	for i := len(encodings) - 1; i >= 0; i-- {
+		enc, err := newEncoder(dst, encodings[i])
+		if err != nil {
+			return fmt.Errorf("encoding %s: %v", encodings[i], err)
+		}
+		encoders[i] = enc
+		dst = enc
+	}
+
+	h.takeNonce(tr, rec.Header())
+	rt := h.responseTransformer(tr, rec.Header())
+	var tw io.WriteCloser
+	if boundary := h.multipartBoundary(rec.Header()); boundary != "" {
+		tw = newMultipartWriter(dst, rt, boundary, h.partSelected)
+	} else if h.single != nil {
+		tw = newLiteralWriter(dst, *h.single)
+	} else {
+		tw = newTransformWriter(dst, rt)
+	}
+	if _, err := io.Copy(tw, br); err != nil {
+		if decoding {
+			h.logDecision(r, "skipping replacements on response that could not be decoded",
+				zap.Error(err))
+			return writeFile(w, rec.Status(), file)
+		}
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	for _, enc := range encoders {
+		if err := enc.Close(); err != nil {
+			return err
+		}
+	}
+
+	for i, repl := range h.rules {
+		if repl.Required && tr.counts[i] == 0 && tr.inNth(repl) && tr.active(repl) && !tr.omits(repl) {
+			status := h.RequiredStatus
+			if status == 0 {
+				status = http.StatusInternalServerError
+			}
+			return caddyhttp.Error(status, fmt.Errorf("required replacement %d made no replacements", repl.index))
+		}
+	}
+
+	if h.Trailers {
+		if err := replaceTrailers(w.Header(), tr); err != nil {
+			return err
+		}
+	}
+
+	if reencode {
+		if len(encodings) > 0 {
+			w.Header().Set("Content-Encoding", encodings[0])
+		} else {
+			w.Header().Del("Content-Encoding")
+		}
+	}
+	if varyEncoding {
+		addVary(w.Header(), "Accept-Encoding")
+	}
+	h.dropHeaders(w.Header())
+	h.addScriptHashes(w.Header(), tr)
+	h.varySelectHeaders(w.Header())
+
+	return writeFile(w, rec.Status(), out)
+}
+
+// writeFile writes the status and the whole of file as the response,
+// correcting the Content-Length if one was set.
+func writeFile(w http.ResponseWriter, status int, file *os.File) error {
+	info, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	if w.Header().Get("Content-Length") != "" {
+		w.Header().Set("Content-Length", strconv.FormatInt(info.Size(), 10))
+	}
+	return sendFile(w, status, file)
+}
+
+// sendFile writes the response with the given status and the contents
+// of file as its body, leaving the headers alone.
+func sendFile(w http.ResponseWriter, status int, file *os.File) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	_, err := io.Copy(w, file)
+	return err
+}
@@ -0,0 +1,125 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestSpillToDisk(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		size    int
+		spilled bool
+	}{
+		{name: "below the threshold", size: 100},
+		{name: "at the threshold", size: 1000},
+		{name: "above the threshold", size: 1001, spilled: true},
+		{name: "far above the threshold", size: 100000, spilled: true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			h := provision(t, &Handler{SpillToDisk: true, SpillThreshold: 1000, TempDir: dir, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"quux"}}}})
+			core, logs := observer.New(zapcore.DebugLevel)
+			h.logger = zap.New(core)
+
+			body := strings.Repeat("a foo ", tt.size/6+1)[:tt.size]
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+				for _, chunk := range splitEvery(body, 512) {
+					if _, err := io.WriteString(w, chunk); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			w := serve(t, h, newRequest("GET", "/", nil), next)
+			want := strings.ReplaceAll(body, "foo", "quux")
+			if got := w.Body.String(); got != want {
+				t.Errorf("got %d bytes, want %d bytes replaced", len(got), len(want))
+			}
+			if got := w.Header().Get("Content-Length"); got != strconv.Itoa(len(want)) {
+				t.Errorf("Content-Length %q, want %d", got, len(want))
+			}
+			if spilled := logs.FilterMessage("spilled response to disk for replacements").Len() > 0; spilled != tt.spilled {
+				t.Errorf("spilled %v, want %v", spilled, tt.spilled)
+			}
+			assertEmptyDir(t, dir)
+		})
+	}
+}
+
+func TestSpillToDiskCleanup(t *testing.T) {
+	dir := t.TempDir()
+	h := provision(t, &Handler{SpillToDisk: true, SpillThreshold: 10, TempDir: dir, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+	errUpstream := errors.New("upstream failed")
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/plain")
+		if _, err := io.WriteString(w, strings.Repeat("foo", 100)); err != nil {
+			return err
+		}
+		return errUpstream
+	})
+	if err := h.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "/", nil), next); !errors.Is(err, errUpstream) {
+		t.Fatalf("got error %v, want %v", err, errUpstream)
+	}
+	assertEmptyDir(t, dir)
+}
+
+func TestSpillToDiskInvalid(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		handler *Handler
+		err     string
+	}{
+		{handler: &Handler{SpillToDisk: true, SpillThreshold: -1}, err: "spill_threshold: must not be negative"},
+		{handler: &Handler{SpillToDisk: true, TempDir: file}, err: "is not a directory"},
+		{handler: &Handler{SpillToDisk: true, TempDir: filepath.Join(file, "missing")}, err: "temp_dir:"},
+	} {
+		tt.handler.Replacements = []*Replacement{{Search: "a", Replaces: []string{"b"}}}
+		if err := provisionErr(tt.handler); err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("got error %v, want %q", err, tt.err)
+		}
+	}
+}
+
+// assertEmptyDir fails the test if dir has any files left in it.
+func assertEmptyDir(t *testing.T, dir string) {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("temporary file %s left behind", entry.Name())
+	}
+}
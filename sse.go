@@ -0,0 +1,87 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+
+	"golang.org/x/text/transform"
+)
+
+// sseEventEnd matches the blank line that terminates a server-sent event.
+var sseEventEnd = regexp.MustCompile(`(\r\n|\n)(\r\n|\n)`)
+
+// isEventStream reports whether a response with the given headers is
+// a stream of server-sent events.
+func isEventStream(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && mediaType == "text/event-stream"
+}
+
+// sseWriter performs replacements on a stream of server-sent events,
+// one event at a time, so that no match can span two events. Each
+// event is buffered until the blank line that ends it has been
+// written, then transformed and written to w as a whole; the blank
+// line itself is never replaced.
+type sseWriter struct {
+	w   io.Writer
+	tr  transform.Transformer
+	buf []byte
+}
+
+func newSSEWriter(w io.Writer, tr transform.Transformer) *sseWriter {
+	return &sseWriter{w: w, tr: tr}
+}
+
+func (sw *sseWriter) Write(p []byte) (int, error) {
+	sw.buf = append(sw.buf, p...)
+	for {
+		loc := sseEventEnd.FindIndex(sw.buf)
+		if loc == nil {
+			return len(p), nil
+		}
+		if err := sw.writeEvent(sw.buf[:loc[0]]); err != nil {
+			return 0, err
+		}
+		if _, err := sw.w.Write(sw.buf[loc[0]:loc[1]]); err != nil {
+			return 0, err
+		}
+		sw.buf = append(sw.buf[:0], sw.buf[loc[1]:]...)
+	}
+}
+
+// writeEvent writes a single event to w after performing replacements.
+func (sw *sseWriter) writeEvent(event []byte) error {
+	sw.tr.Reset()
+	tw := newTransformWriter(sw.w, sw.tr)
+	if _, err := tw.Write(event); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// Close writes the final, unterminated event, if any. It does not
+// close w.
+func (sw *sseWriter) Close() error {
+	if len(sw.buf) == 0 {
+		return nil
+	}
+	err := sw.writeEvent(sw.buf)
+	sw.buf = sw.buf[:0]
+	return err
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import "testing"
+
+func TestSSEBoundaryAware(t *testing.T) {
+	rules := []*Replacement{{SearchRegexp: "(?s)<.*?>", Replaces: []string{"X"}}}
+	for _, tt := range []struct {
+		name  string
+		aware bool
+		body  string
+		want  string
+	}{
+		{
+			name:  "events",
+			aware: true,
+			body:  "data: <a>\n\ndata: <b\n\n: ping\n\ndata: c>\n\n",
+			want:  "data: X\n\ndata: <b\n\n: ping\n\ndata: c>\n\n",
+		},
+		{
+			name: "spanning match without boundaries",
+			body: "data: <a>\n\ndata: <b\n\n: ping\n\ndata: c>\n\n",
+			want: "data: X\n\ndata: X\n\n",
+		},
+		{
+			name:  "crlf",
+			aware: true,
+			body:  "data: <a\r\n\r\ndata: b>\r\n\r\n",
+			want:  "data: <a\r\n\r\ndata: b>\r\n\r\n",
+		},
+		{
+			name:  "multi-line event",
+			aware: true,
+			body:  "data: <a\ndata: b>\n\ndata: <c>\n\n",
+			want:  "data: X\n\ndata: X\n\n",
+		},
+		{
+			name:  "unterminated final event",
+			aware: true,
+			body:  "data: <a>\n\ndata: <b>",
+			want:  "data: X\n\ndata: X",
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, chunk := range []int{len(tt.body), 3, 1} {
+				h := provision(t, &Handler{Stream: true, SSEBoundaryAware: tt.aware, Replacements: rules})
+				w := serve(t, h, newRequest("GET", "/", nil), upstream("text/event-stream", splitEvery(tt.body, chunk)...))
+				if got := w.Body.String(); got != tt.want {
+					t.Errorf("chunks of %d: got %q, want %q", chunk, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestSSEBoundaryAwareOtherTypes(t *testing.T) {
+	// other content types are streamed as before
+	h := provision(t, &Handler{Stream: true, SSEBoundaryAware: true, Replacements: []*Replacement{{SearchRegexp: "(?s)<.*?>", Replaces: []string{"X"}}}})
+	w := serve(t, h, newRequest("GET", "/", nil), upstream("text/plain", "<a\n\nb>"))
+	if got := w.Body.String(); got != "X" {
+		t.Errorf("got %q, want %q", got, "X")
+	}
+}
@@ -0,0 +1,377 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// flushRecorder is a ResponseRecorder that records what the body was
+// at each flush. It may be flushed from another goroutine.
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	mu      sync.Mutex
+	flushed []string
+}
+
+func newFlushRecorder() *flushRecorder {
+	return &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+}
+
+func (fr *flushRecorder) Write(p []byte) (int, error) {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return fr.ResponseRecorder.Write(p)
+}
+
+func (fr *flushRecorder) Flush() {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	fr.flushed = append(fr.flushed, fr.Body.String())
+}
+
+func (fr *flushRecorder) flushes() []string {
+	fr.mu.Lock()
+	defer fr.mu.Unlock()
+	return append([]string(nil), fr.flushed...)
+}
+
+func TestFlushInterval(t *testing.T) {
+	for _, tt := range []struct {
+		name     string
+		interval time.Duration
+		// what the client has been sent while upstream waits
+		want string
+	}{
+		{name: "periodic", interval: 10 * time.Millisecond, want: "hello bar world"},
+		{name: "disabled", want: ""},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{Stream: true, FlushInterval: caddy.Duration(tt.interval), Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+			w := newFlushRecorder()
+			var during []string
+			next := caddyhttp.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) error {
+				rw.Header().Set("Content-Type", "text/plain")
+				// no flushes from upstream
+				if _, err := io.WriteString(rw, "hello foo world"); err != nil {
+					return err
+				}
+				time.Sleep(100 * time.Millisecond)
+				during = w.flushes()
+				_, err := io.WriteString(rw, " foo")
+				return err
+			})
+			if err := h.ServeHTTP(w, newRequest("GET", "/", nil), next); err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if len(during) > 0 {
+				got = during[len(during)-1]
+			}
+			if got != tt.want {
+				t.Errorf("flushed %q while upstream waited, want %q", got, tt.want)
+			}
+			if body := w.Body.String(); body != "hello bar world bar" {
+				t.Errorf("body %q", body)
+			}
+		})
+	}
+}
+
+func TestUpstreamFlush(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		chunks      []string
+		// what the client has been sent at each upstream flush
+		want []string
+	}{
+		{
+			name:        "flushes replaced output",
+			contentType: "text/plain",
+			chunks:      []string{"hello foo", " world", " foo"},
+			want:        []string{"hello bar", "hello bar world", "hello bar world bar"},
+		},
+		{
+			name:        "holds back a partial match",
+			contentType: "text/plain",
+			chunks:      []string{"hello fo", "o world"},
+			want:        []string{"hello ", "hello bar world"},
+		},
+		{
+			name:        "holds back a partial match across flushes",
+			contentType: "text/plain",
+			chunks:      []string{"a f", "o", "o b"},
+			want:        []string{"a ", "a ", "a bar b"},
+		},
+		{
+			name:        "not replaced",
+			contentType: "image/png",
+			chunks:      []string{"a fo", "o"},
+			want:        []string{"a fo", "a foo"},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{Stream: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+			w := newFlushRecorder()
+			var got []string
+			next := caddyhttp.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) error {
+				rw.Header().Set("Content-Type", tt.contentType)
+				for _, chunk := range tt.chunks {
+					if _, err := io.WriteString(rw, chunk); err != nil {
+						return err
+					}
+					if err := http.NewResponseController(rw).Flush(); err != nil {
+						return err
+					}
+					flushes := w.flushes()
+					if len(flushes) == 0 {
+						got = append(got, "")
+					} else {
+						got = append(got, flushes[len(flushes)-1])
+					}
+				}
+				return nil
+			})
+			if err := h.ServeHTTP(w, newRequest("GET", "/", nil), next); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("flushed %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStreamEmptyBody(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		status int
+		write  bool
+	}{
+		{name: "no write", status: http.StatusOK},
+		{name: "empty write", status: http.StatusOK, write: true},
+		{name: "no content", status: http.StatusNoContent},
+		{name: "not modified", status: http.StatusNotModified},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{Stream: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Content-Length", "0")
+				w.WriteHeader(tt.status)
+				if tt.write {
+					_, err := w.Write(nil)
+					return err
+				}
+				return nil
+			})
+			w := serve(t, h, newRequest("GET", "/", nil), next)
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if w.Body.Len() != 0 {
+				t.Errorf("body %q, want none", w.Body.String())
+			}
+			if w.Flushed {
+				t.Error("flushed an empty body")
+			}
+			if got := w.Header().Get("Content-Length"); got != "0" {
+				t.Errorf("Content-Length %q, want it kept", got)
+			}
+		})
+	}
+}
+
+func TestMaxStreamBytes(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		max         int64
+		want        string
+		err         bool
+	}{
+		{name: "under the limit", contentType: "text/plain", max: 100, want: strings.Repeat("bbbb", 10)},
+		{name: "at the limit", contentType: "text/plain", max: 40, want: strings.Repeat("bbbb", 10)},
+		{name: "mid write", contentType: "text/plain", max: 10, want: "bbbbbbbbbb", err: true},
+		{name: "at a write boundary", contentType: "text/plain", max: 8, want: "bbbbbbbb", err: true},
+		{name: "passed through", contentType: "image/png", max: 10, want: "aaaaaaaaaa", err: true},
+		{name: "no limit", contentType: "text/plain", want: strings.Repeat("bbbb", 10)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{Stream: true, MaxStreamBytes: tt.max, Replacements: []*Replacement{{Search: "a", Replaces: []string{"b"}}}})
+			var writes int
+			// an upstream that keeps writing until it fails
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.Header().Set("Content-Length", "40")
+				for i := 0; i < 10; i++ {
+					writes++
+					if _, err := io.WriteString(w, "aaaa"); err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			w := httptest.NewRecorder()
+			err := h.ServeHTTP(w, newRequest("GET", "/", nil), next)
+			if tt.err != errors.Is(err, errMaxStreamBytes) {
+				t.Fatalf("got error %v, want max_stream_bytes exceeded %v", err, tt.err)
+			}
+			if got := w.Body.String(); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+			if tt.err {
+				if limit := int(tt.max)/4 + 1; writes != limit {
+					t.Errorf("upstream made %d writes, want it to stop at write %d", writes, limit)
+				}
+				if cl := w.Header().Get("Content-Length"); cl != "" && cl != strconv.Itoa(len(tt.want)) {
+					t.Errorf("Content-Length %q for a body of %d bytes", cl, len(tt.want))
+				}
+			}
+		})
+	}
+}
+
+func TestStreamWriteCount(t *testing.T) {
+	// the start of a long search string is held back, and the next
+	// write doesn't fit in the transform writer's buffer with it
+	search := strings.Repeat("ab", 1500) + "!"
+	substrings := func() []*Replacement {
+		return []*Replacement{{Search: search, Replaces: []string{"Z"}}, {Search: "q", Replaces: []string{"r"}}}
+	}
+	for _, tt := range []struct {
+		name string
+		h    *Handler
+	}{
+		{"substring", &Handler{Replacements: substrings()}},
+		{"regexp", &Handler{StreamWindow: 4000, Replacements: []*Replacement{{SearchRegexp: "a" + search[1:], Replaces: []string{"Z"}}}}},
+		{"longest match", &Handler{ConflictResolution: conflictLongestMatchWins, Replacements: substrings()}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.h.Stream = true
+			h := provision(t, tt.h)
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "text/plain")
+				for _, chunk := range []string{"x" + search[:2000], strings.Repeat("ab", 1500), "!y"} {
+					n, err := io.WriteString(w, chunk)
+					if err != nil {
+						return err
+					}
+					if n != len(chunk) {
+						t.Errorf("wrote %d of %d bytes without an error", n, len(chunk))
+					}
+				}
+				return nil
+			})
+			w := serve(t, h, newRequest("GET", "/", nil), next)
+			if want := "x" + strings.Repeat("ab", 1000) + "Zy"; w.Body.String() != want {
+				t.Errorf("body %.20q... of %d bytes, want %.20q... of %d", w.Body.String(), w.Body.Len(), want, len(want))
+			}
+		})
+	}
+}
+
+func TestStreamPassthroughLength(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		h      *Handler
+		length string
+		body   string
+		want   string
+		// the Content-Length the client gets, if any
+		wantLength string
+	}{
+		{name: "matcher declines", h: &Handler{ExcludeContentTypes: []string{"text/plain"}}, length: "5", body: "a foo", want: "a foo", wantLength: "5"},
+		{name: "within max_stream_bytes", h: &Handler{ExcludeContentTypes: []string{"text/plain"}, MaxStreamBytes: 5}, length: "5", body: "a foo", want: "a foo", wantLength: "5"},
+		{name: "beyond max_stream_bytes", h: &Handler{ExcludeContentTypes: []string{"text/plain"}, MaxStreamBytes: 3}, length: "5", body: "a foo", want: "a f"},
+		{name: "invalid length with max_stream_bytes", h: &Handler{ExcludeContentTypes: []string{"text/plain"}, MaxStreamBytes: 3}, length: "five", body: "a foo", want: "a f"},
+		{name: "replaced", h: &Handler{}, length: "5", body: "a foo", want: "a barr"},
+		{name: "replaced without a match", h: &Handler{}, length: "5", body: "a baz", want: "a baz"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.h.Stream = true
+			tt.h.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"barr"}}}
+			h := provision(t, tt.h)
+			w := httptest.NewRecorder()
+			err := h.ServeHTTP(w, newRequest("GET", "/", nil), lengthUpstream(http.StatusOK, tt.length, tt.body))
+			if err != nil && !errors.Is(err, errMaxStreamBytes) {
+				t.Fatal(err)
+			}
+			if w.Body.String() != tt.want {
+				t.Errorf("body %q, want %q", w.Body.String(), tt.want)
+			}
+			if got := w.Header().Get("Content-Length"); got != tt.wantLength {
+				t.Errorf("Content-Length %q, want %q", got, tt.wantLength)
+			}
+		})
+	}
+}
+
+// readFromUpstream copies body to the response with io.Copy, as the
+// file server does, which uses ReadFrom if the writer has it.
+func readFromUpstream(status int, body string) caddyhttp.Handler {
+	return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(status)
+		// hide the WriteTo of strings.Reader
+		_, err := io.Copy(w, struct{ io.Reader }{strings.NewReader(body)})
+		return err
+	})
+}
+
+func TestReadFrom(t *testing.T) {
+	long := strings.Repeat("<p>foo</p>", 10000)
+	for _, tt := range []struct {
+		name   string
+		h      *Handler
+		status int
+		body   string
+	}{
+		{name: "buffer", h: &Handler{}, status: http.StatusOK, body: "<p>foo</p>"},
+		{name: "stream", h: &Handler{Stream: true}, status: http.StatusOK, body: "<p>foo</p>"},
+		{name: "stream long body", h: &Handler{Stream: true}, status: http.StatusOK, body: long},
+		{name: "hybrid streamed", h: &Handler{StreamStatusCodes: []int{200}}, status: http.StatusOK, body: long},
+		{name: "hybrid buffered", h: &Handler{StreamStatusCodes: []int{200}}, status: http.StatusNotFound, body: long},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.h.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}
+			h := provision(t, tt.h)
+			w := httptest.NewRecorder()
+			if err := h.ServeHTTP(w, newRequest("GET", "/", nil), readFromUpstream(tt.status, tt.body)); err != nil {
+				t.Fatal(err)
+			}
+			if w.Code != tt.status {
+				t.Errorf("status %d, want %d", w.Code, tt.status)
+			}
+			if want := strings.ReplaceAll(tt.body, "foo", "bar"); w.Body.String() != want {
+				t.Errorf("body %.40q, want %.40q", w.Body.String(), want)
+			}
+		})
+	}
+}
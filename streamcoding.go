@@ -0,0 +1,236 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/klauspost/compress/zstd"
+	"go.uber.org/zap"
+)
+
+// streamEncoding returns the content coding of a streamed response
+// that should be decoded before replacements, or the empty string if
+// there is none. It reports false if the response can't be replaced
+// because of its coding.
+func (h *Handler) streamEncoding(r *http.Request, header http.Header) (string, bool) {
+	if !h.Decompress {
+		return "", true
+	}
+	encodings, ok := contentEncodings(header)
+	if !ok || len(encodings) > 1 {
+		h.logDecision(r, "skipping replacements on streamed response with unsupported encoding",
+			zap.Strings("content_encoding", header.Values("Content-Encoding")))
+		return "", false
+	}
+	if len(encodings) == 0 {
+		return "", true
+	}
+	return encodings[0], true
+}
+
+// newStreamDecoder is like newDecoder, but the decoder only reads
+// from r when it has returned everything it decoded so far.
+func newStreamDecoder(r io.Reader, encoding string) (io.ReadCloser, error) {
+	if encoding == "zstd" {
+		dec, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return dec.IOReadCloser(), nil
+	}
+	return newDecoder(r, encoding)
+}
+
+// newStreamEncoder is like newEncoder, but the encoder only writes to
+// w from within its own methods.
+func newStreamEncoder(w io.Writer, encoding string) (io.WriteCloser, error) {
+	if encoding == "zstd" {
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	}
+	return newEncoder(w, encoding)
+}
+
+// codingWriter performs replacements on a streamed body that is
+// encoded with a content coding. What is written to it is decoded,
+// passed to the writer made by replace, and encoded again before it
+// reaches w. The decoder runs in its own goroutine, but each Write
+// only returns once everything it made decodable has been replaced
+// and flushed from the encoder, so the client receives the body
+// progressively and w is never written to concurrently with the
+// caller. Only a window of the body is held in memory.
+type codingWriter struct {
+	in   chan []byte
+	ack  chan struct{}
+	done chan error
+
+	finished bool
+	err      error
+	// set by Abort before it closes in, so that the decoder
+	// goroutine sees it once it reads the end of the body
+	aborted bool
+}
+
+// newCodingWriter returns a codingWriter that decodes decoding and
+// encodes with encoding, or not at all if encoding is empty.
+func newCodingWriter(w io.Writer, decoding, encoding string, replace func(io.Writer) io.WriteCloser) (*codingWriter, error) {
+	cw := &codingWriter{
+		in:   make(chan []byte),
+		ack:  make(chan struct{}),
+		done: make(chan error, 1),
+	}
+	w = abortableWriter{w: w, cw: cw}
+	var enc io.WriteCloser
+	if encoding != "" {
+		var err error
+		enc, err = newStreamEncoder(w, encoding)
+		if err != nil {
+			return nil, err
+		}
+	}
+	go func() {
+		cw.done <- cw.run(w, decoding, enc, replace)
+	}()
+	return cw, nil
+}
+
+// run decodes what is written to cw until Close is called.
+func (cw *codingWriter) run(w io.Writer, decoding string, enc io.WriteCloser, replace func(io.Writer) io.WriteCloser) error {
+	out := w
+	if enc != nil {
+		out = enc
+	}
+	cr := &chanReader{in: cw.in, ack: cw.ack, flush: func() {
+		if f, ok := enc.(interface{ Flush() error }); ok {
+			_ = f.Flush()
+		}
+	}}
+	dec, err := newStreamDecoder(cr, decoding)
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+
+	// even if the body is cut off or corrupt, what was decoded so
+	// far is written out as a complete encoding
+	tw := replace(out)
+	_, err = io.Copy(tw, dec)
+	if cerr := tw.Close(); err == nil {
+		err = cerr
+	}
+	if enc != nil {
+		if cerr := enc.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+func (cw *codingWriter) Write(p []byte) (int, error) {
+	if cw.finished {
+		// anything after the end of the encoded body is dropped
+		return len(p), cw.err
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	select {
+	case cw.in <- p:
+	case err := <-cw.done:
+		cw.finish(err)
+		return 0, cw.err
+	}
+	select {
+	case <-cw.ack:
+	case err := <-cw.done:
+		// the body ended within p
+		cw.finish(err)
+		if cw.err != nil {
+			return 0, cw.err
+		}
+	}
+	return len(p), nil
+}
+
+// Close ends the body and waits for the rest of it to be written. It
+// does not close the underlying writer.
+func (cw *codingWriter) Close() error {
+	if !cw.finished {
+		close(cw.in)
+		cw.finish(<-cw.done)
+	}
+	return cw.err
+}
+
+// Abort ends the body without writing out what the decoder, the
+// replacements and the encoder still hold, for when the upstream
+// failed, and waits for the decoder goroutine to exit. It does not
+// write to the underlying writer.
+func (cw *codingWriter) Abort() {
+	if !cw.finished {
+		cw.aborted = true
+		close(cw.in)
+		cw.finish(<-cw.done)
+	}
+}
+
+func (cw *codingWriter) finish(err error) {
+	cw.finished = true
+	cw.err = err
+}
+
+// abortableWriter writes to w until the codingWriter cw is aborted,
+// and drops what is written to it afterwards.
+type abortableWriter struct {
+	w  io.Writer
+	cw *codingWriter
+}
+
+func (aw abortableWriter) Write(p []byte) (int, error) {
+	if aw.cw.aborted {
+		return len(p), nil
+	}
+	return aw.w.Write(p)
+}
+
+// chanReader reads the slices sent on in. Before asking for the next
+// one, it calls flush and tells the sender on ack that the previous
+// slice has been consumed.
+type chanReader struct {
+	in      chan []byte
+	ack     chan struct{}
+	flush   func()
+	cur     []byte
+	started bool
+}
+
+func (cr *chanReader) Read(p []byte) (int, error) {
+	if len(cr.cur) == 0 {
+		if cr.started {
+			cr.flush()
+			cr.ack <- struct{}{}
+		}
+		cr.started = true
+		next, ok := <-cr.in
+		if !ok {
+			return 0, io.EOF
+		}
+		cr.cur = next
+	}
+	n := copy(p, cr.cur)
+	cr.cur = cr.cur[n:]
+	return n, nil
+}
@@ -0,0 +1,213 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// chunkedEncodedUpstream responds with body encoded with encoding,
+// written and flushed in chunks of n bytes of the encoded body.
+func chunkedEncodedUpstream(t *testing.T, body, encoding string, n int) caddyhttp.Handler {
+	encoded, err := encodeBody([]byte(body), []string{encoding})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Content-Encoding", encoding)
+		w.Header().Set("Content-Length", strconv.Itoa(len(encoded)))
+		for _, chunk := range splitEvery(string(encoded), n) {
+			if _, err := w.Write([]byte(chunk)); err != nil {
+				return err
+			}
+			w.(http.Flusher).Flush()
+		}
+		return nil
+	})
+}
+
+func TestStreamDecompress(t *testing.T) {
+	var large strings.Builder
+	for i := 0; large.Len() < 1<<20; i++ {
+		large.WriteString("line " + strconv.Itoa(i) + ": foo and <span>foo</span>\n")
+	}
+	for _, tt := range []struct {
+		name     string
+		body     string
+		encoding string
+		chunk    int
+	}{
+		{name: "gzip", body: "a foo b foo", encoding: "gzip", chunk: 1 << 10},
+		{name: "gzip bytewise", body: "a foo b foo", encoding: "gzip", chunk: 1},
+		{name: "deflate bytewise", body: "a foo b foo", encoding: "deflate", chunk: 1},
+		{name: "zstd bytewise", body: "a foo b foo", encoding: "zstd", chunk: 1},
+		{name: "large gzip", body: large.String(), encoding: "gzip", chunk: 1 << 10},
+		{name: "large gzip small chunks", body: large.String(), encoding: "gzip", chunk: 7},
+		{name: "large zstd", body: large.String(), encoding: "zstd", chunk: 1 << 10},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{Stream: true, Decompress: true, Replacements: []*Replacement{
+				{Search: "foo", Replaces: []string{"bar"}},
+				{Search: "<span>bar</span>", Replaces: []string{"baz"}},
+			}})
+			w := newFlushRecorder()
+			if err := h.ServeHTTP(w, newRequest("GET", "/", nil), chunkedEncodedUpstream(t, tt.body, tt.encoding, tt.chunk)); err != nil {
+				t.Fatal(err)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.encoding {
+				t.Errorf("Content-Encoding %q, want %q", got, tt.encoding)
+			}
+			if got := w.Header().Get("Content-Length"); got != "" {
+				t.Errorf("Content-Length %q, want it dropped", got)
+			}
+			body, err := decodeBody(w.Body.Bytes(), []string{tt.encoding})
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := strings.ReplaceAll(strings.ReplaceAll(tt.body, "foo", "bar"), "<span>bar</span>", "baz")
+			if string(body) != want {
+				t.Errorf("got %d bytes, want %d bytes of replaced body", len(body), len(want))
+			}
+		})
+	}
+}
+
+func TestStreamDecompressProgressive(t *testing.T) {
+	var body strings.Builder
+	for i := 0; body.Len() < 1<<20; i++ {
+		body.WriteString(strconv.Itoa(i*7919) + " foo\n")
+	}
+	h := provision(t, &Handler{Stream: true, Decompress: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+	w := newFlushRecorder()
+	if err := h.ServeHTTP(w, newRequest("GET", "/", nil), chunkedEncodedUpstream(t, body.String(), "gzip", 1<<12)); err != nil {
+		t.Fatal(err)
+	}
+	// the client gets encoded output long before the end of the body
+	flushes := w.flushes()
+	if len(flushes) < 2 || len(flushes[len(flushes)/2]) == 0 || len(flushes[len(flushes)/2]) >= w.Body.Len() {
+		t.Errorf("%d flushes, body not written progressively", len(flushes))
+	}
+}
+
+func TestStreamDecompressTruncated(t *testing.T) {
+	encoded, err := encodeBody([]byte("a foo b foo"), []string{"gzip"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name string
+		body []byte
+	}{
+		{"cut off", encoded[:len(encoded)-4]},
+		{"trailing garbage", append(append([]byte(nil), encoded...), "junk"...)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := provision(t, &Handler{Stream: true, Decompress: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+			next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Content-Encoding", "gzip")
+				_, err := w.Write(tt.body)
+				return err
+			})
+			w := newFlushRecorder()
+			_ = h.ServeHTTP(w, newRequest("GET", "/", nil), next)
+			// what was decoded is still sent as a complete encoding
+			body, err := decodeBody(w.Body.Bytes(), []string{"gzip"})
+			if err != nil {
+				t.Fatalf("response is not valid gzip: %v", err)
+			}
+			if !strings.HasPrefix("a bar b bar", string(body)) {
+				t.Errorf("body %q, want a prefix of %q", body, "a bar b bar")
+			}
+		})
+	}
+}
+
+func TestStreamDecompressStacked(t *testing.T) {
+	// stacked codings are passed through in stream mode
+	h := provision(t, &Handler{Stream: true, Decompress: true, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+	w := serve(t, h, newRequest("GET", "/", nil), encodedUpstream(t, "a foo", "gzip", "zstd"))
+	body, err := decodeBody(w.Body.Bytes(), []string{"gzip", "zstd"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "a foo" {
+		t.Errorf("body %q, want it passed through", body)
+	}
+}
+
+func TestStreamDecompressUpstreamError(t *testing.T) {
+	encodedBody := func(encoding string) []byte {
+		encoded, err := encodeBody([]byte(strings.Repeat("<p>foo</p>", 1000)), []string{encoding})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encoded
+	}
+	for _, encoding := range []string{"gzip", "deflate", "zstd"} {
+		for _, tt := range []struct {
+			name string
+			h    *Handler
+		}{
+			{"stream", &Handler{Stream: true}},
+			{"hybrid", &Handler{StreamStatusCodes: []int{200}}},
+		} {
+			t.Run(encoding+"/"+tt.name, func(t *testing.T) {
+				tt.h.Decompress = true
+				tt.h.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}
+				h := provision(t, tt.h)
+				encoded := encodedBody(encoding)
+				upstreamErr := errors.New("upstream failed")
+				// the upstream fails halfway through the body
+				next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+					w.Header().Set("Content-Type", "text/plain")
+					w.Header().Set("Content-Encoding", encoding)
+					if _, err := w.Write(encoded[:len(encoded)/2]); err != nil {
+						return err
+					}
+					return upstreamErr
+				})
+				before := runtime.NumGoroutine()
+				for i := 0; i < 50; i++ {
+					if err := h.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "/", nil), next); !errors.Is(err, upstreamErr) {
+						t.Fatalf("got error %v, want %v", err, upstreamErr)
+					}
+				}
+				// the decoder goroutines may take a moment to exit
+				// after sending their result
+				var after int
+				for i := 0; i < 100; i++ {
+					if after = runtime.NumGoroutine(); after <= before {
+						break
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+				if after > before {
+					t.Errorf("%d goroutines before, %d after", before, after)
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"fmt"
+	"regexp"
+	"text/template"
+)
+
+// templateMatch is the data a replacement template is executed with.
+type templateMatch struct {
+	re    *regexp.Regexp
+	src   []byte
+	index []int
+}
+
+// Full returns the text of the whole match.
+func (m templateMatch) Full() string {
+	return string(m.src[m.index[0]:m.index[1]])
+}
+
+// Group returns the text of the n-th capture group, or the empty
+// string if it didn't participate in the match or doesn't exist.
+func (m templateMatch) Group(n int) string {
+	if n < 0 || 2*n+1 >= len(m.index) || m.index[2*n] < 0 {
+		return ""
+	}
+	return string(m.src[m.index[2*n]:m.index[2*n+1]])
+}
+
+// Named returns the text of the capture group with the given name,
+// or the empty string if there is none.
+func (m templateMatch) Named(name string) string {
+	if m.re == nil {
+		return ""
+	}
+	i := m.re.SubexpIndex(name)
+	if i < 0 {
+		return ""
+	}
+	return m.Group(i)
+}
+
+// parseTemplate parses the replacement template of repl.
+func (repl *Replacement) parseTemplate() error {
+	if repl.Template == "" {
+		return nil
+	}
+	if len(repl.Replaces) > 0 || repl.Mask != "" {
+		return fmt.Errorf("template is mutually exclusive with replace and mask")
+	}
+	tmpl, err := template.New("replacement").Option("missingkey=error").Parse(repl.Template)
+	if err != nil {
+		return fmt.Errorf("parsing template: %v", err)
+	}
+	repl.tmpl = tmpl
+	return nil
+}
+
+// execute returns the result of the replacement template for the
+// match described by index. re is nil for substring replacements.
+func (repl *Replacement) execute(re *regexp.Regexp, src []byte, index []int) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := repl.tmpl.Execute(&buf, templateMatch{re: re, src: src, index: index}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
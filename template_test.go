@@ -0,0 +1,82 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestTemplate(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		repl Replacement
+		body string
+		want string
+	}{
+		{name: "full", repl: Replacement{Search: "foo", Template: "<{{.Full}}>"}, body: "a foo", want: "a <foo>"},
+		{name: "groups", repl: Replacement{SearchRegexp: `(\w+)@(\w+)`, Template: "{{.Group 2}} at {{.Group 1}}"}, body: "me@host", want: "host at me"},
+		{name: "named", repl: Replacement{SearchRegexp: `(?P<n>\d+)`, Template: "#{{.Named \"n\"}}"}, body: "1 2", want: "#1 #2"},
+		{name: "missing group", repl: Replacement{SearchRegexp: `a(b)?`, Template: "[{{.Group 1}}{{.Group 5}}{{.Named \"x\"}}]"}, body: "a ab", want: "[] [b]"},
+		{name: "conditional", repl: Replacement{SearchRegexp: `\d+`, Template: `{{if eq .Full "0"}}none{{else}}{{.Full}}{{end}}`}, body: "0 7", want: "none 7"},
+		{name: "no regexp groups", repl: Replacement{Search: "x", Template: "{{.Group 1}}{{.Named \"n\"}}!"}, body: "x", want: "!"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, stream := range []bool{false, true} {
+				repl := tt.repl
+				h := provision(t, &Handler{Stream: stream, Replacements: []*Replacement{&repl}})
+				// the parsed template is reused across responses
+				for i := 0; i < 2; i++ {
+					if got := replaced(t, h, tt.body); got != tt.want {
+						t.Errorf("stream %v, response %d: got %q, want %q", stream, i, got, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTemplateExecutionError(t *testing.T) {
+	h := provision(t, &Handler{Replacements: []*Replacement{{Search: "foo", Template: "{{.Missing}}"}}})
+	core, logs := observer.New(zapcore.DebugLevel)
+	h.logger = zap.New(core)
+	if got := replaced(t, h, "a foo"); got != "a foo" {
+		t.Errorf("got %q, want the match left unchanged", got)
+	}
+	if logs.Len() == 0 {
+		t.Error("execution error not logged")
+	}
+}
+
+func TestTemplateInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		repl Replacement
+		err  string
+	}{
+		{repl: Replacement{Search: "a", Template: "{{"}, err: "parsing template"},
+		{repl: Replacement{Search: "a", Template: "x", Replaces: []string{"b"}}, err: "template is mutually exclusive with replace and mask"},
+		{repl: Replacement{Search: "a", Template: "x", Mask: "*"}, err: "template is mutually exclusive"},
+	} {
+		repl := tt.repl
+		err := provisionErr(&Handler{Replacements: []*Replacement{&repl}})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%+v: got error %v, want %q", tt.repl, err, tt.err)
+		}
+	}
+}
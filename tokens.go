@@ -0,0 +1,83 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Tokens in a replacement that are expanded freshly for each match.
+const (
+	// counterToken is replaced with a number that starts at 1 and
+	// increases with each expansion in the same response.
+	counterToken = "{counter}"
+
+	// uuidToken is replaced with a random (version 4) UUID.
+	uuidToken = "{uuid}"
+
+	// nonceToken is replaced with the CSP nonce of the current
+	// response; see Handler.CSPNonce.
+	nonceToken = "{csp_nonce}"
+)
+
+// matchKey is the placeholder key that holds the text of the most
+// recent match. In a regexp replacement value, the placeholder stands
+// for the whole match, like ${0}.
+const matchKey = "http.replace_response.match"
+
+// matchPlaceholder is the placeholder for matchKey.
+const matchPlaceholder = "{" + matchKey + "}"
+
+// setMatch stores match as the most recent match of the request.
+func (rt *replacer) setMatch(match []byte) {
+	rt.repl.Set(matchKey, string(match))
+}
+
+// hasMatchTokens reports whether s contains tokens that are expanded
+// per match.
+func hasMatchTokens(s string) bool {
+	return strings.Contains(s, counterToken) || strings.Contains(s, uuidToken) || strings.Contains(s, nonceToken)
+}
+
+// expandTokens returns b with its per-match tokens expanded. b itself
+// is never modified.
+func (rt *replacer) expandTokens(b []byte) []byte {
+	if !bytes.Contains(b, []byte(counterToken)) && !bytes.Contains(b, []byte(uuidToken)) && !bytes.Contains(b, []byte(nonceToken)) {
+		return b
+	}
+	out := make([]byte, 0, len(b)+32)
+	for len(b) > 0 {
+		switch {
+		case bytes.HasPrefix(b, []byte(counterToken)):
+			rt.counter++
+			out = strconv.AppendInt(out, rt.counter, 10)
+			b = b[len(counterToken):]
+		case bytes.HasPrefix(b, []byte(uuidToken)):
+			out = append(out, uuid.NewString()...)
+			b = b[len(uuidToken):]
+		case bytes.HasPrefix(b, []byte(nonceToken)):
+			out = append(out, rt.nonce...)
+			b = b[len(nonceToken):]
+		default:
+			out = append(out, b[0])
+			b = b[1:]
+		}
+	}
+	return out
+}
@@ -0,0 +1,111 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+)
+
+func TestCounterToken(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		rules []*Replacement
+		body  string
+		want  string
+	}{
+		{name: "substring", rules: []*Replacement{{Search: "<li>", Replaces: []string{`<li id="{counter}">`}}}, body: "<li>a<li>b<li>c", want: `<li id="1">a<li id="2">b<li id="3">c`},
+		{name: "regexp", rules: []*Replacement{{SearchRegexp: `x(\w)`, Replaces: []string{"${1}{counter}"}}}, body: "xa xb", want: "a1 b2"},
+		{name: "twice in a value", rules: []*Replacement{{Search: "x", Replaces: []string{"{counter}-{counter}"}}}, body: "xx", want: "1-23-4"},
+		{name: "shared by rules", rules: []*Replacement{{Search: "a", Replaces: []string{"a{counter}"}}, {Search: "b", Replaces: []string{"b{counter}"}}}, body: "ab", want: "a1b2"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, stream := range []bool{false, true} {
+				h := provision(t, &Handler{Stream: stream, Replacements: tt.rules})
+				// the counter starts over for each response
+				for i := 0; i < 2; i++ {
+					if got := replaced(t, h, splitEvery(tt.body, 1)...); got != tt.want {
+						t.Errorf("stream %v, response %d: got %q, want %q", stream, i, got, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestUUIDToken(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		h := provision(t, &Handler{Stream: stream, Replacements: []*Replacement{{Search: "x", Replaces: []string{"{uuid};"}}}})
+		first := replaced(t, h, "xxxx")
+		ids := strings.Split(strings.TrimSuffix(first+replaced(t, h, "xxxx"), ";"), ";")
+		if len(ids) != 8 {
+			t.Fatalf("stream %v: got %q", stream, ids)
+		}
+		seen := make(map[string]bool)
+		for _, id := range ids {
+			parsed, err := uuid.Parse(id)
+			if err != nil || parsed.Version() != 4 {
+				t.Errorf("stream %v: %q is not a version 4 UUID", stream, id)
+			}
+			if seen[id] {
+				t.Errorf("stream %v: %q repeated", stream, id)
+			}
+			seen[id] = true
+		}
+	}
+}
+
+func TestMatchPlaceholder(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		repl Replacement
+		body string
+		want string
+		last string
+	}{
+		{name: "substring", repl: Replacement{Search: "foo", Replaces: []string{"<b>{http.replace_response.match}</b>"}}, body: "a foo", want: "a <b>foo</b>"},
+		{name: "regexp", repl: Replacement{SearchRegexp: `\d+`, Replaces: []string{"[{http.replace_response.match}]"}}, body: "1 22 333", want: "[1] [22] [333]", last: "333"},
+		{name: "with submatches", repl: Replacement{SearchRegexp: `(\w+)@(\w+)`, Replaces: []string{"${1} ({http.replace_response.match})"}}, body: "me@host", want: "me (me@host)", last: "me@host"},
+		{name: "twice", repl: Replacement{Search: "x", Replaces: []string{"{http.replace_response.match}{http.replace_response.match}"}}, body: "x", want: "xx"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, stream := range []bool{false, true} {
+				repl := tt.repl
+				h := provision(t, &Handler{Stream: stream, Replacements: []*Replacement{&repl}})
+				r := newRequest("GET", "/", nil)
+				if got := serve(t, h, r, upstream("text/plain", tt.body)).Body.String(); got != tt.want {
+					t.Errorf("stream %v: got %q, want %q", stream, got, tt.want)
+				}
+				// the last match of a regexp stays available,
+				// e.g. to logs
+				if got, _ := replacerOf(r).GetString(matchKey); tt.last != "" && got != tt.last {
+					t.Errorf("stream %v: placeholder %q after the response, want %q", stream, got, tt.last)
+				}
+			}
+		})
+	}
+}
+
+func TestMatchPlaceholderPerRequest(t *testing.T) {
+	h := provision(t, &Handler{Replacements: []*Replacement{{SearchRegexp: `\w+`, Replaces: []string{"<{http.replace_response.match}>"}}}})
+	first, second := newRequest("GET", "/", nil), newRequest("GET", "/", nil)
+	serve(t, h, first, upstream("text/plain", "one"))
+	serve(t, h, second, upstream("text/plain", "two"))
+	if got, _ := replacerOf(first).GetString(matchKey); got != "one" {
+		t.Errorf("first request has match %q, want %q", got, "one")
+	}
+}
@@ -0,0 +1,375 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+
+	"golang.org/x/text/transform"
+)
+
+// urlAttributes are the HTML attributes whose values contain URLs
+// that insecure URL upgrading applies to.
+var urlAttributes = map[string]bool{
+	"action": true, "background": true, "cite": true, "codebase": true,
+	"content": true, "data": true, "formaction": true, "href": true,
+	"icon": true, "longdesc": true, "manifest": true, "ping": true,
+	"poster": true, "src": true, "srcset": true, "style": true,
+	"xlink:href": true,
+}
+
+// maxHostLength is the longest host name that is upgraded.
+const maxHostLength = 253
+
+// checkUpgradeHosts returns an error if one of the hosts is invalid.
+func checkUpgradeHosts(hosts []string) error {
+	for _, host := range hosts {
+		name := strings.TrimPrefix(host, "*.")
+		if name == "" || strings.IndexFunc(name, func(r rune) bool { return r > 0x7f || !isHostByte(byte(r)) }) >= 0 {
+			return fmt.Errorf("upgrade_hosts: invalid host %q", host)
+		}
+	}
+	return nil
+}
+
+// upgradeState is the position of the urlUpgrader in HTML markup.
+type upgradeState int
+
+const (
+	upgradeText upgradeState = iota
+	upgradeTagName
+	upgradeTagSpace
+	upgradeAttrName
+	upgradeAfterAttrName
+	upgradeBeforeValue
+	upgradeValue
+	upgradeComment
+	upgradeRawText
+)
+
+// urlUpgrader is a transformer that rewrites http:// URLs to https://
+// for the given hosts, or for all hosts if there are none. A host
+// "*.example.com" stands for all subdomains of example.com. URLs with
+// a port other than 80 are left alone, and :80 is dropped. In HTML
+// mode, only URLs in the values of urlAttributes are rewritten, so
+// text, comments and scripts are left alone; otherwise, every URL is
+// rewritten that doesn't directly follow a letter or digit.
+type urlUpgrader struct {
+	hosts []string
+	html  bool
+
+	// the byte before the current one
+	prev byte
+
+	st      upgradeState
+	closing bool
+	tag     []byte
+	attr    []byte
+	quote   byte
+	// the element whose raw text we're in, such as "script"
+	raw string
+}
+
+func newURLUpgrader(hosts []string, html bool) *urlUpgrader {
+	lower := make([]string, len(hosts))
+	for i, host := range hosts {
+		lower[i] = strings.ToLower(host)
+	}
+	return &urlUpgrader{hosts: lower, html: html}
+}
+
+func (u *urlUpgrader) Reset() {
+	u.prev = 0
+	u.st = upgradeText
+	u.closing = false
+	u.tag = u.tag[:0]
+	u.attr = u.attr[:0]
+	u.quote = 0
+	u.raw = ""
+}
+
+func (u *urlUpgrader) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc < len(src) {
+		b := src[nSrc]
+
+		if (b == 'h' || b == 'H') && u.urlContext() {
+			n, host, ok := u.insecureURLAt(src[nSrc:], atEOF)
+			if !ok {
+				return nDst, nSrc, transform.ErrShortSrc
+			}
+			if n > 0 {
+				if len(dst)-nDst < len("https://")+len(host) {
+					return nDst, nSrc, transform.ErrShortDst
+				}
+				nDst += copy(dst[nDst:], "https://")
+				nDst += copy(dst[nDst:], host)
+				nSrc += n
+				u.prev = host[len(host)-1]
+				if u.st == upgradeBeforeValue {
+					u.st, u.quote = upgradeValue, 0
+				}
+				continue
+			}
+		}
+
+		n := 1
+		if u.html {
+			var ok bool
+			if n, ok = u.advance(src[nSrc:], atEOF); !ok {
+				return nDst, nSrc, transform.ErrShortSrc
+			}
+		}
+		if len(dst)-nDst < n {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		nDst += copy(dst[nDst:], src[nSrc:nSrc+n])
+		nSrc += n
+		u.prev = src[nSrc-1]
+	}
+	return nDst, nSrc, nil
+}
+
+// urlContext reports whether a URL starting at the current byte is
+// upgraded.
+func (u *urlUpgrader) urlContext() bool {
+	if !u.html {
+		return !isASCIILetter(u.prev) && (u.prev < '0' || u.prev > '9')
+	}
+	if (u.st != upgradeValue && u.st != upgradeBeforeValue) || !urlAttributes[string(u.attr)] {
+		return false
+	}
+	switch u.prev {
+	case ' ', '\t', '\n', '\r', '\f', ',', '=', '(', '\'', '"':
+		return true
+	}
+	return false
+}
+
+// insecureURLAt returns the length of the http:// URL prefix at the
+// start of p that is to be upgraded, up to the end of its host, and
+// the host to write after https://. It returns 0 if there is nothing
+// to upgrade, and false if more input is needed to tell.
+func (u *urlUpgrader) insecureURLAt(p []byte, atEOF bool) (int, []byte, bool) {
+	const scheme = "http://"
+	if len(p) < len(scheme) {
+		if !atEOF && bytes.EqualFold(p, []byte(scheme[:len(p)])) {
+			return 0, nil, false
+		}
+		return 0, nil, true
+	}
+	if !bytes.EqualFold(p[:len(scheme)], []byte(scheme)) {
+		return 0, nil, true
+	}
+
+	end := len(scheme)
+	for end < len(p) && isHostByte(p[end]) {
+		end++
+		if end-len(scheme) > maxHostLength {
+			return 0, nil, true
+		}
+	}
+	if end == len(p) && !atEOF {
+		return 0, nil, false
+	}
+	host := p[len(scheme):end]
+	if len(host) == 0 || !u.upgradesHost(host) {
+		return 0, nil, true
+	}
+
+	n := end
+	if end < len(p) && p[end] == ':' {
+		port := end + 1
+		for port < len(p) && p[port] >= '0' && p[port] <= '9' {
+			port++
+		}
+		if port == len(p) && !atEOF {
+			return 0, nil, false
+		}
+		if string(p[end+1:port]) != "80" {
+			return 0, nil, true
+		}
+		n = port
+	}
+	return n, host, true
+}
+
+// upgradesHost reports whether URLs with the given host are upgraded.
+func (u *urlUpgrader) upgradesHost(host []byte) bool {
+	if len(u.hosts) == 0 {
+		return true
+	}
+	name := strings.ToLower(string(host))
+	for _, h := range u.hosts {
+		if suffix, ok := strings.CutPrefix(h, "*"); ok {
+			if strings.HasSuffix(name, suffix) && len(name) > len(suffix) {
+				return true
+			}
+		} else if name == h {
+			return true
+		}
+	}
+	return false
+}
+
+// advance updates the HTML state for the bytes at the start of p,
+// and returns how many of them it consumed. It returns false if more
+// input is needed.
+func (u *urlUpgrader) advance(p []byte, atEOF bool) (int, bool) {
+	b := p[0]
+	switch u.st {
+	case upgradeText:
+		if b != '<' {
+			return 1, true
+		}
+		if len(p) < 4 && !atEOF {
+			return 0, false
+		}
+		if bytes.HasPrefix(p, []byte("<!--")) {
+			u.st = upgradeComment
+			return 4, true
+		}
+		if len(p) > 1 && isASCIILetter(p[1]) {
+			u.startTag(false)
+		} else if len(p) > 2 && p[1] == '/' && isASCIILetter(p[2]) {
+			u.startTag(true)
+			return 2, true
+		}
+
+	case upgradeComment:
+		if b != '-' {
+			return 1, true
+		}
+		if len(p) < 3 && !atEOF {
+			return 0, false
+		}
+		if bytes.HasPrefix(p, []byte("-->")) {
+			u.st = upgradeText
+			return 3, true
+		}
+
+	case upgradeRawText:
+		if b != '<' {
+			return 1, true
+		}
+		end := 2 + len(u.raw)
+		if len(p) <= end && !atEOF {
+			return 0, false
+		}
+		if len(p) > end && p[1] == '/' && bytes.EqualFold(p[2:end], []byte(u.raw)) && isTagNameEnd(p[end]) {
+			u.startTag(true)
+			return 2, true
+		}
+
+	case upgradeTagName:
+		switch {
+		case b == '>':
+			u.endTag()
+		case isASCIISpace(b) || b == '/':
+			u.st = upgradeTagSpace
+		default:
+			u.tag = append(u.tag, toLowerASCII(b))
+		}
+
+	case upgradeTagSpace, upgradeAfterAttrName:
+		switch {
+		case b == '>':
+			u.endTag()
+		case isASCIISpace(b) || b == '/':
+		case b == '=' && u.st == upgradeAfterAttrName:
+			u.st = upgradeBeforeValue
+		default:
+			u.st = upgradeAttrName
+			u.attr = append(u.attr[:0], toLowerASCII(b))
+		}
+
+	case upgradeAttrName:
+		switch {
+		case b == '>':
+			u.endTag()
+		case b == '=':
+			u.st = upgradeBeforeValue
+		case isASCIISpace(b):
+			u.st = upgradeAfterAttrName
+		case b == '/':
+			u.st = upgradeTagSpace
+		default:
+			u.attr = append(u.attr, toLowerASCII(b))
+		}
+
+	case upgradeBeforeValue:
+		switch {
+		case b == '>':
+			u.endTag()
+		case isASCIISpace(b):
+		case b == '"' || b == '\'':
+			u.st, u.quote = upgradeValue, b
+		default:
+			u.st, u.quote = upgradeValue, 0
+		}
+
+	case upgradeValue:
+		switch {
+		case u.quote != 0:
+			if b == u.quote {
+				u.st = upgradeTagSpace
+			}
+		case b == '>':
+			u.endTag()
+		case isASCIISpace(b):
+			u.st = upgradeTagSpace
+		}
+	}
+	return 1, true
+}
+
+func (u *urlUpgrader) startTag(closing bool) {
+	u.st = upgradeTagName
+	u.closing = closing
+	u.tag = u.tag[:0]
+	u.attr = u.attr[:0]
+}
+
+// endTag switches to the raw text of script and style elements, and
+// to text otherwise.
+func (u *urlUpgrader) endTag() {
+	u.st = upgradeText
+	u.raw = ""
+	u.attr = u.attr[:0]
+	if !u.closing {
+		for _, name := range rawTextElements {
+			if string(u.tag) == name {
+				u.st = upgradeRawText
+				u.raw = name
+			}
+		}
+	}
+}
+
+func isHostByte(b byte) bool {
+	return isASCIILetter(b) || (b >= '0' && b <= '9') || b == '.' || b == '-'
+}
+
+func isASCIILetter(b byte) bool {
+	return (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+func toLowerASCII(b byte) byte {
+	if b >= 'A' && b <= 'Z' {
+		return b + 'a' - 'A'
+	}
+	return b
+}
@@ -0,0 +1,106 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestUpgradeInsecureURLs(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		hosts       []string
+		body        string
+		want        string
+	}{
+		{name: "quoted attribute", body: `<a href="http://a.com/x">`, want: `<a href="https://a.com/x">`},
+		{name: "single quoted attribute", body: `<a href='http://a.com/x'>`, want: `<a href='https://a.com/x'>`},
+		{name: "unquoted attribute", body: `<img src=http://a.com/i.png alt=x>`, want: `<img src=https://a.com/i.png alt=x>`},
+		{name: "spaces around the value", body: `<a href = "http://a.com">`, want: `<a href = "https://a.com">`},
+		{name: "upper case", body: `<A HREF="HTTP://A.com/">`, want: `<A HREF="https://A.com/">`},
+		{name: "srcset", body: `<img srcset="http://a.com/1.png 1x,http://a.com/2.png 2x">`, want: `<img srcset="https://a.com/1.png 1x,https://a.com/2.png 2x">`},
+		{name: "style url", body: `<div style="background: url(http://a.com/b.png)">`, want: `<div style="background: url(https://a.com/b.png)">`},
+		{name: "script src", body: `<script src="http://a.com/x.js"></script>`, want: `<script src="https://a.com/x.js"></script>`},
+		{name: "several attributes", body: `<a title=x href="http://a.com" data-x="http://a.com">`, want: `<a title=x href="https://a.com" data-x="http://a.com">`},
+		{name: "port 80 dropped", body: `<a href="http://a.com:80/x">`, want: `<a href="https://a.com/x">`},
+		{name: "other port kept", body: `<a href="http://a.com:8080/x">`, want: `<a href="http://a.com:8080/x">`},
+		{name: "protocol-relative", body: `<a href="//a.com/x">`, want: `<a href="//a.com/x">`},
+		{name: "already secure", body: `<a href="https://a.com/x">`, want: `<a href="https://a.com/x">`},
+		{name: "no host", body: `<a href="http://">`, want: `<a href="http://">`},
+		{name: "within a value", body: `<a href="/go?to=http://a.com">`, want: `<a href="/go?to=https://a.com">`},
+		{name: "text", body: `<p>see http://a.com</p>`, want: `<p>see http://a.com</p>`},
+		{name: "non-URL attribute", body: `<a title="http://a.com">`, want: `<a title="http://a.com">`},
+		{name: "comment", body: `<!-- <a href="http://a.com"> -->`, want: `<!-- <a href="http://a.com"> -->`},
+		{name: "script", body: `<script>u = "http://a.com"; s = '<a href="http://a.com">'</script><a href="http://a.com">`, want: `<script>u = "http://a.com"; s = '<a href="http://a.com">'</script><a href="https://a.com">`},
+		{name: "style element", body: `<style>a { background: url(http://a.com) }</style>`, want: `<style>a { background: url(http://a.com) }</style>`},
+		{name: "host", hosts: []string{"a.com"}, body: `<a href="http://a.com"><a href="http://b.a.com"><a href="http://b.com">`, want: `<a href="https://a.com"><a href="http://b.a.com"><a href="http://b.com">`},
+		{name: "host ignoring case", hosts: []string{"A.com"}, body: `<a href="http://a.COM">`, want: `<a href="https://a.COM">`},
+		{name: "subdomains", hosts: []string{"*.a.com"}, body: `<a href="http://b.a.com"><a href="http://a.com"><a href="http://ba.com">`, want: `<a href="https://b.a.com"><a href="http://a.com"><a href="http://ba.com">`},
+		{name: "longer host", hosts: []string{"a.com"}, body: `<a href="http://a.com.evil">`, want: `<a href="http://a.com.evil">`},
+		{name: "plain text", contentType: "text/plain", body: "see http://a.com, or (http://b.com)", want: "see https://a.com, or (https://b.com)"},
+		{name: "plain text after a letter", contentType: "text/plain", body: "xhttp://a.com 1http://a.com", want: "xhttp://a.com 1http://a.com"},
+		{name: "plain text without a URL", contentType: "text/plain", body: "the http:// scheme", want: "the http:// scheme"},
+		{name: "JSON", contentType: "application/json", body: `{"url":"http://a.com"}`, want: `{"url":"https://a.com"}`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			contentType := tt.contentType
+			if contentType == "" {
+				contentType = "text/html"
+			}
+			for _, mode := range []struct {
+				name   string
+				stream bool
+				chunk  int
+			}{{"buffer", false, len(tt.body)}, {"stream", true, len(tt.body)}, {"stream bytewise", true, 1}} {
+				h := provision(t, &Handler{Stream: mode.stream, UpgradeInsecureURLs: true, UpgradeHosts: tt.hosts})
+				w := serve(t, h, newRequest("GET", "/", nil), upstream(contentType, splitEvery(tt.body, mode.chunk)...))
+				if got := w.Body.String(); got != tt.want {
+					t.Errorf("%s: got %q, want %q", mode.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestUpgradeAfterReplacements(t *testing.T) {
+	h := provision(t, &Handler{UpgradeInsecureURLs: true, Replacements: []*Replacement{{Search: "{url}", Replaces: []string{"http://a.com"}}}})
+	w := serve(t, h, newRequest("GET", "/", nil), upstream("text/html", `<a href="{url}">`))
+	if got, want := w.Body.String(), `<a href="https://a.com">`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestUpgradeHostsInvalid(t *testing.T) {
+	for _, host := range []string{"", "*.", "a b", "a/b", "ä.com"} {
+		if err := provisionErr(&Handler{UpgradeInsecureURLs: true, UpgradeHosts: []string{host}}); err == nil {
+			t.Errorf("%q: no error", host)
+		}
+	}
+}
+
+func TestCaddyfileUpgradeInsecureURLs(t *testing.T) {
+	h, err := parse("replace {\n\tupgrade_insecure_urls a.com *.b.com\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.UpgradeInsecureURLs || !reflect.DeepEqual(h.UpgradeHosts, []string{"a.com", "*.b.com"}) {
+		t.Errorf("upgrade_insecure_urls %v with hosts %q", h.UpgradeInsecureURLs, h.UpgradeHosts)
+	}
+	if _, err := parse("replace {\n\tupgrade_insecure_urls\n\tupgrade_insecure_urls\n}"); err == nil {
+		t.Error("repeated upgrade_insecure_urls: no error")
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"errors"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// The values of InvalidUTF8.
+const (
+	invalidUTF8Error = "error"
+	invalidUTF8Skip  = "skip"
+)
+
+// checkUTF8 checks that body, the decoded body of the response to r,
+// is valid UTF-8 if RequireUTF8 is set. If it isn't, it returns an
+// error, or, with the skip policy, reports false so that the response
+// is passed through without replacements.
+func (h *Handler) checkUTF8(r *http.Request, body []byte) (bool, error) {
+	if !h.RequireUTF8 || utf8.Valid(body) {
+		return true, nil
+	}
+	if h.InvalidUTF8 == invalidUTF8Skip {
+		h.logDecision(r, "skipping replacements on response that is not valid UTF-8")
+		return false, nil
+	}
+	return false, caddyhttp.Error(http.StatusBadGateway, errors.New("upstream sent a response body that is not valid UTF-8"))
+}
@@ -0,0 +1,128 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestRequireUTF8(t *testing.T) {
+	// "café" in Latin-1
+	latin1 := "caf\xe9 foo"
+	for _, tt := range []struct {
+		name    string
+		h       *Handler
+		next    caddyhttp.Handler
+		want    string
+		status  int
+		skipped bool
+	}{
+		{name: "valid", h: &Handler{RequireUTF8: true}, next: upstream("text/plain", "café foo"), want: "café bar"},
+		{name: "invalid", h: &Handler{RequireUTF8: true}, next: upstream("text/plain", latin1), status: http.StatusBadGateway},
+		{name: "invalid with error policy", h: &Handler{RequireUTF8: true, InvalidUTF8: invalidUTF8Error}, next: upstream("text/plain", latin1), status: http.StatusBadGateway},
+		{name: "invalid skipped", h: &Handler{RequireUTF8: true, InvalidUTF8: invalidUTF8Skip}, next: upstream("text/plain", latin1), want: latin1, skipped: true},
+		{name: "truncated rune", h: &Handler{RequireUTF8: true}, next: upstream("text/plain", "foo \xe2\x82"), status: http.StatusBadGateway},
+		{name: "not required", h: &Handler{}, next: upstream("text/plain", latin1), want: "caf\xe9 bar"},
+		{name: "checked after decoding", h: &Handler{RequireUTF8: true, Decompress: true}, next: encodedUpstream(t, "café foo", "gzip"), want: "café bar"},
+		{name: "invalid after decoding", h: &Handler{RequireUTF8: true, Decompress: true}, next: encodedUpstream(t, latin1, "gzip"), status: http.StatusBadGateway},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.h.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}
+			h := provision(t, tt.h)
+			core, logs := observer.New(zapcore.DebugLevel)
+			h.logger = zap.New(core)
+			w := httptest.NewRecorder()
+			err := h.ServeHTTP(w, newRequest("GET", "/", nil), tt.next)
+			if tt.status != 0 {
+				if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != tt.status {
+					t.Fatalf("error %v, want a %d handler error", err, tt.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			body := w.Body.Bytes()
+			if encoding := w.Header().Get("Content-Encoding"); encoding != "" {
+				if body, err = decodeBody(body, []string{encoding}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if string(body) != tt.want {
+				t.Errorf("body %q, want %q", body, tt.want)
+			}
+			skipped := logs.FilterMessage("skipping replacements on response that is not valid UTF-8").Len() > 0
+			if skipped != tt.skipped {
+				t.Errorf("skipped %v, want %v", skipped, tt.skipped)
+			}
+		})
+	}
+}
+
+func TestRequireUTF8StreamStatus(t *testing.T) {
+	// only the buffered responses are checked
+	h := provision(t, &Handler{RequireUTF8: true, StreamStatusCodes: []int{200}, Replacements: []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}})
+	if got := serve(t, h, newRequest("GET", "/", nil), statusUpstream(http.StatusOK, "caf\xe9 foo")).Body.String(); got != "caf\xe9 bar" {
+		t.Errorf("streamed: got %q", got)
+	}
+	err := h.ServeHTTP(httptest.NewRecorder(), newRequest("GET", "/", nil), statusUpstream(http.StatusNotFound, "caf\xe9 foo"))
+	if herr, ok := err.(caddyhttp.HandlerError); !ok || herr.StatusCode != http.StatusBadGateway {
+		t.Errorf("buffered: error %v, want a 502 handler error", err)
+	}
+}
+
+func TestRequireUTF8Invalid(t *testing.T) {
+	for _, h := range []*Handler{
+		{RequireUTF8: true, Stream: true},
+		{InvalidUTF8: invalidUTF8Skip},
+		{RequireUTF8: true, InvalidUTF8: "replace"},
+	} {
+		h.Replacements = []*Replacement{{Search: "foo", Replaces: []string{"bar"}}}
+		if err := provisionErr(h); err == nil {
+			t.Errorf("require_utf8 %v, stream %v, invalid_utf8 %q: no error", h.RequireUTF8, h.Stream, h.InvalidUTF8)
+		}
+	}
+}
+
+func TestCaddyfileRequireUTF8(t *testing.T) {
+	for input, want := range map[string]string{
+		"replace {\n\trequire_utf8\n}":       "",
+		"replace {\n\trequire_utf8 skip\n}":  invalidUTF8Skip,
+		"replace {\n\trequire_utf8 error\n}": invalidUTF8Error,
+	} {
+		h, err := parse(input)
+		if err != nil {
+			t.Fatalf("%q: %v", input, err)
+		}
+		if !h.RequireUTF8 || h.InvalidUTF8 != want {
+			t.Errorf("%q: require_utf8 %v %q, want true %q", input, h.RequireUTF8, h.InvalidUTF8, want)
+		}
+	}
+	for _, input := range []string{
+		"replace {\n\trequire_utf8 skip extra\n}",
+		"replace {\n\trequire_utf8\n\trequire_utf8\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
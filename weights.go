@@ -0,0 +1,122 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"strconv"
+
+	"golang.org/x/text/transform"
+)
+
+// checkWeights returns an error if the weights of repl are invalid.
+func (repl *Replacement) checkWeights() error {
+	if len(repl.Weights) == 0 {
+		return nil
+	}
+	if len(repl.Weights) != len(repl.Replaces) {
+		return fmt.Errorf("weights: need one weight for each of the %d replace values, got %d", len(repl.Replaces), len(repl.Weights))
+	}
+	var total float64
+	for _, w := range repl.Weights {
+		if w < 0 || math.IsInf(w, 0) || math.IsNaN(w) {
+			return fmt.Errorf("weights: must be non-negative numbers, got %v", w)
+		}
+		total += w
+	}
+	if total <= 0 {
+		return fmt.Errorf("weights: at least one weight must be positive")
+	}
+	return nil
+}
+
+// variant returns the index of the replace value whose share of the
+// cumulative weights contains point, a number between 0 and 1.
+// Without weights, the values have equal shares.
+func (repl *Replacement) variant(point float64) int {
+	if len(repl.Weights) == 0 {
+		if i := int(point * float64(len(repl.Replaces))); i < len(repl.Replaces) {
+			return i
+		}
+		return len(repl.Replaces) - 1
+	}
+	var total float64
+	for _, w := range repl.Weights {
+		total += w
+	}
+	target := point * total
+	last := 0
+	for i, w := range repl.Weights {
+		if w <= 0 {
+			continue
+		}
+		if target < w {
+			return i
+		}
+		target -= w
+		last = i
+	}
+	// only reached through rounding error
+	return last
+}
+
+// ruleSalt returns the salt of repl's draw, a hash of its name, or of
+// its index if it has none, so that it doesn't change when unnamed
+// replacements are added after it.
+func ruleSalt(repl *Replacement) uint64 {
+	hash := fnv.New64a()
+	if repl.Name != "" {
+		hash.Write([]byte("name:" + repl.Name))
+	} else {
+		hash.Write([]byte("index:" + strconv.Itoa(repl.index)))
+	}
+	return hash.Sum64()
+}
+
+// unitInterval maps seed onto a number between 0 (inclusive) and 1
+// (exclusive). The bits of seed are mixed first, since the high bits
+// of an FNV hash of similar short keys, such as session IDs, are not
+// spread evenly enough for the split to match the weights.
+func unitInterval(seed uint64) float64 {
+	// the splitmix64 finalizer
+	seed ^= seed >> 30
+	seed *= 0xbf58476d1ce4e5b9
+	seed ^= seed >> 27
+	seed *= 0x94d049bb133111eb
+	seed ^= seed >> 31
+	return float64(seed>>11) / (1 << 53)
+}
+
+// variantTransformer performs a replacement with weights or
+// select_by_header with the replace value chosen for the current
+// response. There is a transformer for each of the values; only the
+// chosen one is used until the next Reset.
+type variantTransformer struct {
+	rt       *replacer
+	repl     *Replacement
+	variants []transform.Transformer
+}
+
+func (vt *variantTransformer) Reset() {
+	for _, tr := range vt.variants {
+		tr.Reset()
+	}
+}
+
+func (vt *variantTransformer) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	return vt.variants[vt.repl.chooseVariant(vt.rt.repl, vt.rt.pointOf(vt.repl))].Transform(dst, src, atEOF)
+}
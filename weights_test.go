@@ -0,0 +1,227 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestStickyWeightsIndependence(t *testing.T) {
+	for _, tt := range []struct {
+		name       string
+		correlated bool
+		names      []string
+		// bounds of the number of the keys, out of 1000, that get
+		// the same variant of both rules
+		min, max int
+	}{
+		{name: "independent by index", min: 400, max: 600},
+		{name: "independent by name", names: []string{"a", "b"}, min: 400, max: 600},
+		{name: "correlated", correlated: true, min: 1000, max: 1000},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			h := &Handler{StickyKey: "{session}", CorrelatedRandom: tt.correlated, Replacements: []*Replacement{
+				{Search: "A", Replaces: []string{"0", "1"}, Weights: []float64{1, 1}},
+				{Search: "B", Replaces: []string{"0", "1"}, Weights: []float64{1, 1}},
+			}}
+			for i, name := range tt.names {
+				h.Replacements[i].Name = name
+			}
+			provision(t, h)
+			same := 0
+			for key := 0; key < 1000; key++ {
+				r := newRequest("GET", "/", nil)
+				r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer).Set("session", strconv.Itoa(key))
+				body := serve(t, h, r, upstream("text/plain", "AB")).Body.String()
+				if body[0] == body[1] {
+					same++
+				}
+			}
+			if same < tt.min || same > tt.max {
+				t.Errorf("%d of 1000 keys got the same variants, want between %d and %d", same, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestStickyWeightsRepeatable(t *testing.T) {
+	h := provision(t, &Handler{StickyKey: "{session}", Replacements: []*Replacement{
+		{Search: "A", Replaces: []string{"0", "1", "2"}, Weights: []float64{1, 1, 1}},
+	}})
+	seen := make(map[string]bool)
+	for key := 0; key < 50; key++ {
+		var first string
+		for i := 0; i < 3; i++ {
+			r := newRequest("GET", "/", nil)
+			r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer).Set("session", strconv.Itoa(key))
+			body := serve(t, h, r, upstream("text/plain", "A")).Body.String()
+			if i == 0 {
+				first = body
+			} else if body != first {
+				t.Fatalf("key %d got %q, then %q", key, first, body)
+			}
+		}
+		seen[first] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("50 keys only got the variants %v", seen)
+	}
+}
+
+func TestStickyWeightsDistribution(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		weights []float64
+		// bounds of the number of keys, out of 2000, that get each
+		// variant
+		min, max []int
+	}{
+		{name: "70/30", weights: []float64{70, 30}, min: []int{1300, 500}, max: []int{1500, 700}},
+		{name: "equal", weights: []float64{1, 1, 1, 1}, min: []int{400, 400, 400, 400}, max: []int{600, 600, 600, 600}},
+		{name: "zero weight", weights: []float64{0, 1, 3}, min: []int{0, 400, 1400}, max: []int{0, 600, 1600}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			replaces := make([]string, len(tt.weights))
+			for i := range replaces {
+				replaces[i] = strconv.Itoa(i)
+			}
+			h := provision(t, &Handler{StickyKey: "{session}", Replacements: []*Replacement{{Search: "A", Replaces: replaces, Weights: tt.weights}}})
+			counts := make([]int, len(tt.weights))
+			for key := 0; key < 2000; key++ {
+				r := newRequest("GET", "/", nil)
+				r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer).Set("session", "user-"+strconv.Itoa(key))
+				i, err := strconv.Atoi(serve(t, h, r, upstream("text/plain", "A")).Body.String())
+				if err != nil {
+					t.Fatal(err)
+				}
+				counts[i]++
+			}
+			for i, n := range counts {
+				if n < tt.min[i] || n > tt.max[i] {
+					t.Errorf("variant %d: %d of 2000 keys, want between %d and %d", i, n, tt.min[i], tt.max[i])
+				}
+			}
+		})
+	}
+}
+
+func TestVariant(t *testing.T) {
+	for _, tt := range []struct {
+		weights []float64
+		point   float64
+		want    int
+	}{
+		{weights: []float64{70, 30}, point: 0, want: 0},
+		{weights: []float64{70, 30}, point: 0.69, want: 0},
+		{weights: []float64{70, 30}, point: 0.7, want: 1},
+		{weights: []float64{70, 30}, point: 0.999, want: 1},
+		{weights: []float64{0, 1}, point: 0, want: 1},
+		{weights: []float64{1, 0}, point: 0.999, want: 0},
+		{weights: nil, point: 0.5, want: 1},
+		{weights: nil, point: 0.999, want: 1},
+	} {
+		repl := &Replacement{Replaces: []string{"a", "b"}, Weights: tt.weights}
+		if got := repl.variant(tt.point); got != tt.want {
+			t.Errorf("weights %v, point %v: got variant %d, want %d", tt.weights, tt.point, got, tt.want)
+		}
+	}
+}
+
+func TestWeightsInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		weights []float64
+		err     string
+	}{
+		{weights: []float64{1}, err: "need one weight for each of the 2 replace values, got 1"},
+		{weights: []float64{1, -1}, err: "must be non-negative numbers"},
+		{weights: []float64{0, 0}, err: "at least one weight must be positive"},
+	} {
+		err := provisionErr(&Handler{Replacements: []*Replacement{{Search: "a", Replaces: []string{"b", "c"}, Weights: tt.weights}}})
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("weights %v: got error %v, want %q", tt.weights, err, tt.err)
+		}
+	}
+}
+
+func TestCorrelatedRandom(t *testing.T) {
+	h := provision(t, &Handler{CorrelatedRandom: true, Replacements: []*Replacement{
+		{Search: "A", Replaces: []string{"0", "1", "2"}},
+		{Search: "B", Replaces: []string{"0", "1", "2"}},
+		{Search: "C", Replaces: []string{"c"}},
+	}})
+	seen := make(map[string]bool)
+	for i := 0; i < 300; i++ {
+		// the transformer is reused from the pool, but the values
+		// are chosen again for each response
+		body := replaced(t, h, "ABC")
+		if len(body) != 3 || body[0] != body[1] || body[2] != 'c' {
+			t.Fatalf("got %q, want the same value for A and B", body)
+		}
+		seen[body] = true
+	}
+	if len(seen) != 3 {
+		t.Errorf("300 responses only got the variants %v", seen)
+	}
+}
+
+func TestCorrelatedRandomSticky(t *testing.T) {
+	h := provision(t, &Handler{CorrelatedRandom: true, StickyKey: "{session}", Replacements: []*Replacement{
+		{Search: "A", Replaces: []string{"0", "1"}},
+		{Search: "B", Replaces: []string{"0", "1"}},
+	}})
+	seen := make(map[string]bool)
+	for key := 0; key < 50; key++ {
+		var first string
+		for i := 0; i < 3; i++ {
+			r := newRequest("GET", "/", nil)
+			r.Context().Value(caddy.ReplacerCtxKey).(*caddy.Replacer).Set("session", strconv.Itoa(key))
+			body := serve(t, h, r, upstream("text/plain", "AB")).Body.String()
+			if body[0] != body[1] {
+				t.Fatalf("key %d got %q, want the same value for A and B", key, body)
+			}
+			if i == 0 {
+				first = body
+			} else if body != first {
+				t.Fatalf("key %d got %q, then %q", key, first, body)
+			}
+		}
+		seen[first] = true
+	}
+	if len(seen) != 2 {
+		t.Errorf("50 keys only got the variants %v", seen)
+	}
+}
+
+func TestCaddyfileCorrelatedRandom(t *testing.T) {
+	h, err := parse("replace {\n\tcorrelated_random\n\tfoo bar baz\n}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.CorrelatedRandom {
+		t.Error("correlated_random not set")
+	}
+	for _, input := range []string{
+		"replace {\n\tcorrelated_random yes\n}",
+		"replace {\n\tcorrelated_random\n\tcorrelated_random\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"bytes"
+	"mime"
+	"net/http"
+
+	"golang.org/x/text/transform"
+)
+
+// preservedElements are the HTML elements whose contents are left
+// alone when collapsing whitespace, because whitespace is significant
+// in them.
+var preservedElements = []string{"pre", "textarea", "script", "style"}
+
+// isHTML reports whether a response with the given headers is HTML.
+func isHTML(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	return err == nil && (mediaType == "text/html" || mediaType == "application/xhtml+xml")
+}
+
+// whitespaceCollapser is a transformer that collapses each run of
+// ASCII whitespace (space, tab, newline, carriage return and form
+// feed) into a single space. In HTML mode, the contents of the
+// preservedElements are copied unchanged.
+type whitespaceCollapser struct {
+	html bool
+
+	// whether the last byte written was collapsed whitespace
+	inSpace bool
+	// the preserved element we're inside of, if any
+	preserve string
+}
+
+func newWhitespaceCollapser(html bool) *whitespaceCollapser {
+	return &whitespaceCollapser{html: html}
+}
+
+func (c *whitespaceCollapser) Reset() {
+	c.inSpace = false
+	c.preserve = ""
+}
+
+func (c *whitespaceCollapser) Transform(dst, src []byte, atEOF bool) (nDst, nSrc int, err error) {
+	for nSrc < len(src) {
+		b := src[nSrc]
+		if c.html && b == '<' {
+			tag, closing, ok := preservedTagAt(src[nSrc:], atEOF)
+			if !ok {
+				return nDst, nSrc, transform.ErrShortSrc
+			}
+			// updating the state here is idempotent, so it's fine
+			// to see the same tag again after an ErrShortDst
+			if tag != "" {
+				if c.preserve == "" && !closing {
+					c.preserve = tag
+				} else if closing && tag == c.preserve {
+					c.preserve = ""
+				}
+			}
+		}
+
+		if c.preserve == "" && isASCIISpace(b) {
+			if !c.inSpace {
+				if nDst >= len(dst) {
+					return nDst, nSrc, transform.ErrShortDst
+				}
+				dst[nDst] = ' '
+				nDst++
+				c.inSpace = true
+			}
+			nSrc++
+			continue
+		}
+
+		if nDst >= len(dst) {
+			return nDst, nSrc, transform.ErrShortDst
+		}
+		dst[nDst] = b
+		nDst++
+		nSrc++
+		c.inSpace = false
+	}
+	return nDst, nSrc, nil
+}
+
+// preservedTagAt reports whether p, which starts with '<', starts with
+// an opening or closing tag of one of the preservedElements. It returns
+// false for ok if more input is needed to tell.
+func preservedTagAt(p []byte, atEOF bool) (name string, closing bool, ok bool) {
+	i := 1
+	if len(p) > i && p[i] == '/' {
+		closing = true
+		i++
+	}
+	for _, tag := range preservedElements {
+		end := i + len(tag)
+		if len(p) <= end {
+			// we need the byte after the name too
+			rest := p[i:]
+			if !atEOF && len(rest) <= len(tag) && bytes.EqualFold(rest, []byte(tag[:len(rest)])) {
+				return "", false, false
+			}
+			continue
+		}
+		if bytes.EqualFold(p[i:end], []byte(tag)) && isTagNameEnd(p[end]) {
+			return tag, closing, true
+		}
+	}
+	return "", false, true
+}
+
+func isTagNameEnd(b byte) bool {
+	return b == '>' || b == '/' || isASCIISpace(b)
+}
+
+func isASCIISpace(b byte) bool {
+	switch b {
+	case ' ', '\t', '\n', '\r', '\f':
+		return true
+	}
+	return false
+}
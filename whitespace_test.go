@@ -0,0 +1,54 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import "testing"
+
+func TestCollapseWhitespace(t *testing.T) {
+	for _, tt := range []struct {
+		name        string
+		contentType string
+		body        string
+		want        string
+	}{
+		{name: "runs", contentType: "text/plain", body: "a  b\t\t\nc \r\n\fd", want: "a b c d"},
+		{name: "leading and trailing", contentType: "text/plain", body: "\n\n a \n\n", want: " a "},
+		{name: "non-ASCII space kept", contentType: "text/plain", body: "a  b", want: "a  b"},
+		{name: "pre outside HTML", contentType: "text/plain", body: "<pre>a  b</pre>", want: "<pre>a b</pre>"},
+		{name: "html", contentType: "text/html", body: "<p>\n  a   b\n</p>", want: "<p> a b </p>"},
+		{name: "pre", contentType: "text/html", body: "<p>  a</p>  <pre>\n  x  y\n</pre>  b", want: "<p> a</p> <pre>\n  x  y\n</pre> b"},
+		{name: "pre with attributes", contentType: "text/html", body: "<PRE class=\"c\">  x  </PRE>  y", want: "<PRE class=\"c\">  x  </PRE> y"},
+		{name: "textarea", contentType: "text/html", body: "<textarea>  a\n\nb  </textarea>", want: "<textarea>  a\n\nb  </textarea>"},
+		{name: "script and style", contentType: "text/html", body: "<script>if (a)\n  b()</script>  <style>a  {}</style>", want: "<script>if (a)\n  b()</script> <style>a  {}</style>"},
+		{name: "nested pre in textarea", contentType: "text/html", body: "<textarea><pre>  </pre>  </textarea>  ", want: "<textarea><pre>  </pre>  </textarea> "},
+		{name: "similar tag names", contentType: "text/html", body: "<p>  </p><prefix>  </prefix><presentation  />", want: "<p> </p><prefix> </prefix><presentation />"},
+		{name: "xhtml", contentType: "application/xhtml+xml", body: "<pre>  </pre>  ", want: "<pre>  </pre> "},
+		{name: "unclosed pre", contentType: "text/html", body: "<pre>  a  ", want: "<pre>  a  "},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []struct {
+				name   string
+				stream bool
+				chunk  int
+			}{{"buffer", false, len(tt.body)}, {"stream", true, len(tt.body)}, {"stream bytewise", true, 1}} {
+				h := provision(t, &Handler{Stream: mode.stream, CollapseWhitespace: true})
+				w := serve(t, h, newRequest("GET", "/", nil), upstream(tt.contentType, splitEvery(tt.body, mode.chunk)...))
+				if got := w.Body.String(); got != tt.want {
+					t.Errorf("%s: got %q, want %q", mode.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
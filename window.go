@@ -0,0 +1,63 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import "fmt"
+
+const (
+	// defaultStreamWindow is the longest regexp match that is found
+	// in a streamed body if StreamWindow is not set and there are no
+	// longer substring searches.
+	defaultStreamWindow = 2048
+
+	// maxStreamWindow is the largest StreamWindow. The transform
+	// package passes at most 4 KiB of the body to a transformer at
+	// once, so a transformer that held all of it back could never
+	// make progress.
+	maxStreamWindow = 4000
+)
+
+// provisionStreamWindow sets the window of the regexp transformers,
+// which is StreamWindow or, by default, defaultStreamWindow or the
+// length of the longest substring search, whichever is longer, up to
+// maxStreamWindow, so that substring searches match across writes.
+// It returns an error if StreamWindow is out of range or shorter than
+// one of the searches.
+func (h *Handler) provisionStreamWindow() error {
+	longest := 0
+	for _, repl := range h.Replacements {
+		if len(repl.Search) > longest {
+			longest = len(repl.Search)
+		}
+	}
+	if h.StreamWindow == 0 {
+		h.window = defaultStreamWindow
+		if longest > h.window {
+			h.window = longest
+		}
+		if h.window > maxStreamWindow {
+			h.window = maxStreamWindow
+		}
+		return nil
+	}
+	if h.StreamWindow < 0 || h.StreamWindow > maxStreamWindow {
+		return fmt.Errorf("stream_window: must be between 1 and %d, got %d", maxStreamWindow, h.StreamWindow)
+	}
+	if longest > h.StreamWindow {
+		return fmt.Errorf("stream_window: %d is shorter than the longest search, which is %d bytes long", h.StreamWindow, longest)
+	}
+	h.window = h.StreamWindow
+	return nil
+}
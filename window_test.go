@@ -0,0 +1,203 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+func TestStreamWindow(t *testing.T) {
+	long := strings.Repeat("x", 3000)
+	for _, tt := range []struct {
+		name   string
+		window int
+		repl   *Replacement
+		body   string
+		want   string
+	}{
+		{
+			name: "regexp within the default window",
+			repl: &Replacement{SearchRegexp: `<x+>`, Replaces: []string{"X"}},
+			body: "a <" + long[:2000] + "> b",
+			want: "a X b",
+		},
+		{
+			name:   "regexp within a larger window",
+			window: 4000,
+			repl:   &Replacement{SearchRegexp: `<x+>`, Replaces: []string{"X"}},
+			body:   "a <" + long + "> b <xx>",
+			want:   "a X b X",
+		},
+		{
+			name: "long substring widens the default window",
+			repl: &Replacement{Search: "<" + long + ">", Replaces: []string{"X"}},
+			body: "a <" + long + "> b",
+			want: "a X b",
+		},
+		{
+			name:   "substring as long as the window",
+			window: len(long),
+			repl:   &Replacement{Search: long, Replaces: []string{"X"}},
+			body:   "a " + long + " b",
+			want:   "a X b",
+		},
+		{
+			name: "many matches",
+			repl: &Replacement{Search: "needle", Replaces: []string{"pin"}},
+			body: strings.Repeat("hay needle ", 500),
+			want: strings.Repeat("hay pin ", 500),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			// a regexp replacement next to it makes all of them go
+			// through the transformers with the window
+			rules := []*Replacement{tt.repl, {SearchRegexp: "q+", Replaces: []string{"Q"}}}
+			h := provision(t, &Handler{Stream: true, StreamWindow: tt.window, Replacements: rules})
+			for _, n := range []int{1, 3, 7, 100, len(tt.body)} {
+				if got := replaced(t, h, splitEvery(tt.body, n)...); got != tt.want {
+					t.Errorf("writes of %d bytes: got %.40q..., want %.40q...", n, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestStreamWindowSize(t *testing.T) {
+	for _, tt := range []struct {
+		name   string
+		window int
+		search int
+		want   int
+	}{
+		{name: "default", search: 10, want: defaultStreamWindow},
+		{name: "longest search", search: 3000, want: 3000},
+		{name: "longest search beyond the largest window", search: 5000, want: maxStreamWindow},
+		{name: "configured", window: 100, search: 10, want: 100},
+		{name: "largest", window: maxStreamWindow, search: 10, want: maxStreamWindow},
+	} {
+		h := provision(t, &Handler{StreamWindow: tt.window, Replacements: []*Replacement{{Search: strings.Repeat("a", tt.search), Replaces: []string{"b"}}}})
+		if h.window != tt.want {
+			t.Errorf("%s: window %d, want %d", tt.name, h.window, tt.want)
+		}
+	}
+}
+
+func TestStreamWindowInvalid(t *testing.T) {
+	for _, tt := range []struct {
+		window int
+		search string
+	}{
+		{window: -1, search: "a"},
+		{window: maxStreamWindow + 1, search: "a"},
+		{window: 3, search: "abcd"},
+	} {
+		if err := provisionErr(&Handler{StreamWindow: tt.window, Replacements: []*Replacement{{Search: tt.search, Replaces: []string{"b"}}}}); err == nil {
+			t.Errorf("stream_window %d with search %q: no error", tt.window, tt.search)
+		}
+	}
+}
+
+func TestCaddyfileStreamWindow(t *testing.T) {
+	for input, want := range map[string]int{
+		"replace {\n\tstream_window 100\n}":  100,
+		"replace {\n\tstream_window 4KB\n}":  4000,
+		"replace {\n\tstream_window 1KiB\n}": 1024,
+	} {
+		h, err := parse(input)
+		if err != nil {
+			t.Fatalf("%q: %v", input, err)
+		}
+		if h.StreamWindow != want {
+			t.Errorf("%q: stream_window %d, want %d", input, h.StreamWindow, want)
+		}
+	}
+	for _, input := range []string{
+		"replace {\n\tstream_window\n}",
+		"replace {\n\tstream_window lots\n}",
+		"replace {\n\tstream_window 1KB 2KB\n}",
+		"replace {\n\tstream_window 1KB\n\tstream_window 2KB\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
+
+func TestCaddyfileStreamBlock(t *testing.T) {
+	for _, tt := range []struct {
+		input string
+		want  map[string]any
+	}{
+		{
+			input: "replace {\n\tstream {\n\t\twindow 2KiB\n\t}\n\tfoo bar\n}",
+			want:  map[string]any{"stream": true, "stream_window": 2048.0},
+		},
+		{
+			input: "replace {\n\tstream {\n\t\twindow 100\n\t}\n}",
+			want:  map[string]any{"stream": true, "stream_window": 100.0},
+		},
+		{
+			input: "replace {\n\tstream {\n\t}\n}",
+			want:  map[string]any{"stream": true},
+		},
+		{
+			input: "replace {\n\tstream\n}",
+			want:  map[string]any{"stream": true},
+		},
+	} {
+		h, err := parse(tt.input)
+		if err != nil {
+			t.Fatalf("%q: %v", tt.input, err)
+		}
+		// round trip through the JSON config
+		b, err := json.Marshal(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got map[string]any
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range tt.want {
+			if got[key] != want {
+				t.Errorf("%q: %s is %v, want %v", tt.input, key, got[key], want)
+			}
+		}
+		if _, ok := tt.want["stream_window"]; !ok && got["stream_window"] != nil {
+			t.Errorf("%q: stream_window %v set", tt.input, got["stream_window"])
+		}
+		var decoded Handler
+		if err := json.Unmarshal(b, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.Stream != h.Stream || decoded.StreamWindow != h.StreamWindow {
+			t.Errorf("%q: decoded stream %v, window %d, want %v, %d", tt.input, decoded.Stream, decoded.StreamWindow, h.Stream, h.StreamWindow)
+		}
+	}
+	for _, input := range []string{
+		"replace {\n\tstream {\n\t\twindow\n\t}\n}",
+		"replace {\n\tstream {\n\t\twindow huge\n\t}\n}",
+		"replace {\n\tstream {\n\t\twindow 1KB 2KB\n\t}\n}",
+		"replace {\n\tstream {\n\t\twindow 1KB\n\t\twindow 2KB\n\t}\n}",
+		"replace {\n\tstream {\n\t\twindow 1KB\n\t}\n\tstream_window 2KB\n}",
+		"replace {\n\tstream {\n\t\tflush 1s\n\t}\n}",
+	} {
+		if _, err := parse(input); err == nil {
+			t.Errorf("%q: no error", input)
+		}
+	}
+}
@@ -0,0 +1,49 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import (
+	"fmt"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// wraps reports whether repl wraps its matches in a prefix and suffix.
+func (repl *Replacement) wraps() bool {
+	return repl.Prefix != "" || repl.Suffix != ""
+}
+
+// checkWrap returns an error if prefix and suffix are combined with
+// options that produce the replacement some other way.
+func (repl *Replacement) checkWrap() error {
+	if !repl.wraps() {
+		return nil
+	}
+	if len(repl.Replaces) > 0 || repl.Mask != "" || repl.HashMatch != "" || repl.Template != "" || repl.ReplaceFile != "" || repl.DecodeMatchBase64 {
+		return fmt.Errorf("prefix and suffix are mutually exclusive with replace, mask, hash_match, template, replace_file and decode_match_base64")
+	}
+	return nil
+}
+
+// wrap returns match between the prefix and suffix of repl, with
+// their placeholders expanded.
+func (repl *Replacement) wrap(placeholders *caddy.Replacer, match []byte) []byte {
+	prefix := placeholders.ReplaceKnown(repl.Prefix, "")
+	suffix := placeholders.ReplaceKnown(repl.Suffix, "")
+	out := make([]byte, 0, len(prefix)+len(match)+len(suffix))
+	out = append(out, prefix...)
+	out = append(out, match...)
+	return append(out, suffix...)
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 Matthew Holt
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package replaceresponse
+
+import "testing"
+
+func TestWrap(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		repl *Replacement
+		body string
+		want string
+	}{
+		{
+			name: "substring",
+			repl: &Replacement{Search: "FOO", Prefix: "<mark>", Suffix: "</mark>"},
+			body: "a FOO b FOO",
+			want: "a <mark>FOO</mark> b <mark>FOO</mark>",
+		},
+		{
+			name: "regexp",
+			repl: &Replacement{SearchRegexp: `\b[A-Z]{3}\b`, Prefix: "<abbr>", Suffix: "</abbr>"},
+			body: "the CSS and HTML of a URL",
+			want: "the <abbr>CSS</abbr> and HTML of a <abbr>URL</abbr>",
+		},
+		{
+			name: "prefix only",
+			repl: &Replacement{Search: "note", Prefix: "* "},
+			body: "note: x",
+			want: "* note: x",
+		},
+		{
+			name: "suffix only",
+			repl: &Replacement{Search: "new", Suffix: "!"},
+			body: "new",
+			want: "new!",
+		},
+		{
+			name: "match with dollar signs",
+			repl: &Replacement{SearchRegexp: `\$\{?\w+\}?`, Prefix: "<code>", Suffix: "</code>"},
+			body: "cost $1 or ${x}",
+			want: "cost <code>$1</code> or <code>${x}</code>",
+		},
+		{
+			name: "adjacent matches are wrapped once each",
+			repl: &Replacement{Search: "aa", Prefix: "[", Suffix: "]"},
+			body: "aaaaa",
+			want: "[aa][aa]a",
+		},
+		{
+			name: "search in the prefix",
+			repl: &Replacement{Search: "mark", Prefix: "<mark>", Suffix: "</mark>"},
+			body: "mark mark",
+			want: "<mark>mark</mark> <mark>mark</mark>",
+		},
+		{
+			name: "placeholders",
+			repl: &Replacement{Search: "FOO", Prefix: `<span class="{class}">`, Suffix: "</span>"},
+			body: "FOO",
+			want: `<span class="hl">FOO</span>`,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, mode := range []struct {
+				name     string
+				stream   bool
+				conflict string
+				chunk    int
+			}{
+				{"buffer", false, "", len(tt.body)},
+				{"stream", true, "", len(tt.body)},
+				{"stream bytewise", true, "", 1},
+				{"longest match", false, conflictLongestMatchWins, len(tt.body)},
+			} {
+				h := provision(t, &Handler{Stream: mode.stream, ConflictResolution: mode.conflict, Replacements: []*Replacement{tt.repl}})
+				r := newRequest("GET", "/", nil)
+				replacerOf(r).Set("class", "hl")
+				if got := serve(t, h, r, upstream("text/plain", splitEvery(tt.body, mode.chunk)...)).Body.String(); got != tt.want {
+					t.Errorf("%s: got %q, want %q", mode.name, got, tt.want)
+				}
+			}
+		})
+	}
+}
+
+func TestWrapOverlappingRules(t *testing.T) {
+	// with longest_match_wins, a match inside a longer one isn't
+	// wrapped again
+	h := provision(t, &Handler{ConflictResolution: conflictLongestMatchWins, Replacements: []*Replacement{
+		{Search: "New York", Prefix: "<b>", Suffix: "</b>"},
+		{Search: "York", Prefix: "<i>", Suffix: "</i>"},
+	}})
+	if got, want := replaced(t, h, "New York and York"), "<b>New York</b> and <i>York</i>"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestWrapInvalid(t *testing.T) {
+	for _, repl := range []*Replacement{
+		{Search: "a", Prefix: "<", Replaces: []string{"b"}},
+		{Search: "a", Suffix: ">", Mask: "*"},
+		{Search: "a", Prefix: "<", HashMatch: "md5"},
+		{Search: "a", Prefix: "<", Template: "x"},
+	} {
+		if err := provisionErr(&Handler{Replacements: []*Replacement{repl}}); err == nil {
+			t.Errorf("%+v: no error", repl)
+		}
+	}
+}